@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"port-knocking/pkg/knock"
+)
+
+// auditCommand searches the stored knock outcomes of the running server, e.g.
+// who was granted port 22 on a given day:
+//
+//	audit -event grant -port 22 -since 2026-10-06 -until 2026-10-07
+func auditCommand(args []string) error {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to the JSON config file")
+	event := fs.String("event", "", "only this outcome: grant, deny, fail, ban or expire, or command runs")
+	instance := fs.String("instance", "", "only this instance")
+	ip := fs.String("ip", "", "only this source IP")
+	user := fs.String("user", "", "only this user")
+	port := fs.Int("port", 0, "only grants requesting this port")
+	since := fs.String("since", "", "from this time, date or duration ago, e.g. 2026-10-06 or 48h")
+	until := fs.String("until", "", "before this time, date or duration ago")
+	limit := fs.Int("limit", knock.DefaultAuditLimit, "maximum number of events")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := knock.LoadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	client, err := knock.NewAdminClient(cfg.Admin)
+	if err != nil {
+		return err
+	}
+
+	v := url.Values{}
+	for k, s := range map[string]string{"event": *event, "instance": *instance, "ip": *ip, "user": *user, "since": *since, "until": *until} {
+		if s != "" {
+			v.Set(k, s)
+		}
+	}
+	if *port != 0 {
+		v.Set("port", strconv.Itoa(*port))
+	}
+	v.Set("limit", strconv.Itoa(*limit))
+
+	var events []knock.AuditEvent
+	if err := client.Do(http.MethodGet, "/audit?"+v.Encode(), nil, &events); err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tEVENT\tINSTANCE\tIP\tUSER\tPORTS\tDETAIL")
+	for _, e := range events {
+		detail := e.Reason
+		switch {
+		case e.Event == knock.EventCommand:
+			if e.ExitCode != nil {
+				detail += fmt.Sprintf(", exit %d", *e.ExitCode)
+			}
+			if line, _, _ := strings.Cut(strings.TrimSpace(e.Output), "\n"); line != "" {
+				detail += ": " + line
+			}
+		case e.Session != "":
+			detail = "session " + e.Session
+		case !e.Until.IsZero():
+			detail = "until " + e.Until.Local().Format(time.DateTime)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			e.Time.Local().Format(time.DateTime),
+			e.Event,
+			e.Instance,
+			e.IP,
+			e.User,
+			joinPorts(e.Ports),
+			detail)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"port-knocking/pkg/knock"
+)
+
+const bansUsage = "usage: bans list | bans unban <ip>"
+
+// bansCommand lists and lifts bans on the running server.
+func bansCommand(args []string) error {
+	if len(args) < 1 {
+		return errors.New(bansUsage)
+	}
+
+	fs := flag.NewFlagSet("bans "+args[0], flag.ExitOnError)
+	configPath := fs.String("config", "", "path to the JSON config file")
+
+	// Allow the IP before the flags: `bans unban 10.0.0.1 -config x.json`
+	rest := args[1:]
+	ip := ""
+	if len(rest) > 0 && !strings.HasPrefix(rest[0], "-") {
+		ip, rest = rest[0], rest[1:]
+	}
+	if err := fs.Parse(rest); err != nil {
+		return err
+	}
+	if ip == "" && fs.NArg() > 0 {
+		ip = fs.Arg(0)
+	}
+
+	cfg, err := knock.LoadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	client, err := knock.NewAdminClient(cfg.Admin)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "list":
+		var bans []knock.Ban
+		if err := client.Do(http.MethodGet, "/bans", nil, &bans); err != nil {
+			return err
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "IP\tINSTANCE\tREASON\tOFFENSE\tBANNED\tUNTIL")
+		for _, b := range bans {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\n",
+				b.IP,
+				b.Instance,
+				b.Reason,
+				max(b.Offense, 1),
+				b.BannedAt.Local().Format(time.DateTime),
+				b.Until.Local().Format(time.DateTime))
+		}
+		return tw.Flush()
+
+	case "unban":
+		if ip == "" {
+			return errors.New(bansUsage)
+		}
+
+		if err := client.Do(http.MethodDelete, "/bans/"+url.PathEscape(ip), nil, nil); err != nil {
+			return err
+		}
+		fmt.Printf("Unbanned %s\n", ip)
+		return nil
+
+	default:
+		return fmt.Errorf("unknown bans command %q", args[0])
+	}
+}
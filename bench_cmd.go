@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"port-knocking/pkg/knock"
+	"port-knocking/pkg/knockclient"
+)
+
+// benchSettle is how long bench waits after the last knock for the server
+// to finish granting before counting sessions.
+const benchSettle = 2 * time.Second
+
+// benchClient is one simulated knocker.
+type benchClient struct {
+	source  netip.Addr // Invalid when the system picks the address
+	valid   bool
+	started time.Time
+	sent    time.Duration // Time taken to send the sequence
+	err     error
+}
+
+// benchCommand knocks a server with many concurrent clients, some sending
+// a wrong sequence, then reports how many valid ones were granted, how long
+// that took and how much the server's memory grew.
+//
+// The server follows a sequence per source address, so clients need an
+// address each: on a loopback target they are spread over 127.0.0.0/8,
+// elsewhere over -sources, which must be assigned to this host.
+func benchCommand(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	configPath := fs.String("config", "", "server config whose admin API reports sessions and memory")
+	profilePath := fs.String("profile", "", "client profile to knock with, the default one when empty")
+	clients := fs.Int("clients", 1000, "number of simulated knockers")
+	concurrency := fs.Int("concurrency", 200, "knockers running at once")
+	invalid := fs.Float64("invalid", 0.2, "share of knockers sending a wrong sequence")
+	sources := fs.String("sources", "", "local network the knockers' addresses are taken from, 127.0.0.0/8 on loopback targets")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *clients < 1 || *concurrency < 1 {
+		return errors.New("use at least one client, one at a time")
+	}
+	if *invalid < 0 || *invalid > 1 {
+		return fmt.Errorf("invalid share %v, use 0 to 1", *invalid)
+	}
+
+	p, err := LoadClientProfile(*profilePath)
+	if err != nil {
+		return err
+	}
+	if p.HTTPSURL != "" || p.DNSZone != "" || p.KnockPort != 0 || len(p.Sequence) == 0 && !p.TOTP.Enabled() {
+		return errors.New("bench knocks port sequences only, not HTTPS, DNS or source port ones")
+	}
+	// Every knocker would wait on the same local port
+	p.ConfirmPort = 0
+
+	addrs, err := benchSources(p.Host, *sources, *clients)
+	if err != nil {
+		return err
+	}
+
+	var admin *knock.AdminClient
+	if *configPath != "" {
+		cfg, err := knock.LoadConfig(*configPath)
+		if err != nil {
+			return err
+		}
+		if admin, err = knock.NewAdminClient(cfg.Admin); err != nil {
+			return err
+		}
+	}
+	var before knock.RuntimeStats
+	if admin != nil {
+		if err := admin.Do(http.MethodGet, "/runtime?gc=1", nil, &before); err != nil {
+			return err
+		}
+	}
+
+	bench := make([]*benchClient, *clients)
+	nInvalid := int(float64(*clients) * *invalid)
+	for i := range bench {
+		// Spread the invalid knockers among the valid ones
+		bench[i] = &benchClient{valid: i*nInvalid/(*clients) == (i+1)*nInvalid/(*clients)}
+		if addrs != nil {
+			bench[i].source = addrs[i]
+		}
+	}
+
+	start := time.Now()
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	for range min(*concurrency, *clients) {
+		wg.Go(func() {
+			for i := int(next.Add(1)) - 1; i < len(bench); i = int(next.Add(1)) - 1 {
+				bench[i].run(p)
+			}
+		})
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	fmt.Printf("Knocked %s with %d clients (%d invalid), %d at once, in %s\n",
+		p.Host, *clients, nInvalid, min(*concurrency, *clients), elapsed.Round(time.Millisecond))
+
+	var sent []time.Duration
+	failed := 0
+	for _, c := range bench {
+		if c.err != nil {
+			failed++
+			continue
+		}
+		sent = append(sent, c.sent)
+	}
+	printLatencies("Send time", sent)
+	if failed > 0 {
+		fmt.Printf("Failed to send: %d\n", failed)
+	}
+
+	if admin == nil {
+		fmt.Println("Without -config, grants and server memory are not reported")
+		return nil
+	}
+	if addrs == nil {
+		fmt.Println("Clients shared one address, so grants cannot be told apart")
+		return nil
+	}
+	time.Sleep(benchSettle)
+	return reportBench(admin, bench, start, before)
+}
+
+// run knocks the sequence of p, a wrong one unless c is valid.
+func (c *benchClient) run(p *ClientProfile) {
+	k := newKnocker(p)
+	if !c.valid {
+		// One port off on the last knock never completes the sequence
+		last := &k.Steps[len(k.Steps)-1]
+		last.Port = last.Port%65535 + 1
+	}
+	if c.source.IsValid() {
+		k.Transport = knockclient.TCP{Source: net.IP(c.source.AsSlice())}
+	}
+
+	c.started = time.Now()
+	c.err = k.Knock(context.Background())
+	c.sent = time.Since(c.started)
+}
+
+// benchSources picks an address for each of n clients from network, nil
+// when they all use the system's choice.
+func benchSources(host, network string, n int) ([]netip.Addr, error) {
+	if network == "" {
+		addr, err := netip.ParseAddr(host)
+		if err != nil || !addr.Is4() || !addr.IsLoopback() {
+			fmt.Fprintln(os.Stderr, "Warning: knocking from one address, clients will disturb each other's sequences (see -sources)")
+			return nil, nil
+		}
+		network = "127.0.0.0/8"
+	}
+
+	prefix, err := netip.ParsePrefix(network)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -sources: %w", err)
+	}
+	prefix = prefix.Masked()
+
+	addrs := make([]netip.Addr, 0, n)
+	// Skip the network address, and 127.0.0.1 whose real knocks would mix in
+	for addr := prefix.Addr().Next().Next(); len(addrs) < n; addr = addr.Next() {
+		if !prefix.Contains(addr) {
+			return nil, fmt.Errorf("%s holds fewer than %d addresses", prefix, n)
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// reportBench matches the sessions granted since start to the clients and
+// prints grant latencies, drops and the server's memory growth.
+func reportBench(admin *knock.AdminClient, bench []*benchClient, start time.Time, before knock.RuntimeStats) error {
+	var sessions []knock.SessionView
+	if err := admin.Do(http.MethodGet, "/sessions", nil, &sessions); err != nil {
+		return err
+	}
+	var during, after knock.RuntimeStats
+	if err := admin.Do(http.MethodGet, "/runtime", nil, &during); err != nil {
+		return err
+	}
+	if err := admin.Do(http.MethodGet, "/runtime?gc=1", nil, &after); err != nil {
+		return err
+	}
+
+	granted := make(map[string]time.Time)
+	for _, s := range sessions {
+		if !s.GrantedAt.Before(start) {
+			granted[s.IP] = s.GrantedAt
+		}
+	}
+
+	var latencies []time.Duration
+	dropped, wronglyGranted := 0, 0
+	for _, c := range bench {
+		at, ok := granted[c.source.String()]
+		switch {
+		case c.valid && ok:
+			latencies = append(latencies, at.Sub(c.started))
+		case c.valid:
+			dropped++
+		case ok:
+			wronglyGranted++
+		}
+	}
+
+	printLatencies("Completion latency", latencies)
+	valid := len(latencies) + dropped
+	fmt.Printf("Granted: %d of %d valid clients, dropped: %d (%.1f%%)\n",
+		len(latencies), valid, dropped, 100*float64(dropped)/float64(max(valid, 1)))
+	if wronglyGranted > 0 {
+		fmt.Printf("Granted to invalid clients: %d\n", wronglyGranted)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "\nSERVER\tBEFORE\tAFTER\tAFTER GC")
+	fmt.Fprintf(tw, "heap\t%s\t%s\t%s\n", formatBytes(before.HeapAlloc), formatBytes(during.HeapAlloc), formatBytes(after.HeapAlloc))
+	fmt.Fprintf(tw, "sys\t%s\t%s\t%s\n", formatBytes(before.Sys), formatBytes(during.Sys), formatBytes(after.Sys))
+	fmt.Fprintf(tw, "goroutines\t%d\t%d\t%d\n", before.Goroutines, during.Goroutines, after.Goroutines)
+	fmt.Fprintf(tw, "clients\t%d\t%d\t%d\n", before.Clients, during.Clients, after.Clients)
+	fmt.Fprintf(tw, "sessions\t%d\t%d\t%d\n", before.Sessions, during.Sessions, after.Sessions)
+	return tw.Flush()
+}
+
+func printLatencies(name string, d []time.Duration) {
+	if len(d) == 0 {
+		fmt.Printf("%s: none\n", name)
+		return
+	}
+	slices.Sort(d)
+	at := func(q float64) time.Duration {
+		return d[int(q*float64(len(d)-1))].Round(time.Millisecond)
+	}
+	fmt.Printf("%s: p50 %s, p90 %s, p99 %s, max %s\n", name, at(0.5), at(0.9), at(0.99), d[len(d)-1].Round(time.Millisecond))
+}
+
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -1,29 +1,485 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"net"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
+
+	"sigs.k8s.io/yaml"
+
+	"port-knocking/pkg/knock"
+	"port-knocking/pkg/knockclient"
 )
 
-func knock(host string, port int) {
-	addr := net.JoinHostPort(host, fmt.Sprintf("%d", port))
-	conn, err := net.DialTimeout("tcp", addr, 500*time.Millisecond)
-	if err == nil {
-		if err := conn.Close(); err != nil {
-			panic(err)
+// tokenWait is how long the client waits for the server to mint a token.
+const tokenWait = 3 * time.Second
+
+// ClientProfile is everything the client needs to knock on one server.
+type ClientProfile struct {
+	Host     string         `json:"host"`
+	Sequence []int          `json:"sequence"` // Ports in knock order, repeated per count
+	Delay    knock.Duration `json:"delay"`    // Pause between knocks
+	SNI      []string       `json:"sni"`      // Server name sent in a TLS ClientHello with each sequence knock, "" for a plain one
+
+	TOTP knock.TOTPConfig `json:"totp"` // Derive the sequence from the current time window instead
+
+	// Windows on either side of the current one also knocked, nearest
+	// first, while the server does not confirm the grant; all of them
+	// without a confirm port, each unexpected one a failure towards a ban
+	TOTPSkew int `json:"totp_skew"`
+
+	KnockPort  int            `json:"knock_port"`  // Knock only this port, sending the sequence as source ports
+	PayloadKey string         `json:"payload_key"` // Send an encrypted request with the last knock
+	Open       []int          `json:"open"`        // Ports to request, the server's choice when empty
+	For        knock.Duration `json:"for"`         // Access length to request, the server's choice when zero
+	ClientID   string         `json:"client_id"`   // Sent with payload and HTTPS requests, keeps sessions apart behind a shared NAT
+	Allow      string         `json:"allow"`       // Address requests ask to open instead of the one knocking
+
+	// Command printing the payload key when payload_key is empty, to keep
+	// it in a keychain: "secret-tool lookup port-knocking office"
+	PayloadKeyCommand string `json:"payload_key_command"`
+
+	// Server UDP port the request is sent to alone, as one packet, instead
+	// of knocking the sequence. Needs a payload key
+	SPAPort    int    `json:"spa_port"`
+	SPAProfile string `json:"spa_profile"` // Server profile to complete, the default one when empty
+	SPASource  string `json:"spa_source"`  // Address the request says it comes from, the local one when empty; the public one behind a NAT
+
+	// Local port the server confirms the grant on before the client goes on,
+	// with a payload key, none when zero
+	ConfirmPort  int    `json:"confirm_port"`
+	ConfirmProto string `json:"confirm_proto"` // "udp" (default) or "tcp"
+
+	ChallengeKey string `json:"challenge_key"` // The instance's challenge key, to answer its challenge after the sequence
+
+	TokenURL string `json:"token_url"` // Token endpoint to collect an access token from after knocking
+
+	// HTTPS knock endpoint used instead of the ports, for networks where only 443 gets out
+	HTTPSURL     string `json:"https_url"`     // e.g. https://203.0.113.7/knock
+	HTTPSKey     string `json:"https_key"`     // The instance's https key
+	HTTPSProfile string `json:"https_profile"` // Server profile to complete, the default one when empty
+	HTTPSCA      string `json:"https_ca"`      // PEM CA file verifying a self-signed endpoint
+
+	// DNS knock zone queried instead of the ports, for networks where only DNS gets out
+	DNSZone    string `json:"dns_zone"`
+	DNSKey     string `json:"dns_key"`     // The instance's dns key
+	DNSAllow   string `json:"dns_allow"`   // Address to open, the query source when empty
+	DNSProfile string `json:"dns_profile"` // Server profile to complete, the default one when empty
+	DNSServer  string `json:"dns_server"`  // host:port to query directly, the system resolver when empty
+}
+
+func defaultProfile() *ClientProfile {
+	return &ClientProfile{
+		Host:     "127.0.0.1", // Server address
+		Sequence: []int{7001, 7001, 7001, 8002, 9003, 9003},
+		Delay:    knock.Duration{Duration: 500 * time.Millisecond},
+	}
+}
+
+// ClientConfigEnv names the client config file to use instead of
+// ~/.config/pk/config.yaml.
+const ClientConfigEnv = "PORT_KNOCKING_CLIENT_CONFIG"
+
+// ClientConfig keeps the profiles of several servers in one YAML file, picked
+// by name on the command line: `knock office`.
+//
+//	default: office
+//	profiles:
+//	  office:
+//	    host: office.example.com
+//	    sequence: [7001, 8002, 9003]
+//	    delay: 300ms
+//	  lab:
+//	    host: 10.0.0.5
+//	    totp: {secret: JBSWY3DPEHPK3PXP}
+type ClientConfig struct {
+	Default  string                     `json:"default"`  // Profile knocked when none is named
+	Profiles map[string]json.RawMessage `json:"profiles"` // Client profiles by name
+
+	path string
+}
+
+// clientConfigDir returns the directory of the client config,
+// $XDG_CONFIG_HOME/pk or ~/.config/pk, empty when the home directory is
+// unknown.
+func clientConfigDir() string {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); filepath.IsAbs(dir) {
+		return filepath.Join(dir, "pk")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".config", "pk")
+}
+
+// ClientConfigPath returns the client config file, empty when the home
+// directory is unknown.
+func ClientConfigPath() string {
+	if path := os.Getenv(ClientConfigEnv); path != "" {
+		return path
+	}
+	if dir := clientConfigDir(); dir != "" {
+		return filepath.Join(dir, "config.yaml")
+	}
+	return ""
+}
+
+// decodeClientFile decodes data read from path into v, as YAML unless the
+// file is named *.json. YAML goes through JSON so the json tags of the
+// profiles and the durations parse the same in both formats.
+func decodeClientFile(path string, data []byte, v any) error {
+	if !strings.EqualFold(filepath.Ext(path), ".json") {
+		var err error
+		if data, err = yaml.YAMLToJSON(data); err != nil {
+			return err
+		}
+	}
+	return json.Unmarshal(data, v)
+}
+
+// LoadClientConfig reads the client config, empty when the default file
+// does not exist.
+func LoadClientConfig() (*ClientConfig, error) {
+	cfg := &ClientConfig{path: ClientConfigPath()}
+	if cfg.path == "" {
+		return cfg, nil
+	}
+
+	data, err := os.ReadFile(cfg.path)
+	if errors.Is(err, os.ErrNotExist) && os.Getenv(ClientConfigEnv) == "" {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading client config: %w", err)
+	}
+	if err := decodeClientFile(cfg.path, data, cfg); err != nil {
+		return nil, fmt.Errorf("parsing client config %s: %w", cfg.path, err)
+	}
+	if _, ok := cfg.Profiles[cfg.Default]; cfg.Default != "" && !ok {
+		return nil, fmt.Errorf("client config %s: default profile %q is not defined", cfg.path, cfg.Default)
+	}
+	return cfg, nil
+}
+
+// isProfileName reports whether name is a bare profile name rather than the
+// path of a file.
+func isProfileName(name string) bool {
+	_, err := os.Stat(name)
+	return err != nil && !strings.ContainsRune(name, os.PathSeparator) && filepath.Ext(name) == ""
+}
+
+// resolveClientProfile turns a profile name into its file: a bare name
+// without a file of that name is looked up as profiles/<name>.yaml, or
+// .json, next to the client config, so `knock office` finds a saved profile.
+func resolveClientProfile(name string) string {
+	dir := clientConfigDir()
+	if !isProfileName(name) || dir == "" {
+		return name
+	}
+	path := filepath.Join(dir, "profiles", name+".yaml")
+	if _, err := os.Stat(path); err != nil {
+		legacy := filepath.Join(dir, "profiles", name+".json")
+		if _, err := os.Stat(legacy); err == nil {
+			return legacy
+		}
+	}
+	return path
+}
+
+// profile returns the raw profile called name, if the config defines one.
+func (c *ClientConfig) profile(name string) (json.RawMessage, bool) {
+	if c == nil {
+		return nil, false
+	}
+	data, ok := c.Profiles[name]
+	return data, ok
+}
+
+// LoadClientProfile reads a YAML or JSON client profile, by path or name, or decodes
+// a provisioning URI. Names are looked up in the client config first, then
+// as saved profiles. An empty path returns the default profile of the
+// client config, or the built-in one without it.
+func LoadClientProfile(path string) (*ClientProfile, error) {
+	var cfg *ClientConfig
+	if path == "" || isProfileName(path) {
+		var err error
+		if cfg, err = LoadClientConfig(); err != nil {
+			return nil, err
+		}
+		if path == "" {
+			if cfg.Default == "" {
+				return defaultProfile(), nil
+			}
+			path = cfg.Default
+		}
+	}
+
+	var p *ClientProfile
+	if isProfileURI(path) {
+		label, parsed, err := ParseProfileURI(path)
+		if err != nil {
+			return nil, err
+		}
+		p, path = parsed, label
+	} else {
+		p = defaultProfile()
+		if data, ok := cfg.profile(path); ok {
+			if err := json.Unmarshal(data, p); err != nil {
+				return nil, fmt.Errorf("parsing profile %s in %s: %w", path, cfg.path, err)
+			}
+			path = fmt.Sprintf("%s in %s", path, cfg.path)
+		} else {
+			path = resolveClientProfile(path)
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("reading profile: %w", err)
+			}
+			if err := decodeClientFile(path, data, p); err != nil {
+				return nil, fmt.Errorf("parsing profile %s: %w", path, err)
+			}
+		}
+	}
+
+	if p.TOTP.Enabled() {
+		if err := knock.NormalizeTOTP(&p.TOTP); err != nil {
+			return nil, fmt.Errorf("profile %s: %w", path, err)
+		}
+	}
+	if p.PayloadKey == "" && p.PayloadKeyCommand != "" {
+		key, err := runKeyCommand(p.PayloadKeyCommand)
+		if err != nil {
+			return nil, fmt.Errorf("profile %s: payload_key_command: %w", path, err)
+		}
+		p.PayloadKey = key
+	}
+	return p, nil
+}
+
+// runKeyCommand runs command, split on spaces, and returns the key it
+// prints. Prompts and errors of the keychain go to the terminal.
+func runKeyCommand(command string) (string, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return "", errors.New("empty command")
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin, cmd.Stderr = os.Stdin, os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	key := strings.TrimSpace(string(out))
+	if key == "" {
+		return "", errors.New("printed no key")
+	}
+	return key, nil
+}
+
+func client(p *ClientProfile) error {
+	if p.HTTPSURL != "" {
+		nonce, err := httpsKnock(p)
+		if err != nil {
+			return err
+		}
+		fmt.Println("HTTPS knock accepted")
+		return collectToken(p, nonce)
+	}
+	if p.DNSZone != "" {
+		nonce, err := dnsKnock(p)
+		if err != nil {
+			return err
+		}
+		fmt.Println("DNS knock sent")
+		return collectToken(p, nonce)
+	}
+
+	k := newKnocker(p)
+	var offsets []int
+	if p.TOTP.Enabled() && p.TOTPSkew > 0 {
+		cfg := p.TOTP
+		cfg.Skew = p.TOTPSkew
+		var windows [][]knockclient.Step
+		windows, offsets = knockclient.TOTPWindows(cfg, time.Now())
+		k.Steps, k.Fallbacks = windows[0], windows[1:]
+	}
+	if err := k.Knock(context.Background()); err != nil {
+		return err
+	}
+	if k.Attempt > 0 {
+		fmt.Printf("Clock skew: the server took the sequence of window %+d, check the clock\n", offsets[k.Attempt])
+	}
+	if p.SPAPort != 0 {
+		fmt.Println("SPA request sent")
+	} else {
+		fmt.Println("Port knocking send")
+	}
+	if c := k.Confirmation; c.Session != "" {
+		fmt.Printf("Access confirmed: session %s until %s\n", c.Session, c.ExpiresAt.Local().Format(time.RFC3339))
+	}
+	return collectToken(p, k.Nonce)
+}
+
+// newKnocker builds the knocker sending the port sequence of p.
+func newKnocker(p *ClientProfile) *knockclient.Knocker {
+	k := &knockclient.Knocker{
+		Host:       p.Host,
+		Steps:      knockclient.Ports(p.Sequence...),
+		Delay:      p.Delay.Duration,
+		PayloadKey: p.PayloadKey,
+		Request:    knock.KnockRequest{Ports: p.Open, Duration: p.For, Client: p.ClientID, Allow: p.Allow, Profile: p.SPAProfile},
+		SPAPort:    p.SPAPort,
+		SPASource:  p.SPASource,
+
+		ConfirmPort:  p.ConfirmPort,
+		ConfirmProto: p.ConfirmProto,
+		ChallengeKey: p.ChallengeKey,
+	}
+	for i, name := range p.SNI {
+		if i < len(k.Steps) {
+			k.Steps[i].SNI = name
+		}
+	}
+	if p.TOTP.Enabled() {
+		k.Steps = knockclient.TOTP(p.TOTP, time.Now())
+	}
+	if p.KnockPort != 0 {
+		k.Transport = knockclient.SourcePort{Port: p.KnockPort}
+	}
+	return k
+}
+
+// collectToken prints the access token minted for the knock with nonce,
+// when the profile asks for one.
+func collectToken(p *ClientProfile, nonce string) error {
+	if p.TokenURL != "" {
+		token, err := fetchToken(p.TokenURL, nonce)
+		if err != nil {
+			return err
 		}
+		fmt.Println(token)
 	}
+	return nil
 }
 
-func client() {
-	serverIP := "127.0.0.1" // Server address
-	knockSeqPorts := []int{7001, 7001, 7001, 8002, 9003, 9003}
+// httpsKnock sends the knock as a signed request to the HTTPS endpoint,
+// returning its nonce.
+func httpsKnock(p *ClientProfile) (string, error) {
+	k := &knockclient.HTTPSKnocker{
+		URL: p.HTTPSURL,
+		Key: p.HTTPSKey,
+		Request: knock.HTTPSKnockRequest{
+			Profile:  p.HTTPSProfile,
+			Ports:    p.Open,
+			Duration: p.For,
+			Client:   p.ClientID,
+			Allow:    p.Allow,
+		},
+		Client: &http.Client{Timeout: 10 * time.Second},
+	}
 
-	for _, port := range knockSeqPorts {
-		knock(serverIP, port)
-		time.Sleep(500 * time.Millisecond)
+	if p.HTTPSCA != "" {
+		pem, err := os.ReadFile(p.HTTPSCA)
+		if err != nil {
+			return "", fmt.Errorf("reading https_ca: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return "", fmt.Errorf("https_ca %s holds no certificate", p.HTTPSCA)
+		}
+		k.Client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
 	}
+	err := k.Knock(context.Background())
+	return k.Nonce, err
+}
+
+// dnsKnock sends the knock as a signed query under the knock zone,
+// returning its signature label.
+func dnsKnock(p *ClientProfile) (string, error) {
+	k := &knockclient.DNSKnocker{
+		Zone:    p.DNSZone,
+		Key:     p.DNSKey,
+		Profile: p.DNSProfile,
+		Server:  p.DNSServer,
+	}
+	if p.DNSAllow != "" {
+		addr, err := netip.ParseAddr(p.DNSAllow)
+		if err != nil {
+			return "", fmt.Errorf("dns_allow: %w", err)
+		}
+		k.Allow = addr
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := k.Knock(ctx)
+	return k.Nonce, err
+}
 
-	fmt.Println("Port knocking send")
+// fetchToken collects the access token minted for the knock with nonce,
+// retrying while the server is still granting it.
+func fetchToken(u, nonce string) (string, error) {
+	c := &http.Client{Timeout: 5 * time.Second}
+	deadline := time.Now().Add(tokenWait)
+
+	for {
+		resp, err := c.PostForm(u, url.Values{"nonce": {nonce}})
+		if err != nil {
+			return "", fmt.Errorf("token: %w", err)
+		}
+
+		var body struct {
+			AccessToken string `json:"access_token"`
+			Error       string `json:"error_description"`
+		}
+		err = json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&body)
+		resp.Body.Close()
+
+		switch {
+		case err == nil && resp.StatusCode == http.StatusOK:
+			return body.AccessToken, nil
+		case resp.StatusCode != http.StatusForbidden || time.Now().After(deadline):
+			if body.Error != "" {
+				return "", fmt.Errorf("token: %s", body.Error)
+			}
+			return "", fmt.Errorf("token: unexpected status %s", resp.Status)
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+// parsePorts reads a comma separated port list such as "22,5432".
+func parsePorts(s string) ([]int, error) {
+	var ports []int
+	for _, p := range splitList(s) {
+		port, err := strconv.Atoi(p)
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid port %q", p)
+		}
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+// joinPorts is the inverse of parsePorts.
+func joinPorts(ports []int) string {
+	parts := make([]string, len(ports))
+	for i, p := range ports {
+		parts[i] = strconv.Itoa(p)
+	}
+	return strings.Join(parts, ",")
 }
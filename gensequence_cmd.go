@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"port-knocking/pkg/knock"
+)
+
+const (
+	protoTCP = "tcp" // Plain connection knock
+	protoTLS = "tls" // TLS ClientHello carrying a random server name
+
+	// Bounds of the random min_delay of each step after the first
+	minStepDelay = 200 * time.Millisecond
+	maxStepDelay = time.Second
+	// How late a knock may come past the longest min_delay
+	stepDelaySlack = 5 * time.Second
+)
+
+// genSequenceCommand prints a random knock sequence as an instance's
+// "sequence" value, ready to paste into a config, and with -host a client
+// profile knocking it, optionally as a provisioning QR code to scan onto a
+// phone.
+func genSequenceCommand(args []string) error {
+	fs := flag.NewFlagSet("gen-sequence", flag.ExitOnError)
+	steps := fs.Int("steps", 4, "number of knock steps")
+	exclude := fs.String("exclude", "22", "comma separated ports never to knock on")
+	protocols := fs.String("protocols", protoTCP, "comma separated step kinds to pick from: tcp, tls")
+	sniDomain := fs.String("sni-domain", "example.com", "domain the random server names of tls steps are under")
+	timing := fs.Bool("timing", false, "give each step a random min_delay and a max_delay")
+	host := fs.String("host", "", "server address, to also generate a client profile")
+	serverPath := fs.String("server", "", "file to write the sequence fragment to instead of stdout")
+	clientPath := fs.String("client", "", "file to write the client profile to instead of stdout")
+	qr := fs.Bool("qr", false, "print the client profile as a provisioning URI and QR code on stderr")
+	force := fs.Bool("force", false, "overwrite existing files")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *steps < 2 {
+		return errors.New("use at least 2 knock steps")
+	}
+	if (*clientPath != "" || *qr) && *host == "" {
+		return errors.New("a client profile needs the server address (-host)")
+	}
+
+	kinds := splitList(*protocols)
+	for _, kind := range kinds {
+		if kind != protoTCP && kind != protoTLS {
+			return fmt.Errorf("invalid protocol %q", kind)
+		}
+	}
+	if len(kinds) == 0 {
+		return errors.New("no protocols to pick steps from")
+	}
+
+	excluded := make(map[int]bool)
+	for _, p := range splitList(*exclude) {
+		port, err := strconv.Atoi(p)
+		if err != nil || port < 1 || port > 65535 {
+			return fmt.Errorf("invalid port %q", p)
+		}
+		excluded[port] = true
+	}
+
+	sequence, err := generateSequence(*steps, excluded)
+	if err != nil {
+		return err
+	}
+	for i := range sequence {
+		kind, err := randomInt(0, len(kinds)-1)
+		if err != nil {
+			return err
+		}
+		if kinds[kind] == protoTLS {
+			// A server name is checked once per connection, so one knock
+			sequence[i].Count = 1
+			sequence[i].SNI = randomKey(8) + "." + *sniDomain
+		}
+	}
+	fragment := map[string]any{"sequence": sequence}
+	delay := knock.DefaultInstance().Timeout.Duration / 2
+	if *timing {
+		var timeout time.Duration
+		if delay, timeout, err = randomTiming(sequence); err != nil {
+			return err
+		}
+		fragment["timeout"] = knock.Duration{Duration: timeout}
+	}
+
+	if *serverPath != "" {
+		if err := writeJSONFile(*serverPath, fragment, *force); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Wrote the sequence to %s\n", *serverPath)
+	} else if err := printJSON(fragment); err != nil {
+		return err
+	}
+	if *host == "" {
+		return nil
+	}
+
+	profile := &ClientProfile{
+		Host:     *host,
+		Sequence: expandSequence(sequence),
+		Delay:    knock.Duration{Duration: delay},
+	}
+	for _, step := range sequence {
+		if step.SNI != "" {
+			profile.SNI = expandSNI(sequence)
+			break
+		}
+	}
+	if *clientPath != "" {
+		if err := writeJSONFile(*clientPath, profile, *force); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Wrote the client profile to %s\n", *clientPath)
+	} else if err := printJSON(profile); err != nil {
+		return err
+	}
+
+	if *qr {
+		return printProvisioning(*host, profile)
+	}
+	return nil
+}
+
+// randomTiming bounds the delay before every step after the first with a
+// random min_delay and a max_delay, returning a client delay inside them all
+// and the instance timeout repeated knocks of a step need to stay within.
+func randomTiming(sequence []knock.KnockStep) (delay, timeout time.Duration, err error) {
+	longest := time.Duration(0)
+	for i := 1; i < len(sequence); i++ {
+		ms, err := randomInt(int(minStepDelay.Milliseconds()), int(maxStepDelay.Milliseconds()))
+		if err != nil {
+			return 0, 0, err
+		}
+		sequence[i].MinDelay = knock.Duration{Duration: time.Duration(ms) * time.Millisecond}
+		longest = max(longest, sequence[i].MinDelay.Duration)
+	}
+
+	// The client pauses the same before every knock, so a little past the
+	// longest min_delay
+	delay, timeout = longest+minStepDelay, longest+stepDelaySlack
+	for i := 1; i < len(sequence); i++ {
+		sequence[i].MaxDelay = knock.Duration{Duration: timeout}
+	}
+	return delay, timeout, nil
+}
+
+// expandSNI lists the server name of every knock expandSequence lists.
+func expandSNI(sequence []knock.KnockStep) []string {
+	var names []string
+	for _, step := range sequence {
+		names = append(names, slices.Repeat([]string{step.SNI}, step.Count)...)
+	}
+	return names
+}
+
+// pruneZero removes the zero values from a decoded JSON object, nested ones
+// included, returning nil when nothing is left. Loading defaults them anyway,
+// so leaving them out keeps QR codes small enough to scan.
+func pruneZero(fields map[string]any) map[string]any {
+	for name, v := range fields {
+		if object, ok := v.(map[string]any); ok && pruneZero(object) == nil {
+			delete(fields, name)
+			continue
+		}
+		switch v {
+		case nil, "", "0s", float64(0), false:
+			delete(fields, name)
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	return fields
+}
+
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"port-knocking/pkg/knock"
+)
+
+const systemdUnitPath = "/etc/systemd/system/knock.service"
+
+const systemdUnit = `[Unit]
+Description=Port Knocking Server
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+Type=notify
+ExecStart=%s serve -config %s
+ExecReload=/bin/kill -HUP $MAINPID
+WatchdogSec=30s
+Restart=on-failure
+RestartSec=5s
+
+[Install]
+WantedBy=multi-user.target
+`
+
+// initCommand generates a server config, the matching client profile and
+// optionally a systemd unit, prompting for anything not given as a flag.
+func initCommand(args []string) error {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	dir := fs.String("dir", ".", "directory to write server.json and client.json to")
+	host := fs.String("host", "", "address clients use to reach this server")
+	steps := fs.Int("steps", 4, "number of knock steps in the generated sequence")
+	protected := fs.String("protect", "22", "comma separated service ports to protect")
+	admin := fs.String("admin", "127.0.0.1:8080", "admin API listen address, empty to disable")
+	systemd := fs.Bool("systemd", false, "install a systemd unit for the server")
+	qr := fs.Bool("qr", false, "also print the client profile as a provisioning URI and QR code")
+	yes := fs.Bool("yes", false, "do not prompt, use flag values as given")
+	force := fs.Bool("force", false, "overwrite existing files")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if !*yes && isTerminal(os.Stdin) {
+		in := bufio.NewReader(os.Stdin)
+		var err error
+		if *host, err = ask(in, "Server address for clients", *host); err != nil {
+			return err
+		}
+		if *protected, err = ask(in, "Ports to protect", *protected); err != nil {
+			return err
+		}
+		n, err := ask(in, "Knock steps", strconv.Itoa(*steps))
+		if err != nil {
+			return err
+		}
+		if *steps, err = strconv.Atoi(n); err != nil {
+			return fmt.Errorf("invalid number of steps %q", n)
+		}
+		if *admin, err = ask(in, "Admin API address (empty to disable)", *admin); err != nil {
+			return err
+		}
+		if *dir, err = ask(in, "Output directory", *dir); err != nil {
+			return err
+		}
+		answer, err := ask(in, "Install systemd unit? (y/n)", yesNo(*systemd))
+		if err != nil {
+			return err
+		}
+		*systemd = strings.HasPrefix(strings.ToLower(answer), "y")
+	}
+
+	if *host == "" {
+		return errors.New("server address is required (-host)")
+	}
+	if *steps < 2 {
+		return errors.New("use at least 2 knock steps")
+	}
+
+	var protectedPorts []int
+	exclude := make(map[int]bool)
+	for _, p := range splitList(*protected) {
+		port, err := strconv.Atoi(p)
+		if err != nil || port < 1 || port > 65535 {
+			return fmt.Errorf("invalid port %q", p)
+		}
+		protectedPorts = append(protectedPorts, port)
+		exclude[port] = true
+	}
+
+	sequence, err := generateSequence(*steps, exclude)
+	if err != nil {
+		return err
+	}
+
+	inst := knock.DefaultInstance()
+	inst.Sequence = sequence
+	inst.ProtectedPorts = protectedPorts
+
+	cfg := &knock.Config{
+		StateKey:  randomKey(32),
+		Instances: []knock.InstanceConfig{inst},
+	}
+	if *admin != "" {
+		cfg.Admin = knock.AdminConfig{Listen: *admin, Token: randomKey(24)}
+	}
+
+	profile := &ClientProfile{
+		Host:     *host,
+		Sequence: expandSequence(sequence),
+		Delay:    knock.Duration{Duration: inst.Timeout.Duration / 2},
+	}
+
+	if err := os.MkdirAll(*dir, 0o700); err != nil {
+		return err
+	}
+	serverPath, err := filepath.Abs(filepath.Join(*dir, "server.json"))
+	if err != nil {
+		return err
+	}
+	clientPath := filepath.Join(*dir, "client.json")
+
+	if err := writeJSONFile(serverPath, cfg, *force); err != nil {
+		return err
+	}
+	if err := writeJSONFile(clientPath, profile, *force); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote server config to %s\n", serverPath)
+	fmt.Printf("Wrote client profile to %s (copy it to your clients)\n", clientPath)
+	if *qr {
+		if err := printProvisioning(*host, profile); err != nil {
+			return err
+		}
+	}
+
+	if *systemd {
+		if err := installSystemdUnit(serverPath, *force); err != nil {
+			return err
+		}
+		fmt.Printf("Installed %s, start it with: systemctl enable --now knock\n", systemdUnitPath)
+	}
+	return nil
+}
+
+func ask(in *bufio.Reader, question, def string) (string, error) {
+	if def != "" {
+		fmt.Printf("%s [%s]: ", question, def)
+	} else {
+		fmt.Printf("%s: ", question)
+	}
+
+	line, err := in.ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	if line = strings.TrimSpace(line); line == "" {
+		return def, nil
+	}
+	return line, nil
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "y"
+	}
+	return "n"
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// generateSequence picks n distinct random unprivileged ports, each knocked 1 to 3 times.
+func generateSequence(n int, exclude map[int]bool) ([]knock.KnockStep, error) {
+	used := make(map[int]bool, n)
+	sequence := make([]knock.KnockStep, 0, n)
+
+	for len(sequence) < n {
+		port, err := randomInt(1024, 65535)
+		if err != nil {
+			return nil, err
+		}
+		if used[port] || exclude[port] || knock.WellKnownPort(port) {
+			continue
+		}
+		count, err := randomInt(1, 3)
+		if err != nil {
+			return nil, err
+		}
+
+		used[port] = true
+		sequence = append(sequence, knock.KnockStep{Port: port, Count: count})
+	}
+	return sequence, nil
+}
+
+// expandSequence turns knock steps into the port list a client sends.
+func expandSequence(sequence []knock.KnockStep) []int {
+	var ports []int
+	for _, step := range sequence {
+		for i := 0; i < step.Count; i++ {
+			ports = append(ports, step.Port)
+		}
+	}
+	return ports
+}
+
+// randomInt returns a uniform random integer in [min, max].
+func randomInt(min, max int) (int, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(max-min+1)))
+	if err != nil {
+		return 0, err
+	}
+	return min + int(n.Int64()), nil
+}
+
+func randomKey(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// writeJSONFile writes v readable only by the owner, since configs hold keys.
+func writeJSONFile(path string, v any, force bool) error {
+	if _, err := os.Stat(path); err == nil && !force {
+		return fmt.Errorf("%s already exists (use -force to overwrite)", path)
+	}
+
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o600)
+}
+
+func installSystemdUnit(configPath string, force bool) error {
+	if _, err := os.Stat(systemdUnitPath); err == nil && !force {
+		return fmt.Errorf("%s already exists (use -force to overwrite)", systemdUnitPath)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	unit := fmt.Sprintf(systemdUnit, exe, configPath)
+	if err := os.WriteFile(systemdUnitPath, []byte(unit), 0o644); err != nil {
+		return fmt.Errorf("writing systemd unit: %w", err)
+	}
+
+	cmd := exec.Command("systemctl", "daemon-reload")
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("systemctl daemon-reload: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"port-knocking/pkg/knock"
+)
+
+// knockCommand sends the sequence of a client profile, given with -profile
+// or as the first argument: `knock office -open 22`.
+func knockCommand(args []string) error {
+	fs := flag.NewFlagSet("knock", flag.ExitOnError)
+	profilePath := fs.String("profile", "", "path or name of the JSON client profile, or a portknock:// provisioning URI")
+	open := fs.String("open", "", "comma separated ports to request, needs a payload key")
+	dur := fs.Duration("for", 0, "access length to request, needs a payload key")
+	list := fs.Bool("list", false, "list the profiles of the client config")
+	skew := fs.Int("skew", 0, "TOTP windows on either side also knocked while the server does not confirm, the profile's totp_skew when zero")
+
+	// Allow the profile before the flags
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		*profilePath, args = args[0], args[1:]
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *profilePath == "" && fs.NArg() > 0 {
+		*profilePath = fs.Arg(0)
+	}
+	if *list {
+		return listClientProfiles()
+	}
+
+	p, err := LoadClientProfile(*profilePath)
+	if err != nil {
+		return err
+	}
+	if *open != "" {
+		if p.Open, err = parsePorts(*open); err != nil {
+			return err
+		}
+	}
+	if *dur > 0 {
+		p.For = knock.Duration{Duration: *dur}
+	}
+	if *skew > 0 {
+		p.TOTPSkew = *skew
+	}
+	return client(p)
+}
+
+// listClientProfiles prints the profiles of the client config, marking the
+// default one.
+func listClientProfiles() error {
+	cfg, err := LoadClientConfig()
+	if err != nil {
+		return err
+	}
+	if len(cfg.Profiles) == 0 {
+		fmt.Fprintf(os.Stderr, "No profiles in %s\n", cfg.path)
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tHOST\tDEFAULT")
+	for _, name := range slices.Sorted(maps.Keys(cfg.Profiles)) {
+		p := defaultProfile()
+		if err := json.Unmarshal(cfg.Profiles[name], p); err != nil {
+			return fmt.Errorf("parsing profile %s in %s: %w", name, cfg.path, err)
+		}
+		mark := ""
+		if name == cfg.Default {
+			mark = "*"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", name, p.Host, mark)
+	}
+	return tw.Flush()
+}
@@ -1,9 +1,163 @@
 package main
 
-import "time"
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"port-knocking/pkg/knock"
+
+	// SQL drivers of the audit log
+	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "modernc.org/sqlite"
+)
+
+func usage() {
+	name := filepath.Base(os.Args[0])
+	fmt.Fprintf(os.Stderr, "Usage:\n")
+	fmt.Fprintf(os.Stderr, "  %s serve [-config file] [-pidfile file]       Run the knock server\n", name)
+	fmt.Fprintf(os.Stderr, "  %s check [-config file]                       Run the startup preflight checks\n", name)
+	fmt.Fprintf(os.Stderr, "  %s init [-host addr] [-yes] ...               Generate server and client configs\n", name)
+	fmt.Fprintf(os.Stderr, "  %s knock [profile] [-open ports -for d] [-list] Send the knock sequence\n", name)
+	fmt.Fprintf(os.Stderr, "  %s gen-sequence [-steps n] [-host addr -qr] ...  Generate a random sequence and client profile\n", name)
+	fmt.Fprintf(os.Stderr, "  %s state export|import [-config file] ...     Back up or restore server state\n", name)
+	fmt.Fprintf(os.Stderr, "  %s status [-watch] [-config file]             Show clients, sessions and events live\n", name)
+	fmt.Fprintf(os.Stderr, "  %s sessions list|extend|revoke ...            Manage active sessions\n", name)
+	fmt.Fprintf(os.Stderr, "  %s bans list|unban <ip> [-config file]        Manage banned sources\n", name)
+	fmt.Fprintf(os.Stderr, "  %s users list|add|remove|enable|disable ...   Manage users\n", name)
+	fmt.Fprintf(os.Stderr, "  %s users provision <name> -instance i ...     Provision a user's client profile\n", name)
+	fmt.Fprintf(os.Stderr, "  %s report [-range 7d] [-export csv|json] ...   Summarize or export knock activity\n", name)
+	fmt.Fprintf(os.Stderr, "  %s audit [-event e] [-ip ip] [-since t] ...   Search stored knock outcomes\n", name)
+	fmt.Fprintf(os.Stderr, "  %s bench [-clients n] [-invalid 0.2] ...        Load test a server with simulated knockers\n", name)
+	fmt.Fprintf(os.Stderr, "  %s service install [-config file]|uninstall|start|stop  Manage the Windows service\n", name)
+	fmt.Fprintf(os.Stderr, "\nWithout -config, $%s names the config file, else the first of\n", knock.ConfigEnv)
+	for _, path := range knock.ConfigSearchPath() {
+		fmt.Fprintf(os.Stderr, "  %s\n", path)
+	}
+	fmt.Fprintf(os.Stderr, "is used, falling back to the built-in defaults.\n")
+	if path := ClientConfigPath(); path != "" {
+		fmt.Fprintf(os.Stderr, "\nknock looks profile names up in %s ($%s),\n", path, ClientConfigEnv)
+		fmt.Fprintf(os.Stderr, "knocking its default profile when none is named.\n")
+	}
+}
+
+// loadConfigFlags parses the common -config flag for a subcommand.
+func loadConfigFlags(name string, args []string) (*knock.Config, error) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	configPath := fs.String("config", "", "path to the JSON config file")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	return knock.LoadConfig(*configPath)
+}
 
 func main() {
-	go server()
+	// Started by the Windows service control manager
+	if isWindowsService() {
+		if err := runService(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if len(os.Args) < 2 {
+		demo()
+		return
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "serve":
+		err = serveCommand(os.Args[2:])
+	case "check":
+		var cfg *knock.Config
+		if cfg, err = loadConfigFlags("check", os.Args[2:]); err == nil {
+			err = checkAll(cfg)
+		}
+	case "init":
+		err = initCommand(os.Args[2:])
+	case "knock":
+		err = knockCommand(os.Args[2:])
+	case "gen-sequence":
+		err = genSequenceCommand(os.Args[2:])
+	case "state":
+		err = stateCommand(os.Args[2:])
+	case "status":
+		err = statusCommand(os.Args[2:])
+	case "sessions":
+		err = sessionsCommand(os.Args[2:])
+	case "bans":
+		err = bansCommand(os.Args[2:])
+	case "users":
+		err = usersCommand(os.Args[2:])
+	case "report":
+		err = reportCommand(os.Args[2:])
+	case "audit":
+		err = auditCommand(os.Args[2:])
+	case "bench":
+		err = benchCommand(os.Args[2:])
+	case "service":
+		err = serviceCommand(os.Args[2:])
+	default:
+		usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// serveCommand runs the knock server until it is signalled to stop, see
+// knock.Daemon.
+func serveCommand(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to the JSON config file")
+	pidFile := fs.String("pidfile", "", "file to write the process ID to")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := knock.LoadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	d := &knock.Daemon{ConfigPath: *configPath, PIDFile: *pidFile}
+	return d.Run(cfg)
+}
+
+func checkAll(cfg *knock.Config) error {
+	var errs []error
+	if err := knock.PreflightConfig(cfg); err != nil {
+		errs = append(errs, err)
+	}
+	for _, inst := range cfg.Instances {
+		for _, warning := range knock.SequenceWarnings(inst) {
+			fmt.Printf("Warning: %s\n", warning)
+		}
+		if err := knock.Preflight(inst); err != nil {
+			errs = append(errs, fmt.Errorf("instance %s: %w", inst.Name, err))
+			continue
+		}
+		fmt.Printf("[%s] Preflight OK\n", inst.Name)
+	}
+	return errors.Join(errs...)
+}
+
+func demo() {
+	go func() {
+		if err := knock.Run(context.Background(), knock.DefaultConfig()); err != nil {
+			log.Fatal(err)
+		}
+	}()
 	time.Sleep(5 * time.Second)
-	client()
+	if err := client(defaultProfile()); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,286 @@
+package knock
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"time"
+)
+
+// Access describes a client that completed a knock sequence.
+type Access struct {
+	Instance string    `json:"instance"`
+	IP       string    `json:"ip"`
+	User     string    `json:"user,omitempty"`    // Set when the source matches a known user
+	Client   string    `json:"client,omitempty"`  // Client ID a signed or encrypted request named, for clients sharing a NAT
+	Source   string    `json:"source,omitempty"`  // Address the request came from, set when it asked to open IP instead
+	Profile  string    `json:"profile,omitempty"` // Completed profile, empty for the default one
+	Time     time.Time `json:"time"`
+	Session  string    `json:"session,omitempty"` // Set once a session is opened
+	Expires  time.Time `json:"expires,omitzero"`  // End of the session, set once one is opened
+	Ports    []int     `json:"ports,omitempty"`   // Services asked for by an encrypted request, replacing the actions' own
+
+	// Set from the service of the completed profile, the actions' own when empty
+	Protocol string `json:"protocol,omitempty"` // "tcp" or "udp"
+	Forward  string `json:"forward,omitempty"`  // Host, or host:port, the ports are forwarded to
+
+	Interface string `json:"interface,omitempty"` // Interface the completing knock arrived on, when known
+
+	trace *span  // Span the outcomes of the access are traced under, nil when not traced
+	nonce string // Hex nonce of the sealed or signed request granted, empty for plain knocks
+}
+
+// Action is notified of knock outcomes. OnGranted runs for every access that
+// passes authorization; actions interested in other outcomes also implement
+// DenyHook, FailHook, BanHook or ExpireHook.
+type Action interface {
+	Name() string
+	OnGranted(ctx context.Context, access Access) error
+}
+
+// DenyHook is implemented by actions that want to see refused sequences.
+type DenyHook interface {
+	OnDenied(ctx context.Context, access Access, reason string) error
+}
+
+// FailHook is implemented by actions that want to see invalid knocks and
+// SPA packets, which are not tied to a profile.
+type FailHook interface {
+	OnFailed(ctx context.Context, access Access, reason string) error
+}
+
+// BanHook is implemented by actions that want to see banned sources.
+type BanHook interface {
+	OnBanned(ctx context.Context, access Access, until time.Time) error
+}
+
+// ExpireHook is implemented by actions whose grant is undone when the
+// session ends, whether it expired, was evicted or was revoked.
+type ExpireHook interface {
+	OnExpired(ctx context.Context, access Access) error
+}
+
+// ExtendHook is implemented by actions that must learn the new expiry when
+// a session is extended.
+type ExtendHook interface {
+	OnExtended(ctx context.Context, access Access) error
+}
+
+// HealthCheck is implemented by actions depending on something outside the
+// process, such as a firewall, checked by the readiness endpoint.
+type HealthCheck interface {
+	CheckHealth(ctx context.Context) error
+}
+
+// logAction reports every outcome on the log. Every instance runs it before
+// its configured actions.
+type logAction struct{}
+
+func (logAction) Name() string {
+	return "log"
+}
+
+func (logAction) OnGranted(ctx context.Context, access Access) error {
+	log.Printf("[%s] ACCESS GRANTED for IP %s%s%s%s (session %s until %s)",
+		access.Instance,
+		access.IP,
+		userSuffix(access.User),
+		clientSuffix(access.Client),
+		profileSuffix(access.Profile),
+		access.Session,
+		access.Expires.Format(time.RFC3339))
+	return nil
+}
+
+func (logAction) OnDenied(ctx context.Context, access Access, reason string) error {
+	log.Printf("[%s] ACCESS DENIED for IP %s: %s", access.Instance, access.IP, reason)
+	return nil
+}
+
+func (logAction) OnBanned(ctx context.Context, access Access, until time.Time) error {
+	log.Printf("[%s] BANNED IP %s until %s", access.Instance, access.IP, until.Format(time.RFC3339))
+	return nil
+}
+
+func (logAction) OnExtended(ctx context.Context, access Access) error {
+	log.Printf("[%s] Session %s for IP %s extended until %s",
+		access.Instance,
+		access.Session,
+		access.IP,
+		access.Expires.Format(time.RFC3339))
+	return nil
+}
+
+func (logAction) OnExpired(ctx context.Context, access Access) error {
+	log.Printf("[%s] Session %s for IP %s ended", access.Instance, access.Session, access.IP)
+	return nil
+}
+
+func userSuffix(user string) string {
+	if user == "" {
+		return ""
+	}
+	return " user " + user
+}
+
+// clientSuffix names the client a request identified in log lines.
+func clientSuffix(client string) string {
+	if client == "" {
+		return ""
+	}
+	return " client " + client
+}
+
+// Authorizer decides whether a completed sequence is actually granted.
+type Authorizer interface {
+	Name() string
+	Authorize(ctx context.Context, access Access) (allowed bool, reason string, err error)
+}
+
+// Registry holds every action and policy available to the instances, by name,
+// along with the state the instances share.
+type Registry struct {
+	actions  map[string]Action
+	policies map[string]Authorizer
+
+	// Completed sequences shared by every instance
+	history *History
+	// Sessions held by clients across every instance
+	sessions *SessionManager
+	// Sources banned by any instance
+	bans *BanList
+	// Known users, nil when user management is not configured
+	users *UserStore
+	// Historical counters, nil when statistics are not configured
+	stats *Stats
+	// Live counters, nil when no StatsD agent is configured
+	metrics *StatsD
+	// Spans of the knock pipeline, nil when tracing is not configured
+	tracer *Tracer
+	// Country and ASN lookups, nil when no database is configured
+	geo *GeoIP
+	// Blocklist feeds by name
+	feeds map[string]*Feed
+	// Confirmations grants can wait for, by name
+	secondFactors map[string]*SecondFactor
+	// Debug packet recorder, nil when capture is not configured
+	capture *Recorder
+	// Progress shared with other nodes, nil when each node keeps its own
+	store StateStore
+	// Stored outcomes, nil when auditing is not configured
+	audit *AuditLog
+	// Structured knock events, slog.Default() when nil
+	logger *slog.Logger
+	// Latest outcomes, for status views
+	events *EventLog
+}
+
+func NewRegistry(sessions SessionConfig, users *UserStore) *Registry {
+	return &Registry{
+		actions:  make(map[string]Action),
+		policies: make(map[string]Authorizer),
+		history:  NewHistory(),
+		sessions: NewSessionManager(sessions),
+		bans:     NewBanList(),
+		users:    users,
+		events:   NewEventLog(),
+		feeds:    make(map[string]*Feed),
+
+		secondFactors: make(map[string]*SecondFactor),
+	}
+}
+
+func (r *Registry) AddAction(a Action) error {
+	if _, ok := r.actions[a.Name()]; ok {
+		return fmt.Errorf("action %q already registered", a.Name())
+	}
+	r.actions[a.Name()] = a
+	return nil
+}
+
+func (r *Registry) AddPolicy(p Authorizer) error {
+	if _, ok := r.policies[p.Name()]; ok {
+		return fmt.Errorf("policy %q already registered", p.Name())
+	}
+	r.policies[p.Name()] = p
+	return nil
+}
+
+func (r *Registry) AddFeed(f *Feed) error {
+	if _, ok := r.feeds[f.Name()]; ok {
+		return fmt.Errorf("feed %q already registered", f.Name())
+	}
+	r.feeds[f.Name()] = f
+	return nil
+}
+
+func (r *Registry) AddSecondFactor(f *SecondFactor) error {
+	if _, ok := r.secondFactors[f.Name()]; ok {
+		return fmt.Errorf("second factor %q already registered", f.Name())
+	}
+	r.secondFactors[f.Name()] = f
+	return nil
+}
+
+func (r *Registry) Actions(names []string) ([]Action, error) {
+	actions := make([]Action, 0, len(names))
+	for _, name := range names {
+		a, ok := r.actions[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown action %q", name)
+		}
+		actions = append(actions, a)
+	}
+	return actions, nil
+}
+
+func (r *Registry) Policies(names []string) ([]Authorizer, error) {
+	policies := make([]Authorizer, 0, len(names))
+	for _, name := range names {
+		p, ok := r.policies[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown policy %q", name)
+		}
+		policies = append(policies, p)
+	}
+	return policies, nil
+}
+
+func (r *Registry) Feeds(names []string) ([]*Feed, error) {
+	feeds := make([]*Feed, 0, len(names))
+	for _, name := range names {
+		f, ok := r.feeds[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown feed %q", name)
+		}
+		feeds = append(feeds, f)
+	}
+	return feeds, nil
+}
+
+// SecondFactor looks up a second factor by name, nil for an empty name.
+func (r *Registry) SecondFactor(name string) (*SecondFactor, error) {
+	if name == "" {
+		return nil, nil
+	}
+	f, ok := r.secondFactors[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown second factor %q", name)
+	}
+	return f, nil
+}
+
+// authorize asks every policy in order; the first denial or error wins.
+func authorize(ctx context.Context, policies []Authorizer, access Access) (bool, string, error) {
+	for _, p := range policies {
+		allowed, reason, err := p.Authorize(ctx, access)
+		if err != nil {
+			return false, "", fmt.Errorf("policy %s: %w", p.Name(), err)
+		}
+		if !allowed {
+			return false, fmt.Sprintf("%s: %s", p.Name(), reason), nil
+		}
+	}
+	return true, "", nil
+}
@@ -0,0 +1,649 @@
+package knock
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Response is the envelope returned by every admin API endpoint.
+type Response struct {
+	Success bool   `json:"success"`
+	Data    any    `json:"data,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// AdminServer exposes the supervisor over HTTP.
+type AdminServer struct {
+	cfg      AdminConfig
+	stateKey string
+	sup      *Supervisor
+	sessions *SessionManager
+	bans     *BanList
+	users    *UserStore
+	stats    *Stats
+	audit    *AuditLog
+	capture  *Recorder
+	events   *EventLog
+	checks   map[string]HealthCheck // Actions the readiness probe checks
+
+	ln  net.Listener
+	srv *http.Server
+}
+
+func NewAdminServer(cfg *Config, sup *Supervisor, reg *Registry) *AdminServer {
+	a := &AdminServer{
+		cfg:      cfg.Admin,
+		stateKey: cfg.StateKey,
+		sup:      sup,
+		sessions: reg.sessions,
+		bans:     reg.bans,
+		users:    reg.users,
+		stats:    reg.stats,
+		audit:    reg.audit,
+		capture:  reg.capture,
+		events:   reg.events,
+		checks:   reg.healthChecks(),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /instances", a.listInstances)
+	mux.HandleFunc("GET /clients", a.listClients)
+	mux.HandleFunc("GET /events", a.listEvents)
+	mux.HandleFunc("POST /instances/{name}/start", a.startInstance)
+	mux.HandleFunc("POST /instances/{name}/stop", a.stopInstance)
+	mux.HandleFunc("POST /instances/{name}/provision", a.provision)
+	mux.HandleFunc("PUT /instances/{name}/sequence", a.setSequence)
+	mux.HandleFunc("GET /state", a.exportState)
+	mux.HandleFunc("POST /state", a.importState)
+	mux.HandleFunc("GET /sessions", a.listSessions)
+	mux.HandleFunc("POST /sessions/{id}/extend", a.extendSession)
+	mux.HandleFunc("DELETE /sessions/{id}", a.revokeSession)
+	mux.HandleFunc("DELETE /sessions", a.revokeAllSessions)
+	mux.HandleFunc("GET /bans", a.listBans)
+	mux.HandleFunc("DELETE /bans/{ip}", a.unban)
+	mux.HandleFunc("GET /users", a.listUsers)
+	mux.HandleFunc("GET /users/{name}", a.getUser)
+	mux.HandleFunc("PUT /users/{name}", a.putUser)
+	mux.HandleFunc("DELETE /users/{name}", a.deleteUser)
+	mux.HandleFunc("DELETE /users/{name}/sessions", a.revokeUserSessions)
+	mux.HandleFunc("GET /stats", a.getStats)
+	mux.HandleFunc("GET /stats/export", a.exportStats)
+	mux.HandleFunc("GET /audit", a.queryAudit)
+	mux.HandleFunc("GET /captures", a.listCaptures)
+	mux.HandleFunc("GET /captures/latest", a.latestCapture)
+	mux.HandleFunc("GET /runtime", a.getRuntime)
+
+	// Probes carry no credentials, so the health endpoints skip the token
+	root := http.NewServeMux()
+	root.HandleFunc("GET /healthz", a.healthz)
+	root.HandleFunc("GET /readyz", a.readyz)
+	root.Handle("/", a.authenticate(mux))
+
+	a.srv = &http.Server{
+		Handler:           root,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	return a
+}
+
+// Listen binds the admin address so failures surface before the server starts.
+func (a *AdminServer) Listen() error {
+	network, addr := adminNetwork(a.cfg.Listen)
+	if network == "unix" {
+		// A socket left behind by an unclean stop would fail the bind
+		_ = os.Remove(addr)
+	}
+
+	ln, err := listen(network, addr)
+	if err != nil {
+		return fmt.Errorf("admin API: %w", err)
+	}
+	if network == "unix" {
+		if err := os.Chmod(addr, 0o600); err != nil {
+			_ = ln.Close()
+			return fmt.Errorf("admin API: %w", err)
+		}
+	}
+	a.ln = ln
+	return nil
+}
+
+// adminNetwork splits an admin listen address into the network and address
+// to use, "unix:" prefixing a socket path.
+func adminNetwork(listen string) (string, string) {
+	if path, ok := strings.CutPrefix(listen, "unix:"); ok {
+		return "unix", path
+	}
+	return "tcp", listen
+}
+
+// Serve handles admin requests until ctx is cancelled.
+func (a *AdminServer) Serve(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = a.srv.Shutdown(shutdownCtx)
+	}()
+
+	log.Printf("Admin API listening on %s", a.ln.Addr())
+	if err := a.srv.Serve(a.ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("Admin API stopped: %v", err)
+	}
+}
+
+func (a *AdminServer) authenticate(next http.Handler) http.Handler {
+	if a.cfg.Token == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.authorized(r) {
+			writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authorized reports whether r carries the admin token, if one is set.
+func (a *AdminServer) authorized(r *http.Request) bool {
+	if a.cfg.Token == "" {
+		return true
+	}
+	got := []byte(r.Header.Get("Authorization"))
+	return subtle.ConstantTimeCompare(got, []byte("Bearer "+a.cfg.Token)) == 1
+}
+
+func (a *AdminServer) listInstances(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.sup.Status())
+}
+
+func (a *AdminServer) listClients(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.sup.Progress())
+}
+
+func (a *AdminServer) listEvents(w http.ResponseWriter, r *http.Request) {
+	limit := 50
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q", s))
+			return
+		}
+		limit = n
+	}
+	writeJSON(w, http.StatusOK, a.events.Recent(limit))
+}
+
+func (a *AdminServer) startInstance(w http.ResponseWriter, r *http.Request) {
+	if err := a.sup.Start(r.PathValue("name")); err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, nil)
+}
+
+func (a *AdminServer) stopInstance(w http.ResponseWriter, r *http.Request) {
+	if err := a.sup.Stop(r.PathValue("name")); err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, nil)
+}
+
+// SequenceRequest replaces the sequence of a profile of a running instance.
+type SequenceRequest struct {
+	Profile  string      `json:"profile,omitempty"` // The default one when empty
+	Sequence []KnockStep `json:"sequence"`
+}
+
+// setSequence changes knock ports without a restart, answering with the
+// instance as it now runs.
+func (a *AdminServer) setSequence(w http.ResponseWriter, r *http.Request) {
+	var req SequenceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	name := r.PathValue("name")
+	if err := a.sup.SetSequence(name, req.Profile, req.Sequence); err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+	for _, st := range a.sup.Status() {
+		if st.Name == name {
+			writeJSON(w, http.StatusOK, st)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, nil)
+}
+
+// provision returns the client profile of an instance, recording who it was
+// made for as a user restricted to the instance. With format=file the
+// profile comes alone, as a file to hand to the client.
+func (a *AdminServer) provision(w http.ResponseWriter, r *http.Request) {
+	var req ProvisionRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Host == "" {
+		req.Host = a.cfg.PublicHost
+	}
+	if req.Host == "" {
+		writeError(w, http.StatusBadRequest, errors.New("no host, set one or admin.public_host"))
+		return
+	}
+	if req.User != "" && a.users == nil {
+		writeError(w, http.StatusNotFound, ErrUsersDisabled)
+		return
+	}
+
+	name := r.PathValue("name")
+	bundle, err := a.sup.ClientBundle(name, req.Profile, req.Host)
+	if err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+
+	if req.User != "" {
+		if err := a.users.Enroll(req.User, name, req.Sources); err != nil {
+			writeError(w, statusFor(err), err)
+			return
+		}
+		bundle.ClientID = req.User
+		// The user's own key, so their requests name them and disabling them
+		// locks them out
+		if bundle.PayloadKey != "" {
+			if bundle.PayloadKey, err = a.users.EnsureKey(req.User); err != nil {
+				writeError(w, statusFor(err), err)
+				return
+			}
+		}
+		log.Printf("Provisioned a client profile of instance %s for user %s via admin API", name, req.User)
+	}
+
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "", "json":
+		writeJSON(w, http.StatusOK, bundle)
+	case "file":
+		file := name
+		if req.User != "" {
+			file = req.User
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", file+".json"))
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(bundle)
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid format %q, use json or file", format))
+	}
+}
+
+func (a *AdminServer) exportState(w http.ResponseWriter, r *http.Request) {
+	signed, err := signState(a.stateKey, a.sup.ExportState())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, signed)
+}
+
+func (a *AdminServer) importState(w http.ResponseWriter, r *http.Request) {
+	signed := &SignedState{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<20)).Decode(signed); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	snap, err := verifyState(a.stateKey, signed)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	restored, err := a.sup.ImportState(r.Context(), snap)
+	if err != nil {
+		log.Printf("State import finished with errors: %v", err)
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"sessions": restored})
+}
+
+func (a *AdminServer) listSessions(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.sessions.View())
+}
+
+// ExtendRequest is the body of POST /sessions/{id}/extend.
+type ExtendRequest struct {
+	By Duration `json:"by"`
+}
+
+func (a *AdminServer) extendSession(w http.ResponseWriter, r *http.Request) {
+	var req ExtendRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.By.Duration <= 0 {
+		writeError(w, http.StatusBadRequest, errors.New("extension must be positive"))
+		return
+	}
+
+	s, err := a.sessions.Extend(r.PathValue("id"), req.By.Duration)
+	if err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+	s.extend(r.Context())
+	writeJSON(w, http.StatusOK, s)
+}
+
+func (a *AdminServer) revokeSession(w http.ResponseWriter, r *http.Request) {
+	s, err := a.sessions.Revoke(r.PathValue("id"))
+	if err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+	s.revoke(r.Context())
+	writeJSON(w, http.StatusOK, s)
+}
+
+func (a *AdminServer) revokeAllSessions(w http.ResponseWriter, r *http.Request) {
+	revoked := a.sessions.RevokeAll()
+	for _, s := range revoked {
+		s.revoke(r.Context())
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"sessions": len(revoked)})
+}
+
+func (a *AdminServer) listBans(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.bans.List())
+}
+
+func (a *AdminServer) unban(w http.ResponseWriter, r *http.Request) {
+	ban, err := a.bans.Unban(r.PathValue("ip"))
+	if err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+	log.Printf("Unbanned IP %s via admin API", ban.IP)
+	writeJSON(w, http.StatusOK, ban)
+}
+
+func (a *AdminServer) listUsers(w http.ResponseWriter, r *http.Request) {
+	if a.users == nil {
+		writeError(w, http.StatusNotFound, ErrUsersDisabled)
+		return
+	}
+	writeJSON(w, http.StatusOK, a.users.List())
+}
+
+func (a *AdminServer) getUser(w http.ResponseWriter, r *http.Request) {
+	if a.users == nil {
+		writeError(w, http.StatusNotFound, ErrUsersDisabled)
+		return
+	}
+
+	u, err := a.users.Get(r.PathValue("name"))
+	if err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, u)
+}
+
+func (a *AdminServer) putUser(w http.ResponseWriter, r *http.Request) {
+	if a.users == nil {
+		writeError(w, http.StatusNotFound, ErrUsersDisabled)
+		return
+	}
+
+	var u User
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&u); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	u.Name = r.PathValue("name")
+
+	if err := a.users.Put(u); err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+	// A disabled user's keys stop working, and so do the sessions they opened
+	if u.Disabled {
+		a.revokeUser(r.Context(), u.Name)
+	}
+	writeJSON(w, http.StatusOK, u)
+}
+
+func (a *AdminServer) deleteUser(w http.ResponseWriter, r *http.Request) {
+	if a.users == nil {
+		writeError(w, http.StatusNotFound, ErrUsersDisabled)
+		return
+	}
+
+	name := r.PathValue("name")
+	if err := a.users.Delete(name); err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+	a.revokeUser(r.Context(), name)
+	writeJSON(w, http.StatusOK, nil)
+}
+
+func (a *AdminServer) revokeUserSessions(w http.ResponseWriter, r *http.Request) {
+	if a.users == nil {
+		writeError(w, http.StatusNotFound, ErrUsersDisabled)
+		return
+	}
+
+	name := r.PathValue("name")
+	if _, err := a.users.Get(name); err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"sessions": a.revokeUser(r.Context(), name)})
+}
+
+// revokeUser ends every session of the user, returning how many there were.
+func (a *AdminServer) revokeUser(ctx context.Context, name string) int {
+	revoked := a.sessions.RevokeUser(name)
+	for _, s := range revoked {
+		s.revoke(ctx)
+	}
+	if len(revoked) > 0 {
+		log.Printf("Revoked %d session(s) of user %s via admin API", len(revoked), name)
+	}
+	return len(revoked)
+}
+
+func (a *AdminServer) getStats(w http.ResponseWriter, r *http.Request) {
+	if a.stats == nil {
+		writeError(w, http.StatusNotFound, ErrStatsDisabled)
+		return
+	}
+
+	days, err := parseRangeDays(r.URL.Query().Get("range"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, a.stats.Report(days))
+}
+
+// exportStats returns the daily counters by ip or port over a range of
+// days, as JSON or, with format=csv, as a CSV file.
+func (a *AdminServer) exportStats(w http.ResponseWriter, r *http.Request) {
+	if a.stats == nil {
+		writeError(w, http.StatusNotFound, ErrStatsDisabled)
+		return
+	}
+
+	q, now := r.URL.Query(), time.Now()
+	from, err := parseStatsDay(q.Get("from"), now)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	to, err := parseStatsDay(q.Get("to"), now)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	rows, err := a.stats.Export(q.Get("by"), from, to)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	switch q.Get("format") {
+	case "", "json":
+		writeJSON(w, http.StatusOK, rows)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="knock-stats.csv"`)
+		_ = WriteStatsCSV(w, q.Get("by"), rows)
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid format %q, use json or csv", q.Get("format")))
+	}
+}
+
+func (a *AdminServer) queryAudit(w http.ResponseWriter, r *http.Request) {
+	if a.audit == nil {
+		writeError(w, http.StatusNotFound, ErrAuditDisabled)
+		return
+	}
+
+	q, err := parseAuditQuery(r.URL.Query(), time.Now())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	events, err := a.audit.Query(r.Context(), q)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, events)
+}
+
+func (a *AdminServer) listCaptures(w http.ResponseWriter, r *http.Request) {
+	if a.capture == nil {
+		writeError(w, http.StatusNotFound, ErrCaptureDisabled)
+		return
+	}
+
+	files, err := a.capture.Files()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, files)
+}
+
+// latestCapture downloads the newest pcap file, which may still be growing.
+func (a *AdminServer) latestCapture(w http.ResponseWriter, r *http.Request) {
+	if a.capture == nil {
+		writeError(w, http.StatusNotFound, ErrCaptureDisabled)
+		return
+	}
+
+	path, err := a.capture.Latest()
+	if err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(path)))
+	http.ServeContent(w, r, filepath.Base(path), info.ModTime(), io.NewSectionReader(f, 0, info.Size()))
+}
+
+// RuntimeStats is the resource use of the server process.
+type RuntimeStats struct {
+	HeapAlloc  uint64 `json:"heap_alloc"` // Bytes of allocated heap objects
+	HeapInuse  uint64 `json:"heap_inuse"`
+	Sys        uint64 `json:"sys"` // Bytes obtained from the OS
+	NumGC      uint32 `json:"num_gc"`
+	Goroutines int    `json:"goroutines"`
+	Clients    int    `json:"clients"` // Sources with a sequence in progress
+	Sessions   int    `json:"sessions"`
+}
+
+// getRuntime reports the process's memory and goroutines, after a garbage
+// collection with gc=1 so only what is retained counts.
+func (a *AdminServer) getRuntime(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("gc") == "1" {
+		runtime.GC()
+	}
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	writeJSON(w, http.StatusOK, RuntimeStats{
+		HeapAlloc:  mem.HeapAlloc,
+		HeapInuse:  mem.HeapInuse,
+		Sys:        mem.Sys,
+		NumGC:      mem.NumGC,
+		Goroutines: runtime.NumGoroutine(),
+		Clients:    len(a.sup.Progress()),
+		Sessions:   len(a.sessions.List()),
+	})
+}
+
+func statusFor(err error) int {
+	switch {
+	case errors.Is(err, ErrUnknownInstance), errors.Is(err, ErrUnknownUser), errors.Is(err, ErrUsersDisabled),
+		errors.Is(err, ErrNoCapture), errors.Is(err, ErrUnknownSession), errors.Is(err, ErrUnknownBan),
+		errors.Is(err, ErrUnknownProfile):
+		return http.StatusNotFound
+	case errors.Is(err, ErrInvalidUser), errors.Is(err, ErrConfigValidationFailed):
+		return http.StatusBadRequest
+	default:
+		return http.StatusConflict
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(Response{Success: true, Data: data})
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(Response{Success: false, Error: err.Error()})
+}
@@ -0,0 +1,86 @@
+package knock
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// AdminClient talks to a running server's admin API.
+type AdminClient struct {
+	base  string
+	token string
+	http  *http.Client
+}
+
+func NewAdminClient(cfg AdminConfig) (*AdminClient, error) {
+	if cfg.Listen == "" {
+		return nil, errors.New("admin API is not configured (admin.listen is empty)")
+	}
+
+	c := &AdminClient{
+		base:  "http://" + cfg.Listen,
+		token: cfg.Token,
+		http:  &http.Client{Timeout: 30 * time.Second},
+	}
+	if network, path := adminNetwork(cfg.Listen); network == "unix" {
+		c.base = "http://unix"
+		c.http.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		}
+	}
+	return c, nil
+}
+
+// Do sends in as the JSON body (if not nil) and decodes the response data into out (if not nil).
+func (c *AdminClient) Do(method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, c.base+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var envelope struct {
+		Success bool            `json:"success"`
+		Data    json.RawMessage `json:"data"`
+		Error   string          `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return fmt.Errorf("admin API %s %s: %s", method, path, resp.Status)
+	}
+	if !envelope.Success {
+		return fmt.Errorf("admin API %s %s: %s", method, path, envelope.Error)
+	}
+
+	if out != nil && len(envelope.Data) > 0 {
+		return json.Unmarshal(envelope.Data, out)
+	}
+	return nil
+}
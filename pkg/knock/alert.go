@@ -0,0 +1,78 @@
+package knock
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+const (
+	AlertSlack    = "slack"
+	AlertTelegram = "telegram"
+)
+
+// AlertConfig is a named action posting short messages about knock events to
+// a chat, for teams who want to be pinged rather than read logs.
+type AlertConfig struct {
+	Type     string   `json:"type"`      // "slack" or "telegram"
+	URL      string   `json:"url"`       // Slack incoming webhook URL
+	BotToken string   `json:"bot_token"` // Telegram bot token
+	ChatID   string   `json:"chat_id"`   // Telegram chat receiving the alerts
+	Events   []string `json:"events"`    // As for webhooks, grant, deny and ban when empty
+}
+
+// NewAlertAction builds a webhook delivering chat messages instead of events.
+func NewAlertAction(name string, cfg AlertConfig) (*WebhookAction, error) {
+	var (
+		wcfg   = WebhookConfig{URL: cfg.URL, Events: cfg.Events}
+		encode func(text string) any
+	)
+
+	switch cfg.Type {
+	case AlertSlack:
+		encode = func(text string) any {
+			return map[string]string{"text": text}
+		}
+	case AlertTelegram:
+		if cfg.BotToken == "" || cfg.ChatID == "" {
+			return nil, fmt.Errorf("alert %s: telegram needs bot_token and chat_id", name)
+		}
+		wcfg.URL = "https://api.telegram.org/bot" + url.PathEscape(cfg.BotToken) + "/sendMessage"
+		encode = func(text string) any {
+			return map[string]string{"chat_id": cfg.ChatID, "text": text}
+		}
+	default:
+		return nil, fmt.Errorf("alert %s: unknown type %q", name, cfg.Type)
+	}
+
+	w, err := NewWebhookAction(name, wcfg)
+	if err != nil {
+		return nil, fmt.Errorf("alert %s: %w", name, err)
+	}
+	w.encode = func(event WebhookEvent) ([]byte, error) {
+		return json.Marshal(encode(alertText(event)))
+	}
+	return w, nil
+}
+
+// alertText describes event in one line, like the log does.
+func alertText(event WebhookEvent) string {
+	a := event.Access
+	where := fmt.Sprintf("[%s] IP %s%s%s", a.Instance, a.IP, userSuffix(a.User), profileSuffix(a.Profile))
+
+	switch event.Event {
+	case EventGrant:
+		return fmt.Sprintf("%s: access granted until %s", where, a.Expires.Format(time.RFC3339))
+	case EventDeny:
+		return fmt.Sprintf("%s: access denied, %s", where, event.Reason)
+	case EventFail:
+		return fmt.Sprintf("%s: %s", where, event.Reason)
+	case EventBan:
+		return fmt.Sprintf("%s: banned until %s", where, event.Until.Format(time.RFC3339))
+	case EventExpire:
+		return fmt.Sprintf("%s: session %s ended", where, a.Session)
+	default:
+		return fmt.Sprintf("%s: %s", where, event.Event)
+	}
+}
@@ -0,0 +1,120 @@
+package knock
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAllowlistRefresh = 5 * time.Minute
+	allowlistLookupTimeout  = 10 * time.Second
+)
+
+// Allowlist holds sources that are pre-authorized. Entries are CIDRs, bare
+// addresses or hostnames; hostnames (e.g. dynamic DNS names) are re-resolved
+// periodically so a changing home IP keeps working without config edits.
+type Allowlist struct {
+	prefixes []netip.Prefix
+	hosts    []string
+
+	resolved map[string][]netip.Addr
+	mutex    sync.RWMutex
+}
+
+func NewAllowlist(entries []string) *Allowlist {
+	a := &Allowlist{resolved: make(map[string][]netip.Addr)}
+
+	for _, e := range entries {
+		if p, err := parsePrefix(e); err == nil {
+			a.prefixes = append(a.prefixes, p)
+			continue
+		}
+		a.hosts = append(a.hosts, e)
+	}
+	return a
+}
+
+func (a *Allowlist) Empty() bool {
+	return a == nil || len(a.prefixes)+len(a.hosts) == 0
+}
+
+// Contains reports whether ip matches a CIDR or the last resolved address of a hostname.
+func (a *Allowlist) Contains(ip string) bool {
+	if a.Empty() {
+		return false
+	}
+
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	for _, p := range a.prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	for _, addrs := range a.resolved {
+		if slices.Contains(addrs, addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Refresh re-resolves every hostname. A failed lookup keeps the previous addresses.
+func (a *Allowlist) Refresh(instance string) {
+	for _, host := range a.hosts {
+		ctx, cancel := context.WithTimeout(context.Background(), allowlistLookupTimeout)
+		ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		cancel()
+		if err != nil {
+			log.Printf("[%s] Allowlist lookup of %s failed: %v", instance, host, err)
+			continue
+		}
+
+		addrs := make([]netip.Addr, 0, len(ips))
+		for _, ip := range ips {
+			addrs = append(addrs, ip.Unmap())
+		}
+		slices.SortFunc(addrs, func(x, y netip.Addr) int { return x.Compare(y) })
+
+		a.mutex.Lock()
+		prev := a.resolved[host]
+		a.resolved[host] = addrs
+		a.mutex.Unlock()
+
+		if !slices.Equal(prev, addrs) {
+			log.Printf("[%s] Allowlist %s now resolves to %v", instance, host, addrs)
+		}
+	}
+}
+
+// Run refreshes the hostnames every interval until stop is closed.
+func (a *Allowlist) Run(instance string, interval time.Duration, stop <-chan struct{}) {
+	if len(a.hosts) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			a.Refresh(instance)
+		}
+	}
+}
@@ -0,0 +1,397 @@
+package knock
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrAuditDisabled = errors.New("audit storage is not configured (audit.driver is empty)")
+
+const (
+	auditPruneInterval = time.Hour
+	DefaultAuditLimit  = 100
+	maxAuditLimit      = 10000
+)
+
+// EventCommand is stored by the audit log for every command a command
+// action runs, with its output and exit status. Other sinks do not see it.
+const EventCommand = "command"
+
+// AuditConfig stores every knock outcome in a SQL database so history can be
+// queried. The binary links modernc.org/sqlite for "sqlite" and "sqlite3",
+// and pgx for "postgres" and "pgx"; programs embedding the package import
+// them, or other drivers registered under these names, themselves.
+type AuditConfig struct {
+	Driver    string   `json:"driver"`    // "sqlite" or "postgres", empty disables auditing
+	DSN       string   `json:"dsn"`       // Driver specific data source, e.g. a file path or postgres:// URL
+	Retention Duration `json:"retention"` // Events older than this are deleted, kept forever when zero
+}
+
+// AuditEvent is one stored outcome.
+type AuditEvent struct {
+	ID       int64     `json:"id"`
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	Instance string    `json:"instance"`
+	IP       string    `json:"ip"`
+	User     string    `json:"user,omitempty"`
+	Profile  string    `json:"profile,omitempty"`
+	Session  string    `json:"session,omitempty"`
+	Ports    []int     `json:"ports,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+	Until    time.Time `json:"until,omitzero"`
+
+	// Set for EventCommand: what the command printed, truncated, and how it
+	// exited, -1 when it did not run to an exit
+	Output   string `json:"output,omitempty"`
+	ExitCode *int   `json:"exit_code,omitempty"`
+}
+
+// AuditQuery filters stored events; zero fields match everything.
+type AuditQuery struct {
+	Event    string
+	Instance string
+	IP       string
+	User     string
+	Port     int
+	Since    time.Time
+	Until    time.Time
+	Limit    int
+}
+
+// AuditLog is run by every instance after the log action, storing each
+// outcome as a row of knock_events.
+type AuditLog struct {
+	db        *sql.DB
+	postgres  bool
+	retention time.Duration
+}
+
+func OpenAuditLog(cfg AuditConfig) (*AuditLog, error) {
+	a := &AuditLog{retention: cfg.Retention.Duration}
+	var driver string
+	switch cfg.Driver {
+	case "sqlite", "sqlite3":
+		driver = "sqlite"
+	case "postgres", "pgx":
+		driver, a.postgres = "pgx", true
+	default:
+		return nil, fmt.Errorf("audit: unsupported driver %q, use sqlite or postgres", cfg.Driver)
+	}
+	if !slices.Contains(sql.Drivers(), driver) {
+		return nil, fmt.Errorf("audit: the %s driver is not linked into this program", driver)
+	}
+
+	db, err := sql.Open(driver, cfg.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("audit: %w", err)
+	}
+	a.db = db
+
+	id, ts := "INTEGER PRIMARY KEY AUTOINCREMENT", "DATETIME"
+	if a.postgres {
+		id, ts = "BIGSERIAL PRIMARY KEY", "TIMESTAMPTZ"
+	}
+	schema := []string{
+		`CREATE TABLE IF NOT EXISTS knock_events (
+			id       ` + id + `,
+			time     ` + ts + ` NOT NULL,
+			event    TEXT NOT NULL,
+			instance TEXT NOT NULL,
+			ip       TEXT NOT NULL,
+			username TEXT NOT NULL DEFAULT '',
+			profile  TEXT NOT NULL DEFAULT '',
+			session  TEXT NOT NULL DEFAULT '',
+			ports    TEXT NOT NULL DEFAULT '',
+			reason   TEXT NOT NULL DEFAULT '',
+			until    ` + ts + `,
+			output   TEXT NOT NULL DEFAULT '',
+			exit_code INTEGER
+		)`,
+		`CREATE INDEX IF NOT EXISTS knock_events_time ON knock_events (time)`,
+		`CREATE INDEX IF NOT EXISTS knock_events_ip ON knock_events (ip)`,
+	}
+	for _, stmt := range schema {
+		if _, err := db.Exec(stmt); err != nil {
+			_ = db.Close()
+			return nil, fmt.Errorf("audit: creating schema: %w", err)
+		}
+	}
+	if err := a.addCommandColumns(); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("audit: upgrading schema: %w", err)
+	}
+	return a, nil
+}
+
+// addCommandColumns adds the command columns to a table created before
+// they existed.
+func (a *AuditLog) addCommandColumns() error {
+	if _, err := a.db.Exec("SELECT output, exit_code FROM knock_events WHERE 1 = 0"); err == nil {
+		return nil
+	}
+	for _, stmt := range []string{
+		"ALTER TABLE knock_events ADD COLUMN output TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE knock_events ADD COLUMN exit_code INTEGER",
+	} {
+		if _, err := a.db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *AuditLog) Close() error {
+	return a.db.Close()
+}
+
+func (a *AuditLog) Name() string {
+	return "audit"
+}
+
+func (a *AuditLog) OnGranted(ctx context.Context, access Access) error {
+	return a.insert(ctx, EventGrant, access, "", time.Time{})
+}
+
+func (a *AuditLog) OnDenied(ctx context.Context, access Access, reason string) error {
+	return a.insert(ctx, EventDeny, access, reason, time.Time{})
+}
+
+func (a *AuditLog) OnFailed(ctx context.Context, access Access, reason string) error {
+	return a.insert(ctx, EventFail, access, reason, time.Time{})
+}
+
+func (a *AuditLog) OnBanned(ctx context.Context, access Access, until time.Time) error {
+	return a.insert(ctx, EventBan, access, "", until)
+}
+
+func (a *AuditLog) OnExpired(ctx context.Context, access Access) error {
+	return a.insert(ctx, EventExpire, access, "", time.Time{})
+}
+
+// OnCommand stores a command run by action on event for access, what it
+// printed and its exit code.
+func (a *AuditLog) OnCommand(ctx context.Context, access Access, action, event string, port int, output string, exitCode int) error {
+	access.Ports = nil
+	if port != 0 {
+		access.Ports = []int{port}
+	}
+	return a.store(ctx, EventCommand, access, action+" "+event, time.Time{}, output, exitCode)
+}
+
+func (a *AuditLog) insert(ctx context.Context, event string, access Access, reason string, until time.Time) error {
+	return a.store(ctx, event, access, reason, until, "", nil)
+}
+
+// store inserts a row; exitCode is nil or the int exit code of a command.
+func (a *AuditLog) store(ctx context.Context, event string, access Access, reason string, until time.Time, output string, exitCode any) error {
+	var untilArg any
+	if !until.IsZero() {
+		untilArg = until.UTC()
+	}
+
+	_, err := a.db.ExecContext(ctx, a.rebind(`INSERT INTO knock_events
+		(time, event, instance, ip, username, profile, session, ports, reason, until, output, exit_code)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		time.Now().UTC(), event, access.Instance, access.IP, access.User, access.Profile,
+		access.Session, formatAuditPorts(access.Ports), reason, untilArg, output, exitCode)
+	if err != nil {
+		return fmt.Errorf("audit: %w", err)
+	}
+	return nil
+}
+
+// Query returns the events matching q, newest first.
+func (a *AuditLog) Query(ctx context.Context, q AuditQuery) ([]AuditEvent, error) {
+	var (
+		where []string
+		args  []any
+	)
+	add := func(cond string, arg any) {
+		where = append(where, cond)
+		args = append(args, arg)
+	}
+	if q.Event != "" {
+		add("event = ?", q.Event)
+	}
+	if q.Instance != "" {
+		add("instance = ?", q.Instance)
+	}
+	if q.IP != "" {
+		add("ip = ?", q.IP)
+	}
+	if q.User != "" {
+		add("username = ?", q.User)
+	}
+	if q.Port != 0 {
+		add("ports LIKE ?", "%,"+strconv.Itoa(q.Port)+",%")
+	}
+	if !q.Since.IsZero() {
+		add("time >= ?", q.Since.UTC())
+	}
+	if !q.Until.IsZero() {
+		add("time < ?", q.Until.UTC())
+	}
+
+	stmt := "SELECT id, time, event, instance, ip, username, profile, session, ports, reason, until, output, exit_code FROM knock_events"
+	if len(where) > 0 {
+		stmt += " WHERE " + strings.Join(where, " AND ")
+	}
+	stmt += " ORDER BY time DESC, id DESC LIMIT " + strconv.Itoa(min(cmp.Or(q.Limit, DefaultAuditLimit), maxAuditLimit))
+
+	rows, err := a.db.QueryContext(ctx, a.rebind(stmt), args...)
+	if err != nil {
+		return nil, fmt.Errorf("audit: %w", err)
+	}
+	defer rows.Close()
+
+	events := []AuditEvent{}
+	for rows.Next() {
+		var (
+			e        AuditEvent
+			ports    string
+			until    sql.NullTime
+			exitCode sql.NullInt64
+		)
+		if err := rows.Scan(&e.ID, &e.Time, &e.Event, &e.Instance, &e.IP, &e.User, &e.Profile, &e.Session, &ports, &e.Reason, &until, &e.Output, &exitCode); err != nil {
+			return nil, fmt.Errorf("audit: %w", err)
+		}
+		e.Ports = parseAuditPorts(ports)
+		if until.Valid {
+			e.Until = until.Time
+		}
+		if exitCode.Valid {
+			code := int(exitCode.Int64)
+			e.ExitCode = &code
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// Run deletes events past the retention every auditPruneInterval until stop
+// is closed.
+func (a *AuditLog) Run(stop <-chan struct{}) {
+	if a.retention <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(auditPruneInterval)
+	defer ticker.Stop()
+
+	for {
+		res, err := a.db.Exec(a.rebind("DELETE FROM knock_events WHERE time < ?"), time.Now().Add(-a.retention).UTC())
+		if err != nil {
+			log.Printf("Pruning audit events: %v", err)
+		} else if n, _ := res.RowsAffected(); n > 0 {
+			log.Printf("Pruned %d audit event(s) older than %s", n, a.retention)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// rebind turns ? placeholders into PostgreSQL's numbered ones.
+func (a *AuditLog) rebind(stmt string) string {
+	if !a.postgres {
+		return stmt
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range stmt {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// formatAuditPorts stores ports as ",22,443," so a single port can be
+// matched with LIKE.
+func formatAuditPorts(ports []int) string {
+	if len(ports) == 0 {
+		return ""
+	}
+	parts := make([]string, len(ports))
+	for i, p := range ports {
+		parts[i] = strconv.Itoa(p)
+	}
+	return "," + strings.Join(parts, ",") + ","
+}
+
+func parseAuditPorts(s string) []int {
+	var ports []int
+	for _, part := range strings.Split(strings.Trim(s, ","), ",") {
+		if p, err := strconv.Atoi(part); err == nil {
+			ports = append(ports, p)
+		}
+	}
+	return slices.Clip(ports)
+}
+
+// parseAuditTime reads a query bound: an RFC 3339 time, a local date such
+// as 2026-10-06, or a duration like 48h meaning that long before now.
+func parseAuditTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation(time.DateOnly, s, time.Local); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, use RFC 3339, YYYY-MM-DD or a duration", s)
+}
+
+// parseAuditQuery reads the filters of GET /audit.
+func parseAuditQuery(v url.Values, now time.Time) (AuditQuery, error) {
+	q := AuditQuery{
+		Event:    v.Get("event"),
+		Instance: v.Get("instance"),
+		IP:       v.Get("ip"),
+		User:     v.Get("user"),
+	}
+	if q.Event != "" && q.Event != EventCommand && !slices.Contains(allEvents, q.Event) {
+		return q, fmt.Errorf("unknown event %q", q.Event)
+	}
+
+	var err error
+	if s := v.Get("port"); s != "" {
+		if q.Port, err = strconv.Atoi(s); err != nil || q.Port < 1 || q.Port > 65535 {
+			return q, fmt.Errorf("invalid port %q", s)
+		}
+	}
+	if s := v.Get("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil || q.Limit < 1 {
+			return q, fmt.Errorf("invalid limit %q", s)
+		}
+	}
+	if q.Since, err = parseAuditTime(v.Get("since"), now); err != nil {
+		return q, err
+	}
+	if q.Until, err = parseAuditTime(v.Get("until"), now); err != nil {
+		return q, err
+	}
+	return q, nil
+}
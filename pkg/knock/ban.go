@@ -0,0 +1,408 @@
+package knock
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrUnknownBan = errors.New("ip is not banned")
+
+const (
+	defaultBanWindow      = 5 * time.Minute
+	defaultBanDuration    = time.Hour
+	defaultBanMaxDuration = 24 * time.Hour
+	defaultBanDecay       = 24 * time.Hour
+
+	// banSweepInterval is how often invalid knocks past every window are
+	// dropped, so sources failing once do not pile up
+	banSweepInterval = time.Minute
+)
+
+// BanConfig bans a source after Failures invalid knocks within Window.
+type BanConfig struct {
+	Failures int      `json:"failures"` // 0 disables banning
+	Window   Duration `json:"window"`
+	Duration Duration `json:"duration"` // How long the source stays banned
+
+	// Repeat offenders are banned Backoff times longer than the last time,
+	// e.g. 1m, 10m, 1h40m with a backoff of 10, up to MaxDuration. Every
+	// Decay spent clean after the last ban ended forgets one offense.
+	Backoff     float64  `json:"backoff"`      // Every ban lasts Duration when 0 or 1
+	MaxDuration Duration `json:"max_duration"` // 24h when zero
+	Decay       Duration `json:"decay"`        // 24h when zero
+}
+
+func (c BanConfig) Enabled() bool {
+	return c.Failures > 0
+}
+
+// length returns how long the ban of a source with offenses earlier
+// offenses lasts.
+func (c BanConfig) length(offenses int) time.Duration {
+	d := c.Duration.Duration
+	if c.Backoff <= 1 {
+		return d
+	}
+	for range offenses {
+		if float64(d)*c.Backoff >= float64(c.MaxDuration.Duration) {
+			return c.MaxDuration.Duration
+		}
+		d = time.Duration(float64(d) * c.Backoff)
+	}
+	return min(d, c.MaxDuration.Duration)
+}
+
+// normalize checks the backoff and applies the defaults.
+func (c *BanConfig) normalize() error {
+	if c.Window.Duration == 0 {
+		c.Window = Duration{defaultBanWindow}
+	}
+	if c.Duration.Duration == 0 {
+		c.Duration = Duration{defaultBanDuration}
+	}
+	if c.Backoff < 0 || (c.Backoff > 0 && c.Backoff < 1) {
+		return fmt.Errorf("invalid ban backoff %g, bans may only grow", c.Backoff)
+	}
+	if c.MaxDuration.Duration == 0 {
+		c.MaxDuration = Duration{max(defaultBanMaxDuration, c.Duration.Duration)}
+	}
+	if c.Decay.Duration == 0 {
+		c.Decay = Duration{defaultBanDecay}
+	}
+	if c.MaxDuration.Duration < c.Duration.Duration {
+		return fmt.Errorf("ban max_duration %s is shorter than the duration %s", c.MaxDuration.Duration, c.Duration.Duration)
+	}
+	return nil
+}
+
+// Ban is a source whose knocks are ignored until it expires.
+type Ban struct {
+	IP       string    `json:"ip"`
+	Instance string    `json:"instance"` // Instance that banned the source
+	Reason   string    `json:"reason"`
+	BannedAt time.Time `json:"banned_at"`
+	Until    time.Time `json:"until"`
+	Offense  int       `json:"offense,omitempty"` // Counts the source's recent bans, from 1
+}
+
+// offenses is the ban record of a source, kept after its bans expire so
+// repeat offenders are banned longer.
+type offenses struct {
+	count int
+	last  time.Time // End of the latest ban
+}
+
+// Offense is the ban record of a source as saved next to the bans.
+type Offense struct {
+	IP    string    `json:"ip"`
+	Count int       `json:"count"`
+	Last  time.Time `json:"last"` // End of the latest ban
+}
+
+// banFile is the bans file. Files of earlier versions hold the bans alone.
+type banFile struct {
+	Bans     []Ban     `json:"bans"`
+	Offenses []Offense `json:"offenses,omitempty"`
+}
+
+// BanList tracks invalid knocks per instance and the sources banned because
+// of them. A ban applies to every instance. Bans are saved to path, when set,
+// so they survive restarts.
+type BanList struct {
+	path     string
+	clock    Clock
+	bans     map[string]Ban
+	failures map[string][]time.Time // By instance and IP
+	offenses map[string]offenses    // By IP
+	window   time.Duration          // Longest window failures were counted in
+	swept    time.Time              // Last sweep of the failures
+	mutex    sync.Mutex
+}
+
+func NewBanList() *BanList {
+	return &BanList{
+		clock:    systemClock{},
+		bans:     make(map[string]Ban),
+		failures: make(map[string][]time.Time),
+		offenses: make(map[string]offenses),
+	}
+}
+
+// LoadBans reads the bans file, dropping bans that expired while the server
+// was down but keeping the offense records that lengthen the next ones. A
+// missing file starts an empty list.
+func LoadBans(path string) (*BanList, error) {
+	b := NewBanList()
+	b.path = path
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading bans: %w", err)
+	}
+
+	var file banFile
+	if data = bytes.TrimSpace(data); len(data) > 0 && data[0] == '[' {
+		err = json.Unmarshal(data, &file.Bans)
+	} else {
+		err = json.Unmarshal(data, &file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing bans %s: %w", path, err)
+	}
+	now := b.clock.Now()
+	for _, ban := range file.Bans {
+		b.offenses[ban.IP] = offenses{count: ban.Offense, last: ban.Until}
+		if now.Before(ban.Until) {
+			b.bans[ban.IP] = ban
+		}
+	}
+	for _, o := range file.Offenses {
+		b.offenses[o.IP] = offenses{count: o.Count, last: o.Last}
+	}
+	return b, nil
+}
+
+// List returns the active bans, oldest first.
+func (b *BanList) List() []Ban {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := b.clock.Now()
+	list := make([]Ban, 0, len(b.bans))
+	for _, ban := range b.bans {
+		if now.Before(ban.Until) {
+			list = append(list, ban)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].BannedAt.Before(list[j].BannedAt) })
+	return list
+}
+
+// Unban lifts the ban on ip and forgets its invalid knocks.
+func (b *BanList) Unban(ip string) (Ban, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	ban, ok := b.bans[ip]
+	if !ok || !b.clock.Now().Before(ban.Until) {
+		return Ban{}, fmt.Errorf("%w: %s", ErrUnknownBan, ip)
+	}
+
+	delete(b.bans, ip)
+	delete(b.offenses, ip)
+	for key := range b.failures {
+		if strings.HasSuffix(key, "|"+ip) {
+			delete(b.failures, key)
+		}
+	}
+	if err := b.saveLocked(); err != nil {
+		b.bans[ip] = ban
+		return Ban{}, err
+	}
+	return ban, nil
+}
+
+// Add bans a source regardless of its invalid knocks, replacing any earlier ban.
+func (b *BanList) Add(ban Ban) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.addLocked(ban)
+}
+
+// Penalize bans a source regardless of its invalid knocks for as long as cfg
+// sets for its offenses, replacing any earlier ban.
+func (b *BanList) Penalize(cfg BanConfig, ban Ban) Ban {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.penalizeLocked(cfg, &ban)
+	b.addLocked(ban)
+	return ban
+}
+
+// penalizeLocked counts ban as an offense of its source and sets its end
+// from the offenses before it, once Decay forgot some of them.
+func (b *BanList) penalizeLocked(cfg BanConfig, ban *Ban) {
+	o := b.offenses[ban.IP]
+	if cfg.Decay.Duration > 0 && o.count > 0 && ban.BannedAt.After(o.last) {
+		o.count = max(0, o.count-int(ban.BannedAt.Sub(o.last)/cfg.Decay.Duration))
+	}
+
+	ban.Until = ban.BannedAt.Add(cfg.length(o.count))
+	ban.Offense = o.count + 1
+	b.offenses[ban.IP] = offenses{count: ban.Offense, last: ban.Until}
+
+	// Bans are rare enough to sweep the records decay forgot on each
+	for ip, o := range b.offenses {
+		if cfg.Decay.Duration > 0 && ban.BannedAt.Sub(o.last) >= time.Duration(o.count)*cfg.Decay.Duration {
+			delete(b.offenses, ip)
+		}
+	}
+}
+
+func (b *BanList) addLocked(ban Ban) {
+	b.bans[ban.IP] = ban
+	if err := b.saveLocked(); err != nil {
+		log.Printf("Saving bans: %v", err)
+	}
+}
+
+// Banned returns the ban held by ip at now, if any.
+func (b *BanList) Banned(ip string, now time.Time) (Ban, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	ban, ok := b.bans[ip]
+	if !ok {
+		return Ban{}, false
+	}
+	if !now.Before(ban.Until) {
+		delete(b.bans, ip)
+		return Ban{}, false
+	}
+	return ban, true
+}
+
+// Fail records an invalid knock from ip on instance and bans the source once
+// it reaches the threshold of cfg.
+func (b *BanList) Fail(cfg BanConfig, instance, ip string, now time.Time) (Ban, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.window = max(b.window, cfg.Window.Duration)
+	if now.Sub(b.swept) >= banSweepInterval {
+		b.sweepLocked(now)
+	}
+
+	key := instance + "|" + ip
+	cutoff := now.Add(-cfg.Window.Duration)
+	kept := b.failures[key][:0]
+	for _, t := range b.failures[key] {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	kept = append(kept, now)
+
+	if len(kept) < cfg.Failures {
+		b.failures[key] = kept
+		return Ban{}, false
+	}
+	delete(b.failures, key)
+
+	ban := Ban{
+		IP:       ip,
+		Instance: instance,
+		Reason:   "too many invalid knocks",
+		BannedAt: now,
+	}
+	b.penalizeLocked(cfg, &ban)
+	b.addLocked(ban)
+	return ban, true
+}
+
+// sweepLocked drops the invalid knocks of sources whose latest one is past
+// the longest window, which can no longer count towards a ban.
+func (b *BanList) sweepLocked(now time.Time) {
+	cutoff := now.Add(-b.window)
+	for key, times := range b.failures {
+		if !times[len(times)-1].After(cutoff) {
+			delete(b.failures, key)
+		}
+	}
+	b.swept = now
+}
+
+// Snapshot returns the active bans and the offense records, by IP.
+func (b *BanList) Snapshot() ([]Ban, []Offense) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	file := b.fileLocked()
+	return file.Bans, file.Offenses
+}
+
+// Restore merges the bans and offense records of a snapshot, keeping the
+// longer ban and the higher offense count of each source, and saves them.
+func (b *BanList) Restore(bans []Ban, records []Offense) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := b.clock.Now()
+	for _, ban := range bans {
+		if held, ok := b.bans[ban.IP]; now.Before(ban.Until) && (!ok || ban.Until.After(held.Until)) {
+			b.bans[ban.IP] = ban
+		}
+	}
+	for _, r := range records {
+		if o := b.offenses[r.IP]; r.Count > o.count || r.Count == o.count && r.Last.After(o.last) {
+			b.offenses[r.IP] = offenses{count: r.Count, last: r.Last}
+		}
+	}
+	return b.saveLocked()
+}
+
+func (b *BanList) fileLocked() banFile {
+	now := b.clock.Now()
+	file := banFile{Bans: make([]Ban, 0, len(b.bans))}
+	for _, ban := range b.bans {
+		if now.Before(ban.Until) {
+			file.Bans = append(file.Bans, ban)
+		}
+	}
+	sort.Slice(file.Bans, func(i, j int) bool { return file.Bans[i].IP < file.Bans[j].IP })
+	for ip, o := range b.offenses {
+		file.Offenses = append(file.Offenses, Offense{IP: ip, Count: o.count, Last: o.last})
+	}
+	sort.Slice(file.Offenses, func(i, j int) bool { return file.Offenses[i].IP < file.Offenses[j].IP })
+	return file
+}
+
+func (b *BanList) saveLocked() error {
+	if b.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(b.fileLocked(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write then rename so a crash never leaves a truncated file
+	tmp := b.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, b.path)
+}
+
+// banned tells every action of the default profile interested in bans about
+// ban, caused by a knock on port or zero.
+func (s *Server) banned(ban Ban, port int) {
+	s.stats.record(statBan, s.Name(), ban.IP, port, ban.BannedAt)
+	s.metrics.count(statBan, s.Name(), "", "")
+
+	access := Access{Instance: s.Name(), IP: ban.IP, Time: ban.BannedAt}
+	for _, a := range s.profiles[0].actions {
+		h, ok := a.(BanHook)
+		if !ok {
+			continue
+		}
+		if err := h.OnBanned(context.Background(), access, ban.Until); err != nil {
+			log.Printf("[%s] Action %s failed on ban of IP %s: %v", s.Name(), a.Name(), ban.IP, err)
+		}
+	}
+}
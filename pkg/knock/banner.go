@@ -0,0 +1,106 @@
+package knock
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	BannerSSH  = "ssh"
+	BannerSMTP = "smtp"
+	BannerHTTP = "http"
+)
+
+const (
+	bannerTimeout  = 5 * time.Second
+	bannerMaxLines = 5
+)
+
+var bannerHandlers = map[string]func(conn net.Conn){
+	BannerSSH:  sshBanner,
+	BannerSMTP: smtpBanner,
+	BannerHTTP: httpBanner,
+}
+
+func validBanner(name string) bool {
+	_, ok := bannerHandlers[name]
+	return name == "" || ok
+}
+
+// serveBanner answers conn like a real service would and closes it, so the
+// knock port looks like an ordinary noisy host to scanners.
+func serveBanner(name string, conn net.Conn) {
+	defer conn.Close()
+
+	handler, ok := bannerHandlers[name]
+	if !ok {
+		return
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(bannerTimeout))
+	handler(conn)
+}
+
+func sshBanner(conn net.Conn) {
+	fmt.Fprint(conn, "SSH-2.0-OpenSSH_9.6p1 Ubuntu-3ubuntu13.5\r\n")
+
+	// Wait for the client identification, then drop like a failed key exchange
+	_, _ = bufio.NewReader(conn).ReadString('\n')
+}
+
+func smtpBanner(conn net.Conn) {
+	host, _ := os.Hostname()
+	if host == "" {
+		host = "localhost"
+	}
+	fmt.Fprintf(conn, "220 %s ESMTP Postfix (Ubuntu)\r\n", host)
+
+	r := bufio.NewReader(conn)
+	for i := 0; i < bannerMaxLines; i++ {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			fmt.Fprintf(conn, "250-%s\r\n250-PIPELINING\r\n250-SIZE 10240000\r\n250 STARTTLS\r\n", host)
+		case cmd == "QUIT":
+			fmt.Fprint(conn, "221 2.0.0 Bye\r\n")
+			return
+		default:
+			fmt.Fprint(conn, "502 5.5.2 Error: command not recognized\r\n")
+		}
+	}
+}
+
+func httpBanner(conn net.Conn) {
+	// Read up to the end of the request headers
+	r := bufio.NewReader(conn)
+	for i := 0; i < 100; i++ {
+		line, err := r.ReadString('\n')
+		if err != nil || strings.TrimSpace(line) == "" {
+			break
+		}
+	}
+
+	body := "<html>\r\n<head><title>404 Not Found</title></head>\r\n" +
+		"<body>\r\n<center><h1>404 Not Found</h1></center>\r\n" +
+		"<hr><center>nginx/1.24.0 (Ubuntu)</center>\r\n</body>\r\n</html>\r\n"
+
+	fmt.Fprintf(conn, "HTTP/1.1 404 Not Found\r\n"+
+		"Server: nginx/1.24.0 (Ubuntu)\r\n"+
+		"Date: %s\r\n"+
+		"Content-Type: text/html\r\n"+
+		"Content-Length: %d\r\n"+
+		"Connection: close\r\n\r\n%s",
+		time.Now().UTC().Format(http.TimeFormat),
+		len(body),
+		body)
+}
@@ -0,0 +1,337 @@
+package knock
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	BusNATS  = "nats"
+	BusMQTT  = "mqtt"
+	BusKafka = "kafka"
+
+	defaultBusTopic = "port-knocking"
+	busTimeout      = 2 * time.Second
+)
+
+// BusConfig is a named action publishing knock events to a message bus, so
+// dashboards or SOAR tooling can subscribe to them as they happen.
+type BusConfig struct {
+	Type     string   `json:"type"`     // "nats", "mqtt" or "kafka"
+	Addr     string   `json:"addr"`     // host:port of the NATS or MQTT server, Kafka REST Proxy URL for kafka
+	Topic    string   `json:"topic"`    // "port-knocking" when empty, see Publisher for how events map to it
+	Username string   `json:"username"` // Credentials, none when empty
+	Password string   `json:"password"`
+	Events   []string `json:"events"` // As for webhooks, grant, deny and ban when empty
+}
+
+// Publisher sends one event to a bus. NATS publishes on the subject
+// topic.event and MQTT on topic/event; Kafka has every event on the topic,
+// keyed by source IP, through a Confluent REST Proxy.
+type Publisher interface {
+	Publish(event, key string, data []byte) error
+}
+
+// BusAction publishes the events it subscribes to as JSON WebhookEvents.
+type BusAction struct {
+	name    string
+	events  []string
+	pub     Publisher
+	privacy PrivacyConfig // Masks the addresses published
+}
+
+func NewBusAction(name string, cfg BusConfig) (*BusAction, error) {
+	if cfg.Addr == "" {
+		return nil, fmt.Errorf("bus %s: addr is not set", name)
+	}
+	if cfg.Topic == "" {
+		cfg.Topic = defaultBusTopic
+	}
+
+	events := cfg.Events
+	if len(events) == 0 {
+		events = defaultEvents
+	}
+	for _, e := range events {
+		if !slices.Contains(allEvents, e) {
+			return nil, fmt.Errorf("bus %s: unknown event %q", name, e)
+		}
+	}
+
+	b := &BusAction{name: name, events: events}
+	switch cfg.Type {
+	case BusNATS:
+		b.pub = &natsPublisher{cfg: cfg}
+	case BusMQTT:
+		b.pub = &mqttPublisher{cfg: cfg, clientID: "port-knocking-" + name}
+	case BusKafka:
+		u, err := url.Parse(cfg.Addr)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("bus %s: kafka addr must be the REST Proxy URL", name)
+		}
+		b.pub = &kafkaRESTPublisher{cfg: cfg, client: &http.Client{Timeout: busTimeout}}
+	default:
+		return nil, fmt.Errorf("bus %s: unknown type %q", name, cfg.Type)
+	}
+	return b, nil
+}
+
+func (b *BusAction) Name() string {
+	return b.name
+}
+
+func (b *BusAction) OnGranted(ctx context.Context, access Access) error {
+	return b.publish(WebhookEvent{Event: EventGrant, Access: access})
+}
+
+func (b *BusAction) OnDenied(ctx context.Context, access Access, reason string) error {
+	return b.publish(WebhookEvent{Event: EventDeny, Access: access, Reason: reason})
+}
+
+func (b *BusAction) OnFailed(ctx context.Context, access Access, reason string) error {
+	return b.publish(WebhookEvent{Event: EventFail, Access: access, Reason: reason})
+}
+
+func (b *BusAction) OnBanned(ctx context.Context, access Access, until time.Time) error {
+	return b.publish(WebhookEvent{Event: EventBan, Access: access, Until: until})
+}
+
+func (b *BusAction) OnExpired(ctx context.Context, access Access) error {
+	return b.publish(WebhookEvent{Event: EventExpire, Access: access})
+}
+
+func (b *BusAction) publish(event WebhookEvent) error {
+	if !slices.Contains(b.events, event.Event) {
+		return nil
+	}
+	event.Access = b.privacy.maskAccess(event.Access)
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if err := b.pub.Publish(event.Event, event.Access.IP, data); err != nil {
+		return fmt.Errorf("bus %s: %w", b.name, err)
+	}
+	return nil
+}
+
+// streamPublisher holds the connection of a stream protocol, dialling on
+// first use and once more when a publish fails on a stale connection.
+type streamPublisher struct {
+	conn  net.Conn
+	mutex sync.Mutex
+}
+
+func (p *streamPublisher) publish(dial func() (net.Conn, error), frame []byte) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var err error
+	for range 2 {
+		if p.conn == nil {
+			if p.conn, err = dial(); err != nil {
+				return err
+			}
+		}
+
+		_ = p.conn.SetWriteDeadline(time.Now().Add(busTimeout))
+		if _, err = p.conn.Write(frame); err == nil {
+			return nil
+		}
+		_ = p.conn.Close()
+		p.conn = nil
+	}
+	return err
+}
+
+// natsPublisher speaks the NATS client protocol: CONNECT once, then PUB.
+type natsPublisher struct {
+	streamPublisher
+	cfg BusConfig
+}
+
+func (n *natsPublisher) Publish(event, key string, data []byte) error {
+	frame := fmt.Appendf(nil, "PUB %s.%s %d\r\n", n.cfg.Topic, event, len(data))
+	frame = append(append(frame, data...), "\r\n"...)
+	return n.publish(n.dial, frame)
+}
+
+func (n *natsPublisher) dial() (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", n.cfg.Addr, busTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	_ = conn.SetDeadline(time.Now().Add(busTimeout))
+	if line, err := r.ReadString('\n'); err != nil || !strings.HasPrefix(line, "INFO ") {
+		_ = conn.Close()
+		return nil, fmt.Errorf("nats: no INFO from %s", n.cfg.Addr)
+	}
+
+	connect := map[string]any{"verbose": false, "pedantic": false, "name": "port-knocking"}
+	if n.cfg.Username != "" {
+		connect["user"], connect["pass"] = n.cfg.Username, n.cfg.Password
+	}
+	opts, _ := json.Marshal(connect)
+	if _, err := conn.Write(append(append([]byte("CONNECT "), opts...), "\r\n"...)); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	go n.serve(conn, r)
+	return conn, nil
+}
+
+// serve answers the server's keepalive PINGs and reports its errors until
+// the connection closes.
+func (n *natsPublisher) serve(conn net.Conn, r *bufio.Reader) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		switch {
+		case strings.HasPrefix(line, "PING"):
+			n.mutex.Lock()
+			_ = conn.SetWriteDeadline(time.Now().Add(busTimeout))
+			_, _ = conn.Write([]byte("PONG\r\n"))
+			n.mutex.Unlock()
+		case strings.HasPrefix(line, "-ERR"):
+			log.Printf("NATS server %s: %s", n.cfg.Addr, strings.TrimSpace(line))
+		}
+	}
+}
+
+// mqttPublisher speaks MQTT 3.1.1, publishing at QoS 0 without keepalive.
+type mqttPublisher struct {
+	streamPublisher
+	cfg      BusConfig
+	clientID string
+}
+
+func (m *mqttPublisher) Publish(event, key string, data []byte) error {
+	var body bytes.Buffer
+	mqttString(&body, m.cfg.Topic+"/"+event)
+	body.Write(data)
+	return m.publish(m.dial, mqttPacket(0x30, body.Bytes()))
+}
+
+func (m *mqttPublisher) dial() (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", m.cfg.Addr, busTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	flags := byte(0x02) // Clean session
+	var payload bytes.Buffer
+	mqttString(&payload, m.clientID)
+	if m.cfg.Username != "" {
+		flags |= 0x80
+		mqttString(&payload, m.cfg.Username)
+	}
+	if m.cfg.Password != "" {
+		flags |= 0x40
+		mqttString(&payload, m.cfg.Password)
+	}
+
+	var body bytes.Buffer
+	mqttString(&body, "MQTT")
+	body.Write([]byte{4, flags, 0, 0}) // Protocol level 4, no keepalive
+	body.Write(payload.Bytes())
+
+	_ = conn.SetDeadline(time.Now().Add(busTimeout))
+	ack := make([]byte, 4)
+	if _, err = conn.Write(mqttPacket(0x10, body.Bytes())); err == nil {
+		_, err = io.ReadFull(conn, ack)
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if ack[0] != 0x20 || ack[3] != 0 {
+		_ = conn.Close()
+		return nil, fmt.Errorf("mqtt: connection refused with code %d", ack[3])
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	// Nothing is expected back at QoS 0; reading spots the close early
+	go func() {
+		_, _ = io.Copy(io.Discard, conn)
+		_ = conn.Close()
+	}()
+	return conn, nil
+}
+
+func mqttString(b *bytes.Buffer, s string) {
+	_ = binary.Write(b, binary.BigEndian, uint16(len(s)))
+	b.WriteString(s)
+}
+
+// mqttPacket prefixes body with the fixed header and its variable length.
+func mqttPacket(header byte, body []byte) []byte {
+	packet := []byte{header}
+	for n := len(body); ; {
+		digit := byte(n % 128)
+		if n /= 128; n > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if n == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+// kafkaRESTPublisher produces to Kafka through the Confluent REST Proxy v2 API.
+type kafkaRESTPublisher struct {
+	cfg    BusConfig
+	client *http.Client
+}
+
+func (k *kafkaRESTPublisher) Publish(event, key string, data []byte) error {
+	body, err := json.Marshal(map[string]any{
+		"records": []map[string]any{{"key": key, "value": json.RawMessage(data)}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(k.cfg.Addr, "/")+"/topics/"+url.PathEscape(k.cfg.Topic), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	if k.cfg.Username != "" {
+		req.SetBasicAuth(k.cfg.Username, k.cfg.Password)
+	}
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode/100 != 2 {
+		return errors.New("kafka rest proxy answered " + resp.Status)
+	}
+	return nil
+}
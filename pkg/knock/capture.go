@@ -0,0 +1,223 @@
+package knock
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	pcapSnapLen      = 65535
+	pcapLinkEthernet = 1
+
+	defaultCaptureFileSize = 10 << 20
+	defaultCaptureFileAge  = time.Hour
+	defaultCaptureFiles    = 5
+)
+
+var (
+	ErrCaptureDisabled = errors.New("packet capture is not configured")
+	ErrNoCapture       = errors.New("no packets captured yet")
+)
+
+// CaptureConfig enables the debug recorder. Capture files rotate when they
+// reach MaxFileSize bytes or MaxFileAge, keeping the newest MaxFiles.
+type CaptureConfig struct {
+	Dir         string   `json:"dir"`       // Empty disables recording
+	Interface   string   `json:"interface"` // Empty captures on all interfaces
+	MaxFileSize int64    `json:"max_file_size"`
+	MaxFileAge  Duration `json:"max_file_age"`
+	MaxFiles    int      `json:"max_files"`
+}
+
+// CaptureFile describes one recorded pcap file.
+type CaptureFile struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// Recorder writes traffic seen on the knock ports to ring-buffered pcap files.
+type Recorder struct {
+	cfg   CaptureConfig
+	ports map[uint16]bool
+	src   *packetSource
+
+	file    *os.File
+	size    int64
+	started time.Time
+	mutex   sync.Mutex
+}
+
+func NewRecorder(cfg CaptureConfig, ports []int) *Recorder {
+	r := &Recorder{cfg: cfg, ports: make(map[uint16]bool, len(ports))}
+	for _, p := range ports {
+		r.ports[uint16(p)] = true
+	}
+	return r
+}
+
+// Open creates the capture directory and the packet socket.
+func (r *Recorder) Open() error {
+	if err := os.MkdirAll(r.cfg.Dir, 0o700); err != nil {
+		return fmt.Errorf("capture: %w", err)
+	}
+
+	src, err := openPacketSource(r.cfg.Interface)
+	if err != nil {
+		return fmt.Errorf("capture: %w", err)
+	}
+	r.src = src
+	return nil
+}
+
+// Run records matching frames until stop is closed.
+func (r *Recorder) Run(stop <-chan struct{}) {
+	defer r.close()
+
+	buf := make([]byte, pcapSnapLen)
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		n, _, _, err := r.src.ReadFrame(buf)
+		if err != nil {
+			log.Printf("Packet capture stopped: %v", err)
+			return
+		}
+		if n == 0 {
+			continue
+		}
+
+		p, ok := parseEthernet(buf[:n])
+		if !ok || !(r.ports[p.DstPort] || r.ports[p.SrcPort]) {
+			continue
+		}
+		if err := r.write(time.Now(), buf[:n]); err != nil {
+			log.Printf("Packet capture write failed: %v", err)
+		}
+	}
+}
+
+func (r *Recorder) write(now time.Time, frame []byte) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.file == nil || r.size >= r.cfg.MaxFileSize || now.Sub(r.started) >= r.cfg.MaxFileAge.Duration {
+		if err := r.rotateLocked(now); err != nil {
+			return err
+		}
+	}
+
+	rec := make([]byte, 16, 16+len(frame))
+	binary.LittleEndian.PutUint32(rec[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(rec[8:], uint32(len(frame)))
+	binary.LittleEndian.PutUint32(rec[12:], uint32(len(frame)))
+	rec = append(rec, frame...)
+
+	n, err := r.file.Write(rec)
+	r.size += int64(n)
+	return err
+}
+
+// rotateLocked starts a new capture file and drops the oldest beyond MaxFiles.
+func (r *Recorder) rotateLocked(now time.Time) error {
+	if r.file != nil {
+		_ = r.file.Close()
+		r.file = nil
+	}
+
+	name := filepath.Join(r.cfg.Dir, "knock-"+now.Format("20060102-150405.000000")+".pcap")
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(hdr[4:], 2)
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(hdr[20:], pcapLinkEthernet)
+	if _, err := f.Write(hdr); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	r.file, r.size, r.started = f, int64(len(hdr)), now
+
+	files, err := r.filesLocked()
+	if err != nil {
+		return err
+	}
+	for len(files) > r.cfg.MaxFiles {
+		_ = os.Remove(filepath.Join(r.cfg.Dir, files[0].Name))
+		files = files[1:]
+	}
+	return nil
+}
+
+func (r *Recorder) close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	_ = r.src.Close()
+	if r.file != nil {
+		_ = r.file.Close()
+		r.file = nil
+	}
+}
+
+// Files lists the capture files, oldest first.
+func (r *Recorder) Files() ([]CaptureFile, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.filesLocked()
+}
+
+func (r *Recorder) filesLocked() ([]CaptureFile, error) {
+	entries, err := os.ReadDir(r.cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []CaptureFile
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasPrefix(e.Name(), "knock-") || filepath.Ext(e.Name()) != ".pcap" {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, CaptureFile{Name: e.Name(), Size: info.Size(), ModTime: info.ModTime()})
+	}
+
+	// Names embed the creation time, so they sort chronologically
+	slices.SortFunc(files, func(a, b CaptureFile) int { return strings.Compare(a.Name, b.Name) })
+	return files, nil
+}
+
+// Latest returns the path of the newest capture file.
+func (r *Recorder) Latest() (string, error) {
+	files, err := r.Files()
+	if err != nil {
+		return "", err
+	}
+	if len(files) == 0 {
+		return "", ErrNoCapture
+	}
+	return filepath.Join(r.cfg.Dir, files[len(files)-1].Name), nil
+}
@@ -0,0 +1,203 @@
+package knock
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultChallengeWindow    = 5 * time.Second
+	defaultChallengePortBase  = 40000
+	defaultChallengePortCount = 10000
+
+	challengeBindAttempts = 10
+	challengeWriteTimeout = time.Second
+)
+
+// ChallengeConfig adds a final challenge-response step: the knock completing
+// the sequence is answered, on its own connection, with a random port sealed
+// with Key, which the server listens on for Window. Only a client holding
+// the key learns the port, so replaying a captured sequence, which knows no
+// reply is coming, never gets further than the challenge.
+type ChallengeConfig struct {
+	Key       string   `json:"key"`        // AES-256-GCM secret sealing the port, empty disables challenges
+	PortBase  int      `json:"port_base"`  // Challenge ports are picked from [port_base, port_base+port_count)
+	PortCount int      `json:"port_count"` // 40000 and 10000 when zero
+	Window    Duration `json:"window"`     // How long the port waits for the client, 5s when zero
+}
+
+func (c ChallengeConfig) Enabled() bool {
+	return c.Key != ""
+}
+
+// Challenge is what a client finds in the reply to its last knock.
+type Challenge struct {
+	Port    int       `json:"port"`
+	Expires time.Time `json:"expires"`
+}
+
+// OpenChallenge decrypts the reply to a last knock.
+func OpenChallenge(key string, reply []byte) (Challenge, error) {
+	var c Challenge
+	_, err := openJSON(key, reply, &c)
+	return c, err
+}
+
+// normalize applies the defaults and checks the port range.
+func (c *ChallengeConfig) normalize() error {
+	if c.PortBase == 0 {
+		c.PortBase = defaultChallengePortBase
+	}
+	if c.PortCount == 0 {
+		c.PortCount = defaultChallengePortCount
+	}
+	if c.Window.Duration == 0 {
+		c.Window = Duration{defaultChallengeWindow}
+	}
+	if c.PortBase < 1 || c.PortCount < 1 || c.PortBase+c.PortCount-1 > 65535 {
+		return fmt.Errorf("challenge port range %d+%d is outside 1-65535", c.PortBase, c.PortCount)
+	}
+	return nil
+}
+
+// checkChallenge rejects challenges where no knock connection can carry them.
+func checkChallenge(inst InstanceConfig) error {
+	switch {
+	case !inst.Challenge.Enabled():
+		return nil
+	case observingMode(inst.Mode):
+		return fmt.Errorf("challenges are sent on knock connections, not in %s mode", inst.Mode)
+	case inst.Encoding == EncodingSource:
+		return errors.New("challenges cannot follow source encoded sequences")
+	case inst.Banner != "":
+		return errors.New("challenges cannot be sent behind a banner")
+	}
+	return nil
+}
+
+// pendingChallenge is a completed sequence waiting for its challenge port.
+type pendingChallenge struct {
+	ip     string // The knocking source, which a payload may have had open another
+	access Access
+	p      *profile
+	ln     net.Listener
+	sealed []byte // Sent once, on the first knock connection closed after it
+	sent   bool
+}
+
+// issueChallenge opens a random challenge port for a completed sequence,
+// replacing any challenge ip had pending. Callers hold the server mutex.
+func (s *Server) issueChallenge(access Access, p *profile) {
+	cfg := s.cfg.Challenge
+	ip := access.IP
+	if access.Source != "" {
+		ip = access.Source
+	}
+	s.dropChallenge(ip)
+
+	var ln net.Listener
+	var port int
+	for range challengeBindAttempts {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(cfg.PortCount)))
+		if err != nil {
+			break
+		}
+		port = cfg.PortBase + int(n.Int64())
+		if ln, err = net.Listen(listenNetwork(s.cfg.Family), net.JoinHostPort(s.cfg.Bind, strconv.Itoa(port))); err == nil {
+			break
+		}
+	}
+	if ln == nil {
+		log.Printf("[%s] No free challenge port for %s", s.Name(), ip)
+		s.spawn(func() { s.deny(access, p, "no free challenge port") })
+		return
+	}
+
+	expires := access.Time.Add(cfg.Window.Duration)
+	sealed, err := sealJSON(cfg.Key, Challenge{Port: port, Expires: expires})
+	if err != nil {
+		_ = ln.Close()
+		s.spawn(func() { s.deny(access, p, "sealing challenge: "+err.Error()) })
+		return
+	}
+
+	c := &pendingChallenge{ip: ip, access: access, p: p, ln: ln, sealed: sealed}
+	s.pending[ip] = c
+	log.Printf("[%s] Challenging %s on port %d%s", s.Name(), ip, port, profileSuffix(p.name))
+
+	go s.awaitChallenge(c, port)
+	time.AfterFunc(cfg.Window.Duration, func() { _ = ln.Close() })
+}
+
+// awaitChallenge completes the sequence once its client connects to the
+// challenge port. Anyone else connecting fails, and so does the client
+// when the window closes first.
+func (s *Server) awaitChallenge(c *pendingChallenge, port int) {
+	ip := c.ip
+	for {
+		conn, err := c.ln.Accept()
+		if err != nil {
+			s.mutex.Lock()
+			if s.pending[ip] == c {
+				delete(s.pending, ip)
+				log.Printf("[%s] Challenge of %s on port %d not answered in time", s.Name(), ip, port)
+				s.failed(ip, port, s.clock.Now(), "challenge not answered")
+			}
+			s.mutex.Unlock()
+			return
+		}
+		from, _ := clientIP(conn.RemoteAddr())
+		_ = conn.Close()
+
+		s.mutex.Lock()
+		if from != ip {
+			log.Printf("[%s] Challenge port %d of %s hit by %s", s.Name(), port, ip, from)
+			s.failed(from, port, s.clock.Now(), "knock on another client's challenge port")
+			s.mutex.Unlock()
+			continue
+		}
+		if s.pending[ip] == c {
+			delete(s.pending, ip)
+			log.Printf("[%s] Challenge answered by %s", s.Name(), ip)
+			s.spawn(func() { s.complete(c.access, c.p) })
+		}
+		s.mutex.Unlock()
+		_ = c.ln.Close()
+		return
+	}
+}
+
+// dropChallenge abandons the challenge pending for ip, if any. Callers hold
+// the server mutex.
+func (s *Server) dropChallenge(ip string) {
+	if c, ok := s.pending[ip]; ok {
+		delete(s.pending, ip)
+		_ = c.ln.Close()
+	}
+}
+
+// closeKnock replies to a knock connection with the challenge just issued
+// to its source, if any, then closes it.
+func (s *Server) closeKnock(conn net.Conn, ip string) {
+	var reply []byte
+	if s.cfg.Challenge.Enabled() {
+		s.mutex.Lock()
+		if c, ok := s.pending[ip]; ok && !c.sent {
+			c.sent = true
+			reply = c.sealed
+		}
+		s.mutex.Unlock()
+	}
+
+	if reply != nil {
+		_ = conn.SetWriteDeadline(time.Now().Add(challengeWriteTimeout))
+		_, _ = conn.Write(reply)
+	}
+	_ = conn.Close()
+}
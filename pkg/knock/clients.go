@@ -0,0 +1,116 @@
+package knock
+
+import (
+	"container/list"
+	"log"
+	"time"
+)
+
+const (
+	defaultMaxClients   = 10000
+	clientSweepInterval = 10 * time.Second
+)
+
+// clientTable tracks the knock progress of each source, bounded so a flood
+// of spoofed SYNs cannot grow it without limit. Sources whose tracks all
+// timed out are dropped from the least recently knocking end, and when the
+// table is still full the least recently knocking source is evicted.
+type clientTable struct {
+	max     int
+	full    bool // Evicting live sources to make room
+	entries map[string]*list.Element
+	order   *list.List // Most recently knocking first
+}
+
+type clientEntry struct {
+	ip    string
+	state *ClientState
+}
+
+func newClientTable(max int) *clientTable {
+	return &clientTable{max: max, entries: make(map[string]*list.Element), order: list.New()}
+}
+
+func (c *clientTable) Len() int {
+	return c.order.Len()
+}
+
+// get returns the state of ip, marking it as the most recently used.
+func (c *clientTable) get(ip string) (*ClientState, bool) {
+	e, ok := c.entries[ip]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*clientEntry).state, true
+}
+
+// put stores the state of ip, returning true when the table just became full
+// and started evicting sources still knocking.
+func (c *clientTable) put(ip string, state *ClientState, now time.Time) bool {
+	if e, ok := c.entries[ip]; ok {
+		e.Value.(*clientEntry).state = state
+		c.order.MoveToFront(e)
+		return false
+	}
+
+	for e := c.order.Back(); e != nil && e.Value.(*clientEntry).state.stale(now); e = c.order.Back() {
+		c.remove(e.Value.(*clientEntry).ip)
+	}
+
+	evicting := c.order.Len() >= c.max
+	for c.order.Len() >= c.max {
+		c.remove(c.order.Back().Value.(*clientEntry).ip)
+	}
+	filled := evicting && !c.full
+	c.full = evicting
+
+	c.entries[ip] = c.order.PushFront(&clientEntry{ip: ip, state: state})
+	return filled
+}
+
+func (c *clientTable) remove(ip string) {
+	if e, ok := c.entries[ip]; ok {
+		c.order.Remove(e)
+		delete(c.entries, ip)
+	}
+}
+
+// sweep removes every source whose tracks all timed out, returning how many.
+func (c *clientTable) sweep(now time.Time) int {
+	removed := 0
+	for e := c.order.Back(); e != nil; {
+		prev := e.Prev()
+		if entry := e.Value.(*clientEntry); entry.state.stale(now) {
+			c.remove(entry.ip)
+			removed++
+		}
+		e = prev
+	}
+	if c.order.Len() < c.max {
+		c.full = false
+	}
+	return removed
+}
+
+// sweepClients forgets timed out sequences in the background, rather than
+// only when the same source knocks again, until stop is closed.
+func (s *Server) sweepClients(stop <-chan struct{}) {
+	ticker := time.NewTicker(clientSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			s.mutex.Lock()
+			removed := s.clients.sweep(now)
+			s.mutex.Unlock()
+
+			if removed > 0 {
+				log.Printf("[%s] Forgot %d timed out knock sequences", s.Name(), removed)
+			}
+		}
+	}
+}
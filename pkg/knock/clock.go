@@ -0,0 +1,49 @@
+package knock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the time to the knock state machine. Servers read the wall
+// clock; a Simulation swaps in a SimClock.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// SimClock is a Clock that only moves when told to.
+type SimClock struct {
+	now   time.Time
+	mutex sync.Mutex
+}
+
+func NewSimClock(start time.Time) *SimClock {
+	return &SimClock{now: start}
+}
+
+func (c *SimClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d and returns the new time.
+func (c *SimClock) Advance(d time.Duration) time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+	return c.now
+}
+
+// Set moves the clock to t, backwards if need be.
+func (c *SimClock) Set(t time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = t
+}
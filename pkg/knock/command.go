@@ -0,0 +1,275 @@
+package knock
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	defaultCommandTimeout = 10 * time.Second
+	maxCommandOutput      = 4096 // Bytes of output kept for the log and the audit log
+)
+
+// CommandConfig is a named action running command templates, e.g.
+//
+//	iptables -I INPUT -s {{.IP}} -p tcp --dport {{.Port}} -j ACCEPT
+//
+// Templates see the Access fields plus Port. Commands are split into
+// arguments like a shell would (quotes group words) but run without one.
+type CommandConfig struct {
+	Grant   string            `json:"grant"`  // Run on grant
+	Expire  string            `json:"expire"` // Run when the session ends
+	Ports   []int             `json:"ports"`  // Run once per port, once without when empty
+	Timeout Duration          `json:"timeout"`
+	Env     map[string]string `json:"env"` // Extra environment, values are templates too
+}
+
+type commandData struct {
+	Access
+	Port int
+}
+
+// CommandAction runs the configured commands on grant and expiry.
+type CommandAction struct {
+	name    string
+	cfg     CommandConfig
+	grant   []*template.Template
+	expire  []*template.Template
+	env     map[string]*template.Template
+	timeout time.Duration
+	audit   *AuditLog // Stores each run, nil when auditing is not configured
+}
+
+func NewCommandAction(name string, cfg CommandConfig) (*CommandAction, error) {
+	if cfg.Grant == "" && cfg.Expire == "" {
+		return nil, fmt.Errorf("command %s: neither grant nor expire is set", name)
+	}
+
+	c := &CommandAction{name: name, cfg: cfg, env: make(map[string]*template.Template), timeout: cfg.Timeout.Duration}
+	if c.timeout == 0 {
+		c.timeout = defaultCommandTimeout
+	}
+
+	var err error
+	if c.grant, err = parseCommand(name, cfg.Grant); err != nil {
+		return nil, err
+	}
+	if c.expire, err = parseCommand(name, cfg.Expire); err != nil {
+		return nil, err
+	}
+	for k, v := range cfg.Env {
+		if c.env[k], err = template.New(k).Option("missingkey=error").Parse(v); err != nil {
+			return nil, fmt.Errorf("command %s: env %s: %w", name, k, err)
+		}
+	}
+	return c, nil
+}
+
+func (c *CommandAction) Name() string {
+	return c.name
+}
+
+func (c *CommandAction) OnGranted(ctx context.Context, access Access) error {
+	return c.run(ctx, "grant", c.grant, access)
+}
+
+func (c *CommandAction) OnExpired(ctx context.Context, access Access) error {
+	return c.run(ctx, "expire", c.expire, access)
+}
+
+func (c *CommandAction) run(ctx context.Context, event string, argv []*template.Template, access Access) error {
+	if len(argv) == 0 {
+		return nil
+	}
+
+	ports := c.cfg.Ports
+	if len(access.Ports) > 0 {
+		ports = access.Ports
+	}
+	if len(ports) == 0 {
+		ports = []int{0}
+	}
+
+	var errs []error
+	for _, port := range ports {
+		data := commandData{Access: access, Port: port}
+		if err := c.exec(ctx, event, argv, data); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (c *CommandAction) exec(ctx context.Context, event string, argv []*template.Template, data commandData) error {
+	args, err := renderAll(argv, data)
+	if err != nil {
+		return fmt.Errorf("command %s %s: %w", c.name, event, err)
+	}
+
+	env := append(os.Environ(),
+		"KNOCK_EVENT="+event,
+		"KNOCK_INSTANCE="+data.Instance,
+		"KNOCK_IP="+data.IP,
+		"KNOCK_USER="+data.User,
+		"KNOCK_CLIENT="+data.Client,
+		"KNOCK_SESSION="+data.Session,
+		"KNOCK_PORT="+strconv.Itoa(data.Port),
+		"KNOCK_PROTOCOL="+data.Protocol,
+		"KNOCK_FORWARD="+data.Forward,
+	)
+	for k, t := range c.env {
+		v, err := render(t, data)
+		if err != nil {
+			return fmt.Errorf("command %s env %s: %w", c.name, k, err)
+		}
+		env = append(env, k+"="+v)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	out := &cappedBuffer{limit: maxCommandOutput}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = env
+	cmd.Stdout = out
+	cmd.Stderr = out
+	err = cmd.Run()
+
+	output := out.String()
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		if line != "" {
+			log.Printf("[%s] Command %s (%s) for IP %s: %s", data.Instance, c.name, event, data.IP, line)
+		}
+	}
+	if c.audit != nil {
+		// Exits with -1 when it did not start or was killed, by the timeout too
+		code := -1
+		if cmd.ProcessState != nil {
+			code = cmd.ProcessState.ExitCode()
+		}
+		if auditErr := c.audit.OnCommand(context.WithoutCancel(ctx), data.Access, c.name, event, data.Port, output, code); auditErr != nil {
+			log.Printf("[%s] Command %s (%s) for IP %s: %v", data.Instance, c.name, event, data.IP, auditErr)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("command %s %s: %w", c.name, event, err)
+	}
+	return nil
+}
+
+// cappedBuffer keeps the first limit bytes written to it, noting when more
+// were dropped.
+type cappedBuffer struct {
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.buf.Len(); len(p) > room {
+		b.buf.Write(p[:max(room, 0)])
+		b.truncated = true
+	} else {
+		b.buf.Write(p)
+	}
+	return len(p), nil
+}
+
+func (b *cappedBuffer) String() string {
+	if b.truncated {
+		return b.buf.String() + "\n[output truncated]"
+	}
+	return b.buf.String()
+}
+
+// parseCommand splits a command line and parses every argument as a template.
+func parseCommand(name, line string) ([]*template.Template, error) {
+	words, err := splitArgs(line)
+	if err != nil {
+		return nil, fmt.Errorf("command %s: %w", name, err)
+	}
+
+	argv := make([]*template.Template, len(words))
+	for i, w := range words {
+		if argv[i], err = template.New(name).Option("missingkey=error").Parse(w); err != nil {
+			return nil, fmt.Errorf("command %s: %w", name, err)
+		}
+	}
+	return argv, nil
+}
+
+func renderAll(argv []*template.Template, data commandData) ([]string, error) {
+	args := make([]string, len(argv))
+	for i, t := range argv {
+		v, err := render(t, data)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+	return args, nil
+}
+
+func render(t *template.Template, data commandData) (string, error) {
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// splitArgs splits on whitespace; single or double quotes group words and a
+// backslash escapes the next character outside single quotes.
+func splitArgs(line string) ([]string, error) {
+	var (
+		args    []string
+		cur     strings.Builder
+		inWord  bool
+		quote   rune
+		escaped bool
+	)
+
+	for _, r := range line {
+		switch {
+		case escaped:
+			cur.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inWord = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				cur.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				args = append(args, cur.String())
+				cur.Reset()
+				inWord = false
+			}
+		default:
+			cur.WriteRune(r)
+			inWord = true
+		}
+	}
+
+	if quote != 0 || escaped {
+		return nil, errors.New("unterminated quote or escape")
+	}
+	if inWord {
+		args = append(args, cur.String())
+	}
+	return args, nil
+}
@@ -0,0 +1,388 @@
+package knock
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Duration is a time.Duration that reads and writes as "1s", "500ms", etc.
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+type AdminConfig struct {
+	Listen string `json:"listen"` // host:port or unix:/path/to/socket, empty disables the admin API
+	Token  string `json:"token"`  // Optional bearer token
+
+	PublicHost string `json:"public_host"` // Address provisioned client profiles knock on
+}
+
+// InstanceConfig describes one virtual knock server.
+type InstanceConfig struct {
+	Name             string                   `json:"name"`
+	Bind             string                   `json:"bind"`        // Address to bind knock ports on, empty for all
+	Family           string                   `json:"family"`      // "dual" (default), "ipv4" or "ipv6"
+	Mode             string                   `json:"mode"`        // "listen" (default), "capture", "nflog" or "syn" for stealth knocks
+	Encoding         string                   `json:"encoding"`    // "destination" (default) or "source" to read the sequence from source ports
+	KnockPort        int                      `json:"knock_port"`  // The only port knocked on with source encoding
+	Interface        string                   `json:"interface"`   // Capture mode interface, or the one whose addresses knock ports bind to; empty for all
+	NFLogGroup       uint16                   `json:"nflog_group"` // NFLOG group the firewall copies knock SYNs to
+	Sequence         []KnockStep              `json:"sequence"`
+	Timeout          Duration                 `json:"timeout"`  // Max delay for next knocking, unless the step sets max_delay
+	TOTP             TOTPConfig               `json:"totp"`     // Rotating sequence, replaces sequence when set
+	Profiles         map[string]ProfileConfig `json:"profiles"` // Extra sequences for specific clients
+	ProtectedPorts   []int                    `json:"protected_ports"`
+	TrapPorts        []int                    `json:"trap_ports"`        // Decoy ports that ban any source touching them
+	ReplayWindow     Duration                 `json:"replay_window"`     // A completed sequence cannot be completed again for this long
+	ReorderWindow    Duration                 `json:"reorder_window"`    // How long a knock arriving before its step is held
+	SequenceTimeout  Duration                 `json:"sequence_timeout"`  // Max time from the first knock to the last, none when zero
+	MaxClients       int                      `json:"max_clients"`       // Knocking sources tracked at once, 10000 when zero
+	AcceptWorkers    int                      `json:"accept_workers"`    // Listeners per knock port sharing it with SO_REUSEPORT, 1 when zero
+	SkipLoopback     bool                     `json:"skip_loopback"`     // Bind every non-loopback address rather than the wildcard
+	Listeners        []ListenerConfig         `json:"listeners"`         // Per knock port bind address or interface
+	Interfaces       map[string]IfacePolicy   `json:"interfaces"`        // Per arrival interface policies, "*" for the others
+	Payload          PayloadConfig            `json:"payload"`           // Encrypted request carried by the last knock
+	Fwknop           FwknopConfig             `json:"fwknop"`            // Single Packet Authorization from fwknop clients
+	HTTPS            HTTPSKnockConfig         `json:"https"`             // Signed knock requests over HTTPS, where only 443 gets out
+	DNS              DNSKnockConfig           `json:"dns"`               // Signed knock queries, where only DNS gets out
+	RequestTargets   []string                 `json:"request_targets"`   // CIDRs payloads, HTTPS, fwknop and DNS knocks may ask to open instead of their source
+	Challenge        ChallengeConfig          `json:"challenge"`         // Random port the client must hit after the sequence
+	Banner           string                   `json:"banner"`            // Fake service banner on knock ports: "ssh", "smtp", "http"
+	Proxies          []ProxyConfig            `json:"proxies"`           // Userspace proxies open only to active sessions
+	Allowlist        []string                 `json:"allowlist"`         // Pre-authorized CIDRs or hostnames, skip the sequence
+	AllowlistRefresh Duration                 `json:"allowlist_refresh"` // How often hostnames are re-resolved
+	Denylist         []string                 `json:"denylist"`          // CIDRs whose knocks are always ignored
+	Blocklists       []string                 `json:"blocklists"`        // Feeds whose listed sources are rejected or flagged
+	BlocklistMode    string                   `json:"blocklist_mode"`    // "reject" (default) or "flag"
+	Countries        []string                 `json:"countries"`         // Countries the sequence is accepted from, any when empty
+	ASNs             []uint                   `json:"asns"`              // Networks the sequence is accepted from, any when empty
+	Schedule         Schedule                 `json:"schedule"`          // When the sequence grants access, always when empty
+	SecondFactor     string                   `json:"second_factor"`     // Confirmation a completed sequence waits for, none when empty
+	ExpiryNotice     ExpiryNoticeConfig       `json:"expiry_notice"`
+	Ban              BanConfig                `json:"ban"`          // Ban sources sending too many invalid knocks
+	SessionTTL       Duration                 `json:"session_ttl"`  // How long a grant lasts
+	MaxPerIP         int                      `json:"max_per_ip"`   // Sessions one IP may hold on the instance, unlimited when zero
+	RequireUser      bool                     `json:"require_user"` // Deny grants not attributed to a known user
+	Actions          []string                 `json:"actions"`      // Run on every granted access
+	Policies         []string                 `json:"policies"`     // All must allow before a grant
+	Disabled         bool                     `json:"disabled"`     // Not started with the supervisor
+}
+
+type Config struct {
+	Admin          AdminConfig                   `json:"admin"`
+	PluginDir      string                        `json:"plugin_dir"`
+	Sessions       SessionConfig                 `json:"sessions"`
+	StateKey       string                        `json:"state_key"`  // Signs exported state
+	UsersFile      string                        `json:"users_file"` // Enables user management
+	StatsFile      string                        `json:"stats_file"` // Enables historical statistics
+	StatsD         StatsDConfig                  `json:"statsd"`     // Sends live knock counters to StatsD or DogStatsD
+	Tracing        TracingConfig                 `json:"tracing"`    // Sends spans of knock processing to an OpenTelemetry collector
+	BansFile       string                        `json:"bans_file"`  // Keeps bans across restarts
+	Audit          AuditConfig                   `json:"audit"`      // Stores every knock outcome in SQL
+	Privacy        PrivacyConfig                 `json:"privacy"`    // Hides client IPs in the log and notifications
+	StateFile      string                        `json:"state_file"` // Keeps sessions and sequences in progress across restarts
+	Redis          RedisConfig                   `json:"redis"`      // Shares sequences in progress between nodes
+	NTP            NTPConfig                     `json:"ntp"`
+	GeoIP          GeoIPConfig                   `json:"geoip"`   // Country and ASN databases for geo restricted sequences
+	Capture        CaptureConfig                 `json:"capture"` // Debug pcap recording of knock traffic
+	ScriptPolicies map[string]ScriptPolicyConfig `json:"script_policies"`
+	SecondFactors  map[string]SecondFactorConfig `json:"second_factors"`
+	Firewalls      map[string]FirewallConfig     `json:"firewalls"` // Firewall actions by name
+	Commands       map[string]CommandConfig      `json:"commands"`  // Command template actions by name
+	SSH            map[string]SSHConfig          `json:"ssh"`       // Ephemeral SSH access actions by name
+	Tokens         map[string]TokenConfig        `json:"tokens"`    // JWT issuing actions by name
+	Webhooks       map[string]WebhookConfig      `json:"webhooks"`  // Webhook actions by name
+	Alerts         map[string]AlertConfig        `json:"alerts"`    // Slack and Telegram alert actions by name
+	Syslog         map[string]SyslogConfig       `json:"syslog"`    // Syslog actions by name
+	Feeds          map[string]FeedConfig         `json:"feeds"`     // Threat intel blocklists by name
+	Buses          map[string]BusConfig          `json:"buses"`     // Message bus actions by name
+	Instances      []InstanceConfig              `json:"instances"`
+}
+
+func DefaultInstance() InstanceConfig {
+	return InstanceConfig{
+		Name: "default",
+		Sequence: []KnockStep{
+			{Port: 7001, Count: 3},
+			{Port: 8002, Count: 1},
+			{Port: 9003, Count: 2},
+		},
+		Timeout:        Duration{1 * time.Second},
+		ProtectedPorts: []int{22},
+		SessionTTL:     Duration{1 * time.Hour},
+	}
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Instances: []InstanceConfig{DefaultInstance()},
+	}
+}
+
+// ConfigEnv names the config file to use when -config is not given.
+const ConfigEnv = "PORT_KNOCKING_CONFIG"
+
+// ConfigSearchPath lists the files tried, in order, when neither -config nor
+// ConfigEnv is set.
+func ConfigSearchPath() []string {
+	paths := []string{"port-knocking.json"}
+	if dir, err := os.UserConfigDir(); err == nil {
+		paths = append(paths, filepath.Join(dir, "port-knocking", "config.json"))
+	}
+	return append(paths, "/etc/port-knocking/config.json")
+}
+
+// findConfig returns the config file to use without -config, empty when
+// there is none.
+func findConfig() string {
+	if path := os.Getenv(ConfigEnv); path != "" {
+		return path
+	}
+	for _, path := range ConfigSearchPath() {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// LoadConfig reads a JSON config file, or a classic knockd.conf. An empty path
+// looks the file up with findConfig, returning the built-in defaults when
+// there is none. Ambiguous or weak sequences fail with ErrConfigValidationFailed.
+func LoadConfig(path string) (*Config, error) {
+	if path == "" {
+		if path = findConfig(); path == "" {
+			return DefaultConfig(), nil
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config: %w", err)
+	}
+
+	cfg := &Config{}
+	if isKnockdConfig(data) {
+		if cfg, err = parseKnockdConfig(data); err != nil {
+			return nil, fmt.Errorf("parsing config %s: %w", path, err)
+		}
+	} else if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("parsing config %s: %w", path, err)
+	}
+
+	switch cfg.Sessions.OnLimit {
+	case "", SessionLimitReject, SessionLimitEvict:
+	default:
+		return nil, fmt.Errorf("invalid sessions.on_limit %q", cfg.Sessions.OnLimit)
+	}
+
+	if err := cfg.Privacy.normalize(); err != nil {
+		return nil, err
+	}
+
+	if cfg.Capture.MaxFileSize == 0 {
+		cfg.Capture.MaxFileSize = defaultCaptureFileSize
+	}
+	if cfg.Capture.MaxFileAge.Duration == 0 {
+		cfg.Capture.MaxFileAge = Duration{defaultCaptureFileAge}
+	}
+	if cfg.Capture.MaxFiles == 0 {
+		cfg.Capture.MaxFiles = defaultCaptureFiles
+	}
+
+	if len(cfg.Instances) == 0 {
+		return nil, errors.New("config defines no instances")
+	}
+
+	seen := make(map[string]struct{}, len(cfg.Instances))
+	for i := range cfg.Instances {
+		inst := &cfg.Instances[i]
+		if inst.Name == "" {
+			return nil, fmt.Errorf("instance %d has no name", i+1)
+		}
+		if _, ok := seen[inst.Name]; ok {
+			return nil, fmt.Errorf("duplicate instance name %q", inst.Name)
+		}
+		seen[inst.Name] = struct{}{}
+
+		if err := normalizeInstance(inst); err != nil {
+			return nil, err
+		}
+		if err := checkGeoRules(cfg.GeoIP, *inst); err != nil {
+			return nil, fmt.Errorf("instance %s: %w", inst.Name, err)
+		}
+	}
+	if err := validateSequences(cfg); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// normalizeInstance checks an instance's settings and fills in defaults.
+func normalizeInstance(inst *InstanceConfig) error {
+	// Accept IPv6 literals written like URL hosts, e.g. "[::1]"
+	inst.Bind = strings.TrimSuffix(strings.TrimPrefix(inst.Bind, "["), "]")
+
+	if !validFamily(inst.Family) {
+		return fmt.Errorf("instance %s: unknown family %q", inst.Name, inst.Family)
+	}
+	if !validMode(inst.Mode) {
+		return fmt.Errorf("instance %s: unknown mode %q", inst.Name, inst.Mode)
+	}
+	if !validEncoding(inst.Encoding) {
+		return fmt.Errorf("instance %s: unknown encoding %q", inst.Name, inst.Encoding)
+	}
+	if inst.Encoding == EncodingSource && (inst.KnockPort < 1 || inst.KnockPort > 65535) {
+		return fmt.Errorf("instance %s: source encoding needs a knock_port", inst.Name)
+	}
+	if observingMode(inst.Mode) && inst.Banner != "" {
+		return fmt.Errorf("instance %s: banners need listening sockets, not %s mode", inst.Name, inst.Mode)
+	}
+	if err := checkSNISteps(*inst); err != nil {
+		return fmt.Errorf("instance %s: %w", inst.Name, err)
+	}
+	if err := checkChallenge(*inst); err != nil {
+		return fmt.Errorf("instance %s: %w", inst.Name, err)
+	}
+	if inst.Challenge.Enabled() {
+		if err := inst.Challenge.normalize(); err != nil {
+			return fmt.Errorf("instance %s: %w", inst.Name, err)
+		}
+	}
+	if inst.Payload.Enabled() && (observingMode(inst.Mode) || inst.Banner != "") {
+		return fmt.Errorf("instance %s: payloads need plain listening sockets, without banners", inst.Name)
+	}
+	if !validBanner(inst.Banner) {
+		return fmt.Errorf("instance %s: unknown banner %q", inst.Name, inst.Banner)
+	}
+
+	if inst.ExpiryNotice.Before.Duration > 0 && (inst.ExpiryNotice.Port == 0 || inst.ExpiryNotice.Key == "") {
+		return fmt.Errorf("instance %s: expiry_notice needs a port and a key", inst.Name)
+	}
+
+	if inst.TOTP.Enabled() {
+		if err := NormalizeTOTP(&inst.TOTP); err != nil {
+			return fmt.Errorf("instance %s: %w", inst.Name, err)
+		}
+	}
+	if err := normalizeCountries(inst.Countries); err != nil {
+		return fmt.Errorf("instance %s: %w", inst.Name, err)
+	}
+	if err := inst.Schedule.normalize(); err != nil {
+		return fmt.Errorf("instance %s: %w", inst.Name, err)
+	}
+	for name, p := range inst.Profiles {
+		if err := normalizeCountries(p.Countries); err != nil {
+			return fmt.Errorf("instance %s profile %s: %w", inst.Name, name, err)
+		}
+		if err := p.Schedule.normalize(); err != nil {
+			return fmt.Errorf("instance %s profile %s: %w", inst.Name, name, err)
+		}
+		if p.MaxPerIP < 0 {
+			return fmt.Errorf("instance %s profile %s: invalid max_per_ip %d", inst.Name, name, p.MaxPerIP)
+		}
+		if p.TOTP.Enabled() {
+			if err := NormalizeTOTP(&p.TOTP); err != nil {
+				return fmt.Errorf("instance %s profile %s: %w", inst.Name, name, err)
+			}
+		}
+		inst.Profiles[name] = p
+	}
+
+	if inst.Fwknop.Enabled() {
+		if inst.Fwknop.Port == 0 {
+			inst.Fwknop.Port = defaultFwknopPort
+		}
+		if _, _, err := inst.Fwknop.keys(); err != nil {
+			return fmt.Errorf("instance %s: %w", inst.Name, err)
+		}
+	}
+
+	if port := inst.Payload.SPAPort; port != 0 {
+		switch {
+		case !inst.Payload.Enabled():
+			return fmt.Errorf("instance %s: payload.spa_port needs a payload key", inst.Name)
+		case port < 1 || port > 65535:
+			return fmt.Errorf("instance %s: invalid payload.spa_port %d", inst.Name, port)
+		case inst.Fwknop.Enabled() && inst.Fwknop.Port == port:
+			return fmt.Errorf("instance %s: payload.spa_port %d is also the fwknop port", inst.Name, port)
+		}
+	}
+
+	if inst.HTTPS.Enabled() && (inst.HTTPS.Key == "" || inst.HTTPS.TLSCert == "" || inst.HTTPS.TLSKey == "") {
+		return fmt.Errorf("instance %s: https needs a key, tls_cert and tls_key", inst.Name)
+	}
+
+	if inst.DNS.Enabled() {
+		if err := inst.DNS.normalize(); err != nil {
+			return fmt.Errorf("instance %s: %w", inst.Name, err)
+		}
+	}
+
+	switch inst.BlocklistMode {
+	case "":
+		inst.BlocklistMode = BlocklistReject
+	case BlocklistReject, BlocklistFlag:
+	default:
+		return fmt.Errorf("instance %s: invalid blocklist_mode %q", inst.Name, inst.BlocklistMode)
+	}
+
+	if inst.Timeout.Duration == 0 {
+		inst.Timeout = DefaultInstance().Timeout
+	}
+	if err := checkListeners(*inst); err != nil {
+		return fmt.Errorf("instance %s: %w", inst.Name, err)
+	}
+	if err := checkIfacePolicies(*inst); err != nil {
+		return fmt.Errorf("instance %s: %w", inst.Name, err)
+	}
+	if inst.AcceptWorkers < 0 {
+		return fmt.Errorf("instance %s: invalid accept_workers %d", inst.Name, inst.AcceptWorkers)
+	}
+	if inst.AcceptWorkers > 1 && !reusePortSupported {
+		return fmt.Errorf("instance %s: accept_workers needs SO_REUSEPORT, which this OS lacks", inst.Name)
+	}
+	if inst.MaxPerIP < 0 {
+		return fmt.Errorf("instance %s: invalid max_per_ip %d", inst.Name, inst.MaxPerIP)
+	}
+	if inst.MaxClients < 0 {
+		return fmt.Errorf("instance %s: invalid max_clients %d", inst.Name, inst.MaxClients)
+	}
+	if inst.MaxClients == 0 {
+		inst.MaxClients = defaultMaxClients
+	}
+	if inst.AllowlistRefresh.Duration == 0 {
+		inst.AllowlistRefresh = Duration{defaultAllowlistRefresh}
+	}
+	if inst.SessionTTL.Duration == 0 {
+		inst.SessionTTL = DefaultInstance().SessionTTL
+	}
+	if err := inst.Ban.normalize(); err != nil {
+		return fmt.Errorf("instance %s: %w", inst.Name, err)
+	}
+	return nil
+}
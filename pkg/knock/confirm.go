@@ -0,0 +1,111 @@
+package knock
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	ConfirmUDP = "udp" // A single datagram to the client port
+	ConfirmTCP = "tcp" // A connection to the client port, closed once written
+
+	confirmDialTimeout = 3 * time.Second
+	maxConfirmation    = 1024
+)
+
+// GrantConfirmation tells a client its knock was granted, before it dials
+// the real service. It is sealed with the key of the request and names the nonce
+// of the request it answers, so it cannot be forged or replayed against
+// another knock.
+type GrantConfirmation struct {
+	Request   string    `json:"request"` // Hex nonce of the sealed request
+	Instance  string    `json:"instance"`
+	IP        string    `json:"ip"`
+	Session   string    `json:"session"`
+	Ports     []int     `json:"ports,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// confirmTarget is where a request asked its grant to be confirmed.
+type confirmTarget struct {
+	network string
+	addr    string
+	request string
+	key     string // Payload key the request was sealed with
+}
+
+// newConfirmTarget checks the confirmation a request asked for, sent to
+// the port on ip and sealed with key.
+func newConfirmTarget(req KnockRequest, ip string, nonce []byte, key string) (*confirmTarget, error) {
+	network := req.ConfirmProto
+	switch network {
+	case "":
+		network = ConfirmUDP
+	case ConfirmUDP, ConfirmTCP:
+	default:
+		return nil, fmt.Errorf("invalid confirmation protocol %q", network)
+	}
+	if req.ConfirmPort < 1 || req.ConfirmPort > 65535 {
+		return nil, fmt.Errorf("invalid confirmation port %d", req.ConfirmPort)
+	}
+
+	return &confirmTarget{
+		network: network,
+		addr:    net.JoinHostPort(ip, strconv.Itoa(req.ConfirmPort)),
+		request: hex.EncodeToString(nonce),
+		key:     key,
+	}, nil
+}
+
+// confirm sends the sealed confirmation of a granted access.
+func (s *Server) confirm(access Access, target *confirmTarget) {
+	sealed, err := sealJSON(target.key, GrantConfirmation{
+		Request:   target.request,
+		Instance:  access.Instance,
+		IP:        access.IP,
+		Session:   access.Session,
+		Ports:     access.Ports,
+		ExpiresAt: access.Expires,
+	})
+	if err == nil {
+		err = sendConfirmation(target.network, target.addr, sealed)
+	}
+	if err != nil {
+		log.Printf("[%s] Failed to confirm session %s to %s/%s: %v", s.Name(), access.Session, target.network, target.addr, err)
+		return
+	}
+	log.Printf("[%s] Confirmed session %s to %s/%s", s.Name(), access.Session, target.network, target.addr)
+}
+
+func sendConfirmation(network, addr string, sealed []byte) error {
+	conn, err := net.DialTimeout(network, addr, confirmDialTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_ = conn.SetWriteDeadline(time.Now().Add(confirmDialTimeout))
+	_, err = conn.Write(sealed)
+	return err
+}
+
+// OpenConfirmation decrypts a confirmation received from the server and
+// checks it answers the request sealed with nonce.
+func OpenConfirmation(key string, data, nonce []byte) (GrantConfirmation, error) {
+	var c GrantConfirmation
+	if len(data) > maxConfirmation {
+		return c, errors.New("confirmation too long")
+	}
+	if _, err := openJSON(key, data, &c); err != nil {
+		return c, err
+	}
+	if c.Request != hex.EncodeToString(nonce) {
+		return c, errors.New("confirmation answers another request")
+	}
+	return c, nil
+}
@@ -0,0 +1,170 @@
+package knock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Daemon runs the server as a long-lived process: it writes a PID file, stops
+// gracefully on SIGINT and SIGTERM, reloads the config on SIGHUP and logs its
+// state on SIGUSR1.
+//
+// A reload applies the new config, which must load or the running one is
+// kept, to the running instances when it only changes their sequences, trap
+// ports or timeouts (see Server.Reconfigure). Other changes stop every
+// instance and start them again, and sessions only survive that with a
+// state_file, as the firewalls are reset on start.
+type Daemon struct {
+	ConfigPath string // Read again on reload, found the way LoadConfig does when empty
+	PIDFile    string // Written on start and removed on exit, none when empty
+}
+
+// Run serves cfg until the process is told to stop.
+func (d *Daemon) Run(cfg *Config) error {
+	if d.PIDFile != "" {
+		if err := writePIDFile(d.PIDFile); err != nil {
+			return err
+		}
+		defer os.Remove(d.PIDFile)
+	}
+
+	stop := notify(os.Interrupt, syscall.SIGTERM)
+	reload := notify(reloadSignals...)
+	dump := notify(dumpSignals...)
+	defer signal.Stop(stop)
+	defer signal.Stop(reload)
+	defer signal.Stop(dump)
+
+	reloads := make(chan reloadRequest)
+	for {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() {
+			done <- run(ctx, cfg, dump, reloads)
+		}()
+
+		next, err := d.wait(cancel, done, stop, reload, reloads)
+		if next == nil {
+			return err
+		}
+		cancel()
+		if err := <-done; err != nil {
+			return err
+		}
+		cfg = next
+		log.Printf("Config reloaded")
+	}
+}
+
+// reloadRequest hands a reloaded config to the running server, which answers
+// on done whether it could apply it in place.
+type reloadRequest struct {
+	cfg  *Config
+	done chan error
+}
+
+// wait returns the config to restart with on a reload the server could not
+// apply in place, or nil and the error the server ended with, cancelling it
+// when told to stop.
+func (d *Daemon) wait(cancel context.CancelFunc, done <-chan error, stop, reload <-chan os.Signal, reloads chan<- reloadRequest) (*Config, error) {
+	for {
+		select {
+		case err := <-done:
+			return nil, err
+		case sig := <-stop:
+			log.Printf("Received %s, shutting down", sig)
+			cancel()
+			return nil, <-done
+		case <-reload:
+			next, err := LoadConfig(d.ConfigPath)
+			if err != nil {
+				log.Printf("Reload failed, keeping the running config: %v", err)
+				continue
+			}
+			sdNotify("RELOADING=1")
+
+			req := reloadRequest{cfg: next, done: make(chan error, 1)}
+			select {
+			case reloads <- req:
+			case err := <-done:
+				return nil, err
+			}
+			err = <-req.done
+			if err == nil {
+				log.Printf("Config reloaded in place")
+				sdNotify("READY=1")
+				continue
+			}
+			if errors.Is(err, ErrRestartRequired) {
+				log.Printf("Reloading the config, restarting every instance")
+			} else {
+				log.Printf("Reloading the config in place failed, restarting every instance: %v", err)
+			}
+			return next, nil
+		}
+	}
+}
+
+// notify relays sigs to the returned channel, which never delivers without
+// any: signal.Notify would relay every signal.
+func notify(sigs ...os.Signal) chan os.Signal {
+	c := make(chan os.Signal, 1)
+	if len(sigs) > 0 {
+		signal.Notify(c, sigs...)
+	}
+	return c
+}
+
+func writePIDFile(path string) error {
+	if err := os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644); err != nil {
+		return fmt.Errorf("writing pid file: %w", err)
+	}
+	return nil
+}
+
+// logState writes the instances, the sequences in progress, the sessions and
+// the bans to the log.
+func (sup *Supervisor) logState(bans *BanList) {
+	now := time.Now()
+	log.Printf("State dump:")
+
+	for _, st := range sup.Status() {
+		state := "stopped"
+		if st.Running {
+			state = "running"
+		}
+		if st.LastError != "" {
+			state += ", last error: " + st.LastError
+		}
+		log.Printf("  instance %s %s", st.Name, state)
+	}
+
+	for _, cp := range sup.Progress() {
+		for _, t := range cp.Tracks {
+			log.Printf("  [%s] %s at step %d/%d%s, last knock %s ago",
+				cp.Instance, cp.IP, t.StepIndex+1, t.Steps, profileSuffix(t.Profile), now.Sub(t.LastHit).Round(time.Second))
+		}
+	}
+
+	for _, s := range sup.sessions.List() {
+		who := s.IP
+		if s.User != "" {
+			who += " user " + s.User
+		}
+		if len(s.Ports) > 0 {
+			who += fmt.Sprintf(" ports %v", s.Ports)
+		}
+		log.Printf("  session %s [%s] %s for %s", s.ID, s.Instance, who, s.ExpiresAt.Sub(now).Round(time.Second))
+	}
+
+	for _, b := range bans.List() {
+		log.Printf("  ban %s [%s] %s for %s", b.IP, b.Instance, b.Reason, b.Until.Sub(now).Round(time.Second))
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package knock
+
+import "os"
+
+// Neither a reload nor a state dump can be asked for by signal
+var (
+	reloadSignals []os.Signal
+	dumpSignals   []os.Signal
+)
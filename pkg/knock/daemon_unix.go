@@ -0,0 +1,13 @@
+//go:build unix
+
+package knock
+
+import (
+	"os"
+	"syscall"
+)
+
+var (
+	reloadSignals = []os.Signal{syscall.SIGHUP}
+	dumpSignals   = []os.Signal{syscall.SIGUSR1}
+)
@@ -0,0 +1,325 @@
+package knock
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DNSModeListen = "listen" // Answer queries on a UDP socket, as the zone's authoritative server
+	DNSModeTap    = "tap"    // Read queries off the wire, leaving the real DNS server to answer
+
+	// DNSSourceLabel in place of an address opens the query's own source
+	DNSSourceLabel = "src"
+
+	defaultDNSListen = ":53"
+	dnsMaxMessage    = 512
+	dnsSigLen        = 16 // Bytes of the HMAC kept in the first label
+	dnsRcodeRefused  = 5
+)
+
+// DNSKnockConfig accepts knocks as DNS queries, for networks letting nothing
+// but DNS out. Queries travel through the client's resolver, so the source
+// the server sees is rarely the client: the name carries the address to
+// open instead, and bans or failures are never held against the resolver.
+// Like any address a knock asks to open other than its source, it must be
+// within request_targets.
+//
+// A knock is a query, of any type though TXT is usual, for
+//
+//	<sig>.<time>.<addr>[.<profile>].<zone>
+//
+// with time in Unix seconds, addr the hex bytes of the IPv4 or IPv6 address
+// to open or "src" for the query source, and sig the hex of the first 16
+// bytes of the HMAC-SHA256 of "<time>.<addr>[.<profile>]". DNSKnockName
+// builds it. Like an HTTPS knock, a valid query completes the whole sequence
+// of the profile.
+type DNSKnockConfig struct {
+	Zone      string `json:"zone"`      // Delegated zone knocks are queried under, empty disables DNS knocks
+	Key       string `json:"key"`       // HMAC-SHA256 secret signing names
+	Mode      string `json:"mode"`      // "listen" (default) or "tap"
+	Listen    string `json:"listen"`    // Listen mode UDP address, ":53" when empty
+	Interface string `json:"interface"` // Tap mode interface, every one when empty
+}
+
+func (c DNSKnockConfig) Enabled() bool {
+	return c.Zone != ""
+}
+
+// normalize lowercases the zone and applies the defaults.
+func (c *DNSKnockConfig) normalize() error {
+	c.Zone = strings.ToLower(strings.Trim(c.Zone, "."))
+	if c.Key == "" {
+		return errors.New("dns knocks need a key")
+	}
+	switch c.Mode {
+	case "":
+		c.Mode = DNSModeListen
+	case DNSModeListen, DNSModeTap:
+	default:
+		return fmt.Errorf("invalid dns mode %q", c.Mode)
+	}
+	if c.Listen == "" {
+		c.Listen = defaultDNSListen
+	}
+	return nil
+}
+
+// DNSKnockName returns the name to query under zone to have ip opened,
+// the query source when ip is invalid.
+func DNSKnockName(key, zone string, ip netip.Addr, profile string, t time.Time) string {
+	addr := DNSSourceLabel
+	if ip.IsValid() {
+		addr = hex.EncodeToString(ip.Unmap().AsSlice())
+	}
+	signed := strconv.FormatInt(t.Unix(), 10) + "." + addr
+	if profile != "" {
+		signed += "." + strings.ToLower(profile)
+	}
+	return hex.EncodeToString(dnsKnockMAC(key, signed)) + "." + signed + "." + strings.Trim(zone, ".")
+}
+
+func dnsKnockMAC(key, signed string) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(signed))
+	return mac.Sum(nil)[:dnsSigLen]
+}
+
+// dnsQuestion is the first question of a query.
+type dnsQuestion struct {
+	name string // Lowercase, without the trailing dot
+	end  int    // Offset just past the question
+}
+
+// parseDNSQuery reads the question of a standard query.
+func parseDNSQuery(msg []byte) (dnsQuestion, bool) {
+	if len(msg) < 12 {
+		return dnsQuestion{}, false
+	}
+	flags := binary.BigEndian.Uint16(msg[2:4])
+	if flags&0x8000 != 0 || flags&0x7800 != 0 || binary.BigEndian.Uint16(msg[4:6]) == 0 {
+		return dnsQuestion{}, false // A response, not a QUERY, or no question
+	}
+
+	var labels []string
+	i := 12
+	for {
+		if i >= len(msg) {
+			return dnsQuestion{}, false
+		}
+		n := int(msg[i])
+		i++
+		if n == 0 {
+			break
+		}
+		// Questions are never compressed
+		if n > 63 || i+n > len(msg) {
+			return dnsQuestion{}, false
+		}
+		labels = append(labels, strings.ToLower(string(msg[i:i+n])))
+		i += n
+	}
+	if i+4 > len(msg) {
+		return dnsQuestion{}, false
+	}
+	return dnsQuestion{name: strings.Join(labels, "."), end: i + 4}, true
+}
+
+// dnsReply answers query with rcode and no records. Knock names get the
+// same empty NOERROR whether valid or not, and it keeps resolvers that
+// minimize query names walking down to the full name.
+func dnsReply(query []byte, q dnsQuestion, rcode uint16) []byte {
+	reply := make([]byte, q.end)
+	copy(reply, query[:q.end])
+
+	flags := binary.BigEndian.Uint16(query[2:4])
+	flags = 0x8000 | 0x0400 | flags&0x0100 | rcode // QR, AA, RD echoed
+	binary.BigEndian.PutUint16(reply[2:4], flags)
+	binary.BigEndian.PutUint16(reply[4:6], 1)
+	clear(reply[6:12])
+	return reply
+}
+
+// inZone reports whether name is zone or below it, returning the labels
+// left of the zone.
+func inZone(name, zone string) (string, bool) {
+	if name == zone {
+		return "", true
+	}
+	rest, ok := strings.CutSuffix(name, "."+zone)
+	return rest, ok
+}
+
+// handleDNS answers queries on the listen mode socket until it is closed.
+func (s *Server) handleDNS(pc net.PacketConn) {
+	buf := make([]byte, dnsMaxMessage)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		q, ok := parseDNSQuery(buf[:n])
+		if !ok {
+			continue
+		}
+		ip, err := clientIP(addr)
+		if err != nil {
+			continue
+		}
+
+		labels, ok := inZone(q.name, s.cfg.DNS.Zone)
+		if !ok {
+			_, _ = pc.WriteTo(dnsReply(buf[:n], q, dnsRcodeRefused), addr)
+			continue
+		}
+		_, _ = pc.WriteTo(dnsReply(buf[:n], q, 0), addr)
+
+		if labels != "" {
+			s.processDNSKnock(ip, labels)
+		}
+	}
+}
+
+// tapDNS watches queries to port 53 on the wire until stop is closed.
+func (s *Server) tapDNS(src knockSource, stop <-chan struct{}) {
+	defer src.Close()
+
+	buf := make([]byte, pcapSnapLen)
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		p, ok, err := src.ReadPacket(buf)
+		if err != nil {
+			log.Printf("[%s] DNS tap stopped: %v", s.Name(), err)
+			return
+		}
+		if !ok || p.Proto != protoUDP || p.DstPort != 53 || !s.familyAllows(p.Src) {
+			continue
+		}
+		q, ok := parseDNSQuery(p.Payload)
+		if !ok {
+			continue
+		}
+		if labels, ok := inZone(q.name, s.cfg.DNS.Zone); ok && labels != "" {
+			s.processDNSKnock(p.Src.Unmap().WithZone("").String(), labels)
+		}
+	}
+}
+
+// processDNSKnock checks the labels of a query from source, left of the
+// zone, and completes the profile they name. Resolvers retry and repeat
+// queries, so a replayed name is dropped quietly.
+func (s *Server) processDNSKnock(source, labels string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.clock.Now()
+
+	// Shorter names are resolvers minimizing their queries on the way down
+	sig, signed, _ := strings.Cut(labels, ".")
+	parts := strings.Split(signed, ".")
+	if len(sig) != 2*dnsSigLen || len(parts) < 2 || len(parts) > 3 {
+		return
+	}
+	mac, err := hex.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, dnsKnockMAC(s.cfg.DNS.Key, signed)) {
+		log.Printf("[%s] Invalid DNS knock via %s: bad signature", s.Name(), source)
+		return
+	}
+	if !s.nonces.use("dns:"+sig, now) {
+		return
+	}
+
+	ip := source
+	if parts[1] != DNSSourceLabel {
+		b, err := hex.DecodeString(parts[1])
+		addr, ok := netip.AddrFromSlice(b)
+		if err != nil || !ok {
+			log.Printf("[%s] Invalid DNS knock via %s: bad address", s.Name(), source)
+			return
+		}
+		if ip, err = s.checkTarget(source, addr); err != nil {
+			log.Printf("[%s] Rejected DNS knock via %s: %v", s.Name(), source, err)
+			return
+		}
+	}
+	s.stats.record(statAttempt, s.Name(), ip, 0, now)
+	s.metrics.count(statAttempt, s.Name(), "", "")
+
+	if t, err := strconv.ParseInt(parts[0], 10, 64); err != nil {
+		log.Printf("[%s] Invalid DNS knock for %s: bad time", s.Name(), ip)
+		return
+	} else if age := now.Sub(time.Unix(t, 0)); age > payloadMaxAge || age < -payloadMaxAge {
+		log.Printf("[%s] Invalid DNS knock for %s: %s off the server clock", s.Name(), ip, age.Round(time.Second))
+		return
+	}
+
+	if s.denied(ip) {
+		log.Printf("[%s] Ignoring DNS knock for denylisted IP %s", s.Name(), ip)
+		return
+	}
+	if f := s.blocklisted(ip); f != nil && s.cfg.BlocklistMode == BlocklistReject {
+		log.Printf("[%s] Ignoring DNS knock for %s listed by blocklist %s", s.Name(), ip, f.Name())
+		return
+	}
+	if ban, ok := s.bans.Banned(ip, now); ok {
+		log.Printf("[%s] Ignoring DNS knock for banned IP %s until %s", s.Name(), ip, ban.Until.Format(time.RFC3339))
+		return
+	}
+
+	name := ""
+	if len(parts) == 3 {
+		name = parts[2]
+	}
+	p, err := s.requestedProfile(ip, "", name)
+	if err != nil {
+		log.Printf("[%s] Rejected DNS knock for %s: %v", s.Name(), ip, err)
+		return
+	}
+
+	log.Printf("[%s] DNS knock OK %s via %s%s", s.Name(), ip, source, profileSuffix(p.name))
+	s.stats.record(statCompletion, s.Name(), ip, 0, now)
+	s.metrics.count(statCompletion, s.Name(), profileName(p.name), "")
+
+	access := Access{Instance: s.Name(), IP: ip, Profile: p.name, Time: now, nonce: sig}
+	if ip != source {
+		access.Source = source
+	}
+	s.spawn(func() { s.complete(access, p) })
+}
+
+// openDNS binds the listen mode socket or opens the tap.
+func (s *Server) openDNS() (net.PacketConn, knockSource, error) {
+	if s.cfg.DNS.Mode == DNSModeTap {
+		src, err := openPacketSource(s.cfg.DNS.Interface)
+		if err != nil {
+			return nil, nil, fmt.Errorf("dns tap: %w", err)
+		}
+		log.Printf("[%s] Watching DNS queries for knocks under %s", s.Name(), s.cfg.DNS.Zone)
+		return nil, src, nil
+	}
+
+	pc, err := listenPacket(packetNetwork(s.cfg.Family), s.cfg.DNS.Listen)
+	if err != nil {
+		return nil, nil, fmt.Errorf("listening for DNS knocks: %w", err)
+	}
+	log.Printf("[%s] Answering DNS knocks under %s on %s", s.Name(), s.cfg.DNS.Zone, pc.LocalAddr())
+	return pc, nil, nil
+}
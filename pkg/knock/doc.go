@@ -0,0 +1,45 @@
+// Package knock implements the port knocking server: the knock state
+// machine, its listeners and packet sources, sessions, bans and the actions
+// run when a sequence completes.
+//
+// Run serves every instance of a Config until its context is cancelled,
+// which is what the port-knocking command does. Programs embedding a single
+// server build one with New instead:
+//
+//	srv, err := knock.New(knock.Options{
+//		Instance: knock.DefaultInstance(),
+//		OnGranted: func(a knock.Access) {
+//			log.Printf("open for %s until %s", a.IP, a.Expires)
+//		},
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	if err := srv.Start(); err != nil {
+//		return err
+//	}
+//	defer srv.Stop()
+//
+// Actions and Authorizers passed in Options extend what happens on a grant,
+// and the optional DenyHook, FailHook, BanHook, ExpireHook and ExtendHook
+// interfaces let an action see the other outcomes.
+//
+// NewSimulation builds the same server on a manual clock for tests and
+// fuzzers: knocks are injected with Knock or Inject, time moves with
+// Advance, and every outcome has run by the time those return.
+//
+//	sim, _ := knock.NewSimulation(opts, time.Unix(0, 0))
+//	sim.Knock("192.0.2.1", 7000)
+//	sim.Advance(30 * time.Second)
+//	sim.Knock("192.0.2.1", 8000)
+//
+// KnockSequence drives a complete sequence in one call, and a firewall
+// action on a MemoryFirewall records the rules a grant adds and its expiry
+// removes, without root or a real firewall:
+//
+//	fw, mem, _ := knock.NewMemoryFirewallAction("firewall", knock.FirewallConfig{Ports: []int{22}})
+//	opts.Actions = append(opts.Actions, fw)
+//	sim, _ := knock.NewSimulation(opts, time.Unix(0, 0))
+//	sim.KnockSequence("192.0.2.1", sim.Sequence(""), time.Second)
+//	granted := mem.Allowed("192.0.2.1", 22)
+package knock
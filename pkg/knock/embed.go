@@ -0,0 +1,123 @@
+package knock
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// Options configures a standalone Server built by New.
+type Options struct {
+	// Sequence, ports and behaviour of the server, DefaultInstance is a
+	// starting point. Name defaults to "default".
+	Instance InstanceConfig
+	Sessions SessionConfig
+
+	// Run or consulted after those Instance names, which must be among them
+	Actions  []Action
+	Policies []Authorizer
+
+	// Called as outcomes happen, alongside the actions, so they should not
+	// block. Any may be nil.
+	OnGranted func(access Access)
+	OnDenied  func(access Access, reason string)
+	OnFailed  func(access Access, reason string)
+	OnBanned  func(access Access, until time.Time)
+	OnExpired func(access Access)
+
+	// Receives knock events with their ip, port, step and profile as
+	// attributes, slog.Default() when nil
+	Logger *slog.Logger
+}
+
+// New creates a Server from opts for programs embedding port knocking,
+// rather than running every instance of a Config with Run. The server
+// expires its own sessions between Start and Stop.
+func New(opts Options) (*Server, error) {
+	cfg := opts.Instance
+	if cfg.Name == "" {
+		cfg.Name = "default"
+	}
+	if err := normalizeInstance(&cfg); err != nil {
+		return nil, err
+	}
+
+	reg := NewRegistry(opts.Sessions, nil)
+	reg.logger = opts.Logger
+	cfg.Actions = slices.Clone(cfg.Actions)
+	cfg.Policies = slices.Clone(cfg.Policies)
+
+	actions := opts.Actions
+	if cb := (callbacks{opts}); cb.any() {
+		actions = append(slices.Clip(actions), cb)
+	}
+	for _, a := range actions {
+		if err := reg.AddAction(a); err != nil {
+			return nil, err
+		}
+		cfg.Actions = append(cfg.Actions, a.Name())
+	}
+	for _, p := range opts.Policies {
+		if err := reg.AddPolicy(p); err != nil {
+			return nil, err
+		}
+		cfg.Policies = append(cfg.Policies, p.Name())
+	}
+
+	s, err := NewServer(cfg, reg)
+	if err != nil {
+		return nil, err
+	}
+	s.expireSessions = true
+	return s, nil
+}
+
+// callbacks is the action running the event callbacks of Options.
+type callbacks struct {
+	opts Options
+}
+
+func (c callbacks) any() bool {
+	return c.opts.OnGranted != nil || c.opts.OnDenied != nil || c.opts.OnFailed != nil ||
+		c.opts.OnBanned != nil || c.opts.OnExpired != nil
+}
+
+func (callbacks) Name() string {
+	return "callbacks"
+}
+
+func (c callbacks) OnGranted(ctx context.Context, access Access) error {
+	if c.opts.OnGranted != nil {
+		c.opts.OnGranted(access)
+	}
+	return nil
+}
+
+func (c callbacks) OnDenied(ctx context.Context, access Access, reason string) error {
+	if c.opts.OnDenied != nil {
+		c.opts.OnDenied(access, reason)
+	}
+	return nil
+}
+
+func (c callbacks) OnFailed(ctx context.Context, access Access, reason string) error {
+	if c.opts.OnFailed != nil {
+		c.opts.OnFailed(access, reason)
+	}
+	return nil
+}
+
+func (c callbacks) OnBanned(ctx context.Context, access Access, until time.Time) error {
+	if c.opts.OnBanned != nil {
+		c.opts.OnBanned(access, until)
+	}
+	return nil
+}
+
+func (c callbacks) OnExpired(ctx context.Context, access Access) error {
+	if c.opts.OnExpired != nil {
+		c.opts.OnExpired(access)
+	}
+	return nil
+}
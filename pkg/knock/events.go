@@ -0,0 +1,83 @@
+package knock
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const recentEventsSize = 200
+
+// RecentEvent is an outcome kept in memory for status views.
+type RecentEvent struct {
+	Time time.Time `json:"time"`
+	WebhookEvent
+}
+
+// EventLog remembers the latest outcomes of every instance. Like the log
+// action, every instance runs it.
+type EventLog struct {
+	events []RecentEvent // Ring buffer, next is the oldest once full
+	next   int
+	mutex  sync.Mutex
+}
+
+func NewEventLog() *EventLog {
+	return &EventLog{events: make([]RecentEvent, 0, recentEventsSize)}
+}
+
+func (l *EventLog) Name() string {
+	return "events"
+}
+
+func (l *EventLog) OnGranted(ctx context.Context, access Access) error {
+	l.add(WebhookEvent{Event: EventGrant, Access: access})
+	return nil
+}
+
+func (l *EventLog) OnDenied(ctx context.Context, access Access, reason string) error {
+	l.add(WebhookEvent{Event: EventDeny, Access: access, Reason: reason})
+	return nil
+}
+
+func (l *EventLog) OnFailed(ctx context.Context, access Access, reason string) error {
+	l.add(WebhookEvent{Event: EventFail, Access: access, Reason: reason})
+	return nil
+}
+
+func (l *EventLog) OnBanned(ctx context.Context, access Access, until time.Time) error {
+	l.add(WebhookEvent{Event: EventBan, Access: access, Until: until})
+	return nil
+}
+
+func (l *EventLog) OnExpired(ctx context.Context, access Access) error {
+	l.add(WebhookEvent{Event: EventExpire, Access: access})
+	return nil
+}
+
+func (l *EventLog) add(event WebhookEvent) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	e := RecentEvent{Time: time.Now(), WebhookEvent: event}
+	if len(l.events) < recentEventsSize {
+		l.events = append(l.events, e)
+		return
+	}
+	l.events[l.next] = e
+	l.next = (l.next + 1) % recentEventsSize
+}
+
+// Recent returns up to limit events, newest first.
+func (l *EventLog) Recent(limit int) []RecentEvent {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	n := min(limit, len(l.events))
+	recent := make([]RecentEvent, 0, n)
+	for i := range n {
+		idx := (l.next - 1 - i + 2*len(l.events)) % len(l.events)
+		recent = append(recent, l.events[idx])
+	}
+	return recent
+}
@@ -0,0 +1,299 @@
+package knock
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultFeedRefresh = time.Hour
+	defaultFeedTimeout = 30 * time.Second
+	maxFeedSize        = 64 << 20
+)
+
+const (
+	BlocklistReject = "reject" // Drop knocks from listed sources (default)
+	BlocklistFlag   = "flag"   // Log knocks from listed sources and count them as usual
+)
+
+// FeedConfig is a named IP blocklist fetched periodically, e.g. Spamhaus
+// DROP or an AbuseIPDB blacklist export. Lines hold an address or CIDR
+// followed by anything, or a JSON object with a cidr, ip or ipAddress field;
+// "#" and ";" start comments.
+type FeedConfig struct {
+	URL     string            `json:"url"`     // http(s) URL, or the path of a local list
+	Headers map[string]string `json:"headers"` // Extra request headers, e.g. the AbuseIPDB Key
+	Refresh Duration          `json:"refresh"` // How often the list is fetched, 1h when zero
+	Timeout Duration          `json:"timeout"` // Per fetch, 30s when zero
+	Cache   string            `json:"cache"`   // Keeps the last list, used until a fetch succeeds
+}
+
+// prefixSet holds a list's prefixes by length, so a lookup costs one map
+// access per distinct length.
+type prefixSet struct {
+	prefixes map[netip.Prefix]struct{}
+	bits4    []int
+	bits6    []int
+}
+
+func newPrefixSet(prefixes []netip.Prefix) *prefixSet {
+	s := &prefixSet{prefixes: make(map[netip.Prefix]struct{}, len(prefixes))}
+	for _, p := range prefixes {
+		s.prefixes[p] = struct{}{}
+
+		bits := &s.bits6
+		if p.Addr().Is4() {
+			bits = &s.bits4
+		}
+		if !slices.Contains(*bits, p.Bits()) {
+			*bits = append(*bits, p.Bits())
+		}
+	}
+	return s
+}
+
+func (s *prefixSet) contains(addr netip.Addr) bool {
+	bits := s.bits6
+	if addr.Is4() {
+		bits = s.bits4
+	}
+	for _, b := range bits {
+		p, _ := addr.Prefix(b)
+		if _, ok := s.prefixes[p]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Feed is a blocklist kept up to date in the background. Lookups see the
+// last list fetched successfully.
+type Feed struct {
+	name   string
+	cfg    FeedConfig
+	remote bool
+	client *http.Client
+	set    atomic.Pointer[prefixSet]
+}
+
+func NewFeed(name string, cfg FeedConfig) (*Feed, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("feed %s: url is required", name)
+	}
+	u, err := url.Parse(cfg.URL)
+	remote := err == nil && (u.Scheme == "http" || u.Scheme == "https")
+	if remote && u.Host == "" {
+		return nil, fmt.Errorf("feed %s: invalid url %q", name, cfg.URL)
+	}
+
+	if cfg.Refresh.Duration == 0 {
+		cfg.Refresh = Duration{defaultFeedRefresh}
+	}
+	if cfg.Timeout.Duration == 0 {
+		cfg.Timeout = Duration{defaultFeedTimeout}
+	}
+
+	f := &Feed{
+		name:   name,
+		cfg:    cfg,
+		remote: remote,
+		client: &http.Client{Timeout: cfg.Timeout.Duration},
+	}
+	f.set.Store(newPrefixSet(nil))
+	return f, nil
+}
+
+func (f *Feed) Name() string {
+	return f.name
+}
+
+// Contains reports whether ip is on the list.
+func (f *Feed) Contains(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	return f.set.Load().contains(addr.Unmap())
+}
+
+// Len returns the number of entries on the list.
+func (f *Feed) Len() int {
+	return len(f.set.Load().prefixes)
+}
+
+// LoadCache reads the list kept by the last successful fetch, if any.
+func (f *Feed) LoadCache() error {
+	if f.cfg.Cache == "" {
+		return nil
+	}
+	data, err := os.ReadFile(f.cfg.Cache)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("feed %s: reading cache: %w", f.name, err)
+	}
+
+	prefixes, err := parseFeed(data)
+	if err != nil {
+		return fmt.Errorf("feed %s: cache %s: %w", f.name, f.cfg.Cache, err)
+	}
+	f.set.Store(newPrefixSet(prefixes))
+	log.Printf("Blocklist %s: %d entries from cache", f.name, len(prefixes))
+	return nil
+}
+
+// Fetch replaces the list with a fresh copy. A failed fetch, or one that
+// yields no entries, keeps the current list.
+func (f *Feed) Fetch(ctx context.Context) error {
+	data, err := f.download(ctx)
+	if err != nil {
+		return err
+	}
+	prefixes, err := parseFeed(data)
+	if err != nil {
+		return err
+	}
+	f.set.Store(newPrefixSet(prefixes))
+
+	if f.cfg.Cache != "" {
+		// Write then rename so a crash never leaves a truncated file
+		tmp := f.cfg.Cache + ".tmp"
+		if err := os.WriteFile(tmp, data, 0o600); err != nil {
+			return fmt.Errorf("writing cache: %w", err)
+		}
+		if err := os.Rename(tmp, f.cfg.Cache); err != nil {
+			return fmt.Errorf("writing cache: %w", err)
+		}
+	}
+	return nil
+}
+
+func (f *Feed) download(ctx context.Context) ([]byte, error) {
+	if !f.remote {
+		return os.ReadFile(f.cfg.URL)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.cfg.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range f.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxFeedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxFeedSize {
+		return nil, fmt.Errorf("list exceeds %d bytes", maxFeedSize)
+	}
+	return data, nil
+}
+
+// Run fetches the list right away, then every refresh interval until stop
+// is closed.
+func (f *Feed) Run(stop <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	ticker := time.NewTicker(f.cfg.Refresh.Duration)
+	defer ticker.Stop()
+
+	for {
+		before := f.Len()
+		if err := f.Fetch(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Failed to fetch blocklist %s: %v", f.name, err)
+		} else if after := f.Len(); after != before {
+			log.Printf("Blocklist %s: %d entries", f.name, after)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// parseFeed reads every address and CIDR of a list. Lines that hold
+// neither are skipped; a list without a single entry is an error, since it
+// is more likely an error page than an empty blocklist.
+func parseFeed(data []byte) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(make([]byte, 0, 64<<10), 1<<20)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+
+		var entry string
+		if line[0] == '{' {
+			var obj struct {
+				CIDR      string `json:"cidr"`
+				IP        string `json:"ip"`
+				IPAddress string `json:"ipAddress"`
+			}
+			if json.Unmarshal([]byte(line), &obj) != nil {
+				continue
+			}
+			entry = cmp.Or(obj.CIDR, obj.IP, obj.IPAddress)
+		} else {
+			line, _, _ = strings.Cut(line, "#")
+			line, _, _ = strings.Cut(line, ";")
+			fields := strings.FieldsFunc(line, func(r rune) bool {
+				return r == ',' || r == ' ' || r == '\t'
+			})
+			if len(fields) > 0 {
+				entry = fields[0]
+			}
+		}
+
+		if p, err := parsePrefix(entry); err == nil {
+			prefixes = append(prefixes, p)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(prefixes) == 0 {
+		return nil, errors.New("list holds no addresses")
+	}
+	return prefixes, nil
+}
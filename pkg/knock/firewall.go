@@ -0,0 +1,274 @@
+package knock
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/netip"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	firewallTimeout = 10 * time.Second
+
+	// firewallTagPrefix marks every rule this server creates so stale rules
+	// can be found and removed.
+	firewallTagPrefix = "knock:"
+)
+
+// FirewallConfig is a named firewall action opening Ports to granted clients.
+type FirewallConfig struct {
+	Backend  string `json:"backend"`  // "iptables", "ipset", "nftables", "pf", "firewalld", "aws", "gcp", or "memory" for tests
+	Ports    []int  `json:"ports"`    // Target service ports to open, optional for pf
+	Protocol string `json:"protocol"` // "tcp" (default) or "udp"
+	Chain    string `json:"chain"`    // iptables or ipset chain, INPUT by default
+	Docker   bool   `json:"docker"`   // iptables: gate published container ports in DOCKER-USER
+	Table    string `json:"table"`    // nftables or pf table, or ipset set name, derived from the name by default
+	Zone     string `json:"zone"`     // firewalld zone, the default zone when empty
+
+	// Cloud provider firewalls, for bastions whose host firewall is not the gate
+	AWS AWSFirewallConfig `json:"aws"` // Security group of the "aws" backend
+	GCP GCPFirewallConfig `json:"gcp"` // Project and network of the "gcp" backend
+}
+
+// FirewallRule opens one port for one client address.
+type FirewallRule struct {
+	IP       netip.Addr
+	Port     int
+	Protocol string
+	Tag      string
+	Expires  time.Time      // Zero when the rule does not expire by itself
+	Forward  netip.AddrPort // Where Port is DNATed to, zero when it is opened on this host
+}
+
+// Firewall is a backend able to add and remove tagged allow rules.
+type Firewall interface {
+	Allow(ctx context.Context, rule FirewallRule) error
+	Remove(ctx context.Context, rule FirewallRule) error
+	// Reset removes every rule created by this server and prepares the
+	// backend for new ones.
+	Reset(ctx context.Context) error
+	// Check reports whether the backend can be reached, changing nothing.
+	Check(ctx context.Context) error
+}
+
+// FirewallAction opens the configured ports on grant and closes them when the session ends.
+type FirewallAction struct {
+	name string
+	cfg  FirewallConfig
+	fw   Firewall
+}
+
+func NewFirewallAction(name string, cfg FirewallConfig) (*FirewallAction, error) {
+	if len(cfg.Ports) == 0 && cfg.Backend != "pf" {
+		return nil, fmt.Errorf("firewall %s: no ports configured", name)
+	}
+	switch cfg.Protocol {
+	case "":
+		cfg.Protocol = "tcp"
+	case "tcp", "udp":
+	default:
+		return nil, fmt.Errorf("firewall %s: unknown protocol %q", name, cfg.Protocol)
+	}
+
+	var (
+		fw  Firewall
+		err error
+	)
+	switch cfg.Backend {
+	case "iptables":
+		fw = newIptables(name, cfg)
+	case "ipset":
+		fw = newIpset(name, cfg)
+	case "nftables":
+		fw = newNftables(name, cfg)
+	case "pf":
+		fw = newPf(name, cfg)
+	case "firewalld":
+		fw = newFirewalld(cfg)
+	case "aws":
+		fw, err = newAWSSecurityGroup(name, cfg.AWS)
+	case "gcp":
+		fw, err = newGCPFirewall(name, cfg.GCP)
+	case "memory":
+		fw = NewMemoryFirewall()
+	default:
+		return nil, fmt.Errorf("firewall %s: unknown backend %q", name, cfg.Backend)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &FirewallAction{name: name, cfg: cfg, fw: fw}, nil
+}
+
+func (f *FirewallAction) Name() string {
+	return f.name
+}
+
+func (f *FirewallAction) OnGranted(ctx context.Context, access Access) error {
+	return f.apply(ctx, access, f.fw.Allow)
+}
+
+func (f *FirewallAction) OnExpired(ctx context.Context, access Access) error {
+	return f.apply(ctx, access, f.fw.Remove)
+}
+
+// OnExtended replaces the rules so backends expiring them on their own pick
+// up the new expiry. pf tables keep addresses until removed.
+func (f *FirewallAction) OnExtended(ctx context.Context, access Access) error {
+	if f.cfg.Backend == "pf" {
+		return nil
+	}
+	if err := f.apply(ctx, access, f.fw.Remove); err != nil {
+		return err
+	}
+	return f.apply(ctx, access, f.fw.Allow)
+}
+
+// Reset removes rules left behind by a previous run.
+func (f *FirewallAction) Reset(ctx context.Context) error {
+	return f.fw.Reset(ctx)
+}
+
+// CheckHealth reports whether the firewall backend is reachable.
+func (f *FirewallAction) CheckHealth(ctx context.Context) error {
+	if err := f.fw.Check(ctx); err != nil {
+		return fmt.Errorf("firewall %s: %w", f.name, err)
+	}
+	return nil
+}
+
+func (f *FirewallAction) apply(ctx context.Context, access Access, op func(context.Context, FirewallRule) error) error {
+	ip, err := netip.ParseAddr(access.IP)
+	if err != nil {
+		return err
+	}
+
+	ip = ip.Unmap()
+
+	ports := f.cfg.Ports
+	if len(access.Ports) > 0 {
+		ports = access.Ports
+	}
+	if len(ports) == 0 || f.cfg.Backend == "pf" {
+		// One table entry per address, whatever the ports
+		ports = []int{0}
+	}
+	protocol := f.cfg.Protocol
+	if access.Protocol != "" && access.Protocol != protocol {
+		// These write the protocol into their base rules once
+		if f.cfg.Backend == "nftables" || f.cfg.Backend == "pf" || f.cfg.Docker {
+			return fmt.Errorf("firewall %s: opens %s only, not %s", f.name, protocol, access.Protocol)
+		}
+		protocol = access.Protocol
+	}
+
+	var to netip.AddrPort
+	if access.Forward != "" {
+		if f.cfg.Backend != "iptables" && f.cfg.Backend != "memory" || f.cfg.Docker {
+			return fmt.Errorf("firewall %s: only the iptables backend outside Docker mode forwards ports", f.name)
+		}
+		if to, err = parseForward(access.Forward); err != nil {
+			return err
+		}
+		if to.Addr().Is4() != ip.Is4() {
+			return fmt.Errorf("firewall %s: cannot forward %s to %s", f.name, ip, to.Addr())
+		}
+	}
+
+	for _, port := range ports {
+		rule := FirewallRule{
+			IP:       ip,
+			Port:     port,
+			Protocol: protocol,
+			Tag:      firewallTagPrefix + access.Instance,
+			Expires:  access.Expires,
+		}
+		if to.IsValid() {
+			rule.Forward = to
+			if to.Port() == 0 {
+				rule.Forward = netip.AddrPortFrom(to.Addr(), uint16(port))
+			}
+		}
+		if err := op(ctx, rule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runCommand runs a firewall tool, returning its output or its stderr as the error.
+func runCommand(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return runCommandInput(ctx, nil, name, args...)
+}
+
+func runCommandInput(ctx context.Context, input []byte, name string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, firewallTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s %s: %w: %s", name, strings.Join(args, " "), err, msg)
+		}
+		return nil, fmt.Errorf("%s %s: %w", name, strings.Join(args, " "), err)
+	}
+	return stdout.Bytes(), nil
+}
+
+// entryGrants counts the grants holding each entry of a backend whose
+// entries overlapping sessions share, such as a set element or a rich rule,
+// so the entry is removed with the last of them. Entries that expire on
+// their own keep the latest expiry among their grants. Callers hold the
+// backend's lock.
+type entryGrants map[string]entryGrant
+
+type entryGrant struct {
+	count   int
+	expires time.Time // Zero once a grant does not expire
+}
+
+// needs returns the expiry a grant until expires leaves the entry with, and
+// whether the backend must apply it: for the first grant, or one outlasting
+// the others.
+func (g entryGrants) needs(key string, expires time.Time) (time.Time, bool) {
+	e, ok := g[key]
+	switch {
+	case !ok:
+		return expires, true
+	case e.expires.IsZero():
+		return e.expires, false
+	case expires.IsZero() || expires.After(e.expires):
+		return expires, true
+	}
+	return e.expires, false
+}
+
+// add counts a grant of key, applied until expires as needs returned.
+func (g entryGrants) add(key string, expires time.Time) {
+	e := g[key]
+	e.count++
+	e.expires = expires
+	g[key] = e
+}
+
+// release drops a grant of key, reporting whether it was the last one and
+// the entry must go. Entries not counted, left by a previous run, are
+// released at once. Callers delete the key once the entry is removed.
+func (g entryGrants) release(key string) bool {
+	e, ok := g[key]
+	if ok && e.count > 1 {
+		e.count--
+		g[key] = e
+		return false
+	}
+	return true
+}
@@ -0,0 +1,472 @@
+package knock
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	awsEC2Version = "2016-11-15"
+	awsIMDS       = "http://169.254.169.254"
+	awsIMDSTTL    = "21600"
+)
+
+// AWSFirewallConfig points the "aws" backend at a security group. Without
+// keys, credentials come from the environment, the task or pod role of the
+// container endpoint, or the instance role through IMDSv2. Throttled and
+// failed API calls are retried with backoff.
+type AWSFirewallConfig struct {
+	Region          string `json:"region"`
+	SecurityGroup   string `json:"security_group"`    // Group ID, e.g. sg-0123456789abcdef0
+	AccessKeyID     string `json:"access_key_id"`     // AWS_ACCESS_KEY_ID when empty
+	SecretAccessKey string `json:"secret_access_key"` // AWS_SECRET_ACCESS_KEY when empty
+	SessionToken    string `json:"session_token"`     // AWS_SESSION_TOKEN when empty
+	Endpoint        string `json:"endpoint"`          // https://ec2.<region>.amazonaws.com when empty
+}
+
+type awsCredentials struct {
+	AccessKeyID     string    `json:"AccessKeyId"`
+	SecretAccessKey string    `json:"SecretAccessKey"`
+	Token           string    `json:"Token"`
+	Expiration      time.Time `json:"Expiration"`
+}
+
+// awsSecurityGroup adds an ingress permission per rule to a security group
+// through the EC2 API. Permissions carry the rule tag as their description,
+// which is how Reset finds the ones left by a previous run. Overlapping
+// grants of a client and port share a permission, revoked with the last.
+type awsSecurityGroup struct {
+	cfg    AWSFirewallConfig
+	client *http.Client
+
+	creds awsCredentials
+	mutex sync.Mutex
+
+	grants     entryGrants
+	grantMutex sync.Mutex
+}
+
+func newAWSSecurityGroup(name string, cfg AWSFirewallConfig) (*awsSecurityGroup, error) {
+	if cfg.Region == "" || cfg.SecurityGroup == "" {
+		return nil, fmt.Errorf("firewall %s: aws needs a region and a security_group", name)
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = "https://ec2." + cfg.Region + ".amazonaws.com"
+	}
+	return &awsSecurityGroup{cfg: cfg, client: &http.Client{Timeout: firewallTimeout}, grants: make(entryGrants)}, nil
+}
+
+func (a *awsSecurityGroup) Allow(ctx context.Context, rule FirewallRule) error {
+	a.grantMutex.Lock()
+	defer a.grantMutex.Unlock()
+
+	key := a.permission(rule).Encode()
+	if _, held := a.grants[key]; !held {
+		if err := a.authorize(ctx, rule); err != nil {
+			return err
+		}
+	}
+	// Permissions do not expire
+	a.grants.add(key, time.Time{})
+	return nil
+}
+
+func (a *awsSecurityGroup) authorize(ctx context.Context, rule FirewallRule) error {
+	params := a.permission(rule)
+	if rule.IP.Is4() {
+		params.Set("IpPermissions.1.IpRanges.1.Description", rule.Tag)
+	} else {
+		params.Set("IpPermissions.1.Ipv6Ranges.1.Description", rule.Tag)
+	}
+
+	err := a.call(ctx, "AuthorizeSecurityGroupIngress", params, nil)
+	if isAWSError(err, "InvalidPermission.Duplicate") {
+		return nil
+	}
+	return err
+}
+
+// Remove revokes the permission once no other grant holds it.
+func (a *awsSecurityGroup) Remove(ctx context.Context, rule FirewallRule) error {
+	a.grantMutex.Lock()
+	defer a.grantMutex.Unlock()
+
+	key := a.permission(rule).Encode()
+	if !a.grants.release(key) {
+		return nil
+	}
+	err := a.call(ctx, "RevokeSecurityGroupIngress", a.permission(rule), nil)
+	if err != nil && !isAWSError(err, "InvalidPermission.NotFound") {
+		return err
+	}
+	delete(a.grants, key)
+	return nil
+}
+
+// Reset revokes every permission of the group described with the tag prefix.
+func (a *awsSecurityGroup) Reset(ctx context.Context) error {
+	a.grantMutex.Lock()
+	defer a.grantMutex.Unlock()
+
+	clear(a.grants)
+	params := url.Values{"GroupId.1": {a.cfg.SecurityGroup}}
+	var resp struct {
+		Groups []struct {
+			Permissions []struct {
+				Protocol string `xml:"ipProtocol"`
+				FromPort int    `xml:"fromPort"`
+				ToPort   int    `xml:"toPort"`
+				Ranges   []struct {
+					CIDR        string `xml:"cidrIp"`
+					Description string `xml:"description"`
+				} `xml:"ipRanges>item"`
+				Ranges6 []struct {
+					CIDR        string `xml:"cidrIpv6"`
+					Description string `xml:"description"`
+				} `xml:"ipv6Ranges>item"`
+			} `xml:"ipPermissions>item"`
+		} `xml:"securityGroupInfo>item"`
+	}
+	if err := a.call(ctx, "DescribeSecurityGroups", params, &resp); err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, g := range resp.Groups {
+		for _, p := range g.Permissions {
+			revoke := url.Values{
+				"IpPermissions.1.IpProtocol": {p.Protocol},
+				"IpPermissions.1.FromPort":   {strconv.Itoa(p.FromPort)},
+				"IpPermissions.1.ToPort":     {strconv.Itoa(p.ToPort)},
+			}
+			n, n6 := 0, 0
+			for _, r := range p.Ranges {
+				if strings.HasPrefix(r.Description, firewallTagPrefix) {
+					n++
+					revoke.Set(fmt.Sprintf("IpPermissions.1.IpRanges.%d.CidrIp", n), r.CIDR)
+				}
+			}
+			for _, r := range p.Ranges6 {
+				if strings.HasPrefix(r.Description, firewallTagPrefix) {
+					n6++
+					revoke.Set(fmt.Sprintf("IpPermissions.1.Ipv6Ranges.%d.CidrIpv6", n6), r.CIDR)
+				}
+			}
+			if n+n6 == 0 {
+				continue
+			}
+			revoke.Set("GroupId", a.cfg.SecurityGroup)
+			if err := a.call(ctx, "RevokeSecurityGroupIngress", revoke, nil); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Check describes the security group, which needs working credentials and
+// an existing group.
+func (a *awsSecurityGroup) Check(ctx context.Context) error {
+	return a.call(ctx, "DescribeSecurityGroups", url.Values{"GroupId.1": {a.cfg.SecurityGroup}}, nil)
+}
+
+// permission describes rule as the first IpPermissions entry.
+func (a *awsSecurityGroup) permission(rule FirewallRule) url.Values {
+	params := url.Values{
+		"GroupId":                    {a.cfg.SecurityGroup},
+		"IpPermissions.1.IpProtocol": {rule.Protocol},
+		"IpPermissions.1.FromPort":   {strconv.Itoa(rule.Port)},
+		"IpPermissions.1.ToPort":     {strconv.Itoa(rule.Port)},
+	}
+	cidr := rule.IP.String() + "/" + strconv.Itoa(rule.IP.BitLen())
+	if rule.IP.Is4() {
+		params.Set("IpPermissions.1.IpRanges.1.CidrIp", cidr)
+	} else {
+		params.Set("IpPermissions.1.Ipv6Ranges.1.CidrIpv6", cidr)
+	}
+	return params
+}
+
+type awsError struct {
+	Code    string `xml:"Errors>Error>Code"`
+	Message string `xml:"Errors>Error>Message"`
+}
+
+func (e *awsError) Error() string {
+	return "aws: " + e.Code + ": " + e.Message
+}
+
+func isAWSError(err error, code string) bool {
+	var e *awsError
+	return errors.As(err, &e) && e.Code == code
+}
+
+// awsThrottleCodes are the error codes AWS answers throttled requests with,
+// whatever their HTTP status.
+var awsThrottleCodes = map[string]bool{
+	"Throttling":               true,
+	"ThrottlingException":      true,
+	"RequestLimitExceeded":     true,
+	"RequestThrottled":         true,
+	"TooManyRequestsException": true,
+}
+
+// call runs an EC2 Query API action, decoding the XML response into out,
+// retrying it while AWS throttles it.
+func (a *awsSecurityGroup) call(ctx context.Context, action string, params url.Values, out any) error {
+	params.Set("Action", action)
+	params.Set("Version", awsEC2Version)
+	return retryThrottled(ctx, func() error {
+		return a.do(ctx, action, params.Encode(), out)
+	})
+}
+
+func (a *awsSecurityGroup) do(ctx context.Context, action, body string, out any) error {
+	creds, err := a.credentials(ctx)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.cfg.Endpoint+"/", strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	signAWSRequest(req, []byte(body), creds, a.cfg.Region, "ec2", time.Now())
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e awsError
+		if xml.Unmarshal(data, &e) == nil && e.Code != "" {
+			if awsThrottleCodes[e.Code] {
+				return &throttledError{err: &e}
+			}
+			return throttled(&e, resp.StatusCode, resp.Header)
+		}
+		return throttled(fmt.Errorf("aws %s: unexpected status %s", action, resp.Status), resp.StatusCode, resp.Header)
+	}
+	if out != nil {
+		return xml.Unmarshal(data, out)
+	}
+	return nil
+}
+
+// credentials returns the configured keys, the environment's, or those of
+// the container or instance role, refreshed before they expire.
+func (a *awsSecurityGroup) credentials(ctx context.Context) (awsCredentials, error) {
+	if a.cfg.AccessKeyID != "" {
+		return awsCredentials{
+			AccessKeyID:     a.cfg.AccessKeyID,
+			SecretAccessKey: a.cfg.SecretAccessKey,
+			Token:           a.cfg.SessionToken,
+		}, nil
+	}
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return awsCredentials{
+			AccessKeyID:     id,
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			Token:           os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.creds.AccessKeyID != "" && time.Until(a.creds.Expiration) > 5*time.Minute {
+		return a.creds, nil
+	}
+	if awsContainerEndpoint() != "" {
+		creds, err := a.containerCredentials(ctx)
+		if err != nil {
+			return awsCredentials{}, fmt.Errorf("aws container credentials: %w", err)
+		}
+		a.creds = creds
+		return creds, nil
+	}
+	creds, err := a.roleCredentials(ctx)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("aws instance role credentials: %w", err)
+	}
+	a.creds = creds
+	return creds, nil
+}
+
+// awsContainerEndpoint returns the credentials endpoint ECS gives tasks and
+// EKS Pod Identity gives pods, empty outside them.
+func awsContainerEndpoint() string {
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+		return "http://169.254.170.2" + uri
+	}
+	return os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+}
+
+// containerCredentials reads the task or pod role's credentials from the
+// container endpoint, authorized by the token the agent provides, if any.
+func (a *awsSecurityGroup) containerCredentials(ctx context.Context) (awsCredentials, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, awsContainerEndpoint(), nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+	if path := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return awsCredentials{}, err
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+
+	data, err := a.fetch(req)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	var creds awsCredentials
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return awsCredentials{}, err
+	}
+	return creds, nil
+}
+
+// roleCredentials reads the instance role's credentials through IMDSv2.
+func (a *awsSecurityGroup) roleCredentials(ctx context.Context) (awsCredentials, error) {
+	token, err := a.imds(ctx, http.MethodPut, "/latest/api/token", "")
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	role, err := a.imds(ctx, http.MethodGet, "/latest/meta-data/iam/security-credentials/", token)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	role, _, _ = strings.Cut(strings.TrimSpace(role), "\n")
+	data, err := a.imds(ctx, http.MethodGet, "/latest/meta-data/iam/security-credentials/"+role, token)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+
+	var creds awsCredentials
+	if err := json.Unmarshal([]byte(data), &creds); err != nil {
+		return awsCredentials{}, err
+	}
+	return creds, nil
+}
+
+func (a *awsSecurityGroup) imds(ctx context.Context, method, path, token string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, method, awsIMDS+path, nil)
+	if err != nil {
+		return "", err
+	}
+	if token == "" {
+		req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", awsIMDSTTL)
+	} else {
+		req.Header.Set("X-aws-ec2-metadata-token", token)
+	}
+
+	data, err := a.fetch(req)
+	return string(data), err
+}
+
+// fetch reads the answer of a credentials endpoint, which throttles too.
+func (a *awsSecurityGroup) fetch(req *http.Request) ([]byte, error) {
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, throttled(fmt.Errorf("%s: unexpected status %s", req.URL.Path, resp.Status), resp.StatusCode, resp.Header)
+	}
+	return data, nil
+}
+
+// signAWSRequest adds a Signature Version 4 Authorization header to req.
+func signAWSRequest(req *http.Request, body []byte, creds awsCredentials, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.Token)
+	}
+
+	var headers []string
+	if req.Header.Get("Content-Type") != "" {
+		headers = append(headers, "content-type")
+	}
+	headers = append(headers, "host", "x-amz-date")
+	if creds.Token != "" {
+		headers = append(headers, "x-amz-security-token")
+	}
+	var canonicalHeaders strings.Builder
+	for _, h := range headers {
+		v := req.Header.Get(h)
+		if h == "host" {
+			v = req.URL.Host
+		}
+		canonicalHeaders.WriteString(h + ":" + strings.TrimSpace(v) + "\n")
+	}
+	signed := strings.Join(headers, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	bodyHash := sha256.Sum256(body)
+	canonical := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signed,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signed, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,61 @@
+package knock
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	cloudRetries    = 4
+	cloudRetryDelay = 500 * time.Millisecond // Doubled after every throttled attempt
+)
+
+// throttledError is an answer of a cloud API worth retrying: the request
+// was throttled or the service failed. After is the wait the API asked
+// for, zero when it did not say.
+type throttledError struct {
+	err   error
+	after time.Duration
+}
+
+func (e *throttledError) Error() string { return e.err.Error() }
+func (e *throttledError) Unwrap() error { return e.err }
+
+// throttled marks err as retryable when status is 429 or a server error,
+// honouring the Retry-After header of the response.
+func throttled(err error, status int, header http.Header) error {
+	if status != http.StatusTooManyRequests && status < 500 {
+		return err
+	}
+	e := &throttledError{err: err}
+	if s, convErr := strconv.Atoi(header.Get("Retry-After")); convErr == nil && s > 0 {
+		e.after = time.Duration(s) * time.Second
+	}
+	return e
+}
+
+// retryThrottled runs call until it succeeds or fails with anything but a
+// throttledError, backing off with jitter up to cloudRetries times.
+func retryThrottled(ctx context.Context, call func() error) error {
+	delay := cloudRetryDelay
+	for attempt := 0; ; attempt++ {
+		err := call()
+		var t *throttledError
+		if !errors.As(err, &t) || attempt == cloudRetries {
+			return err
+		}
+
+		wait := max(delay, t.after)
+		wait += rand.N(wait / 2)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		delay *= 2
+	}
+}
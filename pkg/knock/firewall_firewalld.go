@@ -0,0 +1,201 @@
+package knock
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	firewalldName      = "org.fedoraproject.FirewallD1"
+	firewalldPath      = "/org/fedoraproject/FirewallD1"
+	firewalldZoneIface = firewalldName + ".zone"
+)
+
+// firewalld adds runtime rich rules through the firewalld D-Bus API, so they
+// show up in firewall-cmd --list-rich-rules. Rules expire with the session,
+// and active rules are added again whenever firewalld reloads.
+//
+// Overlapping grants of a client and port share a rich rule, which keeps
+// the latest expiry among them and is removed with the last grant.
+type firewalld struct {
+	zone string // Empty uses the default zone
+
+	conn   *dbus.Conn
+	grants entryGrants // Active rich rules with their grants and expiry
+	mutex  sync.Mutex
+}
+
+func newFirewalld(cfg FirewallConfig) *firewalld {
+	return &firewalld{zone: cfg.Zone, grants: make(entryGrants)}
+}
+
+func (f *firewalld) Allow(ctx context.Context, rule FirewallRule) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	rich := richRule(rule)
+	expires, apply := f.grants.needs(rich, rule.Expires)
+	if apply {
+		// firewalld refuses a rule already there, so one that must last
+		// longer is replaced
+		if _, ok := f.grants[rich]; ok {
+			if err := f.removeLocked(ctx, rich); err != nil {
+				return err
+			}
+		}
+		if err := f.addLocked(ctx, rich, expires); err != nil {
+			return err
+		}
+	}
+	f.grants.add(rich, expires)
+	return nil
+}
+
+// Remove deletes the rich rule once no other grant holds it.
+func (f *firewalld) Remove(ctx context.Context, rule FirewallRule) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	rich := richRule(rule)
+	if !f.grants.release(rich) {
+		return nil
+	}
+	if err := f.removeLocked(ctx, rich); err != nil {
+		return err
+	}
+	delete(f.grants, rich)
+	return nil
+}
+
+func (f *firewalld) removeLocked(ctx context.Context, rich string) error {
+	conn, err := f.connectLocked()
+	if err != nil {
+		return err
+	}
+
+	err = conn.Object(firewalldName, firewalldPath).
+		CallWithContext(ctx, firewalldZoneIface+".removeRichRule", 0, f.zone, rich).Err
+	// The rule may already have timed out
+	if err != nil && strings.Contains(err.Error(), "NOT_ENABLED") {
+		return nil
+	}
+	return err
+}
+
+// Reset connects to firewalld. Rules from a previous run expire on their own.
+func (f *firewalld) Reset(ctx context.Context) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	_, err := f.connectLocked()
+	return err
+}
+
+// Check pings firewalld over the bus.
+func (f *firewalld) Check(ctx context.Context) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	conn, err := f.connectLocked()
+	if err != nil {
+		return err
+	}
+	return conn.Object(firewalldName, firewalldPath).
+		CallWithContext(ctx, "org.freedesktop.DBus.Peer.Ping", 0).Err
+}
+
+func (f *firewalld) addLocked(ctx context.Context, rich string, expires time.Time) error {
+	conn, err := f.connectLocked()
+	if err != nil {
+		return err
+	}
+
+	timeout := 0
+	if !expires.IsZero() {
+		if timeout = int(math.Ceil(time.Until(expires).Seconds())); timeout < 1 {
+			return nil
+		}
+	}
+
+	return conn.Object(firewalldName, firewalldPath).
+		CallWithContext(ctx, firewalldZoneIface+".addRichRule", 0, f.zone, rich, int32(timeout)).Err
+}
+
+// pingFirewalld checks firewalld answers on the system bus, on a connection
+// of its own.
+func pingFirewalld(ctx context.Context) error {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return fmt.Errorf("firewalld: %w", err)
+	}
+	defer conn.Close()
+	return conn.Object(firewalldName, firewalldPath).
+		CallWithContext(ctx, "org.freedesktop.DBus.Peer.Ping", 0).Err
+}
+
+// connectLocked opens the system bus once and starts watching for reloads.
+func (f *firewalld) connectLocked() (*dbus.Conn, error) {
+	if f.conn != nil {
+		return f.conn, nil
+	}
+
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return nil, fmt.Errorf("firewalld: %w", err)
+	}
+
+	err = conn.AddMatchSignal(
+		dbus.WithMatchInterface(firewalldName),
+		dbus.WithMatchMember("Reloaded"),
+	)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("firewalld: %w", err)
+	}
+
+	signals := make(chan *dbus.Signal, 8)
+	conn.Signal(signals)
+	go f.watch(signals)
+
+	f.conn = conn
+	return conn, nil
+}
+
+// watch restores the active rules, which firewalld drops on every reload.
+func (f *firewalld) watch(signals <-chan *dbus.Signal) {
+	for sig := range signals {
+		if sig.Name != firewalldName+".Reloaded" {
+			continue
+		}
+
+		f.mutex.Lock()
+		now := time.Now()
+		for rich, g := range f.grants {
+			if !g.expires.IsZero() && !now.Before(g.expires) {
+				delete(f.grants, rich)
+				continue
+			}
+			if err := f.addLocked(context.Background(), rich, g.expires); err != nil {
+				log.Printf("Restoring firewalld rule %q after reload failed: %v", rich, err)
+			}
+		}
+		log.Printf("Restored %d firewalld rule(s) after reload", len(f.grants))
+		f.mutex.Unlock()
+	}
+}
+
+func richRule(rule FirewallRule) string {
+	family := "ipv4"
+	if rule.IP.Is6() {
+		family = "ipv6"
+	}
+	return fmt.Sprintf(`rule family="%s" source address="%s" port port="%d" protocol="%s" accept`,
+		family, rule.IP, rule.Port, rule.Protocol)
+}
@@ -0,0 +1,426 @@
+package knock
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	gcpComputeScope = "https://www.googleapis.com/auth/compute"
+	gcpMetadataHost = "metadata.google.internal"
+	gcpMetadataPath = "/computeMetadata/v1/instance/service-accounts/default/token"
+	gcpDefaultTTL   = time.Hour
+)
+
+// GCPFirewallConfig points the "gcp" backend at a VPC network. Without a
+// credentials file, GOOGLE_APPLICATION_CREDENTIALS or the service account of
+// the metadata server is used: the instance's, or the one Workload Identity
+// maps the pod to on GKE. Rate limited and failed API calls are retried
+// with backoff.
+type GCPFirewallConfig struct {
+	Project     string   `json:"project"`
+	Network     string   `json:"network"`     // VPC network, "default" when empty
+	TargetTags  []string `json:"target_tags"` // Instances the rules apply to, the whole network when empty
+	Priority    int      `json:"priority"`    // Rule priority, 1000 when zero
+	RulePrefix  string   `json:"rule_prefix"` // Name prefix of the rules created, derived from the action name when empty
+	Credentials string   `json:"credentials"` // Service account key file
+	Endpoint    string   `json:"endpoint"`    // https://compute.googleapis.com when empty
+	TokenURL    string   `json:"token_url"`   // Overrides the key file's token_uri
+}
+
+type gcpServiceAccount struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// gcpFirewall creates one firewall rule per client and port, named after
+// both so Remove finds it again, and deletes the rules under its prefix on
+// Reset. Overlapping grants of a client and port share a rule, deleted with
+// the last.
+type gcpFirewall struct {
+	cfg    GCPFirewallConfig
+	client *http.Client
+
+	grants     entryGrants
+	grantMutex sync.Mutex
+
+	account *gcpServiceAccount // Nil when tokens come from the metadata server
+	key     *rsa.PrivateKey
+	token   string
+	expires time.Time
+	mutex   sync.Mutex
+}
+
+func newGCPFirewall(name string, cfg GCPFirewallConfig) (*gcpFirewall, error) {
+	if cfg.Project == "" {
+		return nil, fmt.Errorf("firewall %s: gcp needs a project", name)
+	}
+	if cfg.Network == "" {
+		cfg.Network = "default"
+	}
+	if cfg.Priority == 0 {
+		cfg.Priority = 1000
+	}
+	if cfg.RulePrefix == "" {
+		cfg.RulePrefix = "knock-" + gcpName(name)
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = "https://compute.googleapis.com"
+	}
+	if cfg.Credentials == "" {
+		cfg.Credentials = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+
+	g := &gcpFirewall{cfg: cfg, client: &http.Client{Timeout: firewallTimeout}, grants: make(entryGrants)}
+	if cfg.Credentials != "" {
+		if err := g.loadAccount(cfg.Credentials); err != nil {
+			return nil, fmt.Errorf("firewall %s: %w", name, err)
+		}
+	}
+	return g, nil
+}
+
+// gcpName lower-cases s and keeps what firewall rule names allow.
+func gcpName(s string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(s) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+		} else {
+			b.WriteByte('-')
+		}
+	}
+	return strings.Trim(b.String(), "-")
+}
+
+func (g *gcpFirewall) loadAccount(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var account gcpServiceAccount
+	if err := json.Unmarshal(data, &account); err != nil {
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	block, _ := pem.Decode([]byte(account.PrivateKey))
+	if block == nil {
+		return fmt.Errorf("%s: no private key", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return fmt.Errorf("%s: private key is not RSA", path)
+	}
+
+	if g.cfg.TokenURL != "" {
+		account.TokenURI = g.cfg.TokenURL
+	}
+	g.account, g.key = &account, key
+	return nil
+}
+
+// ruleName identifies the rule opening port to ip, at most 63 characters.
+func (g *gcpFirewall) ruleName(rule FirewallRule) string {
+	sum := sha256.Sum256([]byte(rule.Tag + "|" + rule.IP.String() + "|" + rule.Protocol + "|" + strconv.Itoa(rule.Port)))
+	prefix := g.cfg.RulePrefix
+	if len(prefix) > 46 {
+		prefix = prefix[:46]
+	}
+	return prefix + "-" + hex.EncodeToString(sum[:8])
+}
+
+func (g *gcpFirewall) firewallsURL() string {
+	return g.cfg.Endpoint + "/compute/v1/projects/" + url.PathEscape(g.cfg.Project) + "/global/firewalls"
+}
+
+func (g *gcpFirewall) Allow(ctx context.Context, rule FirewallRule) error {
+	g.grantMutex.Lock()
+	defer g.grantMutex.Unlock()
+
+	name := g.ruleName(rule)
+	if _, held := g.grants[name]; !held {
+		if err := g.create(ctx, rule); err != nil {
+			return err
+		}
+	}
+	// Rules do not expire
+	g.grants.add(name, time.Time{})
+	return nil
+}
+
+func (g *gcpFirewall) create(ctx context.Context, rule FirewallRule) error {
+	allowed := map[string]any{"IPProtocol": rule.Protocol}
+	if rule.Port != 0 {
+		allowed["ports"] = []string{strconv.Itoa(rule.Port)}
+	}
+	body := map[string]any{
+		"name":         g.ruleName(rule),
+		"description":  rule.Tag,
+		"network":      "projects/" + g.cfg.Project + "/global/networks/" + g.cfg.Network,
+		"direction":    "INGRESS",
+		"priority":     g.cfg.Priority,
+		"sourceRanges": []string{rule.IP.String() + "/" + strconv.Itoa(rule.IP.BitLen())},
+		"allowed":      []any{allowed},
+	}
+	if len(g.cfg.TargetTags) > 0 {
+		body["targetTags"] = g.cfg.TargetTags
+	}
+
+	status, err := g.call(ctx, http.MethodPost, g.firewallsURL(), body, nil)
+	if status == http.StatusConflict {
+		return nil
+	}
+	return err
+}
+
+// Remove deletes the rule once no other grant holds it.
+func (g *gcpFirewall) Remove(ctx context.Context, rule FirewallRule) error {
+	g.grantMutex.Lock()
+	defer g.grantMutex.Unlock()
+
+	name := g.ruleName(rule)
+	if !g.grants.release(name) {
+		return nil
+	}
+	status, err := g.call(ctx, http.MethodDelete, g.firewallsURL()+"/"+name, nil, nil)
+	if err != nil && status != http.StatusNotFound {
+		return err
+	}
+	delete(g.grants, name)
+	return nil
+}
+
+// Reset deletes every rule under the prefix left by a previous run.
+func (g *gcpFirewall) Reset(ctx context.Context) error {
+	g.grantMutex.Lock()
+	defer g.grantMutex.Unlock()
+
+	clear(g.grants)
+	var errs []error
+	pageToken := ""
+	for {
+		u := g.firewallsURL() + "?filter=" + url.QueryEscape(`name eq "`+g.cfg.RulePrefix+`-.*"`)
+		if pageToken != "" {
+			u += "&pageToken=" + url.QueryEscape(pageToken)
+		}
+
+		var list struct {
+			Items []struct {
+				Name string `json:"name"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		if _, err := g.call(ctx, http.MethodGet, u, nil, &list); err != nil {
+			return err
+		}
+		for _, item := range list.Items {
+			if !strings.HasPrefix(item.Name, g.cfg.RulePrefix+"-") {
+				continue
+			}
+			status, err := g.call(ctx, http.MethodDelete, g.firewallsURL()+"/"+item.Name, nil, nil)
+			if err != nil && status != http.StatusNotFound {
+				errs = append(errs, err)
+			}
+		}
+
+		if pageToken = list.NextPageToken; pageToken == "" {
+			return errors.Join(errs...)
+		}
+	}
+}
+
+// Check lists one firewall rule of the project, which needs a token and
+// access to the project.
+func (g *gcpFirewall) Check(ctx context.Context) error {
+	_, err := g.call(ctx, http.MethodGet, g.firewallsURL()+"?maxResults=1", nil, nil)
+	return err
+}
+
+// call sends a Compute API request, retrying it while GCP rate limits it,
+// and returns the status of the last answer. Operations are not waited
+// for; GCP applies them within seconds.
+func (g *gcpFirewall) call(ctx context.Context, method, u string, in, out any) (int, error) {
+	var status int
+	err := retryThrottled(ctx, func() error {
+		var err error
+		status, err = g.do(ctx, method, u, in, out)
+		return err
+	})
+	return status, err
+}
+
+func (g *gcpFirewall) do(ctx context.Context, method, u string, in, out any) (int, error) {
+	token, err := g.accessToken(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return 0, err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if resp.StatusCode/100 != 2 {
+		var e struct {
+			Error struct {
+				Message string `json:"message"`
+				Errors  []struct {
+					Reason string `json:"reason"`
+				} `json:"errors"`
+			} `json:"error"`
+		}
+		if json.Unmarshal(data, &e) != nil || e.Error.Message == "" {
+			err := fmt.Errorf("gcp: %s: unexpected status %s", method, resp.Status)
+			return resp.StatusCode, throttled(err, resp.StatusCode, resp.Header)
+		}
+		err := fmt.Errorf("gcp: %s %s: %s", method, resp.Status, e.Error.Message)
+		for _, reason := range e.Error.Errors {
+			// Quotas answer 403 rather than 429
+			if reason.Reason == "rateLimitExceeded" || reason.Reason == "userRateLimitExceeded" {
+				return resp.StatusCode, &throttledError{err: err}
+			}
+		}
+		return resp.StatusCode, throttled(err, resp.StatusCode, resp.Header)
+	}
+	if out != nil {
+		return resp.StatusCode, json.Unmarshal(data, out)
+	}
+	return resp.StatusCode, nil
+}
+
+// accessToken returns an OAuth2 token for the Compute API, from the service
+// account key or the metadata server, refreshed before it expires.
+func (g *gcpFirewall) accessToken(ctx context.Context) (string, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if g.token != "" && time.Until(g.expires) > time.Minute {
+		return g.token, nil
+	}
+
+	var (
+		req *http.Request
+		err error
+	)
+	if g.account != nil {
+		assertion, err := g.assertion(time.Now())
+		if err != nil {
+			return "", err
+		}
+		form := url.Values{
+			"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+			"assertion":  {assertion},
+		}
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, g.account.TokenURI, strings.NewReader(form.Encode()))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		host := os.Getenv("GCE_METADATA_HOST")
+		if host == "" {
+			host = gcpMetadataHost
+		}
+		if req, err = http.NewRequestWithContext(ctx, http.MethodGet, "http://"+host+gcpMetadataPath, nil); err != nil {
+			return "", err
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+	}
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("gcp token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", throttled(fmt.Errorf("gcp token: unexpected status %s", resp.Status), resp.StatusCode, resp.Header)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&tok); err != nil {
+		return "", fmt.Errorf("gcp token: %w", err)
+	}
+
+	ttl := time.Duration(tok.ExpiresIn) * time.Second
+	if ttl == 0 {
+		ttl = gcpDefaultTTL
+	}
+	g.token, g.expires = tok.AccessToken, time.Now().Add(ttl)
+	return g.token, nil
+}
+
+// assertion is the RS256 JWT exchanged for a token, signed with the
+// service account key.
+func (g *gcpFirewall) assertion(now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]any{
+		"iss":   g.account.ClientEmail,
+		"scope": gcpComputeScope,
+		"aud":   g.account.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(gcpDefaultTTL).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	enc := base64.RawURLEncoding
+	signed := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(nil, g.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + enc.EncodeToString(sig), nil
+}
@@ -0,0 +1,149 @@
+package knock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// ipsetMaxTimeout is the largest entry timeout ipset accepts, in seconds
+	ipsetMaxTimeout = 2147483
+
+	// ipsetTagPrefix marks the set's match rule. It differs from
+	// firewallTagPrefix so an iptables action resetting the same chain
+	// leaves the rule alone.
+	ipsetTagPrefix = "knock-ipset:"
+)
+
+// ipset adds granted clients to hash:ip,port sets with a timeout, matched by
+// a single iptables rule per family. The kernel looks clients up in a hash
+// instead of walking a rule per grant, and expires them by itself.
+//
+// Overlapping grants of a client and port share an entry, which keeps the
+// latest expiry among them and leaves the set with the last grant.
+type ipset struct {
+	chain string
+	set   string // Base name, suffixed with 4 and 6 for the families
+	tag   string
+
+	grants entryGrants
+	mutex  sync.Mutex
+}
+
+func newIpset(name string, cfg FirewallConfig) *ipset {
+	chain := cfg.Chain
+	if chain == "" {
+		chain = "INPUT"
+	}
+	set := cfg.Table
+	if set == "" {
+		set = "knock_" + nftIdentifier(name)
+	}
+	// Set names are at most 31 characters, one goes to the family suffix
+	if len(set) > 30 {
+		set = set[:30]
+	}
+	return &ipset{chain: chain, set: set, tag: ipsetTagPrefix + name, grants: make(entryGrants)}
+}
+
+func (s *ipset) Allow(ctx context.Context, rule FirewallRule) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := s.setName(rule) + " " + s.entry(rule)
+	expires, apply := s.grants.needs(key, rule.Expires)
+	if apply {
+		// -exist replaces the timeout of an entry already there
+		args := []string{"add", "-exist", s.setName(rule), s.entry(rule)}
+		if !expires.IsZero() {
+			secs := math.Ceil(time.Until(expires).Seconds())
+			if secs < 1 {
+				return nil
+			}
+			args = append(args, "timeout", strconv.Itoa(int(min(secs, ipsetMaxTimeout))))
+		} else if _, ok := s.grants[key]; ok {
+			args = append(args, "timeout", "0")
+		}
+		if _, err := runCommand(ctx, "ipset", args...); err != nil {
+			return err
+		}
+	}
+	s.grants.add(key, expires)
+	return nil
+}
+
+// Remove deletes the entry once no other grant holds it.
+func (s *ipset) Remove(ctx context.Context, rule FirewallRule) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := s.setName(rule) + " " + s.entry(rule)
+	if !s.grants.release(key) {
+		return nil
+	}
+	// -exist: the entry may already have timed out
+	if _, err := runCommand(ctx, "ipset", "del", "-exist", s.setName(rule), s.entry(rule)); err != nil {
+		return err
+	}
+	delete(s.grants, key)
+	return nil
+}
+
+// Reset creates both sets, empties them of a previous run's entries and
+// makes sure the chain accepts their members.
+func (s *ipset) Reset(ctx context.Context) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	clear(s.grants)
+	var errs []error
+	for _, f := range []struct {
+		family, set, iptables string
+	}{
+		{"inet", s.set + "4", "iptables"},
+		{"inet6", s.set + "6", "ip6tables"},
+	} {
+		if _, err := runCommand(ctx, "ipset", "create", "-exist", f.set, "hash:ip,port", "family", f.family, "timeout", "0"); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if _, err := runCommand(ctx, "ipset", "flush", f.set); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		if _, err := exec.LookPath(f.iptables); err != nil {
+			continue
+		}
+		match := []string{s.chain, "-m", "set", "--match-set", f.set, "src,dst", "-m", "comment", "--comment", s.tag, "-j", "ACCEPT"}
+		if _, err := runCommand(ctx, f.iptables, append([]string{"-C"}, match...)...); err == nil {
+			continue
+		}
+		if _, err := runCommand(ctx, f.iptables, append([]string{"-I"}, match...)...); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *ipset) Check(ctx context.Context) error {
+	_, err := runCommand(ctx, "ipset", "list", "-n", s.set+"4")
+	return err
+}
+
+func (s *ipset) setName(rule FirewallRule) string {
+	if rule.IP.Is6() {
+		return s.set + "6"
+	}
+	return s.set + "4"
+}
+
+func (s *ipset) entry(rule FirewallRule) string {
+	return fmt.Sprintf("%s,%s:%d", rule.IP, rule.Protocol, rule.Port)
+}
@@ -0,0 +1,189 @@
+package knock
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// dockerChain is where Docker lets users filter traffic to published ports
+// before its own rules accept it.
+const dockerChain = "DOCKER-USER"
+
+// iptables manages ACCEPT rules with iptables, or ip6tables for IPv6 clients.
+// Rules carry a comment with the tag so Reset can find them again.
+//
+// In Docker mode the rules live in DOCKER-USER, which sees published ports
+// after DNAT: grants RETURN to Docker's chains and Reset inserts DROP rules
+// for the configured ports below them. Ports are matched on the original
+// destination, so they are the published ones rather than the container's.
+type iptables struct {
+	chain    string
+	docker   bool
+	ports    []int
+	protocol string
+	dropTag  string // Comment of the Docker mode DROP rules
+}
+
+func newIptables(name string, cfg FirewallConfig) *iptables {
+	chain := cfg.Chain
+	if chain == "" {
+		chain = "INPUT"
+		if cfg.Docker {
+			chain = dockerChain
+		}
+	}
+	return &iptables{
+		chain:    chain,
+		docker:   cfg.Docker,
+		ports:    cfg.Ports,
+		protocol: cfg.Protocol,
+		dropTag:  "knock-drop:" + name,
+	}
+}
+
+func (t *iptables) Allow(ctx context.Context, rule FirewallRule) error {
+	if rule.Forward.IsValid() {
+		return t.forward(ctx, "-I", rule)
+	}
+	_, err := runCommand(ctx, iptablesBinary(rule), append([]string{"-I", t.chain}, t.spec(rule)...)...)
+	return err
+}
+
+func (t *iptables) Remove(ctx context.Context, rule FirewallRule) error {
+	if rule.Forward.IsValid() {
+		return t.forward(ctx, "-D", rule)
+	}
+	_, err := runCommand(ctx, iptablesBinary(rule), append([]string{"-D", t.chain}, t.spec(rule)...)...)
+	return err
+}
+
+// forward inserts or deletes, with op, the DNAT of a forwarded rule and the
+// FORWARD rule accepting the traffic it rewrote.
+func (t *iptables) forward(ctx context.Context, op string, rule FirewallRule) error {
+	bin := iptablesBinary(rule)
+	nat := []string{
+		"-t", "nat", op, "PREROUTING",
+		"-s", rule.IP.String(),
+		"-p", rule.Protocol,
+		"--dport", strconv.Itoa(rule.Port),
+		"-m", "comment", "--comment", rule.Tag,
+		"-j", "DNAT", "--to-destination", rule.Forward.String(),
+	}
+	accept := []string{
+		op, "FORWARD",
+		"-s", rule.IP.String(),
+		"-d", rule.Forward.Addr().String(),
+		"-p", rule.Protocol,
+		"--dport", strconv.Itoa(int(rule.Forward.Port())),
+		"-m", "comment", "--comment", rule.Tag,
+		"-j", "ACCEPT",
+	}
+	if _, err := runCommand(ctx, bin, accept...); err != nil {
+		return err
+	}
+	_, err := runCommand(ctx, bin, nat...)
+	return err
+}
+
+func (t *iptables) Reset(ctx context.Context) error {
+	var errs []error
+	for _, bin := range []string{"iptables", "ip6tables"} {
+		if _, err := exec.LookPath(bin); err != nil {
+			continue
+		}
+
+		if err := t.resetChain(ctx, bin, nil, t.chain, &errs); err != nil {
+			// Docker only creates the IPv6 chain when IPv6 is enabled
+			if !t.docker || bin != "ip6tables" {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		// Rules of forwarded services
+		if !t.docker {
+			if t.chain != "FORWARD" {
+				if err := t.resetChain(ctx, bin, nil, "FORWARD", &errs); err != nil {
+					errs = append(errs, err)
+				}
+			}
+			if err := t.resetChain(ctx, bin, []string{"-t", "nat"}, "PREROUTING", &errs); err != nil {
+				errs = append(errs, err)
+			}
+		}
+
+		if t.docker {
+			for _, port := range t.ports {
+				args := append([]string{"-I", t.chain}, t.match(port, "--ctstate", "NEW")...)
+				args = append(args, "-m", "comment", "--comment", t.dropTag, "-j", "DROP")
+				if _, err := runCommand(ctx, bin, args...); err != nil {
+					errs = append(errs, err)
+				}
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// resetChain deletes the tagged rules of chain, in the table selected by the
+// table arguments, adding failed deletions to errs. It fails only when the
+// chain cannot be listed.
+func (t *iptables) resetChain(ctx context.Context, bin string, table []string, chain string, errs *[]error) error {
+	out, err := runCommand(ctx, bin, append(slices.Clip(table), "-S", chain)...)
+	if err != nil {
+		return err
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.ReplaceAll(line, `"`, "")
+		if !strings.HasPrefix(line, "-A ") {
+			continue
+		}
+		if !strings.Contains(line, "--comment "+firewallTagPrefix) && !strings.Contains(line, "--comment "+t.dropTag+" ") {
+			continue
+		}
+
+		args := strings.Fields(line)
+		args[0] = "-D"
+		if _, err := runCommand(ctx, bin, append(slices.Clip(table), args...)...); err != nil {
+			*errs = append(*errs, err)
+		}
+	}
+	return nil
+}
+
+func (t *iptables) Check(ctx context.Context) error {
+	_, err := runCommand(ctx, "iptables", "-S", t.chain)
+	return err
+}
+
+func (t *iptables) spec(rule FirewallRule) []string {
+	if t.docker {
+		args := append([]string{"-s", rule.IP.String()}, t.match(rule.Port)...)
+		return append(args, "-m", "comment", "--comment", rule.Tag, "-j", "RETURN")
+	}
+	return []string{
+		"-s", rule.IP.String(),
+		"-p", rule.Protocol,
+		"--dport", strconv.Itoa(rule.Port),
+		"-m", "comment", "--comment", rule.Tag,
+		"-j", "ACCEPT",
+	}
+}
+
+// match selects Docker mode traffic by its destination before DNAT, with
+// extra conntrack options.
+func (t *iptables) match(port int, extra ...string) []string {
+	args := append([]string{"-p", t.protocol, "-m", "conntrack"}, extra...)
+	return append(args, "--ctorigdstport", strconv.Itoa(port), "--ctdir", "ORIGINAL")
+}
+
+func iptablesBinary(rule FirewallRule) string {
+	if rule.IP.Is6() {
+		return "ip6tables"
+	}
+	return "iptables"
+}
@@ -0,0 +1,150 @@
+package knock
+
+import (
+	"cmp"
+	"context"
+	"net/netip"
+	"slices"
+	"sync"
+)
+
+// Kinds of FirewallChange
+const (
+	FirewallAllowed = "allow"
+	FirewallRemoved = "remove"
+	FirewallReset   = "reset"
+)
+
+// FirewallChange is one call a MemoryFirewall received.
+type FirewallChange struct {
+	Op   string       // FirewallAllowed, FirewallRemoved or FirewallReset
+	Rule FirewallRule // Zero for a reset
+}
+
+// MemoryFirewall is the "memory" backend: a Firewall keeping its rules in
+// memory and recording every change, so grants and revocations can be
+// checked in tests and simulations without root or a real firewall.
+//
+// Like the set backends, overlapping grants share a rule, which keeps the
+// latest expiry among them and goes with the last grant.
+type MemoryFirewall struct {
+	rules   map[memoryRuleKey]FirewallRule
+	grants  map[memoryRuleKey]int
+	changes []FirewallChange
+	mutex   sync.Mutex
+}
+
+// memoryRuleKey identifies a rule apart from its expiry, which an extension
+// changes between removing the rule and adding it back.
+type memoryRuleKey struct {
+	ip       netip.Addr
+	port     int
+	protocol string
+	forward  netip.AddrPort
+}
+
+func NewMemoryFirewall() *MemoryFirewall {
+	return &MemoryFirewall{
+		rules:  make(map[memoryRuleKey]FirewallRule),
+		grants: make(map[memoryRuleKey]int),
+	}
+}
+
+// NewMemoryFirewallAction creates a firewall action on a MemoryFirewall,
+// returned along with it to inspect. The backend of cfg is ignored.
+func NewMemoryFirewallAction(name string, cfg FirewallConfig) (*FirewallAction, *MemoryFirewall, error) {
+	cfg.Backend = "memory"
+	f, err := NewFirewallAction(name, cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, f.fw.(*MemoryFirewall), nil
+}
+
+func (m *MemoryFirewall) Allow(ctx context.Context, rule FirewallRule) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	key := rule.key()
+	if held, ok := m.rules[key]; !ok || !held.Expires.IsZero() && (rule.Expires.IsZero() || rule.Expires.After(held.Expires)) {
+		m.rules[key] = rule
+	}
+	m.grants[key]++
+	m.changes = append(m.changes, FirewallChange{Op: FirewallAllowed, Rule: rule})
+	return nil
+}
+
+func (m *MemoryFirewall) Remove(ctx context.Context, rule FirewallRule) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	key := rule.key()
+	if m.grants[key] > 1 {
+		m.grants[key]--
+	} else {
+		delete(m.rules, key)
+		delete(m.grants, key)
+	}
+	m.changes = append(m.changes, FirewallChange{Op: FirewallRemoved, Rule: rule})
+	return nil
+}
+
+func (m *MemoryFirewall) Reset(ctx context.Context) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	clear(m.rules)
+	clear(m.grants)
+	m.changes = append(m.changes, FirewallChange{Op: FirewallReset})
+	return nil
+}
+
+func (m *MemoryFirewall) Check(ctx context.Context) error {
+	return nil
+}
+
+// Rules returns the rules in place, by address then port.
+func (m *MemoryFirewall) Rules() []FirewallRule {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	rules := make([]FirewallRule, 0, len(m.rules))
+	for _, rule := range m.rules {
+		rules = append(rules, rule)
+	}
+	slices.SortFunc(rules, func(a, b FirewallRule) int {
+		return cmp.Or(a.IP.Compare(b.IP), cmp.Compare(a.Port, b.Port), cmp.Compare(a.Protocol, b.Protocol))
+	})
+	return rules
+}
+
+// Allowed reports whether a rule opens port to ip, whatever its protocol.
+func (m *MemoryFirewall) Allowed(ip string, port int) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for key := range m.rules {
+		if key.ip == addr && key.port == port {
+			return true
+		}
+	}
+	return false
+}
+
+// Changes returns every change made so far, in order.
+func (m *MemoryFirewall) Changes() []FirewallChange {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return slices.Clone(m.changes)
+}
+
+func (r FirewallRule) key() memoryRuleKey {
+	return memoryRuleKey{ip: r.IP, port: r.Port, protocol: r.Protocol, forward: r.Forward}
+}
@@ -0,0 +1,142 @@
+package knock_test
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"port-knocking/pkg/knock"
+)
+
+func TestMemoryFirewallGrantAndExpiry(t *testing.T) {
+	fw, mem, err := knock.NewMemoryFirewallAction("firewall", knock.FirewallConfig{Ports: []int{22, 443}})
+	if err != nil {
+		t.Fatalf("NewMemoryFirewallAction: %v", err)
+	}
+	cfg := knock.DefaultInstance()
+	sim, err := knock.NewSimulation(knock.Options{Instance: cfg, Actions: []knock.Action{fw}}, simStart)
+	if err != nil {
+		t.Fatalf("NewSimulation: %v", err)
+	}
+
+	sim.KnockSequence(simIP, sim.Sequence(""), 100*time.Millisecond)
+	expires := sim.Clock.Now().Add(cfg.SessionTTL.Duration)
+
+	ip := netip.MustParseAddr(simIP)
+	rules := mem.Rules()
+	if len(rules) != 2 {
+		t.Fatalf("%d rules after the grant, want 2: %v", len(rules), rules)
+	}
+	for i, port := range []int{22, 443} {
+		want := knock.FirewallRule{IP: ip, Port: port, Protocol: "tcp", Tag: "knock:default", Expires: expires}
+		if rules[i] != want {
+			t.Errorf("rule %d is %+v, want %+v", i, rules[i], want)
+		}
+	}
+	if mem.Allowed("192.0.2.2", 22) {
+		t.Errorf("port 22 open to an address that did not knock")
+	}
+
+	// Still open just before the TTL runs out
+	sim.Advance(cfg.SessionTTL.Duration - time.Second)
+	if !mem.Allowed(simIP, 22) {
+		t.Fatalf("port 22 closed before the session expired")
+	}
+
+	sim.Advance(2 * time.Second)
+	if rules := mem.Rules(); len(rules) != 0 {
+		t.Fatalf("rules left after the session expired: %v", rules)
+	}
+
+	changes := mem.Changes()
+	ops := make([]string, len(changes))
+	for i, c := range changes {
+		ops[i] = c.Op
+	}
+	want := []string{knock.FirewallAllowed, knock.FirewallAllowed, knock.FirewallRemoved, knock.FirewallRemoved}
+	if !slices.Equal(ops, want) {
+		t.Errorf("changes %v, want %v", ops, want)
+	}
+}
+
+// newMemorySim simulates cfg with a firewall opening 22 on the memory backend.
+func newMemorySim(t *testing.T, cfg knock.InstanceConfig) (*knock.Simulation, *knock.MemoryFirewall) {
+	t.Helper()
+	fw, mem, err := knock.NewMemoryFirewallAction("firewall", knock.FirewallConfig{Ports: []int{22}})
+	if err != nil {
+		t.Fatalf("NewMemoryFirewallAction: %v", err)
+	}
+	sim, err := knock.NewSimulation(knock.Options{Instance: cfg, Actions: []knock.Action{fw}}, simStart)
+	if err != nil {
+		t.Fatalf("NewSimulation: %v", err)
+	}
+	return sim, mem
+}
+
+func TestMemoryFirewallProfilesOfOneIP(t *testing.T) {
+	cfg := knock.DefaultInstance()
+	cfg.Profiles = map[string]knock.ProfileConfig{
+		"pg": {
+			Sequence:   []knock.KnockStep{{Port: 7101, Count: 1}, {Port: 7102, Count: 1}},
+			SessionTTL: knock.Duration{Duration: 2 * time.Hour},
+			Service:    knock.ServiceConfig{Ports: []int{5432}},
+		},
+	}
+	sim, mem := newMemorySim(t, cfg)
+
+	sim.KnockSequence(simIP, sim.Sequence(""), 100*time.Millisecond)
+	sim.KnockSequence(simIP, sim.Sequence("pg"), 100*time.Millisecond)
+	if !mem.Allowed(simIP, 22) || !mem.Allowed(simIP, 5432) {
+		t.Fatalf("rules after both grants: %v", mem.Rules())
+	}
+
+	// The default session ends first; its port closes, the pg one stays
+	sim.Advance(cfg.SessionTTL.Duration + time.Second)
+	if mem.Allowed(simIP, 22) {
+		t.Errorf("port 22 still open after its session ended")
+	}
+	if !mem.Allowed(simIP, 5432) {
+		t.Errorf("port 5432 closed while its session is active")
+	}
+
+	sim.Advance(time.Hour)
+	if rules := mem.Rules(); len(rules) != 0 {
+		t.Errorf("rules left after every session ended: %v", rules)
+	}
+}
+
+func TestMemoryFirewallRepeatedGrant(t *testing.T) {
+	cfg := knock.DefaultInstance()
+	sim, mem := newMemorySim(t, cfg)
+
+	sim.KnockSequence(simIP, sim.Sequence(""), 100*time.Millisecond)
+	sim.Advance(10 * time.Minute)
+	sim.KnockSequence(simIP, sim.Sequence(""), 100*time.Millisecond)
+	if n := len(sim.Sessions()); n != 2 {
+		t.Fatalf("%d sessions after knocking twice, want 2", n)
+	}
+
+	// The second grant keeps the port open past the first session
+	sim.Advance(cfg.SessionTTL.Duration - 5*time.Minute)
+	if !mem.Allowed(simIP, 22) {
+		t.Fatalf("port 22 closed while the second session is active")
+	}
+
+	sim.Advance(10 * time.Minute)
+	if rules := mem.Rules(); len(rules) != 0 {
+		t.Fatalf("rules left after both sessions ended: %v", rules)
+	}
+	allowed, removed := 0, 0
+	for _, c := range mem.Changes() {
+		switch c.Op {
+		case knock.FirewallAllowed:
+			allowed++
+		case knock.FirewallRemoved:
+			removed++
+		}
+	}
+	if allowed != 2 || removed != 2 {
+		t.Errorf("%d allows and %d removals, want 2 of each", allowed, removed)
+	}
+}
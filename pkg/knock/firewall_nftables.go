@@ -0,0 +1,148 @@
+package knock
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// nftables keeps granted clients in timeout sets of a table owned by the
+// action. Its input chain drops the protected ports for everyone not in the
+// sets, so no other firewall configuration is needed. Set elements carry the
+// session expiry as their timeout, so access lapses even if the server dies.
+//
+// Overlapping grants of a client and port share an element, which keeps the
+// latest expiry among them and leaves the set with the last grant.
+type nftables struct {
+	table    string
+	ports    []int
+	protocol string
+
+	grants entryGrants
+	mutex  sync.Mutex
+}
+
+func newNftables(name string, cfg FirewallConfig) *nftables {
+	table := cfg.Table
+	if table == "" {
+		table = "knock_" + nftIdentifier(name)
+	}
+
+	return &nftables{
+		table:    table,
+		ports:    cfg.Ports,
+		protocol: cfg.Protocol,
+		grants:   make(entryGrants),
+	}
+}
+
+func (n *nftables) Allow(ctx context.Context, rule FirewallRule) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	key := n.set(rule) + " " + n.element(rule)
+	expires, apply := n.grants.needs(key, rule.Expires)
+	if apply {
+		if err := n.add(ctx, rule, expires); err != nil {
+			return err
+		}
+	}
+	n.grants.add(key, expires)
+	return nil
+}
+
+// add puts the element in its set until expires. add element leaves the
+// timeout of an element already there alone, so it is added, deleted and
+// added again with the new timeout in one transaction.
+func (n *nftables) add(ctx context.Context, rule FirewallRule, expires time.Time) error {
+	elem := n.element(rule)
+	timed := elem
+	if !expires.IsZero() {
+		secs := math.Ceil(time.Until(expires).Seconds())
+		if secs < 1 {
+			return nil
+		}
+		timed += fmt.Sprintf(" timeout %.0fs", secs)
+	}
+
+	set := "inet " + n.table + " " + n.set(rule)
+	script := fmt.Sprintf("add element %s { %s }\ndelete element %s { %s }\nadd element %s { %s }\n",
+		set, elem, set, elem, set, timed)
+	_, err := runCommandInput(ctx, []byte(script), "nft", "-f", "-")
+	return err
+}
+
+// Remove deletes the element once no other grant holds it.
+func (n *nftables) Remove(ctx context.Context, rule FirewallRule) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	key := n.set(rule) + " " + n.element(rule)
+	if !n.grants.release(key) {
+		return nil
+	}
+	_, err := runCommand(ctx, "nft", "delete", "element", "inet", n.table, n.set(rule), "{ "+n.element(rule)+" }")
+	// The element may already have timed out
+	if err != nil && !strings.Contains(err.Error(), "No such file or directory") {
+		return err
+	}
+	delete(n.grants, key)
+	return nil
+}
+
+// Check lists the table, which Reset created.
+func (n *nftables) Check(ctx context.Context) error {
+	_, err := runCommand(ctx, "nft", "list", "table", "inet", n.table)
+	return err
+}
+
+// Reset recreates the table, dropping every element from a previous run.
+func (n *nftables) Reset(ctx context.Context) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	clear(n.grants)
+	ports := make([]string, len(n.ports))
+	for i, p := range n.ports {
+		ports[i] = fmt.Sprint(p)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "table inet %s\ndelete table inet %s\n", n.table, n.table)
+	fmt.Fprintf(&b, "table inet %s {\n", n.table)
+	b.WriteString("\tset allow4 { type ipv4_addr . inet_service; flags timeout; }\n")
+	b.WriteString("\tset allow6 { type ipv6_addr . inet_service; flags timeout; }\n")
+	b.WriteString("\tchain input {\n\t\ttype filter hook input priority -10; policy accept;\n")
+	b.WriteString("\t\tct state established,related accept\n")
+	fmt.Fprintf(&b, "\t\tip saddr . %s dport @allow4 accept\n", n.protocol)
+	fmt.Fprintf(&b, "\t\tip6 saddr . %s dport @allow6 accept\n", n.protocol)
+	fmt.Fprintf(&b, "\t\t%s dport { %s } drop\n", n.protocol, strings.Join(ports, ", "))
+	b.WriteString("\t}\n}\n")
+
+	_, err := runCommandInput(ctx, []byte(b.String()), "nft", "-f", "-")
+	return err
+}
+
+func (n *nftables) set(rule FirewallRule) string {
+	if rule.IP.Is6() {
+		return "allow6"
+	}
+	return "allow4"
+}
+
+func (n *nftables) element(rule FirewallRule) string {
+	return fmt.Sprintf("%s . %d", rule.IP, rule.Port)
+}
+
+// nftIdentifier maps an action name to a valid nft or pf table name.
+func nftIdentifier(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
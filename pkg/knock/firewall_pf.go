@@ -0,0 +1,78 @@
+package knock
+
+import (
+	"context"
+	"net/netip"
+	"strings"
+	"sync"
+)
+
+// pf adds granted clients to a pf table. pf tables hold addresses only, so
+// the ports are opened by a pf.conf rule referencing the table, e.g.
+//
+//	table <knock_ssh> persist
+//	pass in proto tcp from <knock_ssh> to port 22
+//
+// Every instance running the action shares the table, so an address is
+// counted once per grant and leaves the table with the last one.
+type pf struct {
+	table  string
+	grants map[netip.Addr]int
+	mutex  sync.Mutex
+}
+
+func newPf(name string, cfg FirewallConfig) *pf {
+	table := cfg.Table
+	if table == "" {
+		table = "knock_" + nftIdentifier(name)
+	}
+	return &pf{table: table, grants: make(map[netip.Addr]int)}
+}
+
+func (p *pf) Allow(ctx context.Context, rule FirewallRule) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.grants[rule.IP] == 0 {
+		if _, err := runCommand(ctx, "pfctl", "-t", p.table, "-T", "add", rule.IP.String()); err != nil {
+			return err
+		}
+	}
+	p.grants[rule.IP]++
+	return nil
+}
+
+// Remove deletes the address once no other grant holds it. Addresses not
+// counted, added before a restart, are deleted.
+func (p *pf) Remove(ctx context.Context, rule FirewallRule) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.grants[rule.IP] > 1 {
+		p.grants[rule.IP]--
+		return nil
+	}
+	if _, err := runCommand(ctx, "pfctl", "-t", p.table, "-T", "delete", rule.IP.String()); err != nil {
+		return err
+	}
+	delete(p.grants, rule.IP)
+	return nil
+}
+
+func (p *pf) Check(ctx context.Context) error {
+	_, err := runCommand(ctx, "pfctl", "-s", "info")
+	return err
+}
+
+// Reset empties the table. A table that does not exist yet is not an error.
+func (p *pf) Reset(ctx context.Context) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	_, err := runCommand(ctx, "pfctl", "-t", p.table, "-T", "flush")
+	if err != nil && !strings.Contains(err.Error(), "Table does not exist") {
+		return err
+	}
+	clear(p.grants)
+	return nil
+}
@@ -0,0 +1,334 @@
+package knock
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultFwknopPort = 62201
+	fwknopMaxAge      = 2 * time.Minute // MAX_SPA_PACKET_AGE of fwknopd
+	fwknopMaxPacket   = 1500
+
+	// Base64 of "Salted__", which clients strip from the packet
+	fwknopSaltPrefix = "U2FsdGVkX1"
+
+	fwknopAccessMsg        = 1
+	fwknopTimeoutAccessMsg = 3
+)
+
+// FwknopConfig accepts Single Packet Authorization from stock fwknop clients
+// using Rijndael (AES-256-CBC) keys, optionally with an HMAC-SHA256. The
+// fields mirror the fwknopd access.conf stanza.
+type FwknopConfig struct {
+	Port                 int      `json:"port"`                   // UDP port SPA packets arrive on, 62201 when zero
+	Key                  string   `json:"key"`                    // KEY, empty with no key_base64 disables SPA
+	KeyBase64            string   `json:"key_base64"`             // KEY_BASE64
+	HMACKey              string   `json:"hmac_key"`               // HMAC_KEY, packets must carry an HMAC when set
+	HMACKeyBase64        string   `json:"hmac_key_base64"`        // HMAC_KEY_BASE64
+	Ports                []int    `json:"ports"`                  // OPEN_PORTS, the protected ports when empty
+	MaxTimeout           Duration `json:"max_timeout"`            // Longest client timeout accepted, the session TTL when zero
+	RequireSourceAddress bool     `json:"require_source_address"` // REQUIRE_SOURCE_ADDRESS, else allow must be within request_targets
+}
+
+func (c FwknopConfig) Enabled() bool {
+	return c.Key != "" || c.KeyBase64 != ""
+}
+
+// keys returns the encryption key and the HMAC key, nil when unset.
+func (c FwknopConfig) keys() (key, hmacKey []byte, err error) {
+	key = []byte(c.Key)
+	if c.KeyBase64 != "" {
+		if key, err = base64.StdEncoding.DecodeString(c.KeyBase64); err != nil {
+			return nil, nil, fmt.Errorf("fwknop key_base64: %w", err)
+		}
+	}
+	if len(key) > 32 {
+		return nil, nil, errors.New("fwknop key is longer than 32 bytes")
+	}
+
+	if c.HMACKey != "" {
+		hmacKey = []byte(c.HMACKey)
+	}
+	if c.HMACKeyBase64 != "" {
+		if hmacKey, err = base64.StdEncoding.DecodeString(c.HMACKeyBase64); err != nil {
+			return nil, nil, fmt.Errorf("fwknop hmac_key_base64: %w", err)
+		}
+	}
+	return key, hmacKey, nil
+}
+
+// spaMessage is a decoded SPA packet.
+type spaMessage struct {
+	User    string
+	Time    time.Time
+	Allow   netip.Addr // Address to open, unspecified for the packet source
+	Ports   []int
+	Timeout time.Duration // Client requested access length, zero for the default
+	Digest  string
+}
+
+// decodeSPA verifies and decrypts one SPA packet.
+func decodeSPA(packet []byte, key, hmacKey []byte) (*spaMessage, error) {
+	data := strings.TrimRight(strings.TrimSpace(string(packet)), "=")
+
+	if hmacKey != nil {
+		const macLen = 43 // Unpadded base64 of a SHA-256 sum
+		if len(data) <= macLen {
+			return nil, errors.New("packet too short for an HMAC")
+		}
+		sum := data[len(data)-macLen:]
+		data = data[:len(data)-macLen]
+
+		// The HMAC covers the packet as encrypted, before the prefix was stripped
+		mac := hmac.New(sha256.New, hmacKey)
+		mac.Write([]byte(fwknopSaltPrefix + data))
+		if !hmac.Equal([]byte(sum), []byte(base64.RawStdEncoding.EncodeToString(mac.Sum(nil)))) {
+			return nil, errors.New("HMAC mismatch")
+		}
+	}
+	return decryptSPA(data, key)
+}
+
+func decryptSPA(data string, key []byte) (*spaMessage, error) {
+	raw, err := base64.RawStdEncoding.DecodeString(fwknopSaltPrefix + data)
+	if err != nil {
+		return nil, errors.New("packet is not base64")
+	}
+	if len(raw) < 32 || !bytes.HasPrefix(raw, []byte("Salted__")) || (len(raw)-16)%aes.BlockSize != 0 {
+		return nil, errors.New("packet is not Rijndael encrypted")
+	}
+
+	derivedKey, iv := bytesToKey(key, raw[8:16])
+	block, err := aes.NewCipher(derivedKey)
+	if err != nil {
+		return nil, err
+	}
+	plain := make([]byte, len(raw)-16)
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, raw[16:])
+
+	pad := int(plain[len(plain)-1])
+	if pad < 1 || pad > aes.BlockSize || !bytes.Equal(plain[len(plain)-pad:], bytes.Repeat([]byte{byte(pad)}, pad)) {
+		return nil, errors.New("packet does not decrypt")
+	}
+	return parseSPA(string(plain[:len(plain)-pad]))
+}
+
+// bytesToKey derives the AES-256 key and IV from a password and salt the
+// way OpenSSL's EVP_BytesToKey does with MD5, as fwknop clients do.
+func bytesToKey(password, salt []byte) (key, iv []byte) {
+	var kiv, prev []byte
+	for len(kiv) < 48 {
+		h := md5.New()
+		h.Write(prev)
+		h.Write(password)
+		h.Write(salt)
+		prev = h.Sum(nil)
+		kiv = append(kiv, prev...)
+	}
+	return kiv[:32], kiv[32:48]
+}
+
+// parseSPA reads the decrypted fields:
+//
+//	rand:user:timestamp:version:type:message[:timeout]:digest
+//
+// with user and message base64 encoded.
+func parseSPA(plain string) (*spaMessage, error) {
+	fields := strings.Split(plain, ":")
+	if len(fields) < 7 {
+		return nil, fmt.Errorf("expected at least 7 fields, got %d", len(fields))
+	}
+
+	encoded, digest := plain[:strings.LastIndex(plain, ":")], fields[len(fields)-1]
+	newHash := map[int]func() hash.Hash{22: md5.New, 27: sha1.New, 43: sha256.New, 64: sha512.New384, 86: sha512.New}[len(digest)]
+	if newHash == nil {
+		return nil, errors.New("unknown digest type")
+	}
+	h := newHash()
+	h.Write([]byte(encoded))
+	if base64.RawStdEncoding.EncodeToString(h.Sum(nil)) != digest {
+		return nil, errors.New("digest mismatch")
+	}
+
+	msgType, err := strconv.Atoi(fields[4])
+	if err != nil {
+		return nil, fmt.Errorf("invalid message type %q", fields[4])
+	}
+
+	msg := &spaMessage{Digest: digest}
+	switch {
+	case msgType == fwknopAccessMsg && len(fields) == 7:
+	case msgType == fwknopTimeoutAccessMsg && len(fields) == 8:
+		secs, err := strconv.Atoi(fields[6])
+		if err != nil || secs < 0 {
+			return nil, fmt.Errorf("invalid client timeout %q", fields[6])
+		}
+		msg.Timeout = time.Duration(secs) * time.Second
+	default:
+		return nil, fmt.Errorf("message type %d with %d fields is not supported", msgType, len(fields))
+	}
+
+	user, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(fields[1], "="))
+	if err != nil {
+		return nil, errors.New("invalid username encoding")
+	}
+	msg.User = string(user)
+
+	ts, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp %q", fields[2])
+	}
+	msg.Time = time.Unix(ts, 0)
+
+	access, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(fields[5], "="))
+	if err != nil {
+		return nil, errors.New("invalid message encoding")
+	}
+	if err := msg.parseAccess(string(access)); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// parseAccess reads an access request such as "10.0.0.1,tcp/22,udp/53".
+func (m *spaMessage) parseAccess(s string) error {
+	parts := strings.Split(s, ",")
+	addr, err := netip.ParseAddr(parts[0])
+	if err != nil {
+		return fmt.Errorf("invalid access address %q", parts[0])
+	}
+	m.Allow = addr.Unmap()
+
+	for _, p := range parts[1:] {
+		proto, port, ok := strings.Cut(p, "/")
+		n, err := strconv.Atoi(port)
+		if !ok || (proto != "tcp" && proto != "udp") || err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("invalid access port %q", p)
+		}
+		m.Ports = append(m.Ports, n)
+	}
+	if len(m.Ports) == 0 {
+		return errors.New("access request names no port")
+	}
+	return nil
+}
+
+// handleSPA reads SPA packets until the socket is closed.
+func (s *Server) handleSPA(pc net.PacketConn) {
+	buf := make([]byte, fwknopMaxPacket)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		ip, err := clientIP(addr)
+		if err != nil {
+			continue
+		}
+		s.processSPA(ip, buf[:n])
+	}
+}
+
+func (s *Server) processSPA(ip string, packet []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.clock.Now()
+	if s.denied(ip) {
+		return
+	}
+	if f := s.blocklisted(ip); f != nil && s.cfg.BlocklistMode == BlocklistReject {
+		log.Printf("[%s] Ignoring SPA packet from %s listed by blocklist %s", s.Name(), ip, f.Name())
+		return
+	}
+	if _, ok := s.bans.Banned(ip, now); ok {
+		return
+	}
+
+	key, hmacKey, err := s.cfg.Fwknop.keys()
+	if err != nil {
+		log.Printf("[%s] SPA disabled: %v", s.Name(), err)
+		return
+	}
+
+	msg, err := decodeSPA(packet, key, hmacKey)
+	user := ""
+	if err != nil {
+		// Sealed with a user's own keys, which identifies them
+		if u := s.keyedUser(ip, func(u *User, userKey string) error {
+			userHMAC := hmacKey
+			if u.HMACKey != "" {
+				userHMAC = []byte(u.HMACKey)
+			}
+			msg, err = decodeSPA(packet, []byte(userKey), userHMAC)
+			return err
+		}); u != nil {
+			user = u.Name
+		}
+	}
+	if err == nil {
+		if age := now.Sub(msg.Time); age > fwknopMaxAge || age < -fwknopMaxAge {
+			err = fmt.Errorf("packet is %s off the server clock", age.Round(time.Second))
+		} else if !s.digests.use(msg.Digest, now) {
+			err = errors.New("packet replayed")
+		}
+	}
+	if err != nil {
+		log.Printf("[%s] Invalid SPA packet from %s: %v", s.Name(), ip, err)
+		s.failed(ip, 0, now, "invalid SPA packet: "+err.Error())
+		return
+	}
+
+	// Clients ask for 0.0.0.0 to have the packet source opened
+	allow := ip
+	if !msg.Allow.IsUnspecified() {
+		allow = msg.Allow.String()
+	}
+	if allow != ip && s.cfg.Fwknop.RequireSourceAddress {
+		log.Printf("[%s] SPA packet from %s asks access for %s, refused", s.Name(), ip, allow)
+		s.failed(ip, 0, now, "SPA packet asks access for "+allow)
+		return
+	}
+	if allow != ip {
+		if allow, err = s.checkTarget(ip, msg.Allow); err != nil {
+			log.Printf("[%s] SPA packet from %s refused: %v", s.Name(), ip, err)
+			s.failed(ip, 0, now, "SPA packet: "+err.Error())
+			return
+		}
+	}
+
+	log.Printf("[%s] SPA packet from %s%s (fwknop user %q) for ports %v", s.Name(), ip, userSuffix(user), msg.User, msg.Ports)
+
+	access := Access{Instance: s.Name(), IP: allow, User: user, Time: now}
+	if allow != ip {
+		access.Source = ip
+	}
+	p, err := narrowProfile(&access, s.profiles[0], msg.Ports, msg.Timeout, s.cfg.Fwknop.Ports, s.cfg.Fwknop.MaxTimeout.Duration, s.cfg.ProtectedPorts)
+	if err != nil {
+		log.Printf("[%s] Rejected SPA request from %s: %v", s.Name(), ip, err)
+		s.spawn(func() { s.deny(access, s.profiles[0], err.Error()) })
+		return
+	}
+	s.spawn(func() { s.complete(access, p) })
+}
@@ -0,0 +1,228 @@
+package knock
+
+import (
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultGeoIPReload = time.Minute
+
+type GeoIPConfig struct {
+	Country string   `json:"country"` // GeoLite2/GeoIP2 Country or City database
+	ASN     string   `json:"asn"`     // GeoLite2/GeoIP2 ASN database
+	Reload  Duration `json:"reload"`  // How often the files are checked for updates, 1m when zero
+}
+
+func (c GeoIPConfig) Enabled() bool {
+	return c.Country != "" || c.ASN != ""
+}
+
+// GeoInfo is what the databases know about a source. Fields are empty when
+// the address is not in a database, e.g. private ranges.
+type GeoInfo struct {
+	Country string `json:"country,omitempty"` // ISO 3166-1 alpha-2 code
+	ASN     uint   `json:"asn,omitempty"`
+	Org     string `json:"org,omitempty"` // Owner of the ASN
+}
+
+func (g GeoInfo) String() string {
+	var parts []string
+	if g.Country != "" {
+		parts = append(parts, g.Country)
+	}
+	if g.ASN != 0 {
+		parts = append(parts, fmt.Sprintf("AS%d", g.ASN))
+	}
+	return strings.Join(parts, " ")
+}
+
+// GeoRule restricts a sequence to sources in some countries or networks.
+type GeoRule struct {
+	Countries []string // Any when empty
+	ASNs      []uint   // Any when empty
+}
+
+func (r GeoRule) matches(g GeoInfo) bool {
+	if len(r.Countries) > 0 && !slices.Contains(r.Countries, g.Country) {
+		return false
+	}
+	return len(r.ASNs) == 0 || slices.Contains(r.ASNs, g.ASN)
+}
+
+// normalizeCountries upper-cases the codes and rejects anything but two letters.
+func normalizeCountries(codes []string) error {
+	for i, code := range codes {
+		code = strings.ToUpper(strings.TrimSpace(code))
+		if len(code) != 2 || strings.Trim(code, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+			return fmt.Errorf("invalid country code %q", codes[i])
+		}
+		codes[i] = code
+	}
+	return nil
+}
+
+// geoFile is one database along with the file state it was read from.
+type geoFile struct {
+	path    string
+	db      *mmdb
+	modTime time.Time
+	size    int64
+}
+
+func openGeoFile(path string) (*geoFile, error) {
+	if path == "" {
+		return nil, nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	db, err := openMMDB(path)
+	if err != nil {
+		return nil, err
+	}
+	return &geoFile{path: path, db: db, modTime: info.ModTime(), size: info.Size()}, nil
+}
+
+// changed reports whether the file on disk differs from the one loaded.
+func (f *geoFile) changed() bool {
+	info, err := os.Stat(f.path)
+	return err == nil && (!info.ModTime().Equal(f.modTime) || info.Size() != f.size)
+}
+
+// GeoIP looks sources up in MaxMind databases, picking up new files as
+// they are replaced on disk.
+type GeoIP struct {
+	cfg     GeoIPConfig
+	country *geoFile
+	asn     *geoFile
+	mutex   sync.RWMutex
+}
+
+func OpenGeoIP(cfg GeoIPConfig) (*GeoIP, error) {
+	country, err := openGeoFile(cfg.Country)
+	if err != nil {
+		return nil, fmt.Errorf("geoip country database: %w", err)
+	}
+	asn, err := openGeoFile(cfg.ASN)
+	if err != nil {
+		return nil, fmt.Errorf("geoip asn database: %w", err)
+	}
+	return &GeoIP{cfg: cfg, country: country, asn: asn}, nil
+}
+
+// Lookup returns what the databases know about addr.
+func (g *GeoIP) Lookup(addr netip.Addr) GeoInfo {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+
+	var info GeoInfo
+	if g.country != nil {
+		rec, ok, err := g.country.db.lookup(addr)
+		if err != nil {
+			log.Printf("GeoIP lookup of %s failed: %v", addr, err)
+		}
+		if ok {
+			info.Country = geoCountry(rec)
+		}
+	}
+	if g.asn != nil {
+		rec, ok, err := g.asn.db.lookup(addr)
+		if err != nil {
+			log.Printf("GeoIP lookup of %s failed: %v", addr, err)
+		}
+		if m, isMap := rec.(map[string]any); ok && isMap {
+			info.ASN = uint(mmdbUint(m["autonomous_system_number"]))
+			info.Org, _ = m["autonomous_system_organization"].(string)
+		}
+	}
+	return info
+}
+
+// geoCountry reads the country of a Country or City record, falling back to
+// the country the network is registered in.
+func geoCountry(rec any) string {
+	m, _ := rec.(map[string]any)
+	for _, key := range []string{"country", "registered_country"} {
+		if c, ok := m[key].(map[string]any); ok {
+			if code, ok := c["iso_code"].(string); ok {
+				return code
+			}
+		}
+	}
+	return ""
+}
+
+// Reload reopens the databases whose files changed. A file that fails to
+// load keeps the previous one in use.
+func (g *GeoIP) Reload() {
+	for _, f := range []**geoFile{&g.country, &g.asn} {
+		g.mutex.RLock()
+		current := *f
+		g.mutex.RUnlock()
+
+		if current == nil || !current.changed() {
+			continue
+		}
+		next, err := openGeoFile(current.path)
+		if err != nil {
+			log.Printf("Failed to reload GeoIP database %s: %v", current.path, err)
+			continue
+		}
+
+		g.mutex.Lock()
+		*f = next
+		g.mutex.Unlock()
+		log.Printf("Reloaded GeoIP database %s (%s)", next.path, next.db.dbType)
+	}
+}
+
+// Run reloads changed databases every reload interval until stop is closed.
+func (g *GeoIP) Run(stop <-chan struct{}) {
+	interval := g.cfg.Reload.Duration
+	if interval == 0 {
+		interval = defaultGeoIPReload
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			g.Reload()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// checkGeoRules makes sure the databases the instance's rules need are configured.
+func checkGeoRules(cfg GeoIPConfig, inst InstanceConfig) error {
+	rules := map[string]GeoRule{"": {Countries: inst.Countries, ASNs: inst.ASNs}}
+	for name, p := range inst.Profiles {
+		rules[name] = GeoRule{Countries: p.Countries, ASNs: p.ASNs}
+	}
+
+	for name, r := range rules {
+		switch {
+		case len(r.Countries) > 0 && cfg.Country == "":
+			return fmt.Errorf("%scountries need geoip.country", geoRuleOwner(name))
+		case len(r.ASNs) > 0 && cfg.ASN == "":
+			return fmt.Errorf("%sasns need geoip.asn", geoRuleOwner(name))
+		}
+	}
+	return nil
+}
+
+func geoRuleOwner(profile string) string {
+	if profile == "" {
+		return ""
+	}
+	return "profile " + profile + ": "
+}
@@ -0,0 +1,124 @@
+package knock
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+const healthCheckTimeout = 5 * time.Second
+
+// HealthResult is the outcome of one readiness check.
+type HealthResult struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// HealthReport answers the health endpoints: "ok", or "unavailable" when
+// any check failed.
+type HealthReport struct {
+	Status string         `json:"status"`
+	Checks []HealthResult `json:"checks,omitempty"`
+}
+
+func newHealthReport(checks []HealthResult) HealthReport {
+	report := HealthReport{Status: "ok", Checks: checks}
+	for _, c := range checks {
+		if !c.OK {
+			report.Status = "unavailable"
+		}
+	}
+	return report
+}
+
+func healthResult(name string, err error) HealthResult {
+	if err != nil {
+		return HealthResult{Name: name, Error: err.Error()}
+	}
+	return HealthResult{Name: name, OK: true}
+}
+
+// healthChecks returns the registered actions depending on outside systems.
+func (r *Registry) healthChecks() map[string]HealthCheck {
+	checks := make(map[string]HealthCheck)
+	for name, a := range r.actions {
+		if h, ok := a.(HealthCheck); ok {
+			checks[name] = h
+		}
+	}
+	return checks
+}
+
+// instanceHealth reports whether every enabled instance is running, its
+// listeners bound, along with the error that stopped those that are not.
+func (sup *Supervisor) instanceHealth() []HealthResult {
+	sup.mutex.Lock()
+	defer sup.mutex.Unlock()
+
+	var results []HealthResult
+	for _, name := range sup.order {
+		inst := sup.instances[name]
+		if inst.server.cfg.Disabled {
+			continue
+		}
+
+		var err error
+		switch {
+		case inst.lastErr != nil:
+			err = inst.lastErr
+		case !inst.server.Running():
+			err = errors.New("not running")
+		}
+		results = append(results, healthResult("instance:"+name, err))
+	}
+	return results
+}
+
+// healthz is the liveness probe. Like the systemd watchdog, it takes the
+// supervisor and session locks, so a deadlocked daemon stops answering.
+func (a *AdminServer) healthz(w http.ResponseWriter, r *http.Request) {
+	_ = a.sup.Status()
+	_ = a.sessions.List()
+	writeJSON(w, http.StatusOK, newHealthReport(nil))
+}
+
+// readyz is the readiness probe: the config is loaded, every enabled
+// instance has its listeners bound and every firewall backend answers.
+// Failure details, which name paths and commands, need the admin token.
+func (a *AdminServer) readyz(w http.ResponseWriter, r *http.Request) {
+	checks := []HealthResult{{Name: "config", OK: true}}
+	checks = append(checks, a.sup.instanceHealth()...)
+
+	ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+	defer cancel()
+
+	names := slices.Sorted(maps.Keys(a.checks))
+	results := make([]HealthResult, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Go(func() {
+			results[i] = healthResult("action:"+name, a.checks[name].CheckHealth(ctx))
+		})
+	}
+	wg.Wait()
+
+	report := newHealthReport(append(checks, results...))
+	if !a.authorized(r) {
+		for i := range report.Checks {
+			report.Checks[i].Error = ""
+		}
+	}
+	if report.Status != "ok" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_ = json.NewEncoder(w).Encode(Response{Success: false, Data: report, Error: "not ready"})
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
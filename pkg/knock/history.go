@@ -0,0 +1,49 @@
+package knock
+
+import (
+	"sync"
+	"time"
+)
+
+const historyRetention = 24 * time.Hour
+
+// History remembers recently completed sequences per IP across all instances,
+// so policies can require several sequences to be completed together.
+type History struct {
+	entries map[string][]Access
+	mutex   sync.Mutex
+}
+
+func NewHistory() *History {
+	return &History{
+		entries: make(map[string][]Access),
+	}
+}
+
+func (h *History) Record(access Access) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	cutoff := access.Time.Add(-historyRetention)
+	kept := h.entries[access.IP][:0]
+	for _, a := range h.entries[access.IP] {
+		if a.Time.After(cutoff) {
+			kept = append(kept, a)
+		}
+	}
+	h.entries[access.IP] = append(kept, access)
+}
+
+// CompletedWithin reports whether ip completed the instance's sequence in the last d.
+func (h *History) CompletedWithin(ip, instance string, d time.Duration) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	cutoff := time.Now().Add(-d)
+	for _, a := range h.entries[ip] {
+		if a.Instance == instance && a.Time.After(cutoff) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,210 @@
+package knock
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"time"
+)
+
+const (
+	// HTTPSKnockSignatureHeader carries the hex HMAC-SHA256 of the request body
+	HTTPSKnockSignatureHeader = "X-Knock-Signature"
+
+	maxHTTPSKnockSize = 4 << 10
+)
+
+// HTTPSKnockConfig accepts knocks as signed requests on an HTTPS endpoint,
+// for networks letting nothing but 443 out. A valid request counts as the
+// whole sequence of the profile it names; bans, denylists and failure
+// counting apply as they do to port knocks.
+type HTTPSKnockConfig struct {
+	Listen      string   `json:"listen"`   // Address to serve on, e.g. ":443"; empty disables the endpoint
+	Key         string   `json:"key"`      // HMAC-SHA256 secret signing requests
+	TLSCert     string   `json:"tls_cert"` // Certificate and key the endpoint is served with
+	TLSKey      string   `json:"tls_key"`
+	Ports       []int    `json:"ports"`        // Ports a request may open, the protected ports when empty
+	MaxDuration Duration `json:"max_duration"` // Longest access a request may ask for, the session TTL when zero
+}
+
+func (c HTTPSKnockConfig) Enabled() bool {
+	return c.Listen != ""
+}
+
+// HTTPSKnockRequest is the body a client POSTs to /knock.
+type HTTPSKnockRequest struct {
+	Profile  string   `json:"profile,omitempty"` // Named profile to complete, the default one when empty
+	Ports    []int    `json:"ports,omitempty"`   // Services to open, the actions' own ports when empty
+	Duration Duration `json:"duration,omitzero"` // Session length, the profile TTL when zero
+	Time     int64    `json:"time"`              // Unix seconds when signed
+	Nonce    string   `json:"nonce"`             // Random, never reused
+	Client   string   `json:"client,omitempty"`  // Client ID sessions are kept under instead of the source IP
+	Allow    string   `json:"allow,omitempty"`   // Address to open instead of the source, within request_targets
+}
+
+// SignHTTPSKnock returns the signature header value for body.
+func SignHTTPSKnock(key string, body []byte) string {
+	return hex.EncodeToString(httpsKnockMAC(key, body))
+}
+
+func httpsKnockMAC(key string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// listenHTTPS binds the knock endpoint and builds its server. Code based
+// second factors of the instance are served next to it, at
+// /confirm/<name>, so a client behind the same firewall can complete them.
+func (s *Server) listenHTTPS() (net.Listener, *http.Server, error) {
+	ln, err := listen(listenNetwork(s.cfg.Family), s.cfg.HTTPS.Listen)
+	if err != nil {
+		return nil, nil, fmt.Errorf("listening for HTTPS knocks: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /knock", s.serveHTTPSKnock)
+	for _, p := range s.profiles {
+		if f := p.secondFactor; f != nil && f.acceptsCodes() {
+			prefix := "/confirm/" + f.Name()
+			mux.Handle(prefix+"/", http.StripPrefix(prefix, f.handler()))
+		}
+	}
+	return ln, &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}, nil
+}
+
+func (s *Server) serveHTTPS(srv *http.Server, ln net.Listener) {
+	log.Printf("[%s] Listening for HTTPS knocks on %s", s.Name(), ln.Addr())
+	err := srv.ServeTLS(ln, s.cfg.HTTPS.TLSCert, s.cfg.HTTPS.TLSKey)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("[%s] HTTPS knock endpoint stopped: %v", s.Name(), err)
+	}
+}
+
+func (s *Server) serveHTTPSKnock(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxHTTPSKnockSize+1))
+	if err != nil || len(body) > maxHTTPSKnockSize {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	// Every refusal looks the same, like an unanswered port knock
+	if !s.processHTTPSKnock(requestIP(r), body, r.Header.Get(HTTPSKnockSignatureHeader)) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// processHTTPSKnock checks a signed request from ip and completes the
+// profile it names, reporting whether it was accepted.
+func (s *Server) processHTTPSKnock(ip string, body []byte, signature string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.clock.Now()
+	s.stats.record(statAttempt, s.Name(), ip, 0, now)
+	s.metrics.count(statAttempt, s.Name(), "", "")
+
+	if s.denied(ip) {
+		log.Printf("[%s] Ignoring HTTPS knock from denylisted IP %s", s.Name(), ip)
+		return false
+	}
+	if f := s.blocklisted(ip); f != nil && s.cfg.BlocklistMode == BlocklistReject {
+		log.Printf("[%s] Ignoring HTTPS knock from %s listed by blocklist %s", s.Name(), ip, f.Name())
+		return false
+	}
+	if ban, ok := s.bans.Banned(ip, now); ok {
+		log.Printf("[%s] Ignoring HTTPS knock from banned IP %s until %s", s.Name(), ip, ban.Until.Format(time.RFC3339))
+		return false
+	}
+
+	req, p, err := s.checkHTTPSKnock(ip, body, signature, now)
+	if err != nil {
+		log.Printf("[%s] Invalid HTTPS knock from %s: %v", s.Name(), ip, err)
+		s.failed(ip, 0, now, "invalid HTTPS knock: "+err.Error())
+		return false
+	}
+	log.Printf("[%s] HTTPS knock OK %s%s", s.Name(), ip, profileSuffix(p.name))
+	s.stats.record(statCompletion, s.Name(), ip, 0, now)
+	s.metrics.count(statCompletion, s.Name(), profileName(p.name), "")
+
+	access := Access{Instance: s.Name(), IP: ip, Profile: p.name, Time: now, nonce: req.Nonce}
+	if err := s.identify(&access, req.Client, req.Allow); err != nil {
+		log.Printf("[%s] Rejected HTTPS request from %s: %v", s.Name(), ip, err)
+		s.spawn(func() { s.deny(access, p, err.Error()) })
+		return false
+	}
+	requested, err := narrowProfile(&access, p, req.Ports, req.Duration.Duration, s.cfg.HTTPS.Ports, s.cfg.HTTPS.MaxDuration.Duration, s.cfg.ProtectedPorts)
+	if err != nil {
+		log.Printf("[%s] Rejected HTTPS request from %s: %v", s.Name(), ip, err)
+		s.spawn(func() { s.deny(access, p, err.Error()) })
+		return false
+	}
+	s.spawn(func() { s.complete(access, requested) })
+	return true
+}
+
+// checkHTTPSKnock verifies the signature, freshness and profile of a
+// request. Callers hold the server mutex.
+func (s *Server) checkHTTPSKnock(ip string, body []byte, signature string, now time.Time) (HTTPSKnockRequest, *profile, error) {
+	var req HTTPSKnockRequest
+
+	sig, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(sig, httpsKnockMAC(s.cfg.HTTPS.Key, body)) {
+		return req, nil, errors.New("bad signature")
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return req, nil, fmt.Errorf("parsing request: %w", err)
+	}
+	if age := now.Sub(time.Unix(req.Time, 0)); age > payloadMaxAge || age < -payloadMaxAge {
+		return req, nil, fmt.Errorf("request is %s off the server clock", age.Round(time.Second))
+	}
+	if req.Nonce == "" || !s.nonces.use("https:"+req.Nonce, now) {
+		return req, nil, errors.New("request replayed")
+	}
+
+	p, err := s.requestedProfile(ip, "", req.Profile)
+	return req, p, err
+}
+
+// requestedProfile returns the profile a sequence-less knock names, the
+// default one when empty, checking a knock from ip by user may complete it
+// the way its sequence could be. User is empty when no key named them, and
+// then looked up by address.
+func (s *Server) requestedProfile(ip, user, name string) (*profile, error) {
+	if name == defaultProfileName {
+		name = ""
+	}
+	p := s.profile(name)
+	if p.name != name {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownProfile, name)
+	}
+
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil, err
+	}
+	addr = addr.Unmap()
+	if user == "" && s.users != nil {
+		if u, ok := s.users.Identify(s.Name(), ip); ok {
+			user = u.Name
+		}
+	}
+	var geo GeoInfo
+	if s.geo != nil {
+		geo = s.geo.Lookup(addr)
+	}
+	if !p.allows(addr, geo, user) {
+		return nil, fmt.Errorf("profile %s not allowed from this source", profileName(p.name))
+	}
+	return p, nil
+}
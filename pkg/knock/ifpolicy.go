@@ -0,0 +1,114 @@
+package knock
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// otherInterfaces keys the policy for interfaces without one of their own
+	otherInterfaces  = "*"
+	interfaceRefresh = 5 * time.Second
+)
+
+// IfacePolicy limits what knocks arriving on one interface can do.
+type IfacePolicy struct {
+	Ignore   bool     `json:"ignore"`   // Drop every knock seen on this interface
+	Profiles []string `json:"profiles"` // Sequences accepted here, "default" for the instance's own; all when empty
+}
+
+// accepts reports whether the sequence of the named profile may be knocked.
+func (p IfacePolicy) accepts(profile string) bool {
+	if len(p.Profiles) == 0 {
+		return true
+	}
+	return slices.Contains(p.Profiles, profileName(profile))
+}
+
+func checkIfacePolicies(cfg InstanceConfig) error {
+	for name, p := range cfg.Interfaces {
+		for _, profile := range p.Profiles {
+			if _, ok := cfg.Profiles[profile]; !ok && profile != defaultProfileName {
+				return fmt.Errorf("interface %s: unknown profile %q", name, profile)
+			}
+		}
+	}
+	return nil
+}
+
+// interfaceNames maps interface indexes and local addresses to interface
+// names, reloaded when a lookup misses at most every interfaceRefresh.
+type interfaceNames struct {
+	byIndex map[int]string
+	byAddr  map[netip.Addr]string
+	loaded  time.Time
+	mutex   sync.Mutex
+}
+
+func (n *interfaceNames) lookup(addr netip.Addr, index int) string {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	addr = addr.Unmap().WithZone("")
+	name, ok := n.find(addr, index)
+	if !ok && time.Since(n.loaded) >= interfaceRefresh {
+		n.load()
+		name, _ = n.find(addr, index)
+	}
+	return name
+}
+
+func (n *interfaceNames) find(addr netip.Addr, index int) (string, bool) {
+	if index > 0 {
+		name, ok := n.byIndex[index]
+		return name, ok
+	}
+	name, ok := n.byAddr[addr]
+	return name, ok
+}
+
+func (n *interfaceNames) load() {
+	n.loaded = time.Now()
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return
+	}
+	n.byIndex = make(map[int]string, len(ifaces))
+	n.byAddr = make(map[netip.Addr]string)
+	for _, ifi := range ifaces {
+		n.byIndex[ifi.Index] = ifi.Name
+
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if prefix, err := netip.ParsePrefix(a.String()); err == nil {
+				n.byAddr[prefix.Addr().Unmap()] = ifi.Name
+			}
+		}
+	}
+}
+
+// knockInterface names the interface a knock arrived on, from the index the
+// capture reported or else the local address it was sent to. It is empty
+// when the instance has no interface policies or the interface is unknown.
+func (s *Server) knockInterface(local netip.Addr, index int) string {
+	if s.ifaces == nil {
+		return ""
+	}
+	return s.ifaces.lookup(local, index)
+}
+
+// ifacePolicy returns the policy for knocks seen on iface.
+func (s *Server) ifacePolicy(iface string) IfacePolicy {
+	if p, ok := s.cfg.Interfaces[iface]; ok && iface != "" {
+		return p
+	}
+	return s.cfg.Interfaces[otherInterfaces]
+}
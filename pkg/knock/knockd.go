@@ -0,0 +1,172 @@
+package knock
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// isKnockdConfig reports whether data looks like a knockd.conf rather than
+// JSON: its first meaningful line opens a section.
+func isKnockdConfig(data []byte) bool {
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		return strings.HasPrefix(line, "[")
+	}
+	return false
+}
+
+// parseKnockdConfig converts a classic knockd.conf into a config. Every
+// section but [options] becomes an instance in capture mode, which like
+// knockd sees SYNs to closed ports, and a command action running the
+// section's commands through /bin/sh with %IP% replaced by the client.
+func parseKnockdConfig(data []byte) (*Config, error) {
+	cfg := &Config{Commands: make(map[string]CommandConfig)}
+
+	var (
+		iface   string
+		inst    *InstanceConfig
+		command *CommandConfig
+	)
+
+	finish := func() {
+		if inst == nil {
+			return
+		}
+		if command.Grant != "" || command.Expire != "" {
+			cfg.Commands[inst.Name] = *command
+			inst.Actions = []string{inst.Name}
+		}
+		cfg.Instances = append(cfg.Instances, *inst)
+		inst, command = nil, nil
+	}
+
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			finish()
+			name := strings.TrimSpace(line[1 : len(line)-1])
+			if !strings.EqualFold(name, "options") {
+				inst = &InstanceConfig{Name: name, Mode: ModeCapture, Interface: iface}
+				command = &CommandConfig{}
+			}
+			continue
+		}
+
+		key, value, _ := strings.Cut(line, "=")
+		key, value = strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(value)
+
+		var err error
+		if inst == nil {
+			err = knockdOption(key, value, &iface)
+		} else {
+			err = knockdDirective(key, value, inst, command)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("knockd config line %d: %w", n, err)
+		}
+	}
+	finish()
+
+	return cfg, sc.Err()
+}
+
+func knockdOption(key, value string, iface *string) error {
+	switch key {
+	case "interface":
+		*iface = value
+	case "usesyslog", "logfile", "pidfile":
+		log.Printf("knockd option %s is ignored, the server logs to stderr", key)
+	default:
+		return fmt.Errorf("unknown option %q", key)
+	}
+	return nil
+}
+
+func knockdDirective(key, value string, inst *InstanceConfig, command *CommandConfig) error {
+	switch key {
+	case "sequence":
+		seq, err := parseKnockdSequence(value)
+		if err != nil {
+			return err
+		}
+		inst.Sequence = seq
+	case "seq_timeout":
+		secs, err := strconv.Atoi(value)
+		if err != nil || secs < 1 {
+			return fmt.Errorf("invalid seq_timeout %q", value)
+		}
+		// knockd only bounds the whole sequence, not the gaps within it
+		inst.Timeout = Duration{time.Duration(secs) * time.Second}
+		inst.SequenceTimeout = inst.Timeout
+	case "cmd_timeout":
+		secs, err := strconv.Atoi(value)
+		if err != nil || secs < 1 {
+			return fmt.Errorf("invalid cmd_timeout %q", value)
+		}
+		inst.SessionTTL = Duration{time.Duration(secs) * time.Second}
+	case "command", "start_command":
+		command.Grant = knockdCommand(value)
+	case "stop_command":
+		command.Expire = knockdCommand(value)
+	case "tcpflags":
+		// Only plain SYNs are counted as knocks
+		if !strings.EqualFold(strings.ReplaceAll(value, " ", ""), "syn") {
+			return fmt.Errorf("tcpflags %q is not supported, only syn", value)
+		}
+	case "target":
+		inst.Bind = value
+	case "one_time_sequences":
+		return fmt.Errorf("one_time_sequences is not supported, use replay_window instead")
+	default:
+		return fmt.Errorf("unknown directive %q", key)
+	}
+	return nil
+}
+
+// parseKnockdSequence reads "7000,8000:tcp,7000", merging repeated
+// consecutive ports into counted steps.
+func parseKnockdSequence(value string) ([]KnockStep, error) {
+	var seq []KnockStep
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		port, proto, _ := strings.Cut(item, ":")
+		if proto != "" && !strings.EqualFold(proto, "tcp") {
+			return nil, fmt.Errorf("%s knocks are not supported, only tcp", proto)
+		}
+
+		p, err := strconv.Atoi(port)
+		if err != nil || p < 1 || p > 65535 {
+			return nil, fmt.Errorf("invalid port %q", port)
+		}
+
+		if len(seq) > 0 && seq[len(seq)-1].Port == p {
+			seq[len(seq)-1].Count++
+			continue
+		}
+		seq = append(seq, KnockStep{Port: p, Count: 1})
+	}
+	return seq, nil
+}
+
+// knockdCommand turns a knockd shell command into a command template run by
+// /bin/sh, since knockd commands rely on shell parsing.
+func knockdCommand(value string) string {
+	value = strings.ReplaceAll(value, "%IP%", "{{.IP}}")
+	return "/bin/sh -c '" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
@@ -0,0 +1,296 @@
+package knock
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"os"
+)
+
+// The MaxMind DB format, see https://maxmind.github.io/MaxMind-DB/.
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+const (
+	mmdbMetadataMaxSize = 128 << 10
+	mmdbDataSeparator   = 16
+
+	mmdbPointer   = 1
+	mmdbString    = 2
+	mmdbDouble    = 3
+	mmdbBytes     = 4
+	mmdbUint16    = 5
+	mmdbUint32    = 6
+	mmdbMap       = 7
+	mmdbInt32     = 8
+	mmdbUint64    = 9
+	mmdbUint128   = 10
+	mmdbArray     = 11
+	mmdbContainer = 12
+	mmdbEnd       = 13
+	mmdbBool      = 14
+	mmdbFloat     = 15
+)
+
+var errMMDBCorrupt = errors.New("corrupt MaxMind database")
+
+// mmdb is a MaxMind database read whole into memory. Records decode to
+// map[string]any, []any, string, bool, float64, int64 or uint64 values.
+type mmdb struct {
+	tree       []byte
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	dbType     string
+	ipv4Start  uint // Node of ::/96 in an IPv6 tree
+}
+
+func openMMDB(path string) (*mmdb, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	start := max(0, len(buf)-mmdbMetadataMaxSize)
+	at := bytes.LastIndex(buf[start:], mmdbMetadataMarker)
+	if at < 0 {
+		return nil, fmt.Errorf("%s: not a MaxMind database", path)
+	}
+	metaStart := start + at + len(mmdbMetadataMarker)
+
+	meta, _, err := mmdbDecode(buf[metaStart:], 0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: metadata: %w", path, err)
+	}
+	fields, ok := meta.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%s: metadata: %w", path, errMMDBCorrupt)
+	}
+
+	db := &mmdb{
+		nodeCount:  uint(mmdbUint(fields["node_count"])),
+		recordSize: uint(mmdbUint(fields["record_size"])),
+		ipVersion:  uint(mmdbUint(fields["ip_version"])),
+	}
+	db.dbType, _ = fields["database_type"].(string)
+	switch db.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("%s: unsupported record size %d", path, db.recordSize)
+	}
+
+	treeSize := int(db.nodeCount * db.recordSize / 4)
+	if treeSize+mmdbDataSeparator > start+at {
+		return nil, fmt.Errorf("%s: search tree: %w", path, errMMDBCorrupt)
+	}
+	db.tree = buf[:treeSize]
+	db.data = buf[treeSize+mmdbDataSeparator : start+at]
+
+	if db.ipVersion == 6 {
+		for i := 0; i < 96 && db.ipv4Start < db.nodeCount; i++ {
+			db.ipv4Start = db.record(db.ipv4Start, 0)
+		}
+	}
+	return db, nil
+}
+
+// record reads the left (bit 0) or right (bit 1) record of a tree node.
+func (db *mmdb) record(node uint, bit byte) uint {
+	switch db.recordSize {
+	case 24:
+		b := db.tree[node*6+uint(bit)*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := db.tree[node*7:]
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(db.tree[node*8+uint(bit)*4:]))
+	}
+}
+
+// lookup returns the record holding addr, false when the database has none.
+func (db *mmdb) lookup(addr netip.Addr) (any, bool, error) {
+	addr = addr.Unmap()
+
+	var ip []byte
+	node := uint(0)
+	switch {
+	case addr.Is4() && db.ipVersion == 6:
+		a := addr.As4()
+		ip, node = a[:], db.ipv4Start
+	case addr.Is4():
+		a := addr.As4()
+		ip = a[:]
+	case db.ipVersion == 6:
+		a := addr.As16()
+		ip = a[:]
+	default:
+		return nil, false, nil
+	}
+
+	for i := 0; i < len(ip)*8 && node < db.nodeCount; i++ {
+		node = db.record(node, ip[i/8]>>(7-i%8)&1)
+	}
+	if node <= db.nodeCount {
+		return nil, false, nil
+	}
+
+	offset := node - db.nodeCount - mmdbDataSeparator
+	if offset >= uint(len(db.data)) {
+		return nil, false, errMMDBCorrupt
+	}
+	v, _, err := mmdbDecode(db.data, int(offset))
+	return v, err == nil, err
+}
+
+// mmdbDecode decodes the field at offset of a data section, returning the
+// offset past it.
+func mmdbDecode(data []byte, offset int) (any, int, error) {
+	if offset >= len(data) {
+		return nil, 0, errMMDBCorrupt
+	}
+	ctrl := data[offset]
+	offset++
+
+	typ := int(ctrl >> 5)
+	if typ == mmdbPointer {
+		return mmdbFollow(data, ctrl, offset)
+	}
+	if typ == 0 {
+		if offset >= len(data) {
+			return nil, 0, errMMDBCorrupt
+		}
+		typ = 7 + int(data[offset])
+		offset++
+	}
+
+	size := int(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > len(data) {
+			return nil, 0, errMMDBCorrupt
+		}
+		extra := 0
+		for _, b := range data[offset : offset+n] {
+			extra = extra<<8 | int(b)
+		}
+		offset += n
+		switch n {
+		case 1:
+			size = 29 + extra
+		case 2:
+			size = 285 + extra
+		default:
+			size = 65821 + extra
+		}
+	}
+
+	switch typ {
+	case mmdbMap:
+		m := make(map[string]any, size)
+		for range size {
+			k, next, err := mmdbDecode(data, offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errMMDBCorrupt
+			}
+			if m[key], offset, err = mmdbDecode(data, next); err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, offset, nil
+	case mmdbArray:
+		a := make([]any, size)
+		for i := range a {
+			var err error
+			if a[i], offset, err = mmdbDecode(data, offset); err != nil {
+				return nil, 0, err
+			}
+		}
+		return a, offset, nil
+	case mmdbBool:
+		return size != 0, offset, nil
+	case mmdbContainer, mmdbEnd:
+		return nil, offset, nil
+	}
+
+	if offset+size > len(data) {
+		return nil, 0, errMMDBCorrupt
+	}
+	b := data[offset : offset+size]
+	offset += size
+
+	switch typ {
+	case mmdbString:
+		return string(b), offset, nil
+	case mmdbBytes:
+		return bytes.Clone(b), offset, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	case mmdbInt32:
+		var v int32
+		for _, c := range b {
+			v = v<<8 | int32(c)
+		}
+		return int64(v), offset, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64, mmdbUint128:
+		if size > 8 {
+			return nil, offset, nil // Nothing here needs 128 bit integers
+		}
+		var v uint64
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		return v, offset, nil
+	}
+	return nil, 0, fmt.Errorf("%w: unknown field type %d", errMMDBCorrupt, typ)
+}
+
+// mmdbFollow decodes the field a pointer refers to. The offset returned is
+// past the pointer itself.
+func mmdbFollow(data []byte, ctrl byte, offset int) (any, int, error) {
+	n := int(ctrl>>3&3) + 1
+	if offset+n > len(data) {
+		return nil, 0, errMMDBCorrupt
+	}
+
+	target := 0
+	if n < 4 {
+		target = int(ctrl & 7)
+	}
+	for _, b := range data[offset : offset+n] {
+		target = target<<8 | int(b)
+	}
+	switch n {
+	case 2:
+		target += 2048
+	case 3:
+		target += 526336
+	}
+
+	v, _, err := mmdbDecode(data, target)
+	return v, offset + n, err
+}
+
+// mmdbUint reads an unsigned integer field, 0 when it is anything else.
+func mmdbUint(v any) uint64 {
+	n, _ := v.(uint64)
+	return n
+}
@@ -0,0 +1,236 @@
+package knock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	FamilyDual = "dual" // IPv4 and IPv6 on one socket where the OS allows it
+	FamilyIPv4 = "ipv4"
+	FamilyIPv6 = "ipv6"
+)
+
+// listenNetwork maps an address family setting to a net.Listen network.
+func listenNetwork(family string) string {
+	switch family {
+	case FamilyIPv4:
+		return "tcp4"
+	case FamilyIPv6:
+		return "tcp6"
+	default:
+		return "tcp"
+	}
+}
+
+// packetNetwork maps an address family setting to a net.ListenPacket network.
+func packetNetwork(family string) string {
+	switch family {
+	case FamilyIPv4:
+		return "udp4"
+	case FamilyIPv6:
+		return "udp6"
+	default:
+		return "udp"
+	}
+}
+
+// listen is net.Listen, preferring a matching socket passed by systemd
+// socket activation so the daemon needs no privileges to bind.
+func listen(network, addr string) (net.Listener, error) {
+	if ln, ok := activatedListener(addr); ok {
+		return ln, nil
+	}
+	return net.Listen(network, addr)
+}
+
+// listenShared is listen with SO_REUSEPORT, so several listeners can share
+// addr and the kernel spreads connections between them.
+func listenShared(network, addr string) (net.Listener, error) {
+	if ln, ok := activatedListener(addr); ok {
+		return ln, nil // A dup of the one activated socket, sharing its queue
+	}
+	lc := net.ListenConfig{Control: reusePort}
+	return lc.Listen(context.Background(), network, addr)
+}
+
+// listenPacket is net.ListenPacket, preferring an activated socket.
+func listenPacket(network, addr string) (net.PacketConn, error) {
+	if conn, ok := activatedPacketConn(addr); ok {
+		return conn, nil
+	}
+	return net.ListenPacket(network, addr)
+}
+
+// ListenerConfig overrides where one knock port is bound.
+type ListenerConfig struct {
+	Port      int    `json:"port"`
+	Bind      string `json:"bind"`      // Address to bind, the instance bind when empty
+	Interface string `json:"interface"` // Bind every address of this interface instead
+}
+
+func checkListeners(cfg InstanceConfig) error {
+	if len(cfg.Listeners) == 0 {
+		return nil
+	}
+	if observingMode(cfg.Mode) {
+		return fmt.Errorf("listeners need listening sockets, not %s mode", cfg.Mode)
+	}
+
+	ports := listenPorts(cfg)
+	seen := make(map[int]bool, len(cfg.Listeners))
+	for _, l := range cfg.Listeners {
+		if !slices.Contains(ports, l.Port) {
+			return fmt.Errorf("listener port %d is not a knock or trap port", l.Port)
+		}
+		if seen[l.Port] {
+			return fmt.Errorf("duplicate listener for port %d", l.Port)
+		}
+		seen[l.Port] = true
+
+		if l.Bind != "" && l.Interface != "" {
+			return fmt.Errorf("listener port %d: set bind or interface, not both", l.Port)
+		}
+		if _, err := netip.ParseAddr(strings.Trim(l.Bind, "[]")); l.Bind != "" && err != nil {
+			return fmt.Errorf("listener port %d: invalid bind address %q", l.Port, l.Bind)
+		}
+	}
+	return nil
+}
+
+// listenAddrs returns the addresses knock port is bound on: the bind address
+// of its listener or the instance, every address of an interface, every
+// non-loopback address with skip_loopback, or else the wildcard. Interface
+// addresses are read when the instance starts.
+func listenAddrs(cfg InstanceConfig, port int) ([]string, error) {
+	bind, iface := cfg.Bind, cfg.Interface
+	for _, l := range cfg.Listeners {
+		if l.Port == port {
+			if l.Bind != "" {
+				bind, iface = strings.Trim(l.Bind, "[]"), ""
+			}
+			if l.Interface != "" {
+				iface = l.Interface
+			}
+			break
+		}
+	}
+
+	var (
+		hosts []string
+		err   error
+	)
+	switch {
+	case iface != "":
+		hosts, err = interfaceAddrs(iface, cfg.Family)
+	case bind != "":
+		hosts = []string{bind}
+	case cfg.SkipLoopback:
+		hosts, err = interfaceAddrs("", cfg.Family)
+	default:
+		hosts = []string{""}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := make([]string, len(hosts))
+	for i, host := range hosts {
+		addrs[i] = net.JoinHostPort(host, strconv.Itoa(port))
+	}
+	return addrs, nil
+}
+
+// interfaceAddrs lists the unicast addresses in family of the named
+// interface, or of every up non-loopback interface when name is empty.
+func interfaceAddrs(name, family string) ([]string, error) {
+	var ifaces []net.Interface
+	if name != "" {
+		ifi, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, err
+		}
+		ifaces = []net.Interface{*ifi}
+	} else {
+		all, err := net.Interfaces()
+		if err != nil {
+			return nil, err
+		}
+		for _, ifi := range all {
+			if ifi.Flags&net.FlagUp != 0 && ifi.Flags&net.FlagLoopback == 0 {
+				ifaces = append(ifaces, ifi)
+			}
+		}
+	}
+
+	var hosts []string
+	for _, ifi := range ifaces {
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			prefix, err := netip.ParsePrefix(a.String())
+			if err != nil {
+				continue
+			}
+			ip := prefix.Addr()
+			switch {
+			case ip.IsLoopback() && name == "",
+				family == FamilyIPv4 && !ip.Is4(),
+				family == FamilyIPv6 && !ip.Is6():
+				continue
+			case ip.Is6() && ip.IsLinkLocalUnicast():
+				ip = ip.WithZone(ifi.Name)
+			}
+			hosts = append(hosts, ip.String())
+		}
+	}
+
+	if len(hosts) == 0 {
+		if name == "" {
+			return nil, errors.New("no non-loopback interface has an address")
+		}
+		return nil, fmt.Errorf("interface %s has no address", name)
+	}
+	return hosts, nil
+}
+
+func validFamily(family string) bool {
+	switch family {
+	case "", FamilyDual, FamilyIPv4, FamilyIPv6:
+		return true
+	default:
+		return false
+	}
+}
+
+// clientIP returns the normalized source address of a connection. IPv4-mapped
+// IPv6 addresses become plain IPv4 and zone IDs are dropped, so a client
+// always maps to the same state key, session and firewall rule.
+func clientIP(addr net.Addr) (string, error) {
+	var ap netip.AddrPort
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ap = a.AddrPort()
+	case *net.UDPAddr:
+		ap = a.AddrPort()
+	default:
+		var err error
+		if ap, err = netip.ParseAddrPort(addr.String()); err != nil {
+			return "", err
+		}
+	}
+
+	ip := ap.Addr().Unmap().WithZone("")
+	if !ip.IsValid() {
+		return "", fmt.Errorf("invalid client address %s", addr)
+	}
+	return ip.String(), nil
+}
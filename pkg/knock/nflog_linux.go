@@ -0,0 +1,193 @@
+//go:build linux
+
+package knock
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// nfnetlink_log message types and attributes, see linux/netfilter/nfnetlink_log.h.
+const (
+	nfulnlMsgPacket = 0
+	nfulnlMsgConfig = 1
+
+	nfulaIfindexIndev = 4
+	nfulaPayload      = 9
+
+	nfulaCfgCmd  = 1
+	nfulaCfgMode = 2
+
+	nfulnlCfgCmdBind   = 1
+	nfulnlCfgCmdPfBind = 3
+
+	nfulnlCopyPacket = 2
+)
+
+// nflogSource receives packets copied by an iptables or nftables NFLOG rule.
+// The rule is followed by a DROP, so the kernel discards the knock while the
+// daemon still sees it:
+//
+//	iptables -A INPUT -p tcp --syn -m multiport --dports 7001,8002 -j NFLOG --nflog-group 5
+//	iptables -A INPUT -p tcp -m multiport --dports 7001,8002 -j DROP
+type nflogSource struct {
+	fd      int
+	pending []Packet
+}
+
+func openNFLog(group uint16) (*nflogSource, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW, unix.NETLINK_NETFILTER)
+	if err != nil {
+		return nil, fmt.Errorf("opening netfilter socket (needs CAP_NET_ADMIN): %w", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		_ = unix.Close(fd)
+		return nil, err
+	}
+
+	n := &nflogSource{fd: fd}
+
+	// Older kernels need the protocol families bound before the group
+	for _, family := range []uint8{unix.AF_INET, unix.AF_INET6} {
+		if err := n.config(family, 0, nfulaCfgCmd, []byte{nfulnlCfgCmdPfBind}); err != nil {
+			_ = unix.Close(fd)
+			return nil, err
+		}
+	}
+	if err := n.config(unix.AF_UNSPEC, group, nfulaCfgCmd, []byte{nfulnlCfgCmdBind}); err != nil {
+		_ = unix.Close(fd)
+		return nil, fmt.Errorf("binding NFLOG group %d: %w", group, err)
+	}
+
+	mode := make([]byte, 6)
+	binary.BigEndian.PutUint32(mode, 0xffff)
+	mode[4] = nfulnlCopyPacket
+	if err := n.config(unix.AF_UNSPEC, group, nfulaCfgMode, mode); err != nil {
+		_ = unix.Close(fd)
+		return nil, err
+	}
+
+	tv := unix.NsecToTimeval(int64(time.Second))
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		_ = unix.Close(fd)
+		return nil, err
+	}
+	return n, nil
+}
+
+// config sends one NFULNL_MSG_CONFIG request and waits for its ack.
+func (n *nflogSource) config(family uint8, group uint16, attr uint16, value []byte) error {
+	msg := make([]byte, unix.NLMSG_HDRLEN+4, 64)
+	msg = appendAttr(msg, attr, value)
+
+	binary.NativeEndian.PutUint32(msg[0:], uint32(len(msg)))
+	binary.NativeEndian.PutUint16(msg[4:], unix.NFNL_SUBSYS_ULOG<<8|nfulnlMsgConfig)
+	binary.NativeEndian.PutUint16(msg[6:], unix.NLM_F_REQUEST|unix.NLM_F_ACK)
+	msg[16] = family
+	msg[17] = unix.NFNETLINK_V0
+	binary.BigEndian.PutUint16(msg[18:], group)
+
+	if err := unix.Sendto(n.fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 4096)
+	r, _, err := unix.Recvfrom(n.fd, buf, 0)
+	if err != nil {
+		return err
+	}
+	msgs, err := syscall.ParseNetlinkMessage(buf[:r])
+	if err != nil {
+		return err
+	}
+	for _, m := range msgs {
+		if m.Header.Type == unix.NLMSG_ERROR && len(m.Data) >= 4 {
+			if errno := int32(binary.NativeEndian.Uint32(m.Data)); errno != 0 {
+				return syscall.Errno(-errno)
+			}
+		}
+	}
+	return nil
+}
+
+func appendAttr(b []byte, typ uint16, value []byte) []byte {
+	hdr := make([]byte, 4)
+	binary.NativeEndian.PutUint16(hdr[0:], uint16(4+len(value)))
+	binary.NativeEndian.PutUint16(hdr[2:], typ)
+	b = append(b, hdr...)
+	b = append(b, value...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// ReadPacket returns the next logged packet. A timeout returns false and no error.
+func (n *nflogSource) ReadPacket(buf []byte) (Packet, bool, error) {
+	if len(n.pending) == 0 {
+		r, _, err := unix.Recvfrom(n.fd, buf, 0)
+		if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR) {
+			return Packet{}, false, nil
+		}
+		if err != nil {
+			return Packet{}, false, err
+		}
+
+		msgs, err := syscall.ParseNetlinkMessage(buf[:r])
+		if err != nil {
+			return Packet{}, false, nil
+		}
+		for _, m := range msgs {
+			if m.Header.Type != unix.NFNL_SUBSYS_ULOG<<8|nfulnlMsgPacket || len(m.Data) < 4 {
+				continue
+			}
+			payload, indev := nflogAttrs(m.Data[4:])
+			if p, ok := parseIP(payload); ok {
+				p.Payload = append([]byte(nil), p.Payload...)
+				p.Ifindex = indev
+				n.pending = append(n.pending, p)
+			}
+		}
+	}
+
+	if len(n.pending) == 0 {
+		return Packet{}, false, nil
+	}
+	p := n.pending[0]
+	n.pending = n.pending[1:]
+	return p, true, nil
+}
+
+// nflogAttrs finds the NFULA_PAYLOAD attribute, the packet from its IP
+// header, and the index of the interface it came in on, 0 when not logged.
+func nflogAttrs(attrs []byte) (payload []byte, indev int) {
+	for len(attrs) >= 4 {
+		l := int(binary.NativeEndian.Uint16(attrs[0:]))
+		typ := binary.NativeEndian.Uint16(attrs[2:]) & 0x3fff
+		if l < 4 || l > len(attrs) {
+			return nil, 0
+		}
+		switch {
+		case typ == nfulaPayload:
+			payload = attrs[4:l]
+		case typ == nfulaIfindexIndev && l >= 8:
+			indev = int(binary.BigEndian.Uint32(attrs[4:8]))
+		}
+
+		l = (l + 3) &^ 3
+		if l > len(attrs) {
+			break
+		}
+		attrs = attrs[l:]
+	}
+	return payload, indev
+}
+
+func (n *nflogSource) Close() error {
+	return unix.Close(n.fd)
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package knock
+
+import "errors"
+
+type nflogSource struct{}
+
+func openNFLog(group uint16) (*nflogSource, error) {
+	return nil, errors.New("NFLOG mode is only supported on Linux")
+}
+
+func (n *nflogSource) ReadPacket(buf []byte) (Packet, bool, error) {
+	return Packet{}, false, errors.New("NFLOG mode is only supported on Linux")
+}
+
+func (n *nflogSource) Close() error {
+	return nil
+}
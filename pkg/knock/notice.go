@@ -0,0 +1,104 @@
+package knock
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+const noticeInterval = time.Second
+
+// ExpiryNoticeConfig warns clients shortly before their session expires so
+// they can knock again instead of being cut off mid-transfer.
+type ExpiryNoticeConfig struct {
+	Before Duration `json:"before"` // How long before expiry to notify, 0 disables
+	Port   int      `json:"port"`   // UDP port on the client to notify
+	Key    string   `json:"key"`    // HMAC-SHA256 key signing the notice
+}
+
+// ExpiryNotice is the signed payload sent to the client.
+type ExpiryNotice struct {
+	Event     string    `json:"event"`
+	SessionID string    `json:"session_id"`
+	Instance  string    `json:"instance"`
+	IP        string    `json:"ip"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type signedNotice struct {
+	Notice    json.RawMessage `json:"notice"`
+	Signature string          `json:"signature"` // hex HMAC-SHA256 of Notice
+}
+
+// notifyExpiring sends a notice for every session of the instance entering the
+// notice window, until stop is closed.
+func (s *Server) notifyExpiring(stop <-chan struct{}) {
+	cfg := s.cfg.ExpiryNotice
+
+	ticker := time.NewTicker(noticeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			for _, session := range s.sessions.DueForNotice(s.Name(), cfg.Before.Duration, now) {
+				addr := net.JoinHostPort(session.IP, strconv.Itoa(cfg.Port))
+				if s.users != nil && session.User != "" {
+					if u, err := s.users.Get(session.User); err == nil && u.NotifyAddr != "" {
+						addr = u.NotifyAddr
+					}
+				}
+
+				if err := sendExpiryNotice(addr, cfg.Key, session); err != nil {
+					log.Printf("[%s] Failed to notify %s of expiring session %s: %v", s.Name(), addr, session.ID, err)
+					continue
+				}
+				log.Printf("[%s] Notified %s that session %s expires at %s",
+					s.Name(),
+					addr,
+					session.ID,
+					session.ExpiresAt.Format(time.RFC3339))
+			}
+		}
+	}
+}
+
+func sendExpiryNotice(addr, key string, session *Session) error {
+	notice, err := json.Marshal(ExpiryNotice{
+		Event:     "session_expiring",
+		SessionID: session.ID,
+		Instance:  session.Instance,
+		IP:        session.IP,
+		ExpiresAt: session.ExpiresAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(notice)
+
+	payload, err := json.Marshal(signedNotice{
+		Notice:    notice,
+		Signature: hex.EncodeToString(mac.Sum(nil)),
+	})
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write(payload)
+	return err
+}
@@ -0,0 +1,136 @@
+package knock
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// Seconds between the NTP epoch (1900) and the Unix epoch (1970)
+const ntpEpochOffset = 2208988800
+
+type NTPConfig struct {
+	Server    string   `json:"server"`     // e.g. "pool.ntp.org", empty disables the check
+	MaxOffset Duration `json:"max_offset"` // Fails preflight with TOTP sequences, else warns, when the host clock is off by more than this
+	Timeout   Duration `json:"timeout"`
+}
+
+// checkClock compares the host clock with the configured NTP server, since
+// time-based knock modes depend on it. Drifting past max_offset is a problem
+// when a sequence follows TOTP windows and a warning otherwise; an
+// unreachable server only warns.
+func checkClock(cfg *Config) []PreflightProblem {
+	ntp := cfg.NTP
+	if ntp.Server == "" {
+		return nil
+	}
+
+	timeout := ntp.Timeout.Duration
+	if timeout == 0 {
+		timeout = 3 * time.Second
+	}
+	maxOffset := ntp.MaxOffset.Duration
+	if maxOffset == 0 {
+		maxOffset = time.Second
+	}
+
+	offset, err := ntpOffset(ntp.Server, timeout)
+	if err != nil {
+		log.Printf("WARNING: clock check against %s failed: %v", ntp.Server, err)
+		return nil
+	}
+
+	if offset.Abs() > maxOffset {
+		err := fmt.Errorf("host clock is off by %s according to %s (max %s)", offset.Round(time.Millisecond), ntp.Server, maxOffset)
+		if !usesTOTP(cfg) {
+			log.Printf("WARNING: %v; time-based knocks may fail", err)
+			return nil
+		}
+		return []PreflightProblem{{
+			Check: "clock",
+			Err:   err,
+			Hint:  "TOTP sequences follow the clock; sync it with NTP (e.g. chronyc makestep) or raise ntp.max_offset",
+		}}
+	}
+	log.Printf("Host clock within %s of %s", offset.Abs().Round(time.Millisecond), ntp.Server)
+	return nil
+}
+
+// usesTOTP reports whether any sequence of cfg follows TOTP windows.
+func usesTOTP(cfg *Config) bool {
+	for _, inst := range cfg.Instances {
+		if inst.TOTP.Enabled() {
+			return true
+		}
+		for _, p := range inst.Profiles {
+			if p.TOTP.Enabled() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ntpOffset returns how far the NTP server's clock is ahead of the local one (SNTP, RFC 4330).
+func ntpOffset(server string, timeout time.Duration) (time.Duration, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "123")
+	}
+
+	conn, err := net.DialTimeout("udp", server, timeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	req := make([]byte, 48)
+	req[0] = 0x23 // LI 0, version 4, mode 3 (client)
+
+	t1 := time.Now()
+	binary.BigEndian.PutUint64(req[40:], toNTPTime(t1))
+	if _, err := conn.Write(req); err != nil {
+		return 0, err
+	}
+
+	resp := make([]byte, 48)
+	n, err := conn.Read(resp)
+	t4 := time.Now()
+	if err != nil {
+		return 0, err
+	}
+	if n < 48 {
+		return 0, errors.New("short NTP response")
+	}
+
+	// The server must echo our transmit time as its origin time
+	if binary.BigEndian.Uint64(resp[24:]) != binary.BigEndian.Uint64(req[40:]) {
+		return 0, errors.New("NTP response does not match request")
+	}
+	if mode := resp[0] & 0x07; mode != 4 {
+		return 0, fmt.Errorf("unexpected NTP mode %d", mode)
+	}
+	if stratum := resp[1]; stratum == 0 || stratum > 15 {
+		return 0, fmt.Errorf("NTP server unsynchronized (stratum %d)", stratum)
+	}
+
+	t2 := fromNTPTime(binary.BigEndian.Uint64(resp[32:]))
+	t3 := fromNTPTime(binary.BigEndian.Uint64(resp[40:]))
+
+	return (t2.Sub(t1) + t3.Sub(t4)) / 2, nil
+}
+
+func toNTPTime(t time.Time) uint64 {
+	secs := uint64(t.Unix() + ntpEpochOffset)
+	frac := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return secs<<32 | frac
+}
+
+func fromNTPTime(v uint64) time.Time {
+	secs := int64(v>>32) - ntpEpochOffset
+	nanos := int64((v & 0xffffffff) * uint64(time.Second) >> 32)
+	return time.Unix(secs, nanos)
+}
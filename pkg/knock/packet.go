@@ -0,0 +1,137 @@
+package knock
+
+import (
+	"encoding/binary"
+	"net/netip"
+)
+
+const (
+	protoTCP = 6
+	protoUDP = 17
+
+	tcpFlagFIN = 0x01
+	tcpFlagSYN = 0x02
+	tcpFlagRST = 0x04
+	tcpFlagACK = 0x10
+)
+
+// Packet is the part of a captured frame the knock server cares about.
+type Packet struct {
+	Src      netip.Addr
+	Dst      netip.Addr
+	Proto    uint8
+	SrcPort  uint16
+	DstPort  uint16
+	TCPFlags uint8
+	Seq      uint32 // TCP sequence number
+	Payload  []byte
+	Ifindex  int // Interface the packet arrived on, 0 when unknown
+}
+
+// parseEthernet decodes an Ethernet frame carrying IPv4 or IPv6 TCP/UDP.
+func parseEthernet(frame []byte) (Packet, bool) {
+	if len(frame) < 14 {
+		return Packet{}, false
+	}
+
+	etherType := binary.BigEndian.Uint16(frame[12:14])
+	payload := frame[14:]
+
+	// Skip 802.1Q VLAN tags
+	for etherType == 0x8100 || etherType == 0x88a8 {
+		if len(payload) < 4 {
+			return Packet{}, false
+		}
+		etherType = binary.BigEndian.Uint16(payload[2:4])
+		payload = payload[4:]
+	}
+
+	switch etherType {
+	case 0x0800:
+		return parseIPv4(payload)
+	case 0x86dd:
+		return parseIPv6(payload)
+	default:
+		return Packet{}, false
+	}
+}
+
+// parseIP decodes a bare IPv4 or IPv6 packet, as delivered by NFLOG.
+func parseIP(b []byte) (Packet, bool) {
+	if len(b) == 0 {
+		return Packet{}, false
+	}
+
+	switch b[0] >> 4 {
+	case 4:
+		return parseIPv4(b)
+	case 6:
+		return parseIPv6(b)
+	default:
+		return Packet{}, false
+	}
+}
+
+func parseIPv4(b []byte) (Packet, bool) {
+	if len(b) < 20 || b[0]>>4 != 4 {
+		return Packet{}, false
+	}
+
+	ihl := int(b[0]&0x0f) * 4
+	if ihl < 20 || len(b) < ihl {
+		return Packet{}, false
+	}
+
+	// Only the first fragment carries the transport header
+	if binary.BigEndian.Uint16(b[6:8])&0x1fff != 0 {
+		return Packet{}, false
+	}
+
+	p := Packet{
+		Src:   netip.AddrFrom4([4]byte(b[12:16])),
+		Dst:   netip.AddrFrom4([4]byte(b[16:20])),
+		Proto: b[9],
+	}
+	return parseTransport(p, b[ihl:])
+}
+
+func parseIPv6(b []byte) (Packet, bool) {
+	if len(b) < 40 || b[0]>>4 != 6 {
+		return Packet{}, false
+	}
+
+	p := Packet{
+		Src:   netip.AddrFrom16([16]byte(b[8:24])),
+		Dst:   netip.AddrFrom16([16]byte(b[24:40])),
+		Proto: b[6],
+	}
+	return parseTransport(p, b[40:])
+}
+
+func parseTransport(p Packet, b []byte) (Packet, bool) {
+	switch p.Proto {
+	case protoTCP:
+		if len(b) < 20 {
+			return Packet{}, false
+		}
+		offset := int(b[12]>>4) * 4
+		if offset < 20 || len(b) < offset {
+			return Packet{}, false
+		}
+		p.SrcPort = binary.BigEndian.Uint16(b[0:2])
+		p.DstPort = binary.BigEndian.Uint16(b[2:4])
+		p.Seq = binary.BigEndian.Uint32(b[4:8])
+		p.TCPFlags = b[13]
+		p.Payload = b[offset:]
+	case protoUDP:
+		if len(b) < 8 {
+			return Packet{}, false
+		}
+		p.SrcPort = binary.BigEndian.Uint16(b[0:2])
+		p.DstPort = binary.BigEndian.Uint16(b[2:4])
+		p.Payload = b[8:]
+	default:
+		return Packet{}, false
+	}
+	return p, true
+}
@@ -0,0 +1,303 @@
+package knock
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+	"time"
+)
+
+const (
+	maxPayloadSize     = 4096
+	payloadReadTimeout = 2 * time.Second
+	payloadMaxAge      = time.Minute // How far a request's timestamp may be from the server clock
+	maxClientID        = 64
+	payloadNonceSize   = 12 // AES-GCM standard nonce
+)
+
+// PayloadConfig lets the last knock carry an encrypted KnockRequest, so one
+// sequence can open different services for different durations.
+type PayloadConfig struct {
+	Key         string   `json:"key"`          // Shared secret, empty disables payloads
+	Ports       []int    `json:"ports"`        // Ports a request may open, the protected ports when empty
+	MaxDuration Duration `json:"max_duration"` // Longest access a request may ask for, the session TTL when zero
+	Required    bool     `json:"required"`     // Refuse completions without a valid request
+	SPAPort     int      `json:"spa_port"`     // UDP port also taking a request alone as one packet, none when zero
+
+	// Accept requests sent alone that do not seal the address they come
+	// from, for clients behind a NAT that cannot tell their public one.
+	// Otherwise a captured packet only opens access for its sender
+	SPAAnySource bool `json:"spa_any_source"`
+}
+
+func (c PayloadConfig) Enabled() bool {
+	return c.Key != ""
+}
+
+// KnockRequest is what a client asks for when completing the sequence.
+type KnockRequest struct {
+	Ports    []int    `json:"ports"`             // Services to open, the actions' own ports when empty
+	Duration Duration `json:"duration,omitzero"` // Session length, the profile TTL when zero
+	Time     int64    `json:"time"`              // Unix seconds when sealed
+	Client   string   `json:"client,omitempty"`  // Client ID sessions are kept under instead of the source IP
+	Allow    string   `json:"allow,omitempty"`   // Address to open instead of the source, within request_targets
+	Profile  string   `json:"profile,omitempty"` // Profile a request sent alone completes, the default one when empty
+	Source   string   `json:"source,omitempty"`  // Address the request is sent from, checked when set
+
+	// Client port to send a GrantConfirmation to once access is granted,
+	// none when zero
+	ConfirmPort  int    `json:"confirm_port,omitempty"`
+	ConfirmProto string `json:"confirm_proto,omitempty"` // "udp" (default) or "tcp"
+}
+
+// payloadCipher derives the AES-256-GCM cipher from the shared secret.
+func payloadCipher(key string) (cipher.AEAD, error) {
+	sum := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// SealRequest encrypts req as nonce || ciphertext.
+func SealRequest(key string, req KnockRequest) ([]byte, error) {
+	return sealJSON(key, req)
+}
+
+// RequestNonce returns the nonce of a sealed request, which identifies it.
+func RequestNonce(sealed []byte) []byte {
+	return sealed[:min(len(sealed), payloadNonceSize)]
+}
+
+// openRequest decrypts a payload, returning the request and its nonce.
+func openRequest(key string, payload []byte) (KnockRequest, []byte, error) {
+	var req KnockRequest
+	nonce, err := openJSON(key, payload, &req)
+	return req, nonce, err
+}
+
+// sealJSON encrypts v as JSON, nonce || ciphertext.
+func sealJSON(key string, v any) ([]byte, error) {
+	aead, err := payloadCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	plain, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plain, nil), nil
+}
+
+// openJSON decrypts what sealJSON sealed into v, returning its nonce.
+func openJSON(key string, sealed []byte, v any) ([]byte, error) {
+	aead, err := payloadCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize()+aead.Overhead() {
+		return nil, errors.New("payload too short")
+	}
+
+	nonce, data := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, data, nil)
+	if err != nil {
+		return nil, errors.New("payload does not decrypt")
+	}
+	if err := json.Unmarshal(plain, v); err != nil {
+		return nil, fmt.Errorf("parsing payload: %w", err)
+	}
+	return nonce, nil
+}
+
+// readPayload collects what the client sent on a knock connection, then
+// counts the knock with it.
+func (s *Server) readPayload(conn net.Conn, ip, iface string, port, srcPort int) {
+	_ = conn.SetReadDeadline(time.Now().Add(payloadReadTimeout))
+	payload, _ := io.ReadAll(io.LimitReader(conn, maxPayloadSize))
+
+	s.processKnock(ip, iface, port, srcPort, payload)
+	s.closeKnock(conn, ip)
+}
+
+// applyPayload checks the request carried by a completing knock and returns
+// the profile to grant with, narrowed to what was asked for. Callers hold
+// the server mutex.
+func (s *Server) applyPayload(access *Access, p *profile, payload []byte) (*profile, error) {
+	if len(payload) == 0 {
+		if s.cfg.Payload.Required {
+			return nil, errors.New("no request payload")
+		}
+		return p, nil
+	}
+
+	req, err := s.openPayload(access, payload)
+	if err != nil {
+		return nil, err
+	}
+	return s.applyRequest(access, p, req)
+}
+
+// openPayload decrypts a request, with the instance key or else with a key
+// of the user it then identifies, and checks it is fresh. Callers hold the
+// server mutex.
+func (s *Server) openPayload(access *Access, payload []byte) (*openedRequest, error) {
+	key := s.cfg.Payload.Key
+	req, nonce, err := openRequest(key, payload)
+	if err != nil {
+		// Sealed with a user's own key, which identifies them
+		if u := s.keyedUser(access.IP, func(u *User, userKey string) error {
+			req, nonce, err = openRequest(userKey, payload)
+			key = userKey
+			return err
+		}); u != nil {
+			access.User = u.Name
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if age := access.Time.Sub(time.Unix(req.Time, 0)); age > payloadMaxAge || age < -payloadMaxAge {
+		return nil, fmt.Errorf("request is %s off the server clock", age.Round(time.Second))
+	}
+	// Before the nonce is used, so a copy raced in from elsewhere cannot
+	// spend the sender's request
+	if err := checkSource(access.IP, req.Source); err != nil {
+		return nil, err
+	}
+	if !s.nonces.use(string(nonce), access.Time) {
+		return nil, errors.New("request replayed")
+	}
+	return &openedRequest{KnockRequest: req, nonce: nonce, key: key}, nil
+}
+
+// checkSource checks that a request naming the address it was sent from
+// came from ip, so a captured one opens nothing for anyone else.
+func checkSource(ip, source string) error {
+	if source == "" {
+		return nil
+	}
+	addr, err := netip.ParseAddr(source)
+	if err != nil {
+		return fmt.Errorf("invalid source address %q", source)
+	}
+	if addr.Unmap().WithZone("").String() != ip {
+		return fmt.Errorf("request was sealed for source %s", source)
+	}
+	return nil
+}
+
+// openedRequest is a decrypted request, with the nonce and key it was
+// sealed with.
+type openedRequest struct {
+	KnockRequest
+	nonce []byte
+	key   string
+}
+
+// applyRequest applies an opened request to access and returns p narrowed
+// to what it asks for.
+func (s *Server) applyRequest(access *Access, p *profile, req *openedRequest) (*profile, error) {
+	// Confirmations go back to whoever knocked, not to another address asked for
+	source := access.IP
+	if err := s.identify(access, req.Client, req.Allow); err != nil {
+		return nil, err
+	}
+	access.nonce = hex.EncodeToString(req.nonce)
+
+	requested, err := narrowProfile(access, p, req.Ports, req.Duration.Duration, s.cfg.Payload.Ports, s.cfg.Payload.MaxDuration.Duration, s.cfg.ProtectedPorts)
+	if err != nil || req.ConfirmPort == 0 {
+		return requested, err
+	}
+	requested.confirm, err = newConfirmTarget(req.KnockRequest, source, req.nonce, req.key)
+	return requested, err
+}
+
+// identify applies the client ID and target address an authenticated request
+// carries to access. Clients behind a NAT share its address, so the ID keeps
+// their sessions apart, and a target lets a client open another address it
+// cannot knock from, if request_targets covers it.
+func (s *Server) identify(access *Access, client, allow string) error {
+	if len(client) > maxClientID {
+		return fmt.Errorf("client ID longer than %d bytes", maxClientID)
+	}
+	access.Client = client
+
+	if allow == "" {
+		return nil
+	}
+	addr, err := netip.ParseAddr(allow)
+	if err != nil {
+		return fmt.Errorf("invalid allow address %q", allow)
+	}
+	target, err := s.checkTarget(access.IP, addr)
+	if err != nil || target == access.IP {
+		return err
+	}
+	access.Source, access.IP = access.IP, target
+	return nil
+}
+
+// checkTarget returns addr as the address to open for a knock from source.
+// An address other than the source must be within request_targets and
+// neither denylisted nor blocklisted, whichever way the knock named it.
+func (s *Server) checkTarget(source string, addr netip.Addr) (string, error) {
+	addr = addr.Unmap().WithZone("")
+	target := addr.String()
+	switch {
+	case target == source:
+		return target, nil
+	case !slices.ContainsFunc(s.targets, func(p netip.Prefix) bool { return p.Contains(addr) }):
+		return "", fmt.Errorf("%s may not be opened by request", target)
+	case s.denied(target):
+		return "", fmt.Errorf("%s is denylisted", target)
+	case s.blocklisted(target) != nil && s.cfg.BlocklistMode == BlocklistReject:
+		return "", fmt.Errorf("%s is blocklisted", target)
+	}
+	return target, nil
+}
+
+// narrowProfile checks a client's request for ports and an access length
+// against what may be requested, defaulting to the protected ports and the
+// profile TTL, and returns p narrowed to it.
+func narrowProfile(access *Access, p *profile, ports []int, ttl time.Duration, allowed []int, maxTTL time.Duration, protected []int) (*profile, error) {
+	if len(allowed) == 0 {
+		allowed = protected
+	}
+	for _, port := range ports {
+		if !slices.Contains(allowed, port) {
+			return nil, fmt.Errorf("port %d may not be requested", port)
+		}
+	}
+
+	if maxTTL == 0 {
+		maxTTL = p.ttl
+	}
+	if ttl < 0 || ttl > maxTTL {
+		return nil, fmt.Errorf("requested duration %s exceeds %s", ttl, maxTTL)
+	}
+
+	requested := *p
+	if ttl > 0 {
+		requested.ttl = ttl
+	}
+	access.Ports = ports
+	return &requested, nil
+}
@@ -0,0 +1,201 @@
+package knock
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+)
+
+const pluginTimeout = 5 * time.Second
+
+type pluginInfo struct {
+	Name   string   `json:"name"`
+	Kinds  []string `json:"kinds"`
+	Events []string `json:"events"` // Outcomes besides "granted" the action wants
+}
+
+// pluginEvent is the payload sent for deny, ban and expire calls.
+type pluginEvent struct {
+	Access
+	Reason string    `json:"reason,omitempty"`
+	Until  time.Time `json:"until,omitzero"`
+}
+
+type pluginResponse struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason"`
+	Error  string `json:"error"`
+}
+
+// Plugin is an external action and/or policy backed by an executable.
+//
+// Plugins are standalone executables in the plugin directory that speak a
+// small exec-JSON protocol:
+//
+//	<plugin> describe          -> {"name": "geo", "kinds": ["policy"]}
+//	<plugin> grant     < Access -> {"error": ""}
+//	<plugin> authorize < Access -> {"allow": true, "reason": ""}
+//
+// Actions listing "denied", "banned" or "expired" in the "events" field of
+// describe are also called with deny, ban and expire; the Access payload then
+// carries a "reason" or "until" field where it applies.
+//
+// A non-empty "error" field or a non-zero exit status fails the call.
+type Plugin struct {
+	path string
+	info pluginInfo
+}
+
+func (p *Plugin) Name() string {
+	return p.info.Name
+}
+
+func (p *Plugin) OnGranted(ctx context.Context, access Access) error {
+	_, err := p.call(ctx, "grant", access)
+	return err
+}
+
+func (p *Plugin) OnDenied(ctx context.Context, access Access, reason string) error {
+	return p.notify(ctx, "denied", "deny", pluginEvent{Access: access, Reason: reason})
+}
+
+func (p *Plugin) OnBanned(ctx context.Context, access Access, until time.Time) error {
+	return p.notify(ctx, "banned", "ban", pluginEvent{Access: access, Until: until})
+}
+
+func (p *Plugin) OnExpired(ctx context.Context, access Access) error {
+	return p.notify(ctx, "expired", "expire", pluginEvent{Access: access})
+}
+
+// notify calls method only if the plugin subscribed to event.
+func (p *Plugin) notify(ctx context.Context, event, method string, payload pluginEvent) error {
+	if !slices.Contains(p.info.Events, event) {
+		return nil
+	}
+	_, err := p.call(ctx, method, payload)
+	return err
+}
+
+func (p *Plugin) Authorize(ctx context.Context, access Access) (bool, string, error) {
+	resp, err := p.call(ctx, "authorize", access)
+	if err != nil {
+		return false, "", err
+	}
+	return resp.Allow, resp.Reason, nil
+}
+
+func (p *Plugin) call(ctx context.Context, method string, payload any) (*pluginResponse, error) {
+	input, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := runPlugin(ctx, p.path, method, input)
+	if err != nil {
+		return nil, fmt.Errorf("plugin %s %s: %w", p.Name(), method, err)
+	}
+
+	resp := &pluginResponse{}
+	if err := json.Unmarshal(out, resp); err != nil {
+		return nil, fmt.Errorf("plugin %s %s: invalid response: %w", p.Name(), method, err)
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("plugin %s %s: %s", p.Name(), method, resp.Error)
+	}
+	return resp, nil
+}
+
+func runPlugin(ctx context.Context, path, method string, input []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, pluginTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, path, method)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%w: %s", err, msg)
+		}
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
+
+// loadPlugins describes every executable in dir and registers it by the kinds it declares.
+func loadPlugins(dir string, reg *Registry) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("reading plugin directory: %w", err)
+	}
+
+	var errs []error
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if !isExecutable(entry) {
+			continue
+		}
+
+		p, err := describePlugin(path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		for _, kind := range p.info.Kinds {
+			switch kind {
+			case "action":
+				err = reg.AddAction(p)
+			case "policy":
+				err = reg.AddPolicy(p)
+			default:
+				err = fmt.Errorf("plugin %s: unknown kind %q", p.Name(), kind)
+			}
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+		log.Printf("Loaded plugin %s (%s) from %s", p.Name(), strings.Join(p.info.Kinds, ", "), path)
+	}
+	return errors.Join(errs...)
+}
+
+func describePlugin(path string) (*Plugin, error) {
+	out, err := runPlugin(context.Background(), path, "describe", nil)
+	if err != nil {
+		return nil, fmt.Errorf("describing plugin %s: %w", path, err)
+	}
+
+	p := &Plugin{path: path}
+	if err := json.Unmarshal(out, &p.info); err != nil {
+		return nil, fmt.Errorf("describing plugin %s: %w", path, err)
+	}
+	if p.info.Name == "" {
+		return nil, fmt.Errorf("describing plugin %s: missing name", path)
+	}
+	return p, nil
+}
+
+func isExecutable(entry os.DirEntry) bool {
+	info, err := entry.Info()
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+
+	if runtime.GOOS == "windows" {
+		return strings.EqualFold(filepath.Ext(entry.Name()), ".exe")
+	}
+	return info.Mode().Perm()&0o111 != 0
+}
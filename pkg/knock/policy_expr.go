@@ -0,0 +1,94 @@
+package knock
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+)
+
+// ScriptPolicyConfig is a grant policy written as an expr expression that must
+// evaluate to true for the access to be allowed, e.g.
+//
+//	hour >= 8 && hour < 20 && completed("vpn", "10m")
+type ScriptPolicyConfig struct {
+	Expr   string `json:"expr"`
+	Reason string `json:"reason"` // Logged when the expression denies access
+}
+
+// policyEnv is what a policy expression can see about the access being evaluated.
+type policyEnv struct {
+	IP       string `expr:"ip"`
+	Source   string `expr:"source"` // Request source when it asked to open ip instead, else empty
+	Client   string `expr:"client"` // Client ID the request named, else empty
+	Instance string `expr:"instance"`
+	Hour     int    `expr:"hour"`
+	Minute   int    `expr:"minute"`
+	Weekday  string `expr:"weekday"`
+
+	// completed("name", "10m") reports whether the same IP also completed
+	// instance "name" within the given duration.
+	Completed func(instance, within string) (bool, error) `expr:"completed"`
+}
+
+// ScriptPolicy is an Authorizer evaluating a compiled expression.
+type ScriptPolicy struct {
+	name    string
+	reason  string
+	program *vm.Program
+	history *History
+}
+
+func NewScriptPolicy(name string, cfg ScriptPolicyConfig, history *History) (*ScriptPolicy, error) {
+	program, err := expr.Compile(cfg.Expr, expr.Env(policyEnv{}), expr.AsBool())
+	if err != nil {
+		return nil, fmt.Errorf("compiling policy %s: %w", name, err)
+	}
+
+	reason := cfg.Reason
+	if reason == "" {
+		reason = "policy expression evaluated to false"
+	}
+
+	return &ScriptPolicy{
+		name:    name,
+		reason:  reason,
+		program: program,
+		history: history,
+	}, nil
+}
+
+func (p *ScriptPolicy) Name() string {
+	return p.name
+}
+
+func (p *ScriptPolicy) Authorize(ctx context.Context, access Access) (bool, string, error) {
+	env := policyEnv{
+		IP:       access.IP,
+		Source:   access.Source,
+		Client:   access.Client,
+		Instance: access.Instance,
+		Hour:     access.Time.Hour(),
+		Minute:   access.Time.Minute(),
+		Weekday:  access.Time.Weekday().String()[:3],
+		Completed: func(instance, within string) (bool, error) {
+			d, err := time.ParseDuration(within)
+			if err != nil {
+				return false, err
+			}
+			return p.history.CompletedWithin(access.IP, instance, d), nil
+		},
+	}
+
+	out, err := expr.Run(p.program, env)
+	if err != nil {
+		return false, "", err
+	}
+
+	if allowed, _ := out.(bool); !allowed {
+		return false, p.reason, nil
+	}
+	return true, "", nil
+}
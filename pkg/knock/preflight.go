@@ -0,0 +1,519 @@
+package knock
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// PreflightProblem is a single failed startup check with a hint on how to fix it.
+type PreflightProblem struct {
+	Check string
+	Err   error
+	Hint  string
+}
+
+// PreflightError collects every problem found before the server starts listening.
+type PreflightError struct {
+	Problems []PreflightProblem
+}
+
+func (e *PreflightError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "preflight failed with %d problem(s):", len(e.Problems))
+	for _, p := range e.Problems {
+		fmt.Fprintf(&b, "\n  - %s: %v", p.Check, p.Err)
+		if p.Hint != "" {
+			fmt.Fprintf(&b, "\n    hint: %s", p.Hint)
+		}
+	}
+	return b.String()
+}
+
+type preflightCheck struct {
+	name string
+	run  func(cfg InstanceConfig) []PreflightProblem
+}
+
+var preflightChecks = []preflightCheck{
+	{name: "sequence", run: checkSequence},
+	{name: "protected ports", run: checkProtectedPorts},
+	{name: "trap ports", run: checkTrapPorts},
+	{name: "port availability", run: checkPortsAvailable},
+	{name: "proxies", run: checkProxies},
+	{name: "proxy availability", run: checkProxiesAvailable},
+	{name: "udp availability", run: checkUDPAvailable},
+	{name: "capture", run: checkCapture},
+}
+
+// availabilityChecks bind what a running instance holds already.
+var availabilityChecks = []string{"port availability", "proxy availability", "udp availability"}
+
+// configChecks concern every instance of a config at once.
+var configChecks = []struct {
+	name string
+	run  func(cfg *Config) []PreflightProblem
+}{
+	{name: "firewall access", run: checkFirewallAccess},
+	{name: "clock", run: checkClock},
+}
+
+// firewallProbeTimeout bounds each firewall access probe.
+const firewallProbeTimeout = 5 * time.Second
+
+// Preflight runs every startup check for an instance and reports all problems at once.
+func Preflight(cfg InstanceConfig) error {
+	return preflight(cfg, preflightChecks)
+}
+
+// preflightRunning runs the checks that still apply to a running instance,
+// whose ports and proxy addresses are its own already.
+func preflightRunning(cfg InstanceConfig) error {
+	checks := slices.DeleteFunc(slices.Clone(preflightChecks), func(c preflightCheck) bool {
+		return slices.Contains(availabilityChecks, c.name)
+	})
+	return preflight(cfg, checks)
+}
+
+// PreflightConfig runs the checks shared by every instance of cfg, access to
+// its firewalls and the host clock, before any of them starts.
+func PreflightConfig(cfg *Config) error {
+	var problems []PreflightProblem
+	for _, c := range configChecks {
+		problems = append(problems, c.run(cfg)...)
+	}
+
+	if len(problems) > 0 {
+		return &PreflightError{Problems: problems}
+	}
+	return nil
+}
+
+func preflight(cfg InstanceConfig, checks []preflightCheck) error {
+	var problems []PreflightProblem
+	for _, c := range checks {
+		problems = append(problems, c.run(cfg)...)
+	}
+
+	if len(problems) > 0 {
+		return &PreflightError{Problems: problems}
+	}
+	return nil
+}
+
+func knockPorts(sequence []KnockStep) []int {
+	seen := make(map[int]struct{})
+	ports := make([]int, 0, len(sequence))
+
+	for _, step := range sequence {
+		if _, ok := seen[step.Port]; ok {
+			continue
+		}
+		seen[step.Port] = struct{}{}
+		ports = append(ports, step.Port)
+	}
+	return ports
+}
+
+// listenPorts returns the ports an instance accepts knocks on, across every
+// profile, followed by its trap ports.
+func listenPorts(cfg InstanceConfig) []int {
+	ports := []int{cfg.KnockPort}
+	if cfg.Encoding != EncodingSource {
+		ports = profilePorts(cfg)
+	}
+	for _, port := range cfg.TrapPorts {
+		if !slices.Contains(ports, port) {
+			ports = append(ports, port)
+		}
+	}
+	return ports
+}
+
+// profilePorts returns the ports used by the sequence of any profile.
+func profilePorts(cfg InstanceConfig) []int {
+	ports := sequencePorts(cfg.Sequence, cfg.TOTP)
+	seen := make(map[int]bool, len(ports))
+	for _, port := range ports {
+		seen[port] = true
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(cfg.Profiles)) {
+		p := cfg.Profiles[name]
+		for _, port := range sequencePorts(p.Sequence, p.TOTP) {
+			if !seen[port] {
+				seen[port] = true
+				ports = append(ports, port)
+			}
+		}
+	}
+	return ports
+}
+
+func sequencePorts(sequence []KnockStep, totp TOTPConfig) []int {
+	if totp.Enabled() {
+		return totp.Ports()
+	}
+	return knockPorts(sequence)
+}
+
+func checkSequence(cfg InstanceConfig) []PreflightProblem {
+	if !cfg.TOTP.Enabled() && len(cfg.Sequence) == 0 && len(cfg.Profiles) == 0 {
+		return []PreflightProblem{{
+			Check: "sequence",
+			Err:   errors.New("knock sequence is empty"),
+			Hint:  "define at least one knock step",
+		}}
+	}
+
+	problems := checkSteps("", cfg.Sequence, cfg.Timeout.Duration, cfg.SequenceTimeout.Duration)
+	for _, name := range slices.Sorted(maps.Keys(cfg.Profiles)) {
+		p := cfg.Profiles[name]
+		if !p.TOTP.Enabled() && len(p.Sequence) == 0 {
+			problems = append(problems, PreflightProblem{
+				Check: "sequence",
+				Err:   fmt.Errorf("profile %s: knock sequence is empty", name),
+				Hint:  "define at least one knock step or a totp secret",
+			})
+		}
+		problems = append(problems, checkSteps(name, p.Sequence, cfg.Timeout.Duration, cfg.SequenceTimeout.Duration)...)
+	}
+	return problems
+}
+
+func checkSteps(profile string, sequence []KnockStep, timeout, deadline time.Duration) []PreflightProblem {
+	prefix := ""
+	if profile != "" {
+		prefix = "profile " + profile + " "
+	}
+
+	var problems []PreflightProblem
+	for i, step := range sequence {
+		if step.Port < 1 || step.Port > 65535 {
+			problems = append(problems, PreflightProblem{
+				Check: "sequence",
+				Err:   fmt.Errorf("%sstep %d: invalid port %d", prefix, i+1, step.Port),
+				Hint:  "knock ports must be between 1 and 65535",
+			})
+		}
+		if step.Count < 1 {
+			problems = append(problems, PreflightProblem{
+				Check: "sequence",
+				Err:   fmt.Errorf("%sstep %d: invalid count %d", prefix, i+1, step.Count),
+				Hint:  "each step needs at least one knock",
+			})
+		}
+		switch step.Tolerance {
+		case "", ToleranceExact, ToleranceAtLeast:
+			if step.MaxCount != 0 {
+				problems = append(problems, PreflightProblem{
+					Check: "sequence",
+					Err:   fmt.Errorf("%sstep %d: max_count without a range tolerance", prefix, i+1),
+					Hint:  `set "tolerance": "range" to bound the count`,
+				})
+			}
+		case ToleranceRange:
+			if step.MaxCount < step.Count {
+				problems = append(problems, PreflightProblem{
+					Check: "sequence",
+					Err:   fmt.Errorf("%sstep %d: max_count %d is below the count %d", prefix, i+1, step.MaxCount, step.Count),
+					Hint:  "a range step accepts from count to max_count knocks",
+				})
+			}
+		default:
+			problems = append(problems, PreflightProblem{
+				Check: "sequence",
+				Err:   fmt.Errorf("%sstep %d: unknown tolerance %q", prefix, i+1, step.Tolerance),
+				Hint:  "use exact, at_least or range",
+			})
+		}
+
+		minDelay, maxDelay := step.MinDelay.Duration, step.MaxDelay.Duration
+		switch {
+		case minDelay < 0 || maxDelay < 0 || (maxDelay > 0 && minDelay > maxDelay):
+			problems = append(problems, PreflightProblem{
+				Check: "sequence",
+				Err:   fmt.Errorf("%sstep %d: invalid delay bounds %s-%s", prefix, i+1, minDelay, maxDelay),
+				Hint:  "min_delay must not exceed max_delay",
+			})
+		case i == 0 && minDelay+maxDelay > 0:
+			problems = append(problems, PreflightProblem{
+				Check: "sequence",
+				Err:   fmt.Errorf("%sstep 1: delay bounds have no previous step", prefix),
+				Hint:  "set delays on the later steps only",
+			})
+		case maxDelay == 0 && minDelay > timeout:
+			problems = append(problems, PreflightProblem{
+				Check: "sequence",
+				Err:   fmt.Errorf("%sstep %d: min_delay exceeds the %s timeout", prefix, i+1, timeout),
+				Hint:  "set a max_delay on the step or raise the instance timeout",
+			})
+		case deadline > 0 && max(minDelay, maxDelay) > deadline:
+			problems = append(problems, PreflightProblem{
+				Check: "sequence",
+				Err:   fmt.Errorf("%sstep %d: delay bound exceeds the %s sequence_timeout", prefix, i+1, deadline),
+				Hint:  "raise sequence_timeout above the step delays",
+			})
+		}
+	}
+	return problems
+}
+
+func checkProtectedPorts(cfg InstanceConfig) []PreflightProblem {
+	protected := make(map[int]struct{}, len(cfg.ProtectedPorts))
+	for _, port := range cfg.ProtectedPorts {
+		protected[port] = struct{}{}
+	}
+
+	var problems []PreflightProblem
+	for _, port := range listenPorts(cfg) {
+		if _, ok := protected[port]; ok {
+			problems = append(problems, PreflightProblem{
+				Check: "protected ports",
+				Err:   fmt.Errorf("knock port %d is also a protected service port", port),
+				Hint:  "choose knock ports that are not used by the services being protected",
+			})
+		}
+	}
+	return problems
+}
+
+// checkTrapPorts makes sure no trap port is part of a sequence, which would
+// ban every client knocking it.
+func checkTrapPorts(cfg InstanceConfig) []PreflightProblem {
+	knock := profilePorts(cfg)
+	if cfg.Encoding == EncodingSource {
+		knock = []int{cfg.KnockPort}
+	}
+
+	var problems []PreflightProblem
+	for _, port := range cfg.TrapPorts {
+		switch {
+		case port < 1 || port > 65535:
+			problems = append(problems, PreflightProblem{
+				Check: "trap ports",
+				Err:   fmt.Errorf("trap port %d is outside 1-65535", port),
+				Hint:  "fix the trap_ports entry",
+			})
+		case slices.Contains(knock, port):
+			problems = append(problems, PreflightProblem{
+				Check: "trap ports",
+				Err:   fmt.Errorf("trap port %d is also a knock port", port),
+				Hint:  "remove the port from trap_ports or from the sequence",
+			})
+		}
+	}
+	return problems
+}
+
+// checkPortsAvailable binds every knock port once so conflicts are reported
+// before any listener starts accepting.
+func checkPortsAvailable(cfg InstanceConfig) []PreflightProblem {
+	if observingMode(cfg.Mode) {
+		return nil
+	}
+
+	var problems []PreflightProblem
+
+	for _, port := range listenPorts(cfg) {
+		addrs, err := listenAddrs(cfg, port)
+		if err != nil {
+			problems = append(problems, PreflightProblem{
+				Check: "port availability",
+				Err:   fmt.Errorf("cannot bind knock port %d: %w", port, err),
+				Hint:  "check the interface exists and has an address",
+			})
+			continue
+		}
+
+		for _, addr := range addrs {
+			ln, err := listen(listenNetwork(cfg.Family), addr)
+			if err != nil {
+				problems = append(problems, PreflightProblem{
+					Check: "port availability",
+					Err:   fmt.Errorf("cannot bind knock port %d: %w", port, err),
+					Hint:  bindHint(err, port),
+				})
+				break
+			}
+			_ = ln.Close()
+		}
+	}
+	return problems
+}
+
+func checkProxies(cfg InstanceConfig) []PreflightProblem {
+	var problems []PreflightProblem
+
+	for _, p := range cfg.Proxies {
+		if p.Backend == "" {
+			problems = append(problems, PreflightProblem{
+				Check: "proxies",
+				Err:   fmt.Errorf("proxy on %s has no backend", p.Listen),
+				Hint:  "set backend to the protected service address, e.g. 127.0.0.1:22",
+			})
+		}
+	}
+	return problems
+}
+
+func checkProxiesAvailable(cfg InstanceConfig) []PreflightProblem {
+	var problems []PreflightProblem
+
+	for _, p := range cfg.Proxies {
+		ln, err := listen("tcp", p.Listen)
+		if err != nil {
+			port := 0
+			if _, ps, splitErr := net.SplitHostPort(p.Listen); splitErr == nil {
+				port, _ = strconv.Atoi(ps)
+			}
+			problems = append(problems, PreflightProblem{
+				Check: "proxy availability",
+				Err:   fmt.Errorf("cannot bind proxy on %s: %w", p.Listen, err),
+				Hint:  bindHint(err, port),
+			})
+			continue
+		}
+		_ = ln.Close()
+	}
+	return problems
+}
+
+// checkUDPAvailable binds the UDP sockets of fwknop SPA, requests sent alone
+// and DNS knocks once, as checkPortsAvailable does the knock ports.
+func checkUDPAvailable(cfg InstanceConfig) []PreflightProblem {
+	type socket struct {
+		what string
+		addr string
+	}
+	var sockets []socket
+	if cfg.Fwknop.Enabled() {
+		sockets = append(sockets, socket{"fwknop SPA", net.JoinHostPort(cfg.Bind, strconv.Itoa(cfg.Fwknop.Port))})
+	}
+	if port := cfg.Payload.SPAPort; port != 0 {
+		sockets = append(sockets, socket{"SPA requests", net.JoinHostPort(cfg.Bind, strconv.Itoa(port))})
+	}
+	if cfg.DNS.Enabled() && cfg.DNS.Mode != DNSModeTap {
+		sockets = append(sockets, socket{"DNS knocks", cmp.Or(cfg.DNS.Listen, defaultDNSListen)})
+	}
+
+	var problems []PreflightProblem
+	for _, s := range sockets {
+		pc, err := listenPacket(packetNetwork(cfg.Family), s.addr)
+		if err != nil {
+			port := 0
+			if _, ps, splitErr := net.SplitHostPort(s.addr); splitErr == nil {
+				port, _ = strconv.Atoi(ps)
+			}
+			problems = append(problems, PreflightProblem{
+				Check: "udp availability",
+				Err:   fmt.Errorf("cannot bind %s on udp %s: %w", s.what, s.addr, err),
+				Hint:  bindHint(err, port),
+			})
+			continue
+		}
+		_ = pc.Close()
+	}
+	return problems
+}
+
+// checkFirewallAccess runs a read-only command of each firewall backend,
+// which fails without the privileges managing it needs, so a server that
+// cannot open anything does not start.
+func checkFirewallAccess(cfg *Config) []PreflightProblem {
+	var problems []PreflightProblem
+	for _, name := range slices.Sorted(maps.Keys(cfg.Firewalls)) {
+		fcfg := cfg.Firewalls[name]
+		ctx, cancel := context.WithTimeout(context.Background(), firewallProbeTimeout)
+
+		var err error
+		hint := "managing the firewall needs root or CAP_NET_ADMIN; run as root or grant the capability"
+		switch fcfg.Backend {
+		case "iptables":
+			err = probeFirewall(ctx, "iptables", "-S")
+		case "ipset":
+			err = probeFirewall(ctx, "ipset", "list", "-n")
+		case "nftables":
+			err = probeFirewall(ctx, "nft", "list", "tables")
+		case "pf":
+			err = probeFirewall(ctx, "pfctl", "-s", "info")
+			hint = "pfctl needs root, or read and write access to /dev/pf"
+		case "firewalld":
+			err = pingFirewalld(ctx)
+			hint = "check firewalld is running and the server may call it on the system D-Bus, usually as root"
+		}
+		cancel()
+
+		if err != nil {
+			if errors.Is(err, exec.ErrNotFound) {
+				hint = "install it or choose another backend"
+			}
+			problems = append(problems, PreflightProblem{
+				Check: "firewall access",
+				Err:   fmt.Errorf("firewall %s (%s): %w", name, fcfg.Backend, err),
+				Hint:  hint,
+			})
+		}
+	}
+	return problems
+}
+
+// probeFirewall runs a firewall tool, failing when it is missing.
+func probeFirewall(ctx context.Context, name string, args ...string) error {
+	if _, err := exec.LookPath(name); err != nil {
+		return err
+	}
+	_, err := runCommand(ctx, name, args...)
+	return err
+}
+
+// checkCapture opens the packet socket once so missing privileges are
+// reported before the instance starts. An NFLOG group can only be bound by
+// one process, so nflog mode is not probed.
+func checkCapture(cfg InstanceConfig) []PreflightProblem {
+	if cfg.Mode != ModeCapture && cfg.Mode != ModeSYN {
+		return nil
+	}
+	if cfg.Mode == ModeSYN {
+		for _, bin := range synDropBinaries(cfg) {
+			if _, err := exec.LookPath(bin); err != nil {
+				return []PreflightProblem{{
+					Check: "capture",
+					Err:   err,
+					Hint:  "syn mode drops knock SYNs with " + bin + "; install it or use capture mode",
+				}}
+			}
+		}
+	}
+
+	src, err := openPacketSource(cfg.Interface)
+	if err != nil {
+		return []PreflightProblem{{
+			Check: "capture",
+			Err:   err,
+			Hint:  "capture mode needs Linux and CAP_NET_RAW; run as root or use setcap cap_net_raw+ep on the binary",
+		}}
+	}
+	_ = src.Close()
+	return nil
+}
+
+func bindHint(err error, port int) string {
+	switch {
+	case errors.Is(err, syscall.EADDRINUSE):
+		return fmt.Sprintf("another process is using port %d; stop it or pick a different knock port", port)
+	case errors.Is(err, syscall.EACCES), errors.Is(err, syscall.EPERM):
+		return fmt.Sprintf("port %d requires elevated privileges; run as root or grant CAP_NET_BIND_SERVICE", port)
+	default:
+		return ""
+	}
+}
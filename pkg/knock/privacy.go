@@ -0,0 +1,170 @@
+package knock
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"regexp"
+	"strings"
+)
+
+const (
+	PrivacyHash     = "hash"
+	PrivacyTruncate = "truncate"
+
+	defaultPrivacyPrefixV4 = 24
+	defaultPrivacyPrefixV6 = 48
+
+	privacyHashLen = 12 // Hex digits kept of the HMAC
+)
+
+// PrivacyConfig hides client addresses from the operational log and from
+// notifications, for deployments where IPs are personal data. Hashed
+// addresses stay stable while the salt does, so a source can still be
+// followed through the log without being named. Actions that need the real
+// address, such as firewalls and commands, and the audit store still see it;
+// protecting the audit database is left to its own storage encryption.
+type PrivacyConfig struct {
+	IPs      string `json:"ips"`       // "hash" or "truncate", full addresses when empty
+	Salt     string `json:"salt"`      // HMAC key of hashed addresses, required to hash
+	PrefixV4 int    `json:"prefix_v4"` // Bits kept of truncated IPv4 addresses, 24 when zero
+	PrefixV6 int    `json:"prefix_v6"` // Bits kept of truncated IPv6 addresses, 48 when zero
+}
+
+func (c PrivacyConfig) Enabled() bool {
+	return c.IPs != ""
+}
+
+// normalize checks the mode and applies the defaults.
+func (c *PrivacyConfig) normalize() error {
+	switch c.IPs {
+	case "":
+		return nil
+	case PrivacyHash:
+		if c.Salt == "" {
+			return errors.New("privacy: hashing ips needs a salt, unsalted IPv4 hashes are easily reversed")
+		}
+	case PrivacyTruncate:
+	default:
+		return fmt.Errorf("privacy: invalid ips %q, use hash or truncate", c.IPs)
+	}
+
+	if c.PrefixV4 == 0 {
+		c.PrefixV4 = defaultPrivacyPrefixV4
+	}
+	if c.PrefixV6 == 0 {
+		c.PrefixV6 = defaultPrivacyPrefixV6
+	}
+	if c.PrefixV4 < 0 || c.PrefixV4 > 32 || c.PrefixV6 < 0 || c.PrefixV6 > 128 {
+		return fmt.Errorf("privacy: invalid prefixes %d and %d", c.PrefixV4, c.PrefixV6)
+	}
+	return nil
+}
+
+// MaskIP returns ip as it may be shown, ip itself when privacy is off or it
+// is not an address.
+func (c PrivacyConfig) MaskIP(ip string) string {
+	if !c.Enabled() || ip == "" {
+		return ip
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ip
+	}
+	addr = addr.Unmap()
+
+	if c.IPs == PrivacyHash {
+		mac := hmac.New(sha256.New, []byte(c.Salt))
+		mac.Write(addr.AsSlice())
+		return "ip-" + hex.EncodeToString(mac.Sum(nil))[:privacyHashLen]
+	}
+
+	bits := c.PrefixV6
+	if addr.Is4() {
+		bits = c.PrefixV4
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return ip
+	}
+	return prefix.String()
+}
+
+// maskAccess hides the addresses of access before it leaves the process.
+func (c PrivacyConfig) maskAccess(access Access) Access {
+	access.IP = c.MaskIP(access.IP)
+	access.Source = c.MaskIP(access.Source)
+	return access
+}
+
+// ipCandidate matches runs of characters an address is written with; each
+// run is parsed before being replaced.
+var ipCandidate = regexp.MustCompile(`[0-9A-Fa-f:.]*[:.][0-9A-Fa-f:.]*`)
+
+// MaskIPs replaces every address in text. Networks, written with a trailing
+// prefix length, are configuration rather than clients and are kept.
+func (c PrivacyConfig) MaskIPs(text []byte) []byte {
+	if !c.Enabled() {
+		return text
+	}
+
+	var out []byte
+	last := 0
+	for _, m := range ipCandidate.FindAllIndex(text, -1) {
+		start, end := m[0], m[1]
+		if end < len(text) && text[end] == '/' {
+			continue
+		}
+
+		masked, ok := c.maskToken(string(text[start:end]))
+		if !ok {
+			continue
+		}
+		out = append(out, text[last:start]...)
+		out = append(out, masked...)
+		last = end
+	}
+	if out == nil {
+		return text
+	}
+	return append(out, text[last:]...)
+}
+
+// maskToken masks a single candidate, which may carry a port or the
+// punctuation ending a sentence.
+func (c PrivacyConfig) maskToken(token string) (string, bool) {
+	if _, err := netip.ParseAddr(token); err == nil {
+		return c.MaskIP(token), true
+	}
+	if ap, err := netip.ParseAddrPort(token); err == nil && ap.Addr().Is4() {
+		return c.MaskIP(ap.Addr().String()) + token[strings.LastIndexByte(token, ':'):], true
+	}
+	if trimmed := strings.TrimRight(token, ".:"); trimmed != token {
+		if _, err := netip.ParseAddr(trimmed); err == nil {
+			return c.MaskIP(trimmed) + token[len(trimmed):], true
+		}
+	}
+	return "", false
+}
+
+// privacyWriter masks the addresses in everything logged through it. The log
+// package hands it whole lines, one at a time.
+type privacyWriter struct {
+	out io.Writer
+	cfg PrivacyConfig
+}
+
+func newPrivacyWriter(out io.Writer, cfg PrivacyConfig) *privacyWriter {
+	return &privacyWriter{out: out, cfg: cfg}
+}
+
+func (w *privacyWriter) Write(p []byte) (int, error) {
+	if _, err := w.out.Write(w.cfg.MaskIPs(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,231 @@
+package knock
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"time"
+)
+
+// defaultProfileName stands for the instance's own sequence in settings
+const defaultProfileName = "default"
+
+// ProfileConfig is an extra sequence within an instance, e.g. a separate
+// knock for admins. It is only accepted from the sources and users it lists.
+type ProfileConfig struct {
+	Sequence   []KnockStep `json:"sequence"`
+	TOTP       TOTPConfig  `json:"totp"`        // Rotating sequence, replaces sequence when set
+	Sources    []string    `json:"sources"`     // CIDRs allowed to use the profile, any when empty
+	Users      []string    `json:"users"`       // Users allowed to use the profile, any when empty
+	Countries  []string    `json:"countries"`   // Countries allowed to use the profile, any when empty
+	ASNs       []uint      `json:"asns"`        // Networks allowed to use the profile, any when empty
+	Schedule   Schedule    `json:"schedule"`    // When the profile grants access, always when empty
+	Actions    []string    `json:"actions"`     // Run in addition to the instance actions
+	SessionTTL Duration    `json:"session_ttl"` // The instance TTL when zero
+	MaxPerIP   int         `json:"max_per_ip"`  // Sessions one IP may hold from the profile, unlimited when zero
+	Revoke     bool        `json:"revoke"`      // Close the client's sessions instead of granting
+
+	SecondFactor string `json:"second_factor"` // The instance's when empty
+
+	Service ServiceConfig `json:"service"` // What a grant opens, the actions' own ports when empty
+}
+
+// ServiceConfig is the target service of a profile, so "ssh" and "postgres"
+// profiles open different things from the same actions. Its ports replace
+// those of the firewall and command actions, unless a request asked for
+// others.
+type ServiceConfig struct {
+	Ports    []int  `json:"ports"`
+	Protocol string `json:"protocol"` // "tcp" or "udp", the action's own when empty
+	Forward  string `json:"forward"`  // Address, or address:port for a single port, to DNAT the ports to
+}
+
+// check validates the service of profile name.
+func (c ServiceConfig) check(name string) error {
+	for _, port := range c.Ports {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("profile %s: invalid service port %d", name, port)
+		}
+	}
+	switch c.Protocol {
+	case "", "tcp", "udp":
+	default:
+		return fmt.Errorf("profile %s: unknown service protocol %q", name, c.Protocol)
+	}
+	if c.Forward == "" {
+		return nil
+	}
+	if len(c.Ports) == 0 {
+		return fmt.Errorf("profile %s: forwarding needs service ports", name)
+	}
+	to, err := parseForward(c.Forward)
+	if err != nil {
+		return fmt.Errorf("profile %s: %w", name, err)
+	}
+	if to.Port() != 0 && len(c.Ports) > 1 {
+		return fmt.Errorf("profile %s: forward %s names a port for %d service ports", name, c.Forward, len(c.Ports))
+	}
+	return nil
+}
+
+// parseForward reads a forwarding target, whose port is zero when the
+// ports are forwarded unchanged.
+func parseForward(s string) (netip.AddrPort, error) {
+	if to, err := netip.ParseAddrPort(s); err == nil {
+		return to, nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("invalid forward %q, want an IP address or address:port", s)
+	}
+	return netip.AddrPortFrom(addr, 0), nil
+}
+
+// profile is a sequence an instance accepts along with what a grant runs.
+// Every instance has an unnamed default profile built from its own sequence.
+type profile struct {
+	name     string
+	sequence []KnockStep
+	totp     TOTPConfig
+	sources  []netip.Prefix
+	users    []string
+	geo      GeoRule
+	schedule Schedule
+	actions  []Action
+	ttl      time.Duration
+	maxPerIP int
+	revoke   bool
+	service  ServiceConfig
+	// Confirmation a grant waits for, nil when granted right away
+	secondFactor *SecondFactor
+	// Where a request asked its grant to be confirmed, set on the copy
+	// narrowed to the request
+	confirm *confirmTarget
+}
+
+// newProfiles builds the default profile followed by the named ones in name order.
+func newProfiles(cfg InstanceConfig, actions []Action, reg *Registry) ([]*profile, error) {
+	profiles := []*profile{{
+		sequence: cfg.Sequence,
+		totp:     cfg.TOTP,
+		actions:  actions,
+		ttl:      cfg.SessionTTL.Duration,
+		geo:      GeoRule{Countries: cfg.Countries, ASNs: cfg.ASNs},
+		schedule: cfg.Schedule,
+	}}
+	// Daily sequences are keyed with the profile's own name
+	profiles[0].totp.Profile = ""
+	var err error
+	if profiles[0].secondFactor, err = reg.SecondFactor(cfg.SecondFactor); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(cfg.Profiles))
+	for name := range cfg.Profiles {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		pcfg := cfg.Profiles[name]
+
+		extra, err := reg.Actions(pcfg.Actions)
+		if err != nil {
+			return nil, fmt.Errorf("profile %s: %w", name, err)
+		}
+
+		if err := pcfg.Service.check(name); err != nil {
+			return nil, err
+		}
+
+		p := &profile{
+			name:     name,
+			sequence: pcfg.Sequence,
+			totp:     pcfg.TOTP,
+			users:    pcfg.Users,
+			geo:      GeoRule{Countries: pcfg.Countries, ASNs: pcfg.ASNs},
+			schedule: pcfg.Schedule,
+			actions:  append(slices.Clip(actions), extra...),
+			ttl:      pcfg.SessionTTL.Duration,
+			maxPerIP: pcfg.MaxPerIP,
+			revoke:   pcfg.Revoke,
+			service:  pcfg.Service,
+		}
+		p.totp.Profile = name
+		if p.ttl == 0 {
+			p.ttl = cfg.SessionTTL.Duration
+		}
+		factor := pcfg.SecondFactor
+		if factor == "" {
+			factor = cfg.SecondFactor
+		}
+		if p.secondFactor, err = reg.SecondFactor(factor); err != nil {
+			return nil, fmt.Errorf("profile %s: %w", name, err)
+		}
+		for _, src := range pcfg.Sources {
+			prefix, err := parsePrefix(src)
+			if err != nil {
+				return nil, fmt.Errorf("profile %s: %w", name, err)
+			}
+			p.sources = append(p.sources, prefix)
+		}
+		profiles = append(profiles, p)
+	}
+	return profiles, nil
+}
+
+// knockable reports whether the profile has a sequence at all; an instance
+// made only of named profiles has an empty default one.
+func (p *profile) knockable() bool {
+	return len(p.sequence) > 0 || p.totp.Enabled()
+}
+
+// allows reports whether a client at addr, located at geo and identified as
+// user, may use the profile.
+func (p *profile) allows(addr netip.Addr, geo GeoInfo, user string) bool {
+	if len(p.sources) > 0 && !slices.ContainsFunc(p.sources, func(prefix netip.Prefix) bool {
+		return prefix.Contains(addr)
+	}) {
+		return false
+	}
+	if !p.geo.matches(geo) {
+		return false
+	}
+	return p.allowsUser(user)
+}
+
+// allowsUser reports whether user, empty when unknown, may use the profile.
+func (p *profile) allowsUser(user string) bool {
+	return len(p.users) == 0 || slices.Contains(p.users, user)
+}
+
+// sequences returns every sequence of the profile accepted at now, current
+// TOTP window first.
+func (p *profile) sequences(now time.Time) []knockSequence {
+	if !p.totp.Enabled() {
+		return []knockSequence{{steps: p.sequence, profile: p}}
+	}
+
+	windows, offsets := p.totp.Windows(now)
+	candidates := make([]knockSequence, len(windows))
+	for i, window := range windows {
+		candidates[i] = knockSequence{steps: TOTPSequence(p.totp, window), skew: offsets[i], profile: p}
+	}
+	return candidates
+}
+
+// profileName is the name a profile goes by in settings and messages.
+func profileName(name string) string {
+	if name == "" {
+		return defaultProfileName
+	}
+	return name
+}
+
+// profileSuffix names a non-default profile in log lines.
+func profileSuffix(name string) string {
+	if name == "" {
+		return ""
+	}
+	return " profile " + name
+}
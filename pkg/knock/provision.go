@@ -0,0 +1,137 @@
+package knock
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"time"
+)
+
+var ErrUnknownProfile = errors.New("unknown profile")
+
+// clientStepSlack is how far past the longest min_delay a provisioned client
+// pauses between knocks.
+const clientStepSlack = 200 * time.Millisecond
+
+// ProvisionRequest is the body of POST /instances/{name}/provision.
+type ProvisionRequest struct {
+	User    string   `json:"user"`    // Created, or given the instance and sources, when set
+	Sources []string `json:"sources"` // CIDRs the user knocks from
+	Profile string   `json:"profile"` // Named profile to knock, the default one when empty
+	Host    string   `json:"host"`    // Address clients reach the server at, admin.public_host when empty
+}
+
+// ClientBundle is a client profile as the knock command reads it, carrying
+// everything needed to knock on one instance and nothing else.
+type ClientBundle struct {
+	Host     string     `json:"host"`
+	Sequence []int      `json:"sequence,omitempty"`
+	Delay    Duration   `json:"delay,omitzero"`
+	SNI      []string   `json:"sni,omitempty"`
+	TOTP     TOTPConfig `json:"totp,omitzero"`
+
+	KnockPort    int    `json:"knock_port,omitempty"`
+	PayloadKey   string `json:"payload_key,omitempty"`
+	SPAPort      int    `json:"spa_port,omitempty"`
+	SPAProfile   string `json:"spa_profile,omitempty"`
+	ClientID     string `json:"client_id,omitempty"`
+	ChallengeKey string `json:"challenge_key,omitempty"`
+
+	HTTPSURL     string `json:"https_url,omitempty"`
+	HTTPSKey     string `json:"https_key,omitempty"`
+	HTTPSProfile string `json:"https_profile,omitempty"`
+
+	DNSZone    string `json:"dns_zone,omitempty"`
+	DNSKey     string `json:"dns_key,omitempty"`
+	DNSProfile string `json:"dns_profile,omitempty"`
+}
+
+// ClientBundle builds the client profile knocking the named profile of the
+// instance at host. Clients knock the sequence when the profile has one, and
+// otherwise fall back to the HTTPS endpoint, then to the DNS zone.
+func (sup *Supervisor) ClientBundle(instance, profile, host string) (ClientBundle, error) {
+	sup.mutex.Lock()
+	defer sup.mutex.Unlock()
+
+	inst, ok := sup.instances[instance]
+	if !ok {
+		return ClientBundle{}, fmt.Errorf("%w: %s", ErrUnknownInstance, instance)
+	}
+	return inst.server.cfg.clientBundle(profile, host)
+}
+
+func (cfg InstanceConfig) clientBundle(profile, host string) (ClientBundle, error) {
+	sequence, totp := cfg.Sequence, cfg.TOTP
+	if profile != "" && profile != defaultProfileName {
+		p, ok := cfg.Profiles[profile]
+		if !ok {
+			return ClientBundle{}, fmt.Errorf("%w: %s", ErrUnknownProfile, profile)
+		}
+		sequence, totp = p.Sequence, p.TOTP
+		// Daily sequences are keyed with the profile name
+		totp.Profile = profile
+	} else {
+		profile, totp.Profile = "", ""
+	}
+
+	b := ClientBundle{Host: host}
+	// A single packet is all the client sends where the instance takes one
+	if cfg.Payload.SPAPort != 0 {
+		b.SPAPort, b.SPAProfile, b.PayloadKey = cfg.Payload.SPAPort, profile, cfg.Payload.Key
+		return b, nil
+	}
+	switch {
+	case totp.Enabled():
+		b.TOTP = totp
+		b.Delay = Duration{cfg.Timeout.Duration / 2}
+	case len(sequence) > 0:
+		b.Sequence, b.SNI = expandSteps(sequence)
+		b.Delay = Duration{clientDelay(sequence, cfg.Timeout.Duration)}
+	case cfg.HTTPS.Enabled():
+		_, port, err := net.SplitHostPort(cfg.HTTPS.Listen)
+		if err != nil {
+			return ClientBundle{}, fmt.Errorf("https listen %q: %w", cfg.HTTPS.Listen, err)
+		}
+		b.HTTPSURL = "https://" + net.JoinHostPort(host, port) + "/knock"
+		b.HTTPSKey, b.HTTPSProfile = cfg.HTTPS.Key, profile
+		return b, nil
+	case cfg.DNS.Enabled():
+		b.DNSZone, b.DNSKey, b.DNSProfile = cfg.DNS.Zone, cfg.DNS.Key, profile
+		return b, nil
+	default:
+		return ClientBundle{}, fmt.Errorf("profile %s has nothing to knock", profileName(profile))
+	}
+
+	if cfg.Encoding == EncodingSource {
+		b.KnockPort = cfg.KnockPort
+	}
+	b.PayloadKey = cfg.Payload.Key
+	b.ChallengeKey = cfg.Challenge.Key
+	return b, nil
+}
+
+// expandSteps lists every knock of sequence in order, along with their
+// server names when any step is a TLS one.
+func expandSteps(sequence []KnockStep) ([]int, []string) {
+	var ports []int
+	var names []string
+	for _, step := range sequence {
+		ports = append(ports, slices.Repeat([]int{step.Port}, step.Count)...)
+		names = append(names, slices.Repeat([]string{step.SNI}, step.Count)...)
+	}
+	if !slices.ContainsFunc(names, func(name string) bool { return name != "" }) {
+		names = nil
+	}
+	return ports, names
+}
+
+// clientDelay is a pause between knocks that every step accepts: half the
+// timeout, unless a min_delay asks for longer.
+func clientDelay(sequence []KnockStep, timeout time.Duration) time.Duration {
+	delay := timeout / 2
+	for _, step := range sequence {
+		delay = max(delay, step.MinDelay.Duration+clientStepSlack)
+	}
+	return delay
+}
@@ -0,0 +1,104 @@
+package knock
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+const proxyDialTimeout = 5 * time.Second
+
+// ProxyConfig exposes a protected backend only to clients with an active session.
+type ProxyConfig struct {
+	Listen  string `json:"listen"`  // e.g. ":2222"
+	Backend string `json:"backend"` // e.g. "127.0.0.1:22"
+}
+
+// Proxy forwards TCP connections to a backend for clients holding a session
+// on its instance (or allowlisted), so no host firewall changes are needed.
+type Proxy struct {
+	cfg      ProxyConfig
+	instance string
+	sessions *SessionManager
+	allow    *Allowlist
+
+	ln net.Listener
+}
+
+func NewProxy(cfg ProxyConfig, instance string, sessions *SessionManager, allow *Allowlist) *Proxy {
+	return &Proxy{cfg: cfg, instance: instance, sessions: sessions, allow: allow}
+}
+
+func (p *Proxy) Start() error {
+	ln, err := listen("tcp", p.cfg.Listen)
+	if err != nil {
+		return err
+	}
+	p.ln = ln
+	log.Printf("[%s] Proxying %s to %s for active sessions", p.instance, ln.Addr(), p.cfg.Backend)
+
+	go p.serve()
+	return nil
+}
+
+// Stop closes the listener; established connections run until either side closes.
+func (p *Proxy) Stop() {
+	if p.ln != nil {
+		_ = p.ln.Close()
+	}
+}
+
+func (p *Proxy) serve() {
+	for {
+		conn, err := p.ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		go p.handle(conn)
+	}
+}
+
+func (p *Proxy) handle(conn net.Conn) {
+	defer conn.Close()
+
+	ip, err := clientIP(conn.RemoteAddr())
+	if err != nil {
+		return
+	}
+
+	if !p.sessions.HasActive(p.instance, ip, time.Now()) && !p.allow.Contains(ip) {
+		log.Printf("[%s] Proxy refused %s: no active session", p.instance, ip)
+		return
+	}
+
+	backend, err := net.DialTimeout("tcp", p.cfg.Backend, proxyDialTimeout)
+	if err != nil {
+		log.Printf("[%s] Proxy backend %s unreachable for %s: %v", p.instance, p.cfg.Backend, ip, err)
+		return
+	}
+	defer backend.Close()
+
+	done := make(chan struct{}, 2)
+	go pipe(backend, conn, done)
+	go pipe(conn, backend, done)
+
+	// Wait for both directions so half-closed connections still drain
+	<-done
+	<-done
+}
+
+func pipe(dst, src net.Conn, done chan<- struct{}) {
+	_, _ = io.Copy(dst, src)
+	if tcp, ok := dst.(*net.TCPConn); ok {
+		_ = tcp.CloseWrite()
+	} else {
+		_ = dst.Close()
+	}
+	done <- struct{}{}
+}
@@ -0,0 +1,71 @@
+//go:build linux
+
+package knock
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// packetSource reads raw Ethernet frames from an AF_PACKET socket.
+type packetSource struct {
+	fd int
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+// openPacketSource captures every frame on iface, or on all interfaces when
+// iface is empty. It needs CAP_NET_RAW.
+func openPacketSource(iface string) (*packetSource, error) {
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, int(htons(unix.ETH_P_ALL)))
+	if err != nil {
+		return nil, fmt.Errorf("opening packet socket (needs CAP_NET_RAW): %w", err)
+	}
+
+	if iface != "" {
+		ifi, err := net.InterfaceByName(iface)
+		if err != nil {
+			_ = unix.Close(fd)
+			return nil, err
+		}
+
+		sa := &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ALL), Ifindex: ifi.Index}
+		if err := unix.Bind(fd, sa); err != nil {
+			_ = unix.Close(fd)
+			return nil, fmt.Errorf("binding packet socket to %s: %w", iface, err)
+		}
+	}
+
+	// Wake up regularly so Close is noticed by a blocked reader
+	tv := unix.NsecToTimeval(int64(time.Second))
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		_ = unix.Close(fd)
+		return nil, err
+	}
+
+	return &packetSource{fd: fd}, nil
+}
+
+// ReadFrame reads one frame into buf and reports the interface it was seen
+// on and whether this host sent it. A timeout returns 0 and no error.
+func (s *packetSource) ReadFrame(buf []byte) (n, ifindex int, outgoing bool, err error) {
+	n, from, err := unix.Recvfrom(s.fd, buf, 0)
+	if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR) {
+		return 0, 0, false, nil
+	}
+	if ll, ok := from.(*unix.SockaddrLinklayer); ok {
+		ifindex = ll.Ifindex
+		outgoing = ll.Pkttype == unix.PACKET_OUTGOING
+	}
+	return n, ifindex, outgoing, err
+}
+
+func (s *packetSource) Close() error {
+	return unix.Close(s.fd)
+}
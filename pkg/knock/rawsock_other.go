@@ -0,0 +1,21 @@
+//go:build !linux
+
+package knock
+
+import "errors"
+
+var errRawUnsupported = errors.New("packet capture is only supported on Linux")
+
+type packetSource struct{}
+
+func openPacketSource(iface string) (*packetSource, error) {
+	return nil, errRawUnsupported
+}
+
+func (s *packetSource) ReadFrame(buf []byte) (int, int, bool, error) {
+	return 0, 0, false, errRawUnsupported
+}
+
+func (s *packetSource) Close() error {
+	return nil
+}
@@ -0,0 +1,229 @@
+package knock
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"reflect"
+	"slices"
+	"time"
+)
+
+// ErrRestartRequired is returned for config changes a running instance
+// cannot take, which need it stopped and started again.
+var ErrRestartRequired = errors.New("change needs an instance restart")
+
+// withoutLiveSettings clears what Reconfigure changes on a running instance:
+// the fixed sequences, the trap ports and the timeouts.
+func withoutLiveSettings(cfg InstanceConfig) InstanceConfig {
+	cfg.Sequence = nil
+	cfg.TrapPorts = nil
+	cfg.Timeout = Duration{}
+	cfg.SequenceTimeout = Duration{}
+
+	profiles := make(map[string]ProfileConfig, len(cfg.Profiles))
+	for name, p := range cfg.Profiles {
+		p.Sequence = nil
+		profiles[name] = p
+	}
+	cfg.Profiles = profiles
+	return cfg
+}
+
+// Reconfigure applies cfg, normalized, without stopping the instance when it
+// only changes sequences, trap ports or timeouts. Knock ports no longer used
+// stop listening and new ones start, and clients keep their progress on the
+// sequences that did not change while those on changed ones start over.
+// Other changes fail with ErrRestartRequired, as do port changes in the
+// modes watching for knocks rather than listening.
+func (s *Server) Reconfigure(cfg InstanceConfig) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !reflect.DeepEqual(withoutLiveSettings(s.cfg), withoutLiveSettings(cfg)) {
+		return ErrRestartRequired
+	}
+	if err := validationError(instanceSequenceProblems(cfg)); err != nil {
+		return err
+	}
+	if s.stop == nil {
+		s.applyLiveSettings(cfg)
+		return nil
+	}
+	if err := preflightRunning(cfg); err != nil {
+		return fmt.Errorf("%w: %v", ErrConfigValidationFailed, err)
+	}
+
+	prev, next := listenPorts(s.cfg), listenPorts(cfg)
+	if s.observing() && !slices.Equal(slices.Sorted(slices.Values(prev)), slices.Sorted(slices.Values(next))) {
+		return ErrRestartRequired
+	}
+
+	opened := make(map[int][]net.Listener)
+	for _, port := range next {
+		if slices.Contains(prev, port) {
+			continue
+		}
+		lns, err := s.listenPort(port)
+		if err != nil {
+			for _, lns := range opened {
+				closeListeners(lns)
+			}
+			return err
+		}
+		opened[port] = lns
+	}
+
+	// Knocks accepted before the close wait for the mutex and are then
+	// counted against the new sequences
+	for _, port := range prev {
+		if !slices.Contains(next, port) {
+			closeListeners(s.listeners[port])
+			delete(s.listeners, port)
+			log.Printf("[%s] Stopped listening for knock on port %d", s.Name(), port)
+		}
+	}
+	for port, lns := range opened {
+		s.listeners[port] = lns
+		for _, ln := range lns {
+			go s.handleKnock(ln, port)
+		}
+	}
+
+	s.applyLiveSettings(cfg)
+	kept, reset := s.migrateClients(s.clock.Now())
+	log.Printf("[%s] Sequences reconfigured, %d client(s) kept their progress, %d start over", s.Name(), kept, reset)
+	return nil
+}
+
+// applyLiveSettings copies the settings Reconfigure changes into the
+// instance, leaving the rest, which may be read without the server mutex.
+// Callers hold the server mutex.
+func (s *Server) applyLiveSettings(cfg InstanceConfig) {
+	s.cfg.Sequence = cfg.Sequence
+	s.cfg.TrapPorts = cfg.TrapPorts
+	s.cfg.Timeout = cfg.Timeout
+	s.cfg.SequenceTimeout = cfg.SequenceTimeout
+	s.cfg.Profiles = cfg.Profiles
+
+	for _, p := range s.profiles {
+		if p.name == "" {
+			p.sequence = cfg.Sequence
+		} else {
+			p.sequence = cfg.Profiles[p.name].Sequence
+		}
+	}
+	s.sni = sniSteps(s.cfg)
+}
+
+// migrateClients rebuilds the state of every tracked client on the current
+// sequences, the way a restored state file is, returning how many kept some
+// progress and how many lost it.
+// Callers hold the server mutex.
+func (s *Server) migrateClients(now time.Time) (kept, reset int) {
+	prev := s.clients
+	s.clients = newClientTable(s.cfg.MaxClients)
+
+	// Oldest first, so the table keeps its order
+	for e := prev.order.Back(); e != nil; e = e.Prev() {
+		entry := e.Value.(*clientEntry)
+		if entry.state.stale(now) {
+			continue
+		}
+		cp := ClientProgress{Instance: s.Name(), IP: entry.ip, Tracks: entry.state.progress(now)}
+		state := s.resumeState(cp, now)
+		if state == nil {
+			s.forget(entry.ip)
+			reset++
+			continue
+		}
+		s.clients.put(entry.ip, state, now)
+		s.share(entry.ip, state, now)
+		kept++
+	}
+	return kept, reset
+}
+
+// Reconfigure applies cfg to the instance of the same name, see
+// Server.Reconfigure.
+func (sup *Supervisor) Reconfigure(cfg InstanceConfig) error {
+	sup.mutex.Lock()
+	defer sup.mutex.Unlock()
+
+	inst, ok := sup.instances[cfg.Name]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownInstance, cfg.Name)
+	}
+	return inst.server.Reconfigure(cfg)
+}
+
+// SetSequence replaces the sequence of a profile of instance, the default
+// one when profile is empty, without restarting it.
+func (sup *Supervisor) SetSequence(instance, profile string, sequence []KnockStep) error {
+	sup.mutex.Lock()
+	defer sup.mutex.Unlock()
+
+	inst, ok := sup.instances[instance]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownInstance, instance)
+	}
+
+	cfg := inst.server.cfg
+	cfg.Profiles = maps.Clone(cfg.Profiles)
+	if profile == "" {
+		if cfg.TOTP.Enabled() {
+			return fmt.Errorf("%w: the sequence of instance %s rotates with totp", ErrConfigValidationFailed, instance)
+		}
+		cfg.Sequence = sequence
+	} else {
+		p, ok := cfg.Profiles[profile]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrUnknownProfile, profile)
+		}
+		if p.TOTP.Enabled() {
+			return fmt.Errorf("%w: the sequence of profile %s rotates with totp", ErrConfigValidationFailed, profile)
+		}
+		p.Sequence = sequence
+		cfg.Profiles[profile] = p
+	}
+
+	if err := normalizeInstance(&cfg); err != nil {
+		return fmt.Errorf("%w: %v", ErrConfigValidationFailed, err)
+	}
+	return inst.server.Reconfigure(cfg)
+}
+
+// reload applies next in place of cur to the running instances, failing with
+// ErrRestartRequired, before changing any, when it differs in more than
+// what Reconfigure changes.
+func (sup *Supervisor) reload(cur, next *Config) error {
+	if len(cur.Instances) != len(next.Instances) {
+		return ErrRestartRequired
+	}
+	a, b := *cur, *next
+	a.Instances, b.Instances = nil, nil
+	if !reflect.DeepEqual(a, b) {
+		return ErrRestartRequired
+	}
+
+	sup.mutex.Lock()
+	defer sup.mutex.Unlock()
+
+	for i, cfg := range next.Instances {
+		inst, ok := sup.instances[cfg.Name]
+		if !ok || cur.Instances[i].Name != cfg.Name {
+			return ErrRestartRequired
+		}
+		if !reflect.DeepEqual(withoutLiveSettings(inst.server.cfg), withoutLiveSettings(cfg)) {
+			return ErrRestartRequired
+		}
+	}
+	for _, cfg := range next.Instances {
+		if err := sup.instances[cfg.Name].server.Reconfigure(cfg); err != nil {
+			return fmt.Errorf("instance %s: %w", cfg.Name, err)
+		}
+	}
+	return nil
+}
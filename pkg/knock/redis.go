@@ -0,0 +1,206 @@
+package knock
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRedisPrefix  = "port-knocking:"
+	redisTimeout        = 500 * time.Millisecond
+	maxRedisBulkLength  = 1 << 20
+	redisProgressPrefix = "progress:"
+)
+
+var errRedisNil = errors.New("redis: nil")
+
+// RedisConfig points at the Redis server sharing state between nodes.
+type RedisConfig struct {
+	Addr     string `json:"addr"`     // host:port, empty disables sharing
+	Password string `json:"password"` // AUTH password, none when empty
+	DB       int    `json:"db"`
+	Prefix   string `json:"prefix"` // Key prefix, "port-knocking:" when empty
+}
+
+// RedisStore keeps knock progress in Redis. It speaks just enough RESP for
+// the few commands it needs over a single connection, redialled on error.
+// Knocks wait on Redis, so the server should be close to every node.
+type RedisStore struct {
+	cfg   RedisConfig
+	conn  net.Conn
+	r     *bufio.Reader
+	mutex sync.Mutex
+}
+
+func NewRedisStore(cfg RedisConfig) *RedisStore {
+	if cfg.Prefix == "" {
+		cfg.Prefix = defaultRedisPrefix
+	}
+	return &RedisStore{cfg: cfg}
+}
+
+func (s *RedisStore) progressKey(instance, ip string) string {
+	return s.cfg.Prefix + redisProgressPrefix + instance + ":" + ip
+}
+
+func (s *RedisStore) Progress(instance, ip string) (*ClientProgress, error) {
+	reply, err := s.do("GET", s.progressKey(instance, ip))
+	if errors.Is(err, errRedisNil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	data, ok := reply.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("redis: unexpected GET reply %v", reply)
+	}
+	cp := &ClientProgress{}
+	if err := json.Unmarshal(data, cp); err != nil {
+		return nil, fmt.Errorf("decoding progress: %w", err)
+	}
+	return cp, nil
+}
+
+func (s *RedisStore) SaveProgress(progress ClientProgress, ttl time.Duration) error {
+	data, err := json.Marshal(progress)
+	if err != nil {
+		return err
+	}
+	_, err = s.do("SET", s.progressKey(progress.Instance, progress.IP), string(data), "PX", strconv.FormatInt(max(ttl.Milliseconds(), 1), 10))
+	return err
+}
+
+func (s *RedisStore) DeleteProgress(instance, ip string) error {
+	_, err := s.do("DEL", s.progressKey(instance, ip))
+	return err
+}
+
+// Ping checks the server is reachable, authenticating on the way.
+func (s *RedisStore) Ping() error {
+	_, err := s.do("PING")
+	return err
+}
+
+// do runs one command, dialling first if needed. A failed connection is
+// dropped so the next command starts afresh.
+func (s *RedisStore) do(args ...string) (any, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.conn == nil {
+		if err := s.dialLocked(); err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := s.roundTripLocked(args)
+	var redisErr redisError
+	if err != nil && !errors.Is(err, errRedisNil) && !errors.As(err, &redisErr) {
+		_ = s.conn.Close()
+		s.conn = nil
+	}
+	return reply, err
+}
+
+func (s *RedisStore) dialLocked() error {
+	conn, err := net.DialTimeout("tcp", s.cfg.Addr, redisTimeout)
+	if err != nil {
+		return fmt.Errorf("redis: %w", err)
+	}
+	s.conn, s.r = conn, bufio.NewReader(conn)
+
+	var setup [][]string
+	if s.cfg.Password != "" {
+		setup = append(setup, []string{"AUTH", s.cfg.Password})
+	}
+	if s.cfg.DB != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(s.cfg.DB)})
+	}
+	for _, args := range setup {
+		if _, err := s.roundTripLocked(args); err != nil {
+			_ = conn.Close()
+			s.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *RedisStore) roundTripLocked(args []string) (any, error) {
+	_ = s.conn.SetDeadline(time.Now().Add(redisTimeout))
+
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		buf = append(buf, "$"+strconv.Itoa(len(arg))+"\r\n"+arg+"\r\n"...)
+	}
+	if _, err := s.conn.Write(buf); err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+	return readRESP(s.r)
+}
+
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// readRESP reads one reply: a string, an integer, bulk bytes or an array.
+func readRESP(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil || n > maxRedisBulkLength {
+			return nil, fmt.Errorf("redis: malformed bulk length %q", body)
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, fmt.Errorf("redis: %w", err)
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed array length %q", body)
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = readRESP(r); err != nil && !errors.Is(err, errRedisNil) {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+	}
+}
@@ -0,0 +1,118 @@
+package knock
+
+import (
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Replay caches of a server, as named in a ReplayEntry
+const (
+	replaySequences = "sequences"
+	replayNonces    = "nonces"
+	replayDigests   = "digests"
+)
+
+// ReplayEntry is a completed sequence, request nonce or SPA digest a server
+// saw recently, kept in a snapshot so a restored server still refuses it.
+type ReplayEntry struct {
+	Instance string    `json:"instance"`
+	Cache    string    `json:"cache"` // "sequences", "nonces" or "digests"
+	Key      string    `json:"key"`   // Hex encoded, nonces are binary
+	Used     time.Time `json:"used"`
+}
+
+// replayCache remembers recently completed sequences so an eavesdropper
+// cannot complete the same one again. Rotating TOTP sequences make each
+// completion unique to its window; static sequences become usable once per
+// window for everyone.
+type replayCache struct {
+	window time.Duration
+	used   map[string]time.Time
+}
+
+func newReplayCache(window time.Duration) *replayCache {
+	return &replayCache{window: window, used: make(map[string]time.Time)}
+}
+
+// use records key as seen at now, returning false if it was already seen
+// within the window. Callers hold the server mutex.
+func (c *replayCache) use(key string, now time.Time) bool {
+	if c.window <= 0 {
+		return true
+	}
+
+	for k, t := range c.used {
+		if now.Sub(t) >= c.window {
+			delete(c.used, k)
+		}
+	}
+
+	if _, ok := c.used[key]; ok {
+		return false
+	}
+	c.used[key] = now
+	return true
+}
+
+// restore records key as seen at used, unless it was seen later or used is
+// out of the window at now. Callers hold the server mutex.
+func (c *replayCache) restore(key string, used, now time.Time) {
+	if c.window <= 0 || now.Sub(used) >= c.window {
+		return
+	}
+	if t, ok := c.used[key]; !ok || used.After(t) {
+		c.used[key] = used
+	}
+}
+
+// replayEntries returns what the replay caches of the server hold at now.
+func (s *Server) replayEntries(now time.Time) []ReplayEntry {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var entries []ReplayEntry
+	for name, c := range s.replayCaches() {
+		for key, used := range c.used {
+			if now.Sub(used) < c.window {
+				entries = append(entries, ReplayEntry{Instance: s.Name(), Cache: name, Key: hex.EncodeToString([]byte(key)), Used: used})
+			}
+		}
+	}
+	return entries
+}
+
+// restoreReplay adds a saved entry to the replay cache it came from,
+// ignoring unknown caches and malformed keys.
+func (s *Server) restoreReplay(e ReplayEntry, now time.Time) {
+	c := s.replayCaches()[e.Cache]
+	key, err := hex.DecodeString(e.Key)
+	if c == nil || err != nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	c.restore(string(key), e.Used, now)
+}
+
+func (s *Server) replayCaches() map[string]*replayCache {
+	return map[string]*replayCache{
+		replaySequences: s.replays,
+		replayNonces:    s.nonces,
+		replayDigests:   s.digests,
+	}
+}
+
+func sequenceKey(seq knockSequence) string {
+	var b strings.Builder
+	b.WriteString(seq.profile.name)
+	for _, step := range seq.steps {
+		b.WriteByte('|')
+		b.WriteString(strconv.Itoa(step.Port))
+		b.WriteByte('x')
+		b.WriteString(strconv.Itoa(step.Count))
+	}
+	return b.String()
+}
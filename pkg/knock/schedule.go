@@ -0,0 +1,160 @@
+package knock
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule limits grants to some hours and days, e.g. 08:00 to 20:00 on
+// weekdays in UTC-3. Knocks outside it still complete the sequence, but the
+// grant is denied.
+type Schedule struct {
+	Days     []string `json:"days"`     // "mon".."sun", "weekdays" or "weekends"; every day when empty
+	From     string   `json:"from"`     // "HH:MM", start of the day when empty
+	To       string   `json:"to"`       // "HH:MM", end of the day when empty; before from spans midnight
+	Timezone string   `json:"timezone"` // IANA name or a fixed offset like "UTC-3", the host zone when empty
+
+	days     [7]bool // By time.Weekday
+	from, to int     // Minutes since midnight
+	loc      *time.Location
+}
+
+var scheduleDays = map[string][]time.Weekday{
+	"sun":      {time.Sunday},
+	"mon":      {time.Monday},
+	"tue":      {time.Tuesday},
+	"wed":      {time.Wednesday},
+	"thu":      {time.Thursday},
+	"fri":      {time.Friday},
+	"sat":      {time.Saturday},
+	"weekdays": {time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+	"weekends": {time.Saturday, time.Sunday},
+}
+
+func (s Schedule) Enabled() bool {
+	return len(s.Days) > 0 || s.From != "" || s.To != ""
+}
+
+// normalize parses the schedule, keeping the result alongside the settings.
+func (s *Schedule) normalize() error {
+	if !s.Enabled() {
+		return nil
+	}
+
+	s.days = [7]bool{}
+	for _, d := range s.Days {
+		days, ok := scheduleDays[strings.ToLower(d)]
+		if !ok {
+			return fmt.Errorf("schedule: invalid day %q", d)
+		}
+		for _, wd := range days {
+			s.days[wd] = true
+		}
+	}
+	if len(s.Days) == 0 {
+		s.days = [7]bool{true, true, true, true, true, true, true}
+	}
+
+	var err error
+	if s.from, err = parseClock(s.From, 0); err != nil {
+		return fmt.Errorf("schedule: from: %w", err)
+	}
+	if s.to, err = parseClock(s.To, 24*60); err != nil {
+		return fmt.Errorf("schedule: to: %w", err)
+	}
+	if s.from == s.to {
+		return fmt.Errorf("schedule: from and to are both %s", s.From)
+	}
+	if s.loc, err = parseTimezone(s.Timezone); err != nil {
+		return fmt.Errorf("schedule: %w", err)
+	}
+	return nil
+}
+
+// parseClock reads "HH:MM" as minutes since midnight, def when empty.
+func parseClock(s string, def int) (int, error) {
+	if s == "" {
+		return def, nil
+	}
+	if s == "24:00" {
+		return 24 * 60, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, want HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// parseTimezone loads an IANA zone or a fixed "UTC+H[:MM]" offset.
+func parseTimezone(name string) (*time.Location, error) {
+	if name == "" {
+		return time.Local, nil
+	}
+	if offset, ok := strings.CutPrefix(strings.ToUpper(name), "UTC"); ok && offset != "" {
+		sign := 1
+		switch offset[0] {
+		case '+':
+		case '-':
+			sign = -1
+		default:
+			return nil, fmt.Errorf("invalid timezone %q", name)
+		}
+		hours, minutes, _ := strings.Cut(offset[1:], ":")
+		h, err := strconv.Atoi(hours)
+		if err != nil || h > 14 {
+			return nil, fmt.Errorf("invalid timezone %q", name)
+		}
+		m := 0
+		if minutes != "" {
+			if m, err = strconv.Atoi(minutes); err != nil || m >= 60 {
+				return nil, fmt.Errorf("invalid timezone %q", name)
+			}
+		}
+		return time.FixedZone(name, sign*(h*3600+m*60)), nil
+	}
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone %q: %w", name, err)
+	}
+	return loc, nil
+}
+
+// Allows reports whether t falls in the schedule. The part of a window
+// spanning midnight that falls on the next day belongs to the day it
+// started on.
+func (s Schedule) Allows(t time.Time) bool {
+	if !s.Enabled() {
+		return true
+	}
+
+	t = t.In(s.loc)
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+
+	if s.from < s.to {
+		return s.days[day] && minute >= s.from && minute < s.to
+	}
+	if minute >= s.from {
+		return s.days[day]
+	}
+	return minute < s.to && s.days[(day+6)%7]
+}
+
+func (s Schedule) String() string {
+	days := "every day"
+	if len(s.Days) > 0 {
+		days = strings.ToLower(strings.Join(s.Days, ","))
+	}
+	from, to := s.From, s.To
+	if from == "" {
+		from = "00:00"
+	}
+	if to == "" {
+		to = "24:00"
+	}
+	return fmt.Sprintf("%s-%s %s %s", from, to, days, s.loc)
+}
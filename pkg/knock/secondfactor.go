@@ -0,0 +1,611 @@
+package knock
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SecondFactorTOTP     = "totp"     // Code from the user's authenticator app
+	SecondFactorEmail    = "email"    // One-time code mailed to the user
+	SecondFactorTelegram = "telegram" // Approve or deny buttons in a Telegram chat
+
+	defaultSecondFactorTimeout = 2 * time.Minute
+	secondFactorAttempts       = 3 // Wrong codes before the grant is denied
+	totpStep                   = 30 * time.Second
+	telegramPollTimeout        = 25 * time.Second
+)
+
+var errNoPendingGrant = errors.New("no grant is waiting for a second factor from this address")
+
+// SecondFactorConfig is a named confirmation instances and profiles can
+// require: a completed sequence waits, pending, until it arrives, and is
+// denied if it does not within the timeout. Codes, for totp and email, are
+// submitted from the address that knocked, to the factor's endpoint or to
+// /confirm/<name> on the instance's HTTPS knock endpoint.
+type SecondFactorConfig struct {
+	Method  string     `json:"method"`   // "totp", "email" or "telegram"
+	Timeout Duration   `json:"timeout"`  // How long a grant stays pending, 2 minutes when zero
+	Listen  string     `json:"listen"`   // Code endpoint address, e.g. ":8444", optional with an HTTPS knock endpoint
+	TLSCert string     `json:"tls_cert"` // Serve the endpoint over HTTPS with this certificate
+	TLSKey  string     `json:"tls_key"`
+	SMTP    SMTPConfig `json:"smtp"` // Mail server sending email codes
+
+	BotToken string `json:"bot_token"` // Telegram bot asking for approval
+	ChatID   string `json:"chat_id"`   // Telegram chat of the approvers
+	APIURL   string `json:"api_url"`   // Telegram Bot API, https://api.telegram.org when empty
+}
+
+// SMTPConfig is the mail server email codes are sent through.
+type SMTPConfig struct {
+	Server   string `json:"server"` // host:port
+	From     string `json:"from"`
+	Username string `json:"username"` // PLAIN authentication when set
+	Password string `json:"password"`
+}
+
+// pendingGrant is a completed sequence waiting for its second factor.
+type pendingGrant struct {
+	id       string
+	access   Access
+	code     string // Expected email code
+	attempts int
+	timer    *time.Timer
+	done     func(error)
+}
+
+// SecondFactor holds grants pending confirmation, one per source address,
+// and resolves them as codes or approvals arrive.
+type SecondFactor struct {
+	name   string
+	cfg    SecondFactorConfig
+	users  *UserStore
+	client *http.Client
+
+	pending  map[string]*pendingGrant // By IP
+	lastTOTP map[string]int64         // Last accepted TOTP counter by user
+	mutex    sync.Mutex
+
+	ln  net.Listener
+	srv *http.Server
+}
+
+func NewSecondFactor(name string, cfg SecondFactorConfig, users *UserStore) (*SecondFactor, error) {
+	if cfg.Timeout.Duration == 0 {
+		cfg.Timeout.Duration = defaultSecondFactorTimeout
+	}
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		return nil, fmt.Errorf("second factor %s: tls_cert and tls_key go together", name)
+	}
+
+	switch cfg.Method {
+	case SecondFactorTOTP, SecondFactorEmail:
+		if users == nil {
+			return nil, fmt.Errorf("second factor %s: %s codes need users_file", name, cfg.Method)
+		}
+		if cfg.Method == SecondFactorEmail && (cfg.SMTP.Server == "" || cfg.SMTP.From == "") {
+			return nil, fmt.Errorf("second factor %s: email needs smtp server and from", name)
+		}
+	case SecondFactorTelegram:
+		if cfg.BotToken == "" || cfg.ChatID == "" {
+			return nil, fmt.Errorf("second factor %s: telegram needs bot_token and chat_id", name)
+		}
+		if cfg.APIURL == "" {
+			cfg.APIURL = "https://api.telegram.org"
+		}
+	default:
+		return nil, fmt.Errorf("second factor %s: invalid method %q", name, cfg.Method)
+	}
+
+	return &SecondFactor{
+		name:     name,
+		cfg:      cfg,
+		users:    users,
+		client:   &http.Client{Timeout: telegramPollTimeout + 10*time.Second},
+		pending:  make(map[string]*pendingGrant),
+		lastTOTP: make(map[string]int64),
+	}, nil
+}
+
+func (f *SecondFactor) Name() string {
+	return f.name
+}
+
+// Listen binds the code endpoint, if the method has one, so failures
+// surface before the server starts.
+func (f *SecondFactor) Listen() error {
+	if f.cfg.Listen == "" {
+		return nil
+	}
+
+	ln, err := listen("tcp", f.cfg.Listen)
+	if err != nil {
+		return fmt.Errorf("second factor %s: %w", f.name, err)
+	}
+	f.ln = ln
+	f.srv = &http.Server{Handler: f.handler(), ReadHeaderTimeout: 5 * time.Second}
+	return nil
+}
+
+// acceptsCodes reports whether the factor is confirmed by submitting a code.
+func (f *SecondFactor) acceptsCodes() bool {
+	return f.cfg.Method == SecondFactorTOTP || f.cfg.Method == SecondFactorEmail
+}
+
+// handler serves the code form and submissions, on the factor's own
+// endpoint or mounted on an instance's HTTPS knock endpoint.
+func (f *SecondFactor) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /", f.serveForm)
+	mux.HandleFunc("POST /", f.serveCode)
+	return mux
+}
+
+// Serve answers code submissions, or polls Telegram for approvals, until
+// ctx is cancelled.
+func (f *SecondFactor) Serve(ctx context.Context) {
+	if f.cfg.Method == SecondFactorTelegram {
+		f.pollTelegram(ctx)
+		return
+	}
+	if f.srv == nil {
+		return
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = f.srv.Shutdown(shutdownCtx)
+	}()
+
+	log.Printf("Second factor %s: code endpoint listening on %s", f.name, f.ln.Addr())
+	var err error
+	if f.cfg.TLSCert != "" {
+		err = f.srv.ServeTLS(f.ln, f.cfg.TLSCert, f.cfg.TLSKey)
+	} else {
+		err = f.srv.Serve(f.ln)
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("Second factor %s: code endpoint stopped: %v", f.name, err)
+	}
+}
+
+// Challenge holds access until its second factor arrives, calling done with
+// nil once confirmed or with the reason the grant is refused. A new
+// challenge from the same address replaces the one pending.
+func (f *SecondFactor) Challenge(access Access, done func(error)) {
+	p := &pendingGrant{id: newSessionID(), access: access, done: done}
+
+	switch f.cfg.Method {
+	case SecondFactorTOTP:
+		if _, err := f.userSecret(access); err != nil {
+			done(err)
+			return
+		}
+	case SecondFactorEmail:
+		u, err := f.user(access)
+		if err != nil {
+			done(err)
+			return
+		}
+		if u.Email == "" {
+			done(fmt.Errorf("user %s has no email address", u.Name))
+			return
+		}
+		if p.code, err = randomDigits(6); err != nil {
+			done(err)
+			return
+		}
+		if err := f.sendEmail(u.Email, access, p.code); err != nil {
+			done(fmt.Errorf("sending the code: %w", err))
+			return
+		}
+	case SecondFactorTelegram:
+		if err := f.askTelegram(p); err != nil {
+			done(fmt.Errorf("asking for approval: %w", err))
+			return
+		}
+	}
+
+	f.mutex.Lock()
+	if old := f.pending[access.IP]; old != nil {
+		old.timer.Stop()
+		go old.done(errors.New("superseded by a newer sequence"))
+	}
+	f.pending[access.IP] = p
+	p.timer = time.AfterFunc(f.cfg.Timeout.Duration, func() {
+		if f.take(access.IP, p.id) {
+			done(errors.New("not confirmed in time"))
+		}
+	})
+	f.mutex.Unlock()
+
+	log.Printf("[%s] Pending second factor %s (%s) for IP %s%s",
+		access.Instance, f.name, f.cfg.Method, access.IP, userSuffix(access.User))
+}
+
+// take removes the pending grant of ip if it is still id, reporting whether
+// the caller now owns its outcome.
+func (f *SecondFactor) take(ip, id string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	p := f.pending[ip]
+	if p == nil || p.id != id {
+		return false
+	}
+	delete(f.pending, ip)
+	p.timer.Stop()
+	return true
+}
+
+// submit checks code against the grant pending for ip.
+func (f *SecondFactor) submit(ip, code string, now time.Time) error {
+	f.mutex.Lock()
+	p := f.pending[ip]
+	if p == nil {
+		f.mutex.Unlock()
+		return errNoPendingGrant
+	}
+
+	var ok bool
+	switch f.cfg.Method {
+	case SecondFactorTOTP:
+		ok = f.checkTOTPLocked(p.access, code, now)
+	case SecondFactorEmail:
+		ok = subtle.ConstantTimeCompare([]byte(code), []byte(p.code)) == 1
+	}
+
+	if !ok {
+		p.attempts++
+		if p.attempts < secondFactorAttempts {
+			f.mutex.Unlock()
+			return errors.New("wrong code")
+		}
+	}
+	delete(f.pending, ip)
+	p.timer.Stop()
+	f.mutex.Unlock()
+
+	if !ok {
+		p.done(errors.New("too many wrong codes"))
+		return errors.New("wrong code, the grant is denied")
+	}
+	p.done(nil)
+	return nil
+}
+
+func (f *SecondFactor) user(access Access) (User, error) {
+	if access.User == "" {
+		return User{}, errors.New("the second factor needs a known user")
+	}
+	return f.users.Get(access.User)
+}
+
+func (f *SecondFactor) userSecret(access Access) ([]byte, error) {
+	u, err := f.user(access)
+	if err != nil {
+		return nil, err
+	}
+	if u.TOTPSecret == "" {
+		return nil, fmt.Errorf("user %s has no TOTP secret", u.Name)
+	}
+	return decodeTOTPSecret(u.TOTPSecret)
+}
+
+// checkTOTPLocked accepts the RFC 6238 code of the current step or the ones
+// either side of it, each at most once.
+func (f *SecondFactor) checkTOTPLocked(access Access, code string, now time.Time) bool {
+	secret, err := f.userSecret(access)
+	if err != nil {
+		return false
+	}
+
+	counter := now.Unix() / int64(totpStep/time.Second)
+	for _, c := range []int64{counter, counter - 1, counter + 1} {
+		if c <= f.lastTOTP[access.User] {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(code), []byte(totpCode(secret, c))) == 1 {
+			f.lastTOTP[access.User] = c
+			return true
+		}
+	}
+	return false
+}
+
+// TOTPCounter is the last TOTP step a second factor accepted from a user,
+// kept in a snapshot so a restored server refuses codes already used.
+type TOTPCounter struct {
+	SecondFactor string `json:"second_factor"`
+	User         string `json:"user"`
+	Counter      int64  `json:"counter"`
+}
+
+// totpCounters returns the last step accepted from each user.
+func (f *SecondFactor) totpCounters() []TOTPCounter {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	counters := make([]TOTPCounter, 0, len(f.lastTOTP))
+	for user, c := range f.lastTOTP {
+		counters = append(counters, TOTPCounter{SecondFactor: f.name, User: user, Counter: c})
+	}
+	return counters
+}
+
+// restoreTOTPCounter raises the last step accepted from the user of c.
+func (f *SecondFactor) restoreTOTPCounter(c TOTPCounter) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.lastTOTP[c.User] = max(f.lastTOTP[c.User], c.Counter)
+}
+
+// decodeTOTPSecret reads a base32 secret as authenticator apps show it.
+func decodeTOTPSecret(s string) ([]byte, error) {
+	s = strings.ToUpper(strings.ReplaceAll(s, " ", ""))
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(s, "="))
+	if err != nil || len(secret) == 0 {
+		return nil, errors.New("invalid TOTP secret")
+	}
+	return secret, nil
+}
+
+// NewTOTPSecret generates a 160-bit authenticator secret in base32.
+func NewTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret), nil
+}
+
+// TOTPURI is the otpauth:// URI authenticator apps import secret from.
+func TOTPURI(issuer, account, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	return "otpauth://totp/" + url.PathEscape(issuer+":"+account) + "?" + v.Encode()
+}
+
+// totpCode is the 6-digit HOTP value of counter (RFC 4226).
+func totpCode(secret []byte, counter int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1_000_000)
+}
+
+func randomDigits(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = '0' + b[i]%10
+	}
+	return string(b), nil
+}
+
+func (f *SecondFactor) sendEmail(to string, access Access, code string) error {
+	host, _, err := net.SplitHostPort(f.cfg.SMTP.Server)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if f.cfg.SMTP.Username != "" {
+		auth = smtp.PlainAuth("", f.cfg.SMTP.Username, f.cfg.SMTP.Password, host)
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\nTo: %s\r\nSubject: Knock confirmation code %s\r\n", f.cfg.SMTP.From, to, code)
+	fmt.Fprintf(&msg, "Date: %s\r\n\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Your confirmation code for access from %s on %s is %s.\r\n", access.IP, access.Instance, code)
+	fmt.Fprintf(&msg, "It is valid for %s. If you did not knock, ignore this message.\r\n", f.cfg.Timeout.Duration)
+	return smtp.SendMail(f.cfg.SMTP.Server, auth, f.cfg.SMTP.From, []string{to}, msg.Bytes())
+}
+
+var secondFactorForm = template.Must(template.New("form").Parse(`<!doctype html>
+<title>Confirm access</title>
+<form method="post">
+<label>Confirmation code for {{.}} <input name="code" autocomplete="one-time-code" inputmode="numeric" autofocus></label>
+<button>Confirm</button>
+</form>
+`))
+
+// serveForm lets a browser submit the code.
+func (f *SecondFactor) serveForm(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_ = secondFactorForm.Execute(w, requestIP(r))
+}
+
+// serveCode takes the code from the form or a JSON {"code": ...} body.
+func (f *SecondFactor) serveCode(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 4<<10)
+
+	code := ""
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var body struct {
+			Code string `json:"code"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		code = body.Code
+	} else {
+		code = r.FormValue("code")
+	}
+
+	status, result := http.StatusOK, map[string]string{"status": "confirmed"}
+	if err := f.submit(requestIP(r), strings.TrimSpace(code), time.Now()); err != nil {
+		status, result = http.StatusForbidden, map[string]string{"error": err.Error()}
+		if errors.Is(err, errNoPendingGrant) {
+			status = http.StatusNotFound
+		}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(result)
+}
+
+// askTelegram sends the approval request with its two buttons.
+func (f *SecondFactor) askTelegram(p *pendingGrant) error {
+	a := p.access
+	text := fmt.Sprintf("[%s] IP %s%s%s completed the sequence. Grant access?",
+		a.Instance, a.IP, userSuffix(a.User), profileSuffix(a.Profile))
+	keyboard := map[string]any{"inline_keyboard": [][]map[string]string{{
+		{"text": "Approve", "callback_data": "approve:" + p.access.IP + ":" + p.id},
+		{"text": "Deny", "callback_data": "deny:" + p.access.IP + ":" + p.id},
+	}}}
+	return f.telegram(context.Background(), "sendMessage", map[string]any{
+		"chat_id":      f.cfg.ChatID,
+		"text":         text,
+		"reply_markup": keyboard,
+	}, nil)
+}
+
+// pollTelegram long-polls the bot for button presses from the approvers' chat.
+func (f *SecondFactor) pollTelegram(ctx context.Context) {
+	offset := 0
+	for ctx.Err() == nil {
+		var updates []struct {
+			ID       int `json:"update_id"`
+			Callback *struct {
+				ID      string `json:"id"`
+				Data    string `json:"data"`
+				Message struct {
+					MessageID int `json:"message_id"`
+					Chat      struct {
+						ID int64 `json:"id"`
+					} `json:"chat"`
+					Text string `json:"text"`
+				} `json:"message"`
+				From struct {
+					Username string `json:"username"`
+				} `json:"from"`
+			} `json:"callback_query"`
+		}
+		err := f.telegram(ctx, "getUpdates", map[string]any{
+			"offset":          offset,
+			"timeout":         int(telegramPollTimeout / time.Second),
+			"allowed_updates": []string{"callback_query"},
+		}, &updates)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Second factor %s: polling Telegram: %v", f.name, err)
+				select {
+				case <-ctx.Done():
+				case <-time.After(5 * time.Second):
+				}
+			}
+			continue
+		}
+
+		for _, u := range updates {
+			offset = u.ID + 1
+			cb := u.Callback
+			if cb == nil || strconv.FormatInt(cb.Message.Chat.ID, 10) != f.cfg.ChatID {
+				continue
+			}
+
+			verdict := f.answer(cb.Data, cb.From.Username)
+			_ = f.telegram(ctx, "answerCallbackQuery", map[string]any{"callback_query_id": cb.ID, "text": verdict}, nil)
+			_ = f.telegram(ctx, "editMessageText", map[string]any{
+				"chat_id":    f.cfg.ChatID,
+				"message_id": cb.Message.MessageID,
+				"text":       cb.Message.Text + "\n" + verdict,
+			}, nil)
+		}
+	}
+}
+
+// answer resolves the grant a button press refers to.
+func (f *SecondFactor) answer(data, by string) string {
+	action, rest, _ := strings.Cut(data, ":")
+	i := strings.LastIndexByte(rest, ':')
+	if i < 0 {
+		return "Unknown request"
+	}
+	ip, id := rest[:i], rest[i+1:]
+
+	f.mutex.Lock()
+	p := f.pending[ip]
+	f.mutex.Unlock()
+	if p == nil || p.id != id || !f.take(ip, id) {
+		return "No longer pending"
+	}
+
+	if by == "" {
+		by = "an approver"
+	}
+	if action != "approve" {
+		p.done(fmt.Errorf("denied by %s", by))
+		return "Denied by " + by
+	}
+	log.Printf("[%s] Second factor %s: IP %s approved by %s", p.access.Instance, f.name, ip, by)
+	p.done(nil)
+	return "Approved by " + by
+}
+
+// telegram calls a Bot API method, decoding its result into out.
+func (f *SecondFactor) telegram(ctx context.Context, method string, in, out any) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	u := f.cfg.APIURL + "/bot" + url.PathEscape(f.cfg.BotToken) + "/" + method
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		OK          bool            `json:"ok"`
+		Result      json.RawMessage `json:"result"`
+		Description string          `json:"description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&result); err != nil {
+		return fmt.Errorf("%s: %s", method, resp.Status)
+	}
+	if !result.OK {
+		return fmt.Errorf("%s: %s", method, result.Description)
+	}
+	if out != nil {
+		return json.Unmarshal(result.Result, out)
+	}
+	return nil
+}
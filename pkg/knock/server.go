@@ -0,0 +1,1302 @@
+package knock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type KnockStep struct {
+	Port  int    `json:"port"`
+	Count int    `json:"count"`
+	SNI   string `json:"sni,omitempty"` // Server name a TLS ClientHello to the port must carry, for a plain knock when empty
+
+	// Bounds on the delay between the previous step and this one, unchecked when zero
+	MinDelay Duration `json:"min_delay,omitzero"`
+	MaxDelay Duration `json:"max_delay,omitzero"`
+
+	// Knocks past Count, such as retransmitted SYNs, the step absorbs until
+	// the next step starts instead of resetting the sequence
+	Tolerance string `json:"tolerance,omitempty"` // "exact" (default), "at_least" or "range"
+	MaxCount  int    `json:"max_count,omitempty"` // Most knocks of a range step
+}
+
+const (
+	ToleranceExact   = "exact"
+	ToleranceAtLeast = "at_least"
+	ToleranceRange   = "range"
+)
+
+// accepts reports whether the step may have been knocked n times.
+func (s KnockStep) accepts(n int) bool {
+	switch s.Tolerance {
+	case ToleranceAtLeast:
+		return n >= s.Count
+	case ToleranceRange:
+		return n >= s.Count && n <= s.MaxCount
+	}
+	return n == s.Count
+}
+
+// Server is one knock server instance with its own sequence and client state.
+type Server struct {
+	cfg      InstanceConfig
+	profiles []*profile // Default profile first
+	policies []Authorizer
+	history  *History
+	sessions *SessionManager
+	bans     *BanList
+	users    *UserStore
+	stats    *Stats
+	metrics  *StatsD
+	tracer   *Tracer
+	geo      *GeoIP
+	allow    *Allowlist
+	denylist []netip.Prefix
+	targets  []netip.Prefix // Addresses requests may ask to open instead of their source
+	feeds    []*Feed
+	ifaces   *interfaceNames // Set when the instance has interface policies
+
+	// Server names accepted per TLS knock port
+	sni map[int][]string
+	// Completed sequences waiting for their challenge port, by knocking IP
+	pending map[string]*pendingChallenge
+
+	// Knock events with their ip, port, step and profile as attributes
+	logger *slog.Logger
+
+	clients   *clientTable
+	store     StateStore   // Shares progress with other nodes, nil when local
+	replays   *replayCache // Recently completed sequences
+	nonces    *replayCache // Recently accepted request payloads
+	digests   *replayCache // Recently accepted SPA packets
+	spa       net.PacketConn
+	requests  net.PacketConn // Requests sent alone to payload.spa_port
+	https     *http.Server
+	dns       net.PacketConn         // DNS knock socket in listen mode
+	syn       *synSource             // Capture source holding the DROP rules of syn mode
+	listeners map[int][]net.Listener // By knock port
+	proxies   []*Proxy
+	stop      chan struct{} // Closed when the instance stops
+	mutex     sync.Mutex
+
+	clock Clock
+	// Runs the outcomes of a knock once it is counted, on their own
+	// goroutine unless a Simulation queues them
+	spawn func(func())
+
+	// Set when built by New, which leaves no supervisor to expire sessions
+	expireSessions bool
+}
+
+// NewServer creates an instance using the actions and policies it names from reg.
+func NewServer(cfg InstanceConfig, reg *Registry) (*Server, error) {
+	actions, err := reg.Actions(cfg.Actions)
+	if err != nil {
+		return nil, err
+	}
+	policies, err := reg.Policies(cfg.Policies)
+	if err != nil {
+		return nil, err
+	}
+
+	builtin := []Action{logAction{}, reg.events}
+	if reg.audit != nil {
+		builtin = append(builtin, reg.audit)
+	}
+	profiles, err := newProfiles(cfg, append(builtin, actions...), reg)
+	if err != nil {
+		return nil, err
+	}
+
+	var deny []netip.Prefix
+	for _, entry := range cfg.Denylist {
+		prefix, err := parsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("denylist: %w", err)
+		}
+		deny = append(deny, prefix)
+	}
+	var targets []netip.Prefix
+	for _, entry := range cfg.RequestTargets {
+		prefix, err := parsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("request_targets: %w", err)
+		}
+		targets = append(targets, prefix)
+	}
+
+	feeds, err := reg.Feeds(cfg.Blocklists)
+	if err != nil {
+		return nil, err
+	}
+
+	var ifaces *interfaceNames
+	if len(cfg.Interfaces) > 0 {
+		ifaces = &interfaceNames{}
+	}
+	logger := reg.logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	return &Server{
+		cfg:      cfg,
+		profiles: profiles,
+		policies: policies,
+		history:  reg.history,
+		sessions: reg.sessions,
+		bans:     reg.bans,
+		users:    reg.users,
+		stats:    reg.stats,
+		metrics:  reg.metrics,
+		tracer:   reg.tracer,
+		geo:      reg.geo,
+		allow:    NewAllowlist(cfg.Allowlist),
+		denylist: deny,
+		targets:  targets,
+		feeds:    feeds,
+		ifaces:   ifaces,
+		sni:      sniSteps(cfg),
+		logger:   logger.With("instance", cfg.Name),
+		pending:  make(map[string]*pendingChallenge),
+		clients:  newClientTable(cfg.MaxClients),
+		store:    reg.store,
+		replays:  newReplayCache(cfg.ReplayWindow.Duration),
+		nonces:   newReplayCache(2 * payloadMaxAge),
+		digests:  newReplayCache(2 * fwknopMaxAge),
+		clock:    systemClock{},
+		spawn:    func(f func()) { go f() },
+	}, nil
+}
+
+func (s *Server) Name() string {
+	return s.cfg.Name
+}
+
+// profile returns the named profile, or the default one.
+func (s *Server) profile(name string) *profile {
+	for _, p := range s.profiles {
+		if p.name == name {
+			return p
+		}
+	}
+	return s.profiles[0]
+}
+
+// candidateSequences returns every sequence ip may start at now, from the
+// profiles its address and user allow.
+func (s *Server) candidateSequences(ip string, now time.Time) []knockSequence {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil
+	}
+	addr = addr.Unmap()
+
+	var user *User
+	name := ""
+	if s.users != nil {
+		if u, ok := s.users.Identify(s.Name(), ip); ok {
+			user, name = u, u.Name
+		}
+	}
+
+	var geo GeoInfo
+	if s.geo != nil {
+		geo = s.geo.Lookup(addr)
+	}
+
+	var candidates []knockSequence
+	for _, p := range s.profiles {
+		if user != nil && !user.AllowsProfile(p.name) {
+			continue
+		}
+		if p.knockable() && p.allows(addr, geo, name) {
+			candidates = append(candidates, p.sequences(now)...)
+		}
+	}
+	return candidates
+}
+
+// blocklisted returns the first feed listing ip, nil when none does.
+func (s *Server) blocklisted(ip string) *Feed {
+	for _, f := range s.feeds {
+		if f.Contains(ip) {
+			return f
+		}
+	}
+	return nil
+}
+
+// denied reports whether ip falls in a denylisted range.
+func (s *Server) denied(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	return slices.ContainsFunc(s.denylist, func(p netip.Prefix) bool { return p.Contains(addr) })
+}
+
+func (s *Server) handleKnock(ln net.Listener, port int) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		ip, err := clientIP(conn.RemoteAddr())
+		if err != nil {
+			if err := conn.Close(); err != nil {
+				panic(err)
+			}
+			continue
+		}
+
+		srcPort := 0
+		if a, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			srcPort = a.Port
+		}
+		var local netip.Addr
+		if a, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+			local = a.AddrPort().Addr()
+		}
+		iface := s.knockInterface(local, 0)
+
+		// Server name steps count once the ClientHello is in
+		if _, ok := s.sni[port]; ok {
+			go s.readClientHello(conn, ip, iface, port, srcPort)
+			continue
+		}
+
+		// The knock is counted once the client is done sending its request
+		if s.cfg.Payload.Enabled() {
+			go s.readPayload(conn, ip, iface, port, srcPort)
+			continue
+		}
+
+		// The connection completing a sequence carries its challenge back
+		if s.cfg.Challenge.Enabled() {
+			s.processKnock(ip, iface, port, srcPort, nil)
+			go s.closeKnock(conn, ip)
+			continue
+		}
+
+		// Decoy banner: keep talking like a real service while the knock is counted
+		if s.cfg.Banner != "" {
+			go serveBanner(s.cfg.Banner, conn)
+		} else if err := conn.Close(); err != nil {
+			panic(err)
+		}
+
+		s.processKnock(ip, iface, port, srcPort, nil)
+	}
+}
+
+// processKnock counts a knock on port from ip's srcPort, seen on iface.
+// payload is what the client sent on the connection: the ClientHello on
+// server name ports, else used when the knock completes a sequence.
+func (s *Server) processKnock(ip, iface string, port, srcPort int, payload []byte) {
+	sp := s.tracer.start("knock", nil)
+	defer sp.finish()
+	sp.set("knock.instance", s.Name())
+	sp.setClient(ip)
+	sp.set("knock.port", port)
+	if iface != "" {
+		sp.set("knock.interface", iface)
+	}
+	sp.set("knock.outcome", "ignored")
+
+	locking := time.Now()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	sp.set("knock.lock_wait_us", time.Since(locking).Microseconds())
+
+	now := s.clock.Now()
+
+	policy := s.ifacePolicy(iface)
+	if policy.Ignore {
+		s.logger.Info("Ignoring knock on interface", "ip", ip, "port", port, "interface", iface)
+		return
+	}
+
+	// TLS knock ports may front a real service: other names are its traffic
+	sni := ""
+	if names, ok := s.sni[port]; ok {
+		sni, _ = clientHelloSNI(payload)
+		if !slices.Contains(names, sni) {
+			return
+		}
+	}
+	s.stats.record(statAttempt, s.Name(), ip, port, now)
+	s.metrics.count(statAttempt, s.Name(), "", iface)
+
+	// Denied ranges never reach the allowlist or the sequences
+	if s.denied(ip) {
+		s.logger.Info("Ignoring knock from denylisted IP", "ip", ip, "port", port)
+		return
+	}
+
+	// Pre-authorized source: any knock grants, unless it already holds access
+	if s.allow.Contains(ip) {
+		s.forget(ip)
+		if !s.sessions.HasActive(s.Name(), ip, now) {
+			s.logger.Info("Allowlisted source, skipping sequence", "ip", ip, "port", port)
+			sp.set("knock.outcome", "allowlisted")
+			s.spawn(func() { s.grant(Access{Instance: s.Name(), IP: ip, Time: now, trace: sp}, s.profiles[0]) })
+		}
+		return
+	}
+
+	// Threat intel lists, checked before the sequence is evaluated
+	if f := s.blocklisted(ip); f != nil {
+		if s.cfg.BlocklistMode == BlocklistReject {
+			s.logger.Warn("Ignoring knock from blocklisted IP", "ip", ip, "port", port, "blocklist", f.Name())
+			return
+		}
+		s.logger.Warn("Knock from blocklisted IP", "ip", ip, "port", port, "blocklist", f.Name())
+	}
+
+	if ban, ok := s.bans.Banned(ip, now); ok {
+		s.logger.Info("Ignoring knock from banned IP", "ip", ip, "port", port, "until", ban.Until.Format(time.RFC3339))
+		return
+	}
+
+	// Decoy port: no legitimate client ever touches it
+	if slices.Contains(s.cfg.TrapPorts, port) {
+		s.forget(ip)
+		s.logger.Warn("TRAP port hit", "ip", ip, "port", port)
+		sp.set("knock.outcome", "trapped")
+
+		ban := s.bans.Penalize(s.cfg.Ban, Ban{
+			IP:       ip,
+			Instance: s.Name(),
+			Reason:   fmt.Sprintf("knocked trap port %d", port),
+			BannedAt: now,
+		})
+		s.spawn(func() { s.banned(ban, port) })
+		return
+	}
+
+	// Past the trap ports, the sequence may be in the source ports
+	port = s.knockValue(port, srcPort)
+
+	state, ok := s.clientState(ip, now)
+
+	// New client or every track timed out: reset
+	if !ok || state.stale(now) {
+		state = s.newClientState(ip, now)
+		if s.clients.put(ip, state, now) {
+			s.logger.Warn("Tracking the maximum of knocking sources, evicting the least recent", "ip", ip, "port", port, "max_clients", s.cfg.MaxClients)
+		}
+	}
+
+	advanced := false
+	for _, t := range state.Tracks {
+		// Sequences the interface does not accept see the knock as invalid
+		if !policy.accepts(t.sequence.profile.name) {
+			continue
+		}
+		hits, ok := t.advance(port, sni, now, s.cfg.ReorderWindow.Duration)
+		if !ok {
+			continue
+		}
+		advanced = true
+		sp.set("knock.outcome", "advanced")
+
+		if len(hits) == 0 {
+			s.logger.Info("Knock held, arrived early", "ip", ip, "port", port, "profile", profileName(t.sequence.profile.name))
+			sp.set("knock.outcome", "held")
+		}
+		for _, h := range hits {
+			sp.set("knock.step", h.index+1)
+			sp.set("knock.steps", len(t.sequence.steps))
+			attrs := []any{
+				"ip", ip,
+				"port", h.step.Port,
+				"hit", h.hit,
+				"count", h.step.Count,
+				"step", h.index + 1,
+				"steps", len(t.sequence.steps),
+				"profile", profileName(t.sequence.profile.name),
+			}
+			if h.step.SNI != "" {
+				attrs = append(attrs, "sni", h.step.SNI)
+			}
+			s.logger.Info("Knock OK", attrs...)
+		}
+
+		if t.complete() {
+			s.forget(ip)
+			s.stats.record(statCompletion, s.Name(), ip, port, now)
+			s.metrics.count(statCompletion, s.Name(), profileName(t.sequence.profile.name), iface)
+			sp.set("knock.outcome", "completed")
+			sp.set("knock.profile", profileName(t.sequence.profile.name))
+
+			if t.sequence.skew != 0 {
+				s.logger.Warn("Clock skew, knocked the sequence of another window", "ip", ip, "profile", profileName(t.sequence.profile.name), "window", t.sequence.skew)
+			}
+
+			p := t.sequence.profile
+			access := Access{Instance: s.Name(), IP: ip, Profile: p.name, Interface: iface, Time: now, trace: sp}
+			if !s.replays.use(sequenceKey(t.sequence), access.Time) {
+				s.logger.Warn("Replayed sequence", "ip", ip, "port", port, "profile", profileName(p.name))
+				s.spawn(func() { s.deny(access, p, "sequence already used") })
+				return
+			}
+
+			if s.cfg.Payload.Enabled() {
+				requested, err := s.applyPayload(&access, p, payload)
+				if err != nil {
+					s.logger.Warn("Rejected request", "ip", ip, "port", port, "profile", profileName(p.name), "error", err)
+					s.spawn(func() { s.deny(access, p, err.Error()) })
+					return
+				}
+				p = requested
+			}
+			if s.cfg.Challenge.Enabled() {
+				s.issueChallenge(access, p)
+				return
+			}
+			s.spawn(func() { s.complete(access, p) })
+			return
+		}
+	}
+
+	if !advanced {
+		s.logger.Warn("Invalid knock", "ip", ip, "port", port)
+		sp.set("knock.outcome", "invalid")
+		s.forget(ip)
+
+		s.failed(ip, port, now, fmt.Sprintf("invalid knock on port %d", port))
+		return
+	}
+	state.LastKnock = now
+	s.share(ip, state, now)
+}
+
+// failed records an invalid knock from ip on port, zero when there is no
+// port, banning the source past the threshold.
+// Callers hold the server mutex.
+func (s *Server) failed(ip string, port int, now time.Time, reason string) {
+	s.stats.record(statFailure, s.Name(), ip, port, now)
+	s.metrics.count(statFailure, s.Name(), "", "")
+	s.spawn(func() { s.notifyFailed(Access{Instance: s.Name(), IP: ip, Time: now}, reason) })
+
+	if s.cfg.Ban.Enabled() {
+		if ban, ok := s.bans.Fail(s.cfg.Ban, s.Name(), ip, now); ok {
+			s.spawn(func() { s.banned(ban, port) })
+		}
+	}
+}
+
+// notifyFailed tells every action of the default profile interested in
+// failures about an invalid attempt.
+func (s *Server) notifyFailed(access Access, reason string) {
+	for _, a := range s.profiles[0].actions {
+		h, ok := a.(FailHook)
+		if !ok {
+			continue
+		}
+		if err := h.OnFailed(context.Background(), access, reason); err != nil {
+			s.logger.Error("Action failed on invalid attempt", "ip", access.IP, "action", a.Name(), "error", err)
+		}
+	}
+}
+
+// complete handles a finished sequence: revoke profiles close every session
+// the source holds, the others ask for a grant.
+func (s *Server) complete(access Access, p *profile) {
+	if !p.revoke {
+		s.grant(access, p)
+		return
+	}
+
+	ended := s.sessions.RevokeClient(access.IP, access.Client)
+	attrs := []any{"ip", access.IP, "profile", profileName(p.name), "sessions", len(ended)}
+	if access.Client != "" {
+		attrs = append(attrs, "client", access.Client)
+	}
+	s.logger.Info("Closing sessions", attrs...)
+	for _, session := range ended {
+		session.revoke(context.Background())
+	}
+}
+
+// grant runs the policies for a completed sequence and, if allowed, every
+// action of the profile it completed.
+func (s *Server) grant(access Access, p *profile) {
+	sp := s.tracer.start("grant", access.trace)
+	defer sp.finish()
+	sp.set("knock.instance", s.Name())
+	sp.setClient(access.IP)
+	sp.set("knock.profile", profileName(p.name))
+	access.trace = sp
+
+	ctx := context.Background()
+
+	// Requested ports are opened as asked rather than forwarded
+	if len(access.Ports) == 0 {
+		access.Ports, access.Forward = p.service.Ports, p.service.Forward
+	}
+	access.Protocol = p.service.Protocol
+
+	if s.history != nil {
+		s.history.Record(access)
+	}
+
+	limits := SessionLimits{Instance: s.cfg.MaxPerIP, Profile: p.maxPerIP}
+	if s.users != nil {
+		user, err := s.accessUser(access)
+		if err != nil {
+			s.deny(access, p, err.Error())
+			return
+		}
+		if user != nil {
+			access.User = user.Name
+			limits.User = user.MaxSessions
+			if !user.AllowsProfile(p.name) || !p.allowsUser(user.Name) {
+				s.deny(access, p, fmt.Sprintf("user %s may not use profile %s", user.Name, profileName(p.name)))
+				return
+			}
+		}
+	}
+	if s.cfg.RequireUser && access.User == "" {
+		s.deny(access, p, "no enabled user matches")
+		return
+	}
+	if !p.schedule.Allows(access.Time) {
+		s.deny(access, p, "outside the allowed schedule "+p.schedule.String())
+		return
+	}
+
+	asp := s.tracer.start("authorize", sp)
+	allowed, reason, err := authorize(ctx, s.policies, access)
+	asp.fail(err)
+	asp.finish()
+	if err != nil {
+		s.deny(access, p, err.Error())
+		return
+	}
+	if !allowed {
+		s.deny(access, p, reason)
+		return
+	}
+
+	if p.secondFactor != nil {
+		p.secondFactor.Challenge(access, func(err error) {
+			if err != nil {
+				s.deny(access, p, "second factor: "+err.Error())
+				return
+			}
+			s.open(access, p, limits)
+		})
+		return
+	}
+	s.open(access, p, limits)
+}
+
+// open starts a session for an authorized access and runs the actions of
+// its profile.
+func (s *Server) open(access Access, p *profile, limits SessionLimits) {
+	ctx := context.Background()
+
+	sp := s.tracer.start("session", access.trace)
+	session, evicted, err := s.sessions.Open(access, p.ttl, limits, p.actions)
+	sp.fail(err)
+	sp.finish()
+	if err != nil {
+		s.logger.Warn("Session refused", "ip", access.IP, "profile", profileName(p.name), "error", err)
+		s.deny(access, p, err.Error())
+		return
+	}
+	access.Session, access.Expires = session.ID, session.ExpiresAt
+
+	for _, old := range evicted {
+		s.logger.Warn("Session limit reached, evicting session", "ip", access.IP, "profile", profileName(p.name), "session", old.ID, "session_instance", old.Instance)
+		old.revoke(ctx)
+	}
+
+	s.stats.record(statGrant, s.Name(), access.IP, 0, access.Time)
+	s.metrics.count(statGrant, s.Name(), profileName(access.Profile), access.Interface)
+
+	for _, a := range p.actions {
+		sp := s.tracer.start("action "+a.Name(), access.trace)
+		err := a.OnGranted(ctx, access)
+		sp.fail(err)
+		sp.finish()
+		if err != nil {
+			s.logger.Error("Action failed", "ip", access.IP, "profile", profileName(p.name), "action", a.Name(), "error", err)
+		}
+	}
+	if p.confirm != nil {
+		s.confirm(access, p.confirm)
+	}
+}
+
+// deny tells every action of p interested in refusals why access was not granted.
+func (s *Server) deny(access Access, p *profile, reason string) {
+	sp := s.tracer.start("deny", access.trace)
+	sp.set("knock.reason", reason)
+	sp.finish()
+
+	s.stats.record(statDenial, s.Name(), access.IP, 0, access.Time)
+	s.metrics.count(statDenial, s.Name(), profileName(access.Profile), access.Interface)
+
+	for _, a := range p.actions {
+		h, ok := a.(DenyHook)
+		if !ok {
+			continue
+		}
+		if err := h.OnDenied(context.Background(), access, reason); err != nil {
+			s.logger.Error("Action failed on denial", "ip", access.IP, "profile", profileName(p.name), "action", a.Name(), "reason", reason, "error", err)
+		}
+	}
+}
+
+// Start checks the instance config, binds the knock ports and starts accepting knocks.
+func (s *Server) Start() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.stop != nil {
+		return fmt.Errorf("instance %s already running", s.Name())
+	}
+
+	if err := Preflight(s.cfg); err != nil {
+		return err
+	}
+
+	ports := listenPorts(s.cfg)
+	listeners := make(map[int][]net.Listener, len(ports))
+
+	var capture knockSource
+	if s.observing() {
+		var err error
+		if capture, err = s.openKnockSource(); err != nil {
+			return err
+		}
+		log.Printf("[%s] Watching for knocks on ports %v without listening", s.Name(), ports)
+		ports = nil
+	}
+
+	var spa net.PacketConn
+	if s.cfg.Fwknop.Enabled() {
+		port := s.cfg.Fwknop.Port
+		var err error
+		if spa, err = listenPacket(packetNetwork(s.cfg.Family), net.JoinHostPort(s.cfg.Bind, strconv.Itoa(port))); err != nil {
+			if capture != nil {
+				_ = capture.Close()
+			}
+			return fmt.Errorf("listening for SPA on udp port %d: %w", port, err)
+		}
+		log.Printf("[%s] Listening for fwknop SPA packets on udp port %d", s.Name(), port)
+	}
+
+	var (
+		httpsLn  net.Listener
+		httpsSrv *http.Server
+	)
+	if s.cfg.HTTPS.Enabled() {
+		var err error
+		if httpsLn, httpsSrv, err = s.listenHTTPS(); err != nil {
+			if capture != nil {
+				_ = capture.Close()
+			}
+			if spa != nil {
+				_ = spa.Close()
+			}
+			return err
+		}
+	}
+
+	var (
+		dns    net.PacketConn
+		dnsTap knockSource
+	)
+	if s.cfg.DNS.Enabled() {
+		var err error
+		if dns, dnsTap, err = s.openDNS(); err != nil {
+			if capture != nil {
+				_ = capture.Close()
+			}
+			if spa != nil {
+				_ = spa.Close()
+			}
+			if httpsLn != nil {
+				_ = httpsLn.Close()
+			}
+			return err
+		}
+	}
+
+	var requests net.PacketConn
+	fail := func(err error) error {
+		for _, lns := range listeners {
+			closeListeners(lns)
+		}
+		if capture != nil {
+			// Also deletes the DROP rules of syn mode
+			_ = capture.Close()
+		}
+		if spa != nil {
+			_ = spa.Close()
+		}
+		if requests != nil {
+			_ = requests.Close()
+		}
+		if httpsLn != nil {
+			_ = httpsLn.Close()
+		}
+		if dns != nil {
+			_ = dns.Close()
+		}
+		if dnsTap != nil {
+			_ = dnsTap.Close()
+		}
+		return err
+	}
+
+	for _, port := range ports {
+		lns, err := s.listenPort(port)
+		if err != nil {
+			return fail(err)
+		}
+		listeners[port] = lns
+	}
+	if port := s.cfg.Payload.SPAPort; port != 0 {
+		var err error
+		if requests, err = listenPacket(packetNetwork(s.cfg.Family), net.JoinHostPort(s.cfg.Bind, strconv.Itoa(port))); err != nil {
+			return fail(fmt.Errorf("listening for SPA requests on udp port %d: %w", port, err))
+		}
+		log.Printf("[%s] Listening for SPA requests on udp port %d", s.Name(), port)
+	}
+
+	s.allow.Refresh(s.Name())
+
+	for _, pcfg := range s.cfg.Proxies {
+		p := NewProxy(pcfg, s.Name(), s.sessions, s.allow)
+		if err := p.Start(); err != nil {
+			for _, p := range s.proxies {
+				p.Stop()
+			}
+			s.proxies = nil
+			return fail(fmt.Errorf("proxy on %s: %w", pcfg.Listen, err))
+		}
+		s.proxies = append(s.proxies, p)
+	}
+
+	s.listeners = listeners
+	for port, lns := range listeners {
+		for _, ln := range lns {
+			go s.handleKnock(ln, port)
+		}
+	}
+	if s.spa = spa; spa != nil {
+		go s.handleSPA(spa)
+	}
+	if s.requests = requests; requests != nil {
+		go s.handleRequestSPA(requests)
+	}
+	if s.https = httpsSrv; httpsSrv != nil {
+		go s.serveHTTPS(httpsSrv, httpsLn)
+	}
+	if s.dns = dns; dns != nil {
+		go s.handleDNS(dns)
+	}
+
+	s.stop = make(chan struct{})
+	if capture != nil {
+		s.syn, _ = capture.(*synSource)
+		go s.handleCapture(capture, listenPorts(s.cfg), s.stop)
+	}
+	if dnsTap != nil {
+		go s.tapDNS(dnsTap, s.stop)
+	}
+	go s.allow.Run(s.Name(), s.cfg.AllowlistRefresh.Duration, s.stop)
+	go s.sweepClients(s.stop)
+	if s.expireSessions {
+		go s.sessions.Run(time.Second, s.stop)
+	}
+	if s.cfg.ExpiryNotice.Before.Duration > 0 {
+		go s.notifyExpiring(s.stop)
+	}
+
+	log.Printf("[%s] Port knocking server running...", s.Name())
+	return nil
+}
+
+// listenPort opens the listeners of a knock port, one per address and
+// accept worker.
+func (s *Server) listenPort(port int) ([]net.Listener, error) {
+	addrs, err := listenAddrs(s.cfg, port)
+	if err != nil {
+		return nil, fmt.Errorf("listening on port %d: %w", port, err)
+	}
+
+	workers := max(s.cfg.AcceptWorkers, 1)
+	listeners := make([]net.Listener, 0, len(addrs)*workers)
+	for _, addr := range addrs {
+		for range workers {
+			var ln net.Listener
+			if workers > 1 {
+				ln, err = listenShared(listenNetwork(s.cfg.Family), addr)
+			} else {
+				ln, err = listen(listenNetwork(s.cfg.Family), addr)
+			}
+			if err != nil {
+				closeListeners(listeners)
+				return nil, fmt.Errorf("listening on port %d: %w", port, err)
+			}
+			listeners = append(listeners, ln)
+		}
+	}
+
+	where := ""
+	if addrs[0] != net.JoinHostPort("", strconv.Itoa(port)) {
+		where = " on " + strings.Join(addrs, ", ")
+	}
+	if workers > 1 {
+		log.Printf("[%s] Listening for knock on port %d%s with %d workers", s.Name(), port, where, workers)
+	} else {
+		log.Printf("[%s] Listening for knock on port %d%s", s.Name(), port, where)
+	}
+	return listeners, nil
+}
+
+func closeListeners(listeners []net.Listener) {
+	for _, ln := range listeners {
+		_ = ln.Close()
+	}
+}
+
+// Stop closes the knock listeners and forgets in-progress sequences.
+func (s *Server) Stop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.stop == nil {
+		return
+	}
+
+	for _, lns := range s.listeners {
+		closeListeners(lns)
+	}
+	s.listeners = nil
+
+	if s.spa != nil {
+		_ = s.spa.Close()
+		s.spa = nil
+	}
+	if s.requests != nil {
+		_ = s.requests.Close()
+		s.requests = nil
+	}
+
+	// Close, not Shutdown: requests in flight wait for the mutex held here
+	if s.https != nil {
+		_ = s.https.Close()
+		s.https = nil
+	}
+
+	if s.dns != nil {
+		_ = s.dns.Close()
+		s.dns = nil
+	}
+
+	// The capture goroutine closes its source once it sees the stop, which
+	// may come after the process exits; the rules must not outlive it
+	if s.syn != nil {
+		if err := s.syn.removeRules(); err != nil {
+			log.Printf("[%s] Removing SYN drop rules: %v", s.Name(), err)
+		}
+		s.syn = nil
+	}
+
+	for _, p := range s.proxies {
+		p.Stop()
+	}
+	s.proxies = nil
+
+	for ip := range s.pending {
+		s.dropChallenge(ip)
+	}
+
+	close(s.stop)
+	s.stop = nil
+	s.clients = newClientTable(s.cfg.MaxClients)
+
+	log.Printf("[%s] Port knocking server stopped", s.Name())
+}
+
+// Running reports whether the instance is accepting knocks.
+func (s *Server) Running() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.stop != nil
+}
+
+// Run runs every configured instance under a supervisor until ctx is cancelled.
+func Run(ctx context.Context, cfg *Config) error {
+	return run(ctx, cfg, nil, nil)
+}
+
+// run is Run logging the state whenever dump delivers and applying the
+// configs reloads deliver in place. It returns once the servers it started
+// are closed, so a restart can bind their addresses again.
+func run(ctx context.Context, cfg *Config, dump <-chan os.Signal, reloads <-chan reloadRequest) error {
+	var serving sync.WaitGroup
+	defer serving.Wait()
+	// Stops the servers started before a failure too
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if cfg.Privacy.Enabled() {
+		out := log.Writer()
+		log.SetOutput(newPrivacyWriter(out, cfg.Privacy))
+		defer log.SetOutput(out)
+	}
+	if err := PreflightConfig(cfg); err != nil {
+		return err
+	}
+	for _, inst := range cfg.Instances {
+		for _, warning := range SequenceWarnings(inst) {
+			log.Printf("WARNING: %s", warning)
+		}
+	}
+
+	var users *UserStore
+	if cfg.UsersFile != "" {
+		var err error
+		if users, err = LoadUsers(cfg.UsersFile); err != nil {
+			return err
+		}
+	}
+
+	reg := NewRegistry(cfg.Sessions, users)
+
+	if cfg.BansFile != "" {
+		bans, err := LoadBans(cfg.BansFile)
+		if err != nil {
+			return err
+		}
+		reg.bans = bans
+	}
+
+	if cfg.Redis.Addr != "" {
+		store := NewRedisStore(cfg.Redis)
+		if err := store.Ping(); err != nil {
+			return err
+		}
+		reg.store = store
+		log.Printf("Sharing knock progress through Redis at %s", cfg.Redis.Addr)
+	}
+
+	expiryStop := make(chan struct{})
+	go reg.sessions.Run(time.Second, expiryStop)
+	defer close(expiryStop)
+
+	if cfg.StatsFile != "" {
+		stats, err := LoadStats(cfg.StatsFile)
+		if err != nil {
+			return err
+		}
+		reg.stats = stats
+
+		stop := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			stats.Run(time.Minute, stop)
+			close(done)
+		}()
+		defer func() {
+			close(stop)
+			<-done
+		}()
+	}
+
+	if cfg.StatsD.Enabled() {
+		metrics, err := NewStatsD(cfg.StatsD)
+		if err != nil {
+			return err
+		}
+		reg.metrics = metrics
+
+		stop := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			metrics.Run(stop)
+			close(done)
+		}()
+		defer func() {
+			close(stop)
+			<-done
+		}()
+		log.Printf("Sending metrics to StatsD at %s", cfg.StatsD.Addr)
+	}
+
+	if cfg.Tracing.Enabled() {
+		tracer, err := NewTracer(cfg.Tracing)
+		if err != nil {
+			return err
+		}
+		tracer.privacy = cfg.Privacy
+		reg.tracer = tracer
+
+		stop := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			tracer.Run(stop)
+			close(done)
+		}()
+		defer func() {
+			close(stop)
+			<-done
+		}()
+		log.Printf("Exporting traces to %s", cfg.Tracing.Endpoint)
+	}
+
+	if cfg.GeoIP.Enabled() {
+		geo, err := OpenGeoIP(cfg.GeoIP)
+		if err != nil {
+			return err
+		}
+		reg.geo = geo
+
+		stop := make(chan struct{})
+		go geo.Run(stop)
+		defer close(stop)
+	}
+
+	if cfg.Audit.Driver != "" {
+		audit, err := OpenAuditLog(cfg.Audit)
+		if err != nil {
+			return err
+		}
+		defer audit.Close()
+		reg.audit = audit
+
+		stop := make(chan struct{})
+		go audit.Run(stop)
+		defer close(stop)
+	}
+
+	if cfg.Capture.Dir != "" {
+		var ports []int
+		for _, inst := range cfg.Instances {
+			ports = append(ports, listenPorts(inst)...)
+		}
+
+		rec := NewRecorder(cfg.Capture, ports)
+		if err := rec.Open(); err != nil {
+			return err
+		}
+		reg.capture = rec
+
+		stop := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			rec.Run(stop)
+			close(done)
+		}()
+		defer func() {
+			close(stop)
+			<-done
+		}()
+		log.Printf("Recording knock traffic to %s", cfg.Capture.Dir)
+	}
+
+	if cfg.PluginDir != "" {
+		if err := loadPlugins(cfg.PluginDir, reg); err != nil {
+			return err
+		}
+	}
+
+	for name, pcfg := range cfg.ScriptPolicies {
+		p, err := NewScriptPolicy(name, pcfg, reg.history)
+		if err != nil {
+			return err
+		}
+		if err := reg.AddPolicy(p); err != nil {
+			return err
+		}
+	}
+
+	for name, fcfg := range cfg.Feeds {
+		f, err := NewFeed(name, fcfg)
+		if err != nil {
+			return err
+		}
+		if err := f.LoadCache(); err != nil {
+			log.Printf("WARNING: %v", err)
+		}
+		if err := reg.AddFeed(f); err != nil {
+			return err
+		}
+
+		stop := make(chan struct{})
+		go f.Run(stop)
+		defer close(stop)
+	}
+
+	for name, fcfg := range cfg.Firewalls {
+		fw, err := NewFirewallAction(name, fcfg)
+		if err != nil {
+			return err
+		}
+		if err := fw.Reset(ctx); err != nil {
+			log.Printf("Resetting firewall %s: %v", name, err)
+		}
+		if err := reg.AddAction(fw); err != nil {
+			return err
+		}
+	}
+
+	for name, ccfg := range cfg.Commands {
+		c, err := NewCommandAction(name, ccfg)
+		if err != nil {
+			return err
+		}
+		c.audit = reg.audit
+		if err := reg.AddAction(c); err != nil {
+			return err
+		}
+	}
+
+	for name, scfg := range cfg.SSH {
+		a, err := NewSSHAction(name, scfg, reg.users)
+		if err != nil {
+			return err
+		}
+		if err := reg.AddAction(a); err != nil {
+			return err
+		}
+	}
+
+	for name, fcfg := range cfg.SecondFactors {
+		f, err := NewSecondFactor(name, fcfg, reg.users)
+		if err != nil {
+			return err
+		}
+		if err := f.Listen(); err != nil {
+			return err
+		}
+		serving.Go(func() { f.Serve(ctx) })
+		if err := reg.AddSecondFactor(f); err != nil {
+			return err
+		}
+	}
+
+	for name, tcfg := range cfg.Tokens {
+		t, err := NewTokenAction(name, tcfg)
+		if err != nil {
+			return err
+		}
+		t.clock = reg.sessions.clock
+		if err := t.Listen(); err != nil {
+			return err
+		}
+		serving.Go(func() { t.Serve(ctx) })
+		if err := reg.AddAction(t); err != nil {
+			return err
+		}
+	}
+
+	for name, wcfg := range cfg.Webhooks {
+		w, err := NewWebhookAction(name, wcfg)
+		if err != nil {
+			return err
+		}
+		w.privacy = cfg.Privacy
+		if err := reg.AddAction(w); err != nil {
+			return err
+		}
+	}
+
+	for name, acfg := range cfg.Alerts {
+		a, err := NewAlertAction(name, acfg)
+		if err != nil {
+			return err
+		}
+		a.privacy = cfg.Privacy
+		if err := reg.AddAction(a); err != nil {
+			return err
+		}
+	}
+
+	for name, scfg := range cfg.Syslog {
+		s, err := NewSyslogAction(name, scfg)
+		if err != nil {
+			return err
+		}
+		s.privacy = cfg.Privacy
+		if err := reg.AddAction(s); err != nil {
+			return err
+		}
+	}
+
+	for name, bcfg := range cfg.Buses {
+		b, err := NewBusAction(name, bcfg)
+		if err != nil {
+			return err
+		}
+		b.privacy = cfg.Privacy
+		if err := reg.AddAction(b); err != nil {
+			return err
+		}
+	}
+
+	sup, err := NewSupervisor(cfg.Instances, reg)
+	if err != nil {
+		return err
+	}
+	if sup.stateFile = cfg.StateFile; sup.stateFile != "" {
+		if err := sup.RestoreStateFile(ctx); err != nil {
+			return err
+		}
+	}
+
+	if cfg.Admin.Listen != "" {
+		admin := NewAdminServer(cfg, sup, reg)
+		if err := admin.Listen(); err != nil {
+			return err
+		}
+		serving.Go(func() { admin.Serve(ctx) })
+	}
+
+	if dump != nil || reloads != nil {
+		go func() {
+			current := cfg
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-dump:
+					sup.logState(reg.bans)
+				case req := <-reloads:
+					err := sup.reload(current, req.cfg)
+					if err == nil {
+						current = req.cfg
+					}
+					req.done <- err
+				}
+			}
+		}()
+	}
+	return sup.Run(ctx)
+}
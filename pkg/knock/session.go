@@ -0,0 +1,471 @@
+package knock
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+var (
+	ErrSessionLimit   = errors.New("session limit reached")
+	ErrUnknownSession = errors.New("unknown session")
+)
+
+const (
+	SessionLimitReject = "reject" // Refuse the new grant
+	SessionLimitEvict  = "evict"  // Revoke the oldest session to make room
+)
+
+type SessionConfig struct {
+	MaxPerClient int    `json:"max_per_client"` // 0 means unlimited
+	OnLimit      string `json:"on_limit"`       // "reject" (default) or "evict"
+}
+
+// SessionLimits caps the sessions a new grant can join, unlimited when zero.
+// Reaching one always rejects the grant.
+type SessionLimits struct {
+	User     int // Sessions of the user, across every instance
+	Instance int // Sessions of the client on the granting instance
+	Profile  int // Sessions of the client from the granting profile
+}
+
+// Session is an access currently held by a client.
+type Session struct {
+	ID        string    `json:"id"`
+	Instance  string    `json:"instance"`
+	IP        string    `json:"ip"`
+	User      string    `json:"user,omitempty"`
+	Client    string    `json:"client,omitempty"`
+	Profile   string    `json:"profile,omitempty"`
+	Ports     []int     `json:"ports,omitempty"`
+	Protocol  string    `json:"protocol,omitempty"`
+	Forward   string    `json:"forward,omitempty"`
+	GrantedAt time.Time `json:"granted_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+
+	// Actions that granted the access, used to revoke it
+	actions []Action
+	// Set once the client was warned about the upcoming expiry
+	notified bool
+}
+
+// key is what the session is tracked under, see sessionKey.
+func (s *Session) key() string {
+	return sessionKey(s.IP, s.Client)
+}
+
+// sessionKey identifies a client holding sessions: its IP, or the client ID
+// its request named, so clients sharing a NAT have their own limits and
+// revoke only their own sessions.
+func sessionKey(ip, client string) string {
+	if client != "" {
+		return "client " + client
+	}
+	return ip
+}
+
+func (s *Session) expired(now time.Time) bool {
+	return !now.Before(s.ExpiresAt)
+}
+
+// access rebuilds the access the session was opened for.
+func (s *Session) access() Access {
+	return Access{
+		Instance: s.Instance,
+		IP:       s.IP,
+		User:     s.User,
+		Client:   s.Client,
+		Profile:  s.Profile,
+		Time:     s.GrantedAt,
+		Session:  s.ID,
+		Expires:  s.ExpiresAt,
+		Ports:    s.Ports,
+		Protocol: s.Protocol,
+		Forward:  s.Forward,
+	}
+}
+
+// extend tells every action that supports it about the new expiry.
+func (s *Session) extend(ctx context.Context) {
+	access := s.access()
+	for _, a := range s.actions {
+		h, ok := a.(ExtendHook)
+		if !ok {
+			continue
+		}
+		if err := h.OnExtended(ctx, access); err != nil {
+			log.Printf("[%s] Action %s failed to extend IP %s: %v", s.Instance, a.Name(), s.IP, err)
+		}
+	}
+}
+
+// revoke undoes the access on every action that supports it. Firewalls
+// count the grants holding each rule, so a rule another session of the
+// same IP still needs stays open.
+func (s *Session) revoke(ctx context.Context) {
+	access := s.access()
+	for _, a := range s.actions {
+		h, ok := a.(ExpireHook)
+		if !ok {
+			continue
+		}
+		if err := h.OnExpired(ctx, access); err != nil {
+			log.Printf("[%s] Action %s failed to revoke IP %s: %v", s.Instance, a.Name(), s.IP, err)
+		}
+	}
+}
+
+// SessionView is a session as reported by the admin API.
+type SessionView struct {
+	*Session
+	Remaining Duration `json:"remaining"`
+}
+
+// SessionManager tracks active sessions per client, by IP or client ID,
+// across every instance.
+type SessionManager struct {
+	cfg      SessionConfig
+	clock    Clock
+	sessions map[string][]*Session
+	// Expired sessions not revoked yet
+	expired []*Session
+	mutex   sync.Mutex
+}
+
+func NewSessionManager(cfg SessionConfig) *SessionManager {
+	return &SessionManager{
+		cfg:      cfg,
+		clock:    systemClock{},
+		sessions: make(map[string][]*Session),
+	}
+}
+
+// Open records a new session for access. When the client already holds the
+// maximum number of sessions it either fails with ErrSessionLimit or returns
+// the evicted sessions, which the caller must revoke. userLimit caps the
+// sessions of access.User across every IP, 0 meaning unlimited.
+func (m *SessionManager) Open(access Access, ttl time.Duration, limits SessionLimits, actions []Action) (*Session, []*Session, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if access.User != "" && limits.User > 0 {
+		if n := m.countUserLocked(access.User, access.Time); n >= limits.User {
+			return nil, nil, fmt.Errorf("%w: user %s holds %d session(s)", ErrSessionLimit, access.User, n)
+		}
+	}
+
+	key := sessionKey(access.IP, access.Client)
+	who := access.IP + clientSuffix(access.Client)
+	active := m.activeLocked(key, access.Time)
+
+	onInstance, fromProfile := 0, 0
+	for _, s := range active {
+		if s.Instance == access.Instance {
+			onInstance++
+			if s.Profile == access.Profile {
+				fromProfile++
+			}
+		}
+	}
+	if limits.Instance > 0 && onInstance >= limits.Instance {
+		return nil, nil, fmt.Errorf("%w: %s holds %d session(s) on instance %s", ErrSessionLimit, who, onInstance, access.Instance)
+	}
+	if limits.Profile > 0 && fromProfile >= limits.Profile {
+		return nil, nil, fmt.Errorf("%w: %s holds %d session(s) from profile %s", ErrSessionLimit, who, fromProfile, profileName(access.Profile))
+	}
+
+	var evicted []*Session
+	if max := m.cfg.MaxPerClient; max > 0 && len(active) >= max {
+		if m.cfg.OnLimit != SessionLimitEvict {
+			return nil, nil, fmt.Errorf("%w: %s holds %d session(s)", ErrSessionLimit, who, len(active))
+		}
+
+		// Oldest sessions come first
+		n := len(active) - max + 1
+		evicted, active = active[:n:n], active[n:]
+	}
+	m.sessions[key] = active
+
+	session := &Session{
+		ID:        newSessionID(),
+		Instance:  access.Instance,
+		IP:        access.IP,
+		User:      access.User,
+		Client:    access.Client,
+		Profile:   access.Profile,
+		Ports:     access.Ports,
+		Protocol:  access.Protocol,
+		Forward:   access.Forward,
+		GrantedAt: access.Time,
+		ExpiresAt: access.Time.Add(ttl),
+		actions:   actions,
+	}
+	m.sessions[key] = append(active, session)
+
+	return session, evicted, nil
+}
+
+// activeLocked moves expired sessions under key to the revocation queue and
+// returns the remaining ones.
+func (m *SessionManager) activeLocked(key string, now time.Time) []*Session {
+	active := m.sessions[key][:0]
+	for _, s := range m.sessions[key] {
+		if s.expired(now) {
+			m.expired = append(m.expired, s)
+			continue
+		}
+		active = append(active, s)
+	}
+
+	if len(active) == 0 {
+		delete(m.sessions, key)
+		return nil
+	}
+	m.sessions[key] = active
+	return active
+}
+
+func (m *SessionManager) countUserLocked(user string, now time.Time) int {
+	n := 0
+	for key := range m.sessions {
+		for _, s := range m.activeLocked(key, now) {
+			if s.User == user {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func newSessionID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// List returns a copy of every active session.
+func (m *SessionManager) List() []*Session {
+	return m.listAt(m.clock.Now())
+}
+
+func (m *SessionManager) listAt(now time.Time) []*Session {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var list []*Session
+	for key := range m.sessions {
+		for _, s := range m.activeLocked(key, now) {
+			c := *s
+			list = append(list, &c)
+		}
+	}
+	return list
+}
+
+// View returns the active sessions with their remaining time.
+func (m *SessionManager) View() []SessionView {
+	now := m.clock.Now()
+	list := m.List()
+
+	views := make([]SessionView, len(list))
+	for i, s := range list {
+		views[i] = SessionView{Session: s, Remaining: Duration{s.ExpiresAt.Sub(now).Round(time.Second)}}
+	}
+	return views
+}
+
+// Extend pushes the expiry of session id back by d and returns a copy.
+func (m *SessionManager) Extend(id string, d time.Duration) (*Session, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	s := m.findLocked(id)
+	if s == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownSession, id)
+	}
+	s.ExpiresAt = s.ExpiresAt.Add(d)
+	s.notified = false
+
+	c := *s
+	return &c, nil
+}
+
+// Revoke ends session id before its TTL and returns it; the caller must
+// revoke its actions.
+func (m *SessionManager) Revoke(id string) (*Session, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	s := m.findLocked(id)
+	if s == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownSession, id)
+	}
+
+	key := s.key()
+	active := m.sessions[key][:0]
+	for _, other := range m.sessions[key] {
+		if other != s {
+			active = append(active, other)
+		}
+	}
+	if len(active) == 0 {
+		delete(m.sessions, key)
+	} else {
+		m.sessions[key] = active
+	}
+	return s, nil
+}
+
+// RevokeClient ends every active session of ip, or of client when a request
+// named one, and returns them for revocation.
+func (m *SessionManager) RevokeClient(ip, client string) []*Session {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := m.clock.Now()
+	key := sessionKey(ip, client)
+	active := m.activeLocked(key, now)
+	delete(m.sessions, key)
+	return active
+}
+
+// RevokeUser ends every active session of user, across instances and IPs,
+// and returns them for revocation.
+func (m *SessionManager) RevokeUser(user string) []*Session {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := m.clock.Now()
+	var ended []*Session
+	for key := range m.sessions {
+		var kept []*Session
+		for _, s := range m.activeLocked(key, now) {
+			if s.User == user {
+				ended = append(ended, s)
+			} else {
+				kept = append(kept, s)
+			}
+		}
+		if len(kept) == 0 {
+			delete(m.sessions, key)
+		} else {
+			m.sessions[key] = kept
+		}
+	}
+	return ended
+}
+
+// RevokeAll ends every active session and returns them for revocation.
+func (m *SessionManager) RevokeAll() []*Session {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := m.clock.Now()
+	var all []*Session
+	for key := range m.sessions {
+		all = append(all, m.activeLocked(key, now)...)
+	}
+	m.sessions = make(map[string][]*Session)
+	return all
+}
+
+func (m *SessionManager) findLocked(id string) *Session {
+	now := m.clock.Now()
+	for key := range m.sessions {
+		for _, s := range m.activeLocked(key, now) {
+			if s.ID == id {
+				return s
+			}
+		}
+	}
+	return nil
+}
+
+// Expire removes every session past its TTL and returns them for revocation.
+func (m *SessionManager) Expire(now time.Time) []*Session {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for key := range m.sessions {
+		m.activeLocked(key, now)
+	}
+
+	expired := m.expired
+	m.expired = nil
+	return expired
+}
+
+// Run revokes sessions as their TTL elapses, checking every interval until
+// stop is closed.
+func (m *SessionManager) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			for _, s := range m.Expire(now) {
+				s.revoke(context.Background())
+			}
+		}
+	}
+}
+
+// Restore adds a previously exported session as is, ignoring the session
+// limit. It reports false, adding nothing, when a session with its ID is
+// already active.
+func (m *SessionManager) Restore(s *Session) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.findLocked(s.ID) != nil {
+		return false
+	}
+	key := s.key()
+	m.sessions[key] = append(m.activeLocked(key, m.clock.Now()), s)
+	return true
+}
+
+// HasActive reports whether ip holds an unexpired session on instance at now,
+// its own or one of a client ID behind it.
+func (m *SessionManager) HasActive(instance, ip string, now time.Time) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for key := range m.sessions {
+		for _, s := range m.activeLocked(key, now) {
+			if s.Instance == instance && s.IP == ip {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// DueForNotice returns the sessions of instance expiring within before that
+// have not been notified yet, marking them as notified.
+func (m *SessionManager) DueForNotice(instance string, before time.Duration, now time.Time) []*Session {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var due []*Session
+	for key := range m.sessions {
+		for _, s := range m.activeLocked(key, now) {
+			if s.Instance != instance || s.notified || now.Before(s.ExpiresAt.Add(-before)) {
+				continue
+			}
+			s.notified = true
+
+			c := *s
+			due = append(due, &c)
+		}
+	}
+	return due
+}
@@ -0,0 +1,129 @@
+package knock
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// KnockEvent is one knock injected into a Simulation, as a listener or the
+// capture would have seen it.
+type KnockEvent struct {
+	IP        string
+	Port      int
+	SrcPort   int    // Source port, for sequences knocked in source ports
+	Interface string // Interface the knock arrived on, for interface policies
+	Payload   []byte // Request sent on the connection, for encrypted payloads
+}
+
+// Simulation drives a Server built from Options on a SimClock, without
+// sockets or sleeping, so sequences, timeouts and bans can be tested and
+// fuzzed deterministically. Whatever a knock triggers, grants, denials,
+// bans and the actions they run, is done by the time Knock returns.
+type Simulation struct {
+	Clock *SimClock
+
+	server *Server
+	queue  []func()
+	mutex  sync.Mutex // Serializes injected events
+}
+
+// NewSimulation creates the server New would from opts, with its clock
+// starting at start. The server is never started; events are injected.
+func NewSimulation(opts Options, start time.Time) (*Simulation, error) {
+	s, err := New(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	sim := &Simulation{Clock: NewSimClock(start), server: s}
+	s.clock = sim.Clock
+	s.sessions.clock = sim.Clock
+	s.bans.clock = sim.Clock
+	s.spawn = func(f func()) { sim.queue = append(sim.queue, f) }
+	return sim, nil
+}
+
+// Server returns the simulated server.
+func (sim *Simulation) Server() *Server {
+	return sim.server
+}
+
+// Knock injects a knock on port from ip.
+func (sim *Simulation) Knock(ip string, port int) {
+	sim.Inject(KnockEvent{IP: ip, Port: port})
+}
+
+// Sequence returns the steps of the named profile accepted at the current
+// time, the default one when profile is empty, or nil without such a profile.
+func (sim *Simulation) Sequence(profile string) []KnockStep {
+	for _, p := range sim.server.profiles {
+		if p.name == profile && p.knockable() {
+			return p.sequences(sim.Clock.Now())[0].steps
+		}
+	}
+	return nil
+}
+
+// KnockSequence knocks every step of sequence from ip as many times as it
+// counts, advancing the clock by gap between knocks, or by the step's
+// min_delay when longer.
+func (sim *Simulation) KnockSequence(ip string, sequence []KnockStep, gap time.Duration) {
+	for i, step := range sequence {
+		for n := range max(step.Count, 1) {
+			if i > 0 || n > 0 {
+				delay := gap
+				if n == 0 {
+					delay = max(delay, step.MinDelay.Duration)
+				}
+				sim.Advance(delay)
+			}
+			sim.Knock(ip, step.Port)
+		}
+	}
+}
+
+// Inject counts ev at the current time of the clock and runs its outcomes.
+func (sim *Simulation) Inject(ev KnockEvent) {
+	sim.mutex.Lock()
+	defer sim.mutex.Unlock()
+
+	sim.server.processKnock(ev.IP, ev.Interface, ev.Port, ev.SrcPort, ev.Payload)
+	sim.drain()
+}
+
+// Advance moves the clock forward by d and ends the sessions that expired
+// meanwhile, running their actions.
+func (sim *Simulation) Advance(d time.Duration) {
+	sim.mutex.Lock()
+	defer sim.mutex.Unlock()
+
+	now := sim.Clock.Advance(d)
+	for _, s := range sim.server.sessions.Expire(now) {
+		s.revoke(context.Background())
+	}
+}
+
+// Progress returns the sequences in progress at the current time.
+func (sim *Simulation) Progress() []ClientProgress {
+	return sim.server.progress(sim.Clock.Now())
+}
+
+// Sessions returns the sessions active at the current time.
+func (sim *Simulation) Sessions() []*Session {
+	return sim.server.sessions.listAt(sim.Clock.Now())
+}
+
+// Banned returns the ban ip holds at the current time, if any.
+func (sim *Simulation) Banned(ip string) (Ban, bool) {
+	return sim.server.bans.Banned(ip, sim.Clock.Now())
+}
+
+// drain runs the queued outcomes in order, including those they queue.
+func (sim *Simulation) drain() {
+	for len(sim.queue) > 0 {
+		f := sim.queue[0]
+		sim.queue = sim.queue[1:]
+		f()
+	}
+}
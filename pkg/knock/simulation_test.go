@@ -0,0 +1,136 @@
+package knock_test
+
+import (
+	"testing"
+	"time"
+
+	"port-knocking/pkg/knock"
+)
+
+const simIP = "192.0.2.1"
+
+var simStart = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// outcomes records what the callbacks of a simulated server saw.
+type outcomes struct {
+	granted []knock.Access
+	denied  []string
+	failed  []string
+	banned  []time.Time
+	expired []knock.Access
+}
+
+func newSim(t *testing.T, cfg knock.InstanceConfig) (*knock.Simulation, *outcomes) {
+	t.Helper()
+	o := &outcomes{}
+	sim, err := knock.NewSimulation(knock.Options{
+		Instance:  cfg,
+		OnGranted: func(a knock.Access) { o.granted = append(o.granted, a) },
+		OnDenied:  func(a knock.Access, reason string) { o.denied = append(o.denied, reason) },
+		OnFailed:  func(a knock.Access, reason string) { o.failed = append(o.failed, reason) },
+		OnBanned:  func(a knock.Access, until time.Time) { o.banned = append(o.banned, until) },
+		OnExpired: func(a knock.Access) { o.expired = append(o.expired, a) },
+	}, simStart)
+	if err != nil {
+		t.Fatalf("NewSimulation: %v", err)
+	}
+	return sim, o
+}
+
+func TestSimulationGrantsAndExpires(t *testing.T) {
+	cfg := knock.DefaultInstance()
+	sim, o := newSim(t, cfg)
+
+	sim.KnockSequence(simIP, sim.Sequence(""), 100*time.Millisecond)
+	if len(o.granted) != 1 {
+		t.Fatalf("granted %d times, want 1", len(o.granted))
+	}
+	a := o.granted[0]
+	if a.IP != simIP {
+		t.Errorf("granted IP %s, want %s", a.IP, simIP)
+	}
+	if want := sim.Clock.Now().Add(cfg.SessionTTL.Duration); !a.Expires.Equal(want) {
+		t.Errorf("session expires at %s, want %s", a.Expires, want)
+	}
+	if n := len(sim.Sessions()); n != 1 {
+		t.Fatalf("%d active sessions, want 1", n)
+	}
+
+	sim.Advance(cfg.SessionTTL.Duration + time.Second)
+	if len(sim.Sessions()) != 0 {
+		t.Errorf("session still active after its TTL")
+	}
+	if len(o.expired) != 1 || o.expired[0].Session != a.Session {
+		t.Errorf("expired %v, want session %s", o.expired, a.Session)
+	}
+}
+
+func TestSimulationTimeoutResetsSequence(t *testing.T) {
+	cfg := knock.DefaultInstance()
+	sim, o := newSim(t, cfg)
+
+	// Every knock arrives after the previous one timed out
+	sim.KnockSequence(simIP, sim.Sequence(""), cfg.Timeout.Duration+time.Second)
+	if len(o.granted) != 0 {
+		t.Fatalf("granted a sequence knocked too slowly")
+	}
+	if len(sim.Sessions()) != 0 {
+		t.Errorf("session opened for a sequence knocked too slowly")
+	}
+}
+
+func TestSimulationDeniesMissingPayload(t *testing.T) {
+	cfg := knock.DefaultInstance()
+	cfg.Payload = knock.PayloadConfig{Key: "secret", Required: true}
+	sim, o := newSim(t, cfg)
+
+	sim.KnockSequence(simIP, sim.Sequence(""), 100*time.Millisecond)
+	if len(o.granted) != 0 {
+		t.Fatalf("granted without the required payload")
+	}
+	if len(o.denied) != 1 || o.denied[0] != "no request payload" {
+		t.Errorf("denied %q, want one denial for the missing payload", o.denied)
+	}
+}
+
+func TestSimulationBansAfterFailures(t *testing.T) {
+	cfg := knock.DefaultInstance()
+	cfg.Ban = knock.BanConfig{
+		Failures: 3,
+		Window:   knock.Duration{Duration: time.Minute},
+		Duration: knock.Duration{Duration: 10 * time.Minute},
+	}
+	sim, o := newSim(t, cfg)
+
+	// The second step first is an invalid knock
+	wrong := sim.Sequence("")[1].Port
+	for range cfg.Ban.Failures {
+		sim.Knock(simIP, wrong)
+		sim.Advance(time.Second)
+	}
+	if len(o.failed) != cfg.Ban.Failures {
+		t.Errorf("%d failures reported, want %d", len(o.failed), cfg.Ban.Failures)
+	}
+	ban, ok := sim.Banned(simIP)
+	if !ok {
+		t.Fatalf("%s not banned after %d invalid knocks", simIP, cfg.Ban.Failures)
+	}
+	if len(o.banned) != 1 || !o.banned[0].Equal(ban.Until) {
+		t.Errorf("ban callbacks %v, want one until %s", o.banned, ban.Until)
+	}
+
+	// A banned source's correct sequence opens nothing
+	sim.KnockSequence(simIP, sim.Sequence(""), 100*time.Millisecond)
+	if len(o.granted) != 0 {
+		t.Fatalf("granted a banned source")
+	}
+
+	sim.Advance(cfg.Ban.Duration.Duration)
+	if _, ok := sim.Banned(simIP); ok {
+		t.Fatalf("ban outlived its duration")
+	}
+	sim.KnockSequence(simIP, sim.Sequence(""), 100*time.Millisecond)
+	if len(o.granted) != 1 {
+		t.Errorf("granted %d times once the ban ended, want 1", len(o.granted))
+	}
+}
@@ -0,0 +1,168 @@
+package knock
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// A ClientHello fits one TLS record, at most 16 KiB plus its header
+	maxClientHello = 5 + 16<<10
+
+	tlsRecordHandshake  = 22
+	tlsClientHello      = 1
+	tlsExtServerName    = 0
+	tlsServerNameHost   = 0
+	clientHelloDeadline = 3 * time.Second
+)
+
+var errTruncatedHello = errors.New("truncated ClientHello")
+
+// sniSteps maps every port a step knocks with a TLS server name to the
+// names a knock on it may carry, "" for the steps that are plain knocks.
+func sniSteps(cfg InstanceConfig) map[int][]string {
+	steps := slices.Clone(cfg.Sequence)
+	for _, p := range cfg.Profiles {
+		steps = append(steps, p.Sequence...)
+	}
+
+	names := make(map[int][]string)
+	for _, step := range steps {
+		if step.SNI != "" {
+			names[step.Port] = append(names[step.Port], strings.ToLower(step.SNI))
+		}
+	}
+	for _, step := range steps {
+		if _, ok := names[step.Port]; ok && step.SNI == "" {
+			names[step.Port] = append(names[step.Port], "")
+		}
+	}
+	return names
+}
+
+// checkSNISteps rejects server name steps where no ClientHello can be seen.
+func checkSNISteps(inst InstanceConfig) error {
+	if len(sniSteps(inst)) == 0 {
+		return nil
+	}
+	switch {
+	case inst.Mode == ModeNFLog || inst.Mode == ModeSYN:
+		return fmt.Errorf("sni steps need a listening socket or capture mode, not %s", inst.Mode)
+	case inst.Encoding == EncodingSource:
+		return errors.New("sni steps cannot be knocked with source encoding")
+	case inst.Payload.Enabled():
+		return errors.New("sni steps cannot carry payloads")
+	}
+	return nil
+}
+
+// readClientHello waits for the ClientHello of a knock on a server name
+// port, then drops the connection without a TLS answer: the handshake never
+// completes, so nothing behind the port is revealed.
+func (s *Server) readClientHello(conn net.Conn, ip, iface string, port, srcPort int) {
+	_ = conn.SetReadDeadline(time.Now().Add(clientHelloDeadline))
+
+	hello := make([]byte, 5, maxClientHello)
+	if _, err := io.ReadFull(conn, hello); err == nil && hello[0] == tlsRecordHandshake {
+		n := int(binary.BigEndian.Uint16(hello[3:5]))
+		if n <= maxClientHello-5 {
+			hello = hello[:5+n]
+			if _, err := io.ReadFull(conn, hello[5:]); err != nil {
+				hello = nil
+			}
+		}
+	}
+
+	s.processKnock(ip, iface, port, srcPort, hello)
+	s.closeKnock(conn, ip)
+}
+
+// clientHelloSNI returns the host name a TLS record carrying a ClientHello
+// asks for, lowercased.
+func clientHelloSNI(record []byte) (string, error) {
+	if len(record) < 5 || record[0] != tlsRecordHandshake {
+		return "", errors.New("not a TLS handshake")
+	}
+	b := record[5:]
+	if n := int(binary.BigEndian.Uint16(record[3:5])); n < len(b) {
+		b = b[:n]
+	}
+
+	if len(b) < 4 || b[0] != tlsClientHello {
+		return "", errors.New("not a ClientHello")
+	}
+	if n := int(b[1])<<16 | int(b[2])<<8 | int(b[3]); n+4 < len(b) {
+		b = b[:n+4]
+	}
+	b = b[4:]
+
+	// Version and random, then the session ID, cipher suites and
+	// compression methods, each prefixed with its length
+	if len(b) < 34 {
+		return "", errors.New("short ClientHello")
+	}
+	b = b[34:]
+	for _, size := range []int{1, 2, 1} {
+		var err error
+		if _, b, err = cutVector(b, size); err != nil {
+			return "", err
+		}
+	}
+
+	exts, _, err := cutVector(b, 2)
+	switch {
+	case errors.Is(err, errTruncatedHello) && len(b) > 2:
+		// Captured large hellos span segments, the name is usually in the first
+		exts = b[2:]
+	case err != nil:
+		return "", errors.New("ClientHello has no extensions")
+	}
+	for len(exts) >= 4 {
+		typ := binary.BigEndian.Uint16(exts[0:2])
+		var data []byte
+		if data, exts, err = cutVector(exts[2:], 2); err != nil {
+			return "", err
+		}
+		if typ != tlsExtServerName {
+			continue
+		}
+
+		list, _, err := cutVector(data, 2)
+		if err != nil {
+			return "", err
+		}
+		for len(list) >= 3 {
+			nameType := list[0]
+			var name []byte
+			if name, list, err = cutVector(list[1:], 2); err != nil {
+				return "", err
+			}
+			if nameType == tlsServerNameHost {
+				return strings.ToLower(string(name)), nil
+			}
+		}
+	}
+	return "", errors.New("ClientHello names no server")
+}
+
+// cutVector splits a TLS vector prefixed with a size byte length from the
+// rest of b.
+func cutVector(b []byte, size int) (vector, rest []byte, err error) {
+	if len(b) < size {
+		return nil, nil, errTruncatedHello
+	}
+	n := 0
+	for _, c := range b[:size] {
+		n = n<<8 | int(c)
+	}
+	if len(b) < size+n {
+		return nil, nil, errTruncatedHello
+	}
+	return b[size : size+n], b[size+n:], nil
+}
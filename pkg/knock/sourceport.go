@@ -0,0 +1,24 @@
+package knock
+
+const (
+	EncodingDestination = "destination" // The sequence is the ports knocked on
+	EncodingSource      = "source"      // The sequence is the client's source ports, all knocking on one port
+)
+
+func validEncoding(encoding string) bool {
+	switch encoding {
+	case "", EncodingDestination, EncodingSource:
+		return true
+	default:
+		return false
+	}
+}
+
+// knockValue returns the port a knock counts as: the destination port, or
+// the client's source port when the sequence is encoded in source ports.
+func (s *Server) knockValue(dstPort, srcPort int) int {
+	if s.cfg.Encoding == EncodingSource {
+		return srcPort
+	}
+	return dstPort
+}
@@ -0,0 +1,78 @@
+package knock
+
+import (
+	"errors"
+	"log"
+	"net"
+)
+
+// handleRequestSPA reads requests sent alone to payload.spa_port until the
+// socket is closed. Each is one UDP packet sealed with AES-GCM as a payload
+// is, so it grants without a sequence, unlike the fwknop format.
+func (s *Server) handleRequestSPA(pc net.PacketConn) {
+	buf := make([]byte, maxPayloadSize)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		ip, err := clientIP(addr)
+		if err != nil {
+			continue
+		}
+		s.processRequestSPA(ip, buf[:n])
+	}
+}
+
+func (s *Server) processRequestSPA(ip string, packet []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.clock.Now()
+	if s.denied(ip) {
+		return
+	}
+	if f := s.blocklisted(ip); f != nil && s.cfg.BlocklistMode == BlocklistReject {
+		log.Printf("[%s] Ignoring SPA request from %s listed by blocklist %s", s.Name(), ip, f.Name())
+		return
+	}
+	if _, ok := s.bans.Banned(ip, now); ok {
+		return
+	}
+
+	access := Access{Instance: s.Name(), IP: ip, Time: now}
+	req, err := s.openPayload(&access, packet)
+	if err != nil {
+		log.Printf("[%s] Invalid SPA request from %s: %v", s.Name(), ip, err)
+		s.failed(ip, 0, now, "invalid SPA request: "+err.Error())
+		return
+	}
+
+	if req.Source == "" && !s.cfg.Payload.SPAAnySource {
+		log.Printf("[%s] Rejected SPA request from %s: no source address sealed in", s.Name(), ip)
+		s.failed(ip, 0, now, "SPA request without a source address")
+		return
+	}
+
+	p, err := s.requestedProfile(ip, access.User, req.Profile)
+	if err != nil {
+		log.Printf("[%s] Rejected SPA request from %s: %v", s.Name(), ip, err)
+		s.failed(ip, 0, now, "SPA request: "+err.Error())
+		return
+	}
+	access.Profile = p.name
+
+	requested, err := s.applyRequest(&access, p, req)
+	if err != nil {
+		log.Printf("[%s] Rejected SPA request from %s: %v", s.Name(), ip, err)
+		s.spawn(func() { s.deny(access, p, err.Error()) })
+		return
+	}
+
+	log.Printf("[%s] SPA request from %s%s%s", s.Name(), ip, userSuffix(access.User), profileSuffix(p.name))
+	s.spawn(func() { s.complete(access, requested) })
+}
@@ -0,0 +1,265 @@
+package knock
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	SSHAuthorizedKeys = "authorized_keys" // Time-limited authorized_keys entries
+	SSHCertificate    = "certificate"     // Short-lived certificates signed by a CA
+
+	sshMarker     = "port-knocking:" // Comment tagging the entries of a session
+	sshKeygenTime = 10 * time.Second
+)
+
+// SSHConfig is a named action giving the knocking user SSH access for the
+// length of the session. Keys come from the user's ssh_keys, or from keys
+// when the source matches no user. Paths are templates over the Access
+// fields, e.g. /home/{{.User}}/.ssh/authorized_keys.
+type SSHConfig struct {
+	Mode           string   `json:"mode"`            // "authorized_keys" (default) or "certificate"
+	AuthorizedKeys string   `json:"authorized_keys"` // File the entries are added to
+	Options        string   `json:"options"`         // Extra authorized_keys options, e.g. "no-agent-forwarding"
+	CAKey          string   `json:"ca_key"`          // Private key signing certificates
+	Certificate    string   `json:"certificate"`     // Where the signed certificate is written
+	Principals     []string `json:"principals"`      // Certificate principals, the user name when empty
+	Keys           []string `json:"keys"`            // Public keys for sources that match no user
+}
+
+// SSHAction installs an authorized_keys entry restricted to the knocking IP
+// and expiring with the session, or signs a certificate valid as long.
+// Either is removed when the session ends; the expiry built into them
+// covers a session that outlives the daemon.
+type SSHAction struct {
+	name  string
+	cfg   SSHConfig
+	users *UserStore
+	path  *template.Template // authorized_keys or certificate
+	mutex sync.Mutex
+}
+
+func NewSSHAction(name string, cfg SSHConfig, users *UserStore) (*SSHAction, error) {
+	if cfg.Mode == "" {
+		cfg.Mode = SSHAuthorizedKeys
+	}
+
+	path := cfg.AuthorizedKeys
+	switch cfg.Mode {
+	case SSHAuthorizedKeys:
+		if path == "" {
+			return nil, fmt.Errorf("ssh %s: authorized_keys is required", name)
+		}
+		if strings.ContainsAny(cfg.Options, "\r\n") {
+			return nil, fmt.Errorf("ssh %s: invalid options", name)
+		}
+	case SSHCertificate:
+		if cfg.CAKey == "" || cfg.Certificate == "" {
+			return nil, fmt.Errorf("ssh %s: certificates need ca_key and certificate", name)
+		}
+		if _, err := exec.LookPath("ssh-keygen"); err != nil {
+			return nil, fmt.Errorf("ssh %s: %w", name, err)
+		}
+		path = cfg.Certificate
+	default:
+		return nil, fmt.Errorf("ssh %s: invalid mode %q", name, cfg.Mode)
+	}
+
+	for _, key := range cfg.Keys {
+		if err := checkSSHKey(key); err != nil {
+			return nil, fmt.Errorf("ssh %s: %w", name, err)
+		}
+	}
+
+	t, err := template.New(name).Option("missingkey=error").Parse(path)
+	if err != nil {
+		return nil, fmt.Errorf("ssh %s: %w", name, err)
+	}
+	return &SSHAction{name: name, cfg: cfg, users: users, path: t}, nil
+}
+
+// checkSSHKey rejects anything but a single "type base64 [comment]" line.
+func checkSSHKey(key string) error {
+	if strings.ContainsAny(key, "\r\n") || len(strings.Fields(key)) < 2 {
+		return fmt.Errorf("invalid public key %q", key)
+	}
+	return nil
+}
+
+func (a *SSHAction) Name() string {
+	return a.name
+}
+
+func (a *SSHAction) OnGranted(ctx context.Context, access Access) error {
+	keys, err := a.keys(access)
+	if err != nil {
+		return err
+	}
+	path, err := render(a.path, commandData{Access: access})
+	if err != nil {
+		return fmt.Errorf("ssh %s: %w", a.name, err)
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.cfg.Mode == SSHCertificate {
+		return a.sign(ctx, path, keys[0], access)
+	}
+	return a.authorize(path, keys, access)
+}
+
+// OnExtended moves the expiry of the session's entries or certificate.
+func (a *SSHAction) OnExtended(ctx context.Context, access Access) error {
+	return a.OnGranted(ctx, access)
+}
+
+func (a *SSHAction) OnExpired(ctx context.Context, access Access) error {
+	path, err := render(a.path, commandData{Access: access})
+	if err != nil {
+		return fmt.Errorf("ssh %s: %w", a.name, err)
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.cfg.Mode == SSHCertificate {
+		err := os.Remove(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("ssh %s: %w", a.name, err)
+		}
+		return nil
+	}
+	return a.updateAuthorizedKeys(path, access.Session, nil)
+}
+
+// keys returns the public keys of the knocking user.
+func (a *SSHAction) keys(access Access) ([]string, error) {
+	if access.User == "" || a.users == nil {
+		if len(a.cfg.Keys) == 0 {
+			return nil, fmt.Errorf("ssh %s: %s matches no user with SSH keys", a.name, access.IP)
+		}
+		return a.cfg.Keys, nil
+	}
+
+	u, err := a.users.Get(access.User)
+	if err != nil {
+		return nil, fmt.Errorf("ssh %s: %w", a.name, err)
+	}
+	if len(u.SSHKeys) == 0 {
+		return nil, fmt.Errorf("ssh %s: user %s has no SSH keys", a.name, u.Name)
+	}
+	return u.SSHKeys, nil
+}
+
+// authorize adds one entry per key, replacing the session's previous ones.
+func (a *SSHAction) authorize(path string, keys []string, access Access) error {
+	options := fmt.Sprintf(`from="%s",expiry-time="%s"`, access.IP, access.Expires.UTC().Format("20060102150405Z"))
+	if a.cfg.Options != "" {
+		options += "," + a.cfg.Options
+	}
+
+	lines := make([]string, len(keys))
+	for i, key := range keys {
+		fields := strings.Fields(key)
+		lines[i] = fmt.Sprintf("%s %s %s %s%s", options, fields[0], fields[1], sshMarker, access.Session)
+	}
+	if err := a.updateAuthorizedKeys(path, access.Session, lines); err != nil {
+		return err
+	}
+
+	log.Printf("[%s] SSH %s: authorized %d key(s) for IP %s in %s until %s",
+		access.Instance, a.name, len(keys), access.IP, path, access.Expires.Format(time.RFC3339))
+	return nil
+}
+
+// updateAuthorizedKeys drops the entries of session and appends add. The
+// file is rewritten in place so it keeps its owner and mode.
+func (a *SSHAction) updateAuthorizedKeys(path, session string, add []string) error {
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("ssh %s: %w", a.name, err)
+	}
+	if len(add) == 0 && len(data) == 0 {
+		return nil
+	}
+
+	var out bytes.Buffer
+	for line := range strings.Lines(string(data)) {
+		if !strings.HasSuffix(strings.TrimRight(line, "\r\n"), " "+sshMarker+session) {
+			out.WriteString(line)
+		}
+	}
+	if out.Len() > 0 && !bytes.HasSuffix(out.Bytes(), []byte("\n")) {
+		out.WriteByte('\n')
+	}
+	for _, line := range add {
+		out.WriteString(line + "\n")
+	}
+
+	if err := os.WriteFile(path, out.Bytes(), 0o600); err != nil {
+		return fmt.Errorf("ssh %s: %w", a.name, err)
+	}
+	return nil
+}
+
+// sign has ssh-keygen certify key until the session ends, usable only from
+// the knocking IP, and writes the certificate to path.
+func (a *SSHAction) sign(ctx context.Context, path, key string, access Access) error {
+	dir, err := os.MkdirTemp("", "port-knocking-ssh")
+	if err != nil {
+		return fmt.Errorf("ssh %s: %w", a.name, err)
+	}
+	defer os.RemoveAll(dir)
+
+	pub := filepath.Join(dir, "key.pub")
+	if err := os.WriteFile(pub, []byte(key+"\n"), 0o600); err != nil {
+		return fmt.Errorf("ssh %s: %w", a.name, err)
+	}
+
+	principals := a.cfg.Principals
+	if len(principals) == 0 {
+		if access.User == "" {
+			return fmt.Errorf("ssh %s: certificates need principals or a known user", a.name)
+		}
+		principals = []string{access.User}
+	}
+	validity := max(int((time.Until(access.Expires)+time.Second-1)/time.Second), 1)
+
+	ctx, cancel := context.WithTimeout(ctx, sshKeygenTime)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "ssh-keygen", "-q",
+		"-s", a.cfg.CAKey,
+		"-I", access.Instance+":"+access.Session,
+		"-n", strings.Join(principals, ","),
+		"-V", "-1m:+"+strconv.Itoa(validity)+"s",
+		"-O", "source-address="+access.IP,
+		pub)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("ssh %s: ssh-keygen: %w: %s", a.name, err, bytes.TrimSpace(out))
+	}
+
+	cert, err := os.ReadFile(filepath.Join(dir, "key-cert.pub"))
+	if err != nil {
+		return fmt.Errorf("ssh %s: %w", a.name, err)
+	}
+	if err := os.WriteFile(path, cert, 0o644); err != nil {
+		return fmt.Errorf("ssh %s: %w", a.name, err)
+	}
+
+	log.Printf("[%s] SSH %s: signed a certificate for IP %s as %s until %s",
+		access.Instance, a.name, access.IP, strings.Join(principals, ","), access.Expires.Format(time.RFC3339))
+	return nil
+}
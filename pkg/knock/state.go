@@ -0,0 +1,143 @@
+package knock
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	stateVersion      = 1
+	stateSaveInterval = 10 * time.Second
+)
+
+var (
+	ErrStateKeyMissing   = errors.New("state_key is not configured")
+	ErrStateBadSignature = errors.New("state signature does not match")
+)
+
+// StateSnapshot is the server state that survives an export/import: the
+// grants, and what keeps a restored server from accepting old knocks again.
+type StateSnapshot struct {
+	Sessions     []*Session       `json:"sessions"`
+	Progress     []ClientProgress `json:"progress,omitempty"`
+	Bans         []Ban            `json:"bans,omitempty"`
+	Offenses     []Offense        `json:"offenses,omitempty"`      // Ban records of repeat offenders
+	TOTPCounters []TOTPCounter    `json:"totp_counters,omitempty"` // Second factor codes already used
+	Replays      []ReplayEntry    `json:"replays,omitempty"`       // Sequences, nonces and SPA packets already used
+}
+
+// ClientProgress is how far a source got through the sequences of an instance.
+type ClientProgress struct {
+	Instance string          `json:"instance"`
+	IP       string          `json:"ip"`
+	Tracks   []TrackProgress `json:"tracks"`
+}
+
+// TrackProgress is the position within one candidate sequence, identified by
+// its profile and ports so a rotated TOTP sequence no longer matches.
+type TrackProgress struct {
+	Sequence  string    `json:"sequence"`
+	Profile   string    `json:"profile,omitempty"`
+	Steps     int       `json:"steps"`
+	StepIndex int       `json:"step_index"`
+	HitCount  int       `json:"hit_count"`
+	Started   time.Time `json:"started"`
+	LastHit   time.Time `json:"last_hit"`
+}
+
+// SignedState is the file format written by `state export`.
+type SignedState struct {
+	Version    int             `json:"version"`
+	ExportedAt time.Time       `json:"exported_at"`
+	State      json.RawMessage `json:"state"`
+	Signature  string          `json:"signature"` // HMAC-SHA256 of State, hex encoded
+}
+
+func signState(key string, snap *StateSnapshot) (*SignedState, error) {
+	if key == "" {
+		return nil, ErrStateKeyMissing
+	}
+
+	raw, err := json.Marshal(snap)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SignedState{
+		Version:    stateVersion,
+		ExportedAt: time.Now().UTC(),
+		State:      raw,
+		Signature:  hex.EncodeToString(stateMAC(key, raw)),
+	}, nil
+}
+
+func verifyState(key string, signed *SignedState) (*StateSnapshot, error) {
+	if key == "" {
+		return nil, ErrStateKeyMissing
+	}
+	if signed.Version != stateVersion {
+		return nil, fmt.Errorf("unsupported state version %d", signed.Version)
+	}
+
+	// The export may have been re-indented; the signature covers the compact form
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, signed.State); err != nil {
+		return nil, fmt.Errorf("decoding state: %w", err)
+	}
+
+	sig, err := hex.DecodeString(signed.Signature)
+	if err != nil || !hmac.Equal(sig, stateMAC(key, compact.Bytes())) {
+		return nil, ErrStateBadSignature
+	}
+
+	snap := &StateSnapshot{}
+	if err := json.Unmarshal(signed.State, snap); err != nil {
+		return nil, fmt.Errorf("decoding state: %w", err)
+	}
+	return snap, nil
+}
+
+func stateMAC(key string, data []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// loadStateFile reads the state saved by a previous run, nil when there is none.
+func loadStateFile(path string) (*StateSnapshot, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading state: %w", err)
+	}
+
+	snap := &StateSnapshot{}
+	if err := json.Unmarshal(data, snap); err != nil {
+		return nil, fmt.Errorf("parsing state %s: %w", path, err)
+	}
+	return snap, nil
+}
+
+// saveStateFile writes snap unsigned; unlike an export it never leaves the host.
+func saveStateFile(path string, snap *StateSnapshot) error {
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write then rename so a crash never leaves a truncated file
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,430 @@
+package knock
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrStatsDisabled = errors.New("statistics are not configured (stats_file is empty)")
+
+const (
+	statsDayLayout = "2006-01-02"
+	statsRetention = 90 // Days of history kept on disk
+)
+
+// Counters are the knock outcomes tracked per IP, instance and day, and
+// per knocked port. Grants and denials are not tied to a port.
+type Counters struct {
+	Attempts    int `json:"attempts"`    // Knocks received
+	Completions int `json:"completions"` // Sequences completed, granted or not
+	Grants      int `json:"grants"`
+	Denials     int `json:"denials"`
+	Failures    int `json:"failures"`
+	Bans        int `json:"bans"`
+}
+
+func (c *Counters) add(o Counters) {
+	c.Attempts += o.Attempts
+	c.Completions += o.Completions
+	c.Grants += o.Grants
+	c.Denials += o.Denials
+	c.Failures += o.Failures
+	c.Bans += o.Bans
+}
+
+// total ranks sources by outcomes; every knock is an attempt, so those are
+// left out.
+func (c Counters) total() int {
+	return c.Grants + c.Denials + c.Failures + c.Bans
+}
+
+type statsKind int
+
+const (
+	statGrant statsKind = iota
+	statDenial
+	statFailure
+	statBan
+	statAttempt
+	statCompletion
+)
+
+// statsDays maps day -> instance -> ip or port -> counters.
+type statsDays map[string]map[string]map[string]*Counters
+
+func (d statsDays) counters(day, instance, key string) *Counters {
+	if d[day] == nil {
+		d[day] = make(map[string]map[string]*Counters)
+	}
+	if d[day][instance] == nil {
+		d[day][instance] = make(map[string]*Counters)
+	}
+	c := d[day][instance][key]
+	if c == nil {
+		c = &Counters{}
+		d[day][instance][key] = c
+	}
+	return c
+}
+
+// statsFile is the layout of the stats file. Files written before per-port
+// counters hold the IP days alone at the top level.
+type statsFile struct {
+	IPs   statsDays `json:"ips"`
+	Ports statsDays `json:"ports"`
+}
+
+// Stats aggregates knock outcomes per day and persists them to a JSON file.
+type Stats struct {
+	path  string
+	days  statsDays // By IP
+	ports statsDays // By knocked port
+	dirty bool
+	mutex sync.Mutex
+}
+
+// LoadStats reads the stats file, starting empty when it does not exist yet.
+func LoadStats(path string) (*Stats, error) {
+	s := &Stats{path: path, days: make(statsDays), ports: make(statsDays)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading stats: %w", err)
+	}
+
+	var f statsFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("parsing stats %s: %w", path, err)
+	}
+	if f.IPs == nil && f.Ports == nil {
+		if err := json.Unmarshal(data, &s.days); err != nil {
+			return nil, fmt.Errorf("parsing stats %s: %w", path, err)
+		}
+		return s, nil
+	}
+	if f.IPs != nil {
+		s.days = f.IPs
+	}
+	if f.Ports != nil {
+		s.ports = f.Ports
+	}
+	return s, nil
+}
+
+// record counts an outcome for ip, and for port unless it is zero.
+func (s *Stats) record(kind statsKind, instance, ip string, port int, t time.Time) {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	day := t.UTC().Format(statsDayLayout)
+	s.days.counters(day, instance, ip).count(kind)
+	if port != 0 {
+		s.ports.counters(day, instance, strconv.Itoa(port)).count(kind)
+	}
+	s.dirty = true
+}
+
+func (c *Counters) count(kind statsKind) {
+	switch kind {
+	case statGrant:
+		c.Grants++
+	case statDenial:
+		c.Denials++
+	case statFailure:
+		c.Failures++
+	case statBan:
+		c.Bans++
+	case statAttempt:
+		c.Attempts++
+	case statCompletion:
+		c.Completions++
+	}
+}
+
+// Flush writes the counters to disk if they changed, dropping expired days.
+func (s *Stats) Flush() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.dirty {
+		return nil
+	}
+
+	cutoff := time.Now().UTC().AddDate(0, 0, -statsRetention).Format(statsDayLayout)
+	for _, days := range []statsDays{s.days, s.ports} {
+		for day := range days {
+			if day < cutoff {
+				delete(days, day)
+			}
+		}
+	}
+
+	data, err := json.Marshal(statsFile{IPs: s.days, Ports: s.ports})
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// Run flushes the counters every interval until stop is closed.
+func (s *Stats) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			if err := s.Flush(); err != nil {
+				log.Printf("Failed to save stats: %v", err)
+			}
+			return
+		}
+		if err := s.Flush(); err != nil {
+			log.Printf("Failed to save stats: %v", err)
+		}
+	}
+}
+
+type IPCount struct {
+	IP string `json:"ip"`
+	Counters
+}
+
+// StatsReport summarizes the counters over a range of days.
+type StatsReport struct {
+	From       string              `json:"from"`
+	To         string              `json:"to"`
+	Total      Counters            `json:"total"`
+	ByDay      map[string]Counters `json:"by_day"`
+	ByInstance map[string]Counters `json:"by_instance"`
+	ByPort     map[string]Counters `json:"by_port"`
+	TopIPs     []IPCount           `json:"top_ips"`
+}
+
+const statsTopIPs = 10
+
+func (s *Stats) Report(days int) *StatsReport {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now().UTC()
+	report := &StatsReport{
+		From:       now.AddDate(0, 0, -(days - 1)).Format(statsDayLayout),
+		To:         now.Format(statsDayLayout),
+		ByDay:      make(map[string]Counters),
+		ByInstance: make(map[string]Counters),
+		ByPort:     make(map[string]Counters),
+	}
+
+	perIP := make(map[string]*Counters)
+	for day, instances := range s.days {
+		if day < report.From || day > report.To {
+			continue
+		}
+
+		for instance, ips := range instances {
+			for ip, c := range ips {
+				report.Total.add(*c)
+
+				d := report.ByDay[day]
+				d.add(*c)
+				report.ByDay[day] = d
+
+				i := report.ByInstance[instance]
+				i.add(*c)
+				report.ByInstance[instance] = i
+
+				if perIP[ip] == nil {
+					perIP[ip] = &Counters{}
+				}
+				perIP[ip].add(*c)
+			}
+		}
+	}
+
+	for day, instances := range s.ports {
+		if day < report.From || day > report.To {
+			continue
+		}
+		for _, ports := range instances {
+			for port, c := range ports {
+				p := report.ByPort[port]
+				p.add(*c)
+				report.ByPort[port] = p
+			}
+		}
+	}
+
+	for ip, c := range perIP {
+		report.TopIPs = append(report.TopIPs, IPCount{IP: ip, Counters: *c})
+	}
+	sort.Slice(report.TopIPs, func(i, j int) bool {
+		a, b := report.TopIPs[i], report.TopIPs[j]
+		if a.total() != b.total() {
+			return a.total() > b.total()
+		}
+		return a.IP < b.IP
+	})
+	if len(report.TopIPs) > statsTopIPs {
+		report.TopIPs = report.TopIPs[:statsTopIPs]
+	}
+
+	return report
+}
+
+const (
+	StatsByIP   = "ip"
+	StatsByPort = "port"
+)
+
+// StatsRow is one day of counters for an IP or a knocked port on an instance.
+type StatsRow struct {
+	Day      string `json:"day"`
+	Instance string `json:"instance"`
+	IP       string `json:"ip,omitempty"`
+	Port     int    `json:"port,omitempty"`
+	Counters
+}
+
+// Export returns the daily counters by IP or by port for the days from to
+// to, inclusive, as YYYY-MM-DD in UTC. An empty bound leaves that end open.
+// Rows are ordered by day, instance, then IP or port.
+func (s *Stats) Export(by, from, to string) ([]StatsRow, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	days := s.days
+	switch by {
+	case "", StatsByIP:
+		by = StatsByIP
+	case StatsByPort:
+		days = s.ports
+	default:
+		return nil, fmt.Errorf("invalid grouping %q, use ip or port", by)
+	}
+
+	rows := []StatsRow{}
+	for day, instances := range days {
+		if (from != "" && day < from) || (to != "" && day > to) {
+			continue
+		}
+		for instance, keys := range instances {
+			for key, c := range keys {
+				row := StatsRow{Day: day, Instance: instance, Counters: *c}
+				if by == StatsByIP {
+					row.IP = key
+				} else {
+					row.Port, _ = strconv.Atoi(key)
+				}
+				rows = append(rows, row)
+			}
+		}
+	}
+
+	sort.Slice(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		if a.Day != b.Day {
+			return a.Day < b.Day
+		}
+		if a.Instance != b.Instance {
+			return a.Instance < b.Instance
+		}
+		if a.Port != b.Port {
+			return a.Port < b.Port
+		}
+		return a.IP < b.IP
+	})
+	return rows, nil
+}
+
+// WriteStatsCSV writes exported rows as CSV under a header line, with an ip
+// or port column depending on by.
+func WriteStatsCSV(w io.Writer, by string, rows []StatsRow) error {
+	key := StatsByIP
+	if by == StatsByPort {
+		key = StatsByPort
+	}
+
+	cw := csv.NewWriter(w)
+	_ = cw.Write([]string{"day", "instance", key, "attempts", "completions", "grants", "denials", "failures", "bans"})
+	for _, r := range rows {
+		k := r.IP
+		if key == StatsByPort {
+			k = strconv.Itoa(r.Port)
+		}
+		_ = cw.Write([]string{
+			r.Day,
+			r.Instance,
+			k,
+			strconv.Itoa(r.Attempts),
+			strconv.Itoa(r.Completions),
+			strconv.Itoa(r.Grants),
+			strconv.Itoa(r.Denials),
+			strconv.Itoa(r.Failures),
+			strconv.Itoa(r.Bans),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// parseStatsDay turns an export bound into a UTC day. Dates are taken as
+// is; times and durations ago are converted.
+func parseStatsDay(s string, now time.Time) (string, error) {
+	if _, err := time.Parse(statsDayLayout, s); err == nil || s == "" {
+		return s, nil
+	}
+	t, err := parseAuditTime(s, now)
+	if err != nil {
+		return "", err
+	}
+	return t.UTC().Format(statsDayLayout), nil
+}
+
+// parseRangeDays accepts "7d", "30d" or a Go duration such as "48h", rounded up to days.
+func parseRangeDays(s string) (int, error) {
+	if s == "" {
+		return 7, nil
+	}
+
+	if n, ok := strings.CutSuffix(s, "d"); ok {
+		days, err := strconv.Atoi(n)
+		if err != nil || days < 1 {
+			return 0, fmt.Errorf("invalid range %q", s)
+		}
+		return days, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid range %q", s)
+	}
+	return int((d + 24*time.Hour - 1) / (24 * time.Hour)), nil
+}
@@ -0,0 +1,146 @@
+package knock
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultStatsDPrefix   = "port_knocking."
+	defaultStatsDInterval = 10 * time.Second
+	// Keeps a packet of metrics within the MTU of most links
+	maxStatsDPacket = 1432
+)
+
+// StatsDConfig sends the knock counters to a StatsD or DogStatsD agent, for
+// environments standardized on Datadog. Plain StatsD has no tags, so the
+// counters are only split by instance, profile and interface with DogStatsD.
+type StatsDConfig struct {
+	Addr          string   `json:"addr"`           // host:port of the agent, disabled when empty
+	Prefix        string   `json:"prefix"`         // Prepended to metric names, "port_knocking." by default
+	DogStatsD     bool     `json:"dogstatsd"`      // Tag metrics with instance, profile and interface
+	Tags          []string `json:"tags"`           // Added to every metric with DogStatsD, like "env:prod"
+	FlushInterval Duration `json:"flush_interval"` // How often counts are sent, 10s by default
+}
+
+func (c StatsDConfig) Enabled() bool {
+	return c.Addr != ""
+}
+
+// statsDNames are the metrics the counters are sent as.
+var statsDNames = map[statsKind]string{
+	statAttempt:    "knocks",
+	statCompletion: "completions",
+	statGrant:      "grants",
+	statDenial:     "denials",
+	statFailure:    "failures",
+	statBan:        "bans",
+}
+
+// StatsD adds up counts between flushes, sending each metric and tag set
+// once per interval.
+type StatsD struct {
+	cfg    StatsDConfig
+	conn   net.Conn
+	counts map[string]int64 // By metric name and tags, as written on the wire
+	mutex  sync.Mutex
+}
+
+func NewStatsD(cfg StatsDConfig) (*StatsD, error) {
+	if cfg.Prefix == "" {
+		cfg.Prefix = defaultStatsDPrefix
+	}
+	if cfg.FlushInterval.Duration == 0 {
+		cfg.FlushInterval = Duration{defaultStatsDInterval}
+	}
+	conn, err := net.Dial("udp", cfg.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("statsd: %w", err)
+	}
+	return &StatsD{cfg: cfg, conn: conn, counts: make(map[string]int64)}, nil
+}
+
+// count adds one to the metric of kind. Empty tags are left out.
+func (d *StatsD) count(kind statsKind, instance, profile, iface string) {
+	if d == nil {
+		return
+	}
+
+	key := d.cfg.Prefix + statsDNames[kind]
+	if d.cfg.DogStatsD {
+		tags := append(slices.Clip(d.cfg.Tags), "instance:"+instance)
+		if profile != "" {
+			tags = append(tags, "profile:"+profile)
+		}
+		if iface != "" {
+			tags = append(tags, "interface:"+iface)
+		}
+		key += "|#" + strings.Join(tags, ",")
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.counts[key]++
+}
+
+// Run sends the counts every flush interval until stop is closed, then sends
+// the last ones.
+func (d *StatsD) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(d.cfg.FlushInterval.Duration)
+	defer ticker.Stop()
+	defer d.conn.Close()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			if err := d.Flush(); err != nil {
+				log.Printf("Failed to send metrics to StatsD: %v", err)
+			}
+			return
+		}
+		if err := d.Flush(); err != nil {
+			log.Printf("Failed to send metrics to StatsD: %v", err)
+		}
+	}
+}
+
+// Flush sends and resets the counts, as few packets as fit them.
+func (d *StatsD) Flush() error {
+	d.mutex.Lock()
+	counts := d.counts
+	d.counts = make(map[string]int64, len(counts))
+	d.mutex.Unlock()
+
+	var packet []byte
+	for _, key := range slices.Sorted(maps.Keys(counts)) {
+		name, tags, _ := strings.Cut(key, "|")
+		line := name + ":" + strconv.FormatInt(counts[key], 10) + "|c"
+		if tags != "" {
+			line += "|" + tags
+		}
+
+		if len(packet) > 0 && len(packet)+1+len(line) > maxStatsDPacket {
+			if _, err := d.conn.Write(packet); err != nil {
+				return err
+			}
+			packet = packet[:0]
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+	if len(packet) == 0 {
+		return nil
+	}
+	_, err := d.conn.Write(packet)
+	return err
+}
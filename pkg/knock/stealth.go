@@ -0,0 +1,271 @@
+package knock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	ModeListen  = "listen"  // Bind a TCP listener on every knock port
+	ModeCapture = "capture" // Observe SYNs on the wire without binding anything
+	ModeNFLog   = "nflog"   // Read SYNs copied by a firewall NFLOG rule that drops them
+	ModeSYN     = "syn"     // Observe SYNs like capture, dropping them so the ports look filtered
+
+	// SYNs repeated within this window are retransmissions of one knock
+	synRetransmitWindow = 3 * time.Second
+
+	maxStaleSYNDrops = 8 // Leftover DROP rules removed per port before inserting one
+)
+
+func validMode(mode string) bool {
+	switch mode {
+	case "", ModeListen, ModeCapture, ModeNFLog, ModeSYN:
+		return true
+	default:
+		return false
+	}
+}
+
+// observingMode reports whether mode sees knocks without binding sockets.
+func observingMode(mode string) bool {
+	return mode == ModeCapture || mode == ModeNFLog || mode == ModeSYN
+}
+
+// synKey identifies one connection attempt, which retransmits keep. The
+// initial sequence number tells apart attempts reusing a source port.
+type synKey struct {
+	src     netip.Addr
+	srcPort uint16
+	dstPort uint16
+	seq     uint32
+}
+
+// knockSource yields packets observed without a listening socket. ReadPacket
+// returns false when nothing arrived before its internal timeout.
+type knockSource interface {
+	ReadPacket(buf []byte) (Packet, bool, error)
+	Close() error
+}
+
+// ReadPacket returns the next inbound frame this host did not send.
+func (s *packetSource) ReadPacket(buf []byte) (Packet, bool, error) {
+	n, ifindex, outgoing, err := s.ReadFrame(buf)
+	if err != nil || n == 0 || outgoing {
+		return Packet{}, false, err
+	}
+	p, ok := parseEthernet(buf[:n])
+	p.Ifindex = ifindex
+	return p, ok, nil
+}
+
+// observing reports whether the instance sees knocks without binding sockets.
+func (s *Server) observing() bool {
+	return observingMode(s.cfg.Mode)
+}
+
+// handleCapture feeds every inbound SYN to a knock port, or ClientHello to a
+// TLS knock port, into processKnock.
+// No socket is bound, so the ports look closed (or, with NFLOG and a DROP
+// rule, filtered) to scanners.
+func (s *Server) handleCapture(src knockSource, ports []int, stop <-chan struct{}) {
+	defer src.Close()
+
+	knock := make(map[uint16]bool, len(ports))
+	for _, p := range ports {
+		knock[uint16(p)] = true
+	}
+
+	var bind netip.Addr
+	if s.cfg.Bind != "" {
+		bind, _ = netip.ParseAddr(s.cfg.Bind)
+	}
+
+	seen := make(map[synKey]time.Time)
+	lastPrune := time.Now()
+	buf := make([]byte, pcapSnapLen)
+
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		p, ok, err := src.ReadPacket(buf)
+		if err != nil {
+			log.Printf("[%s] Packet capture stopped: %v", s.Name(), err)
+			return
+		}
+		if !ok || p.Proto != protoTCP || !knock[p.DstPort] {
+			continue
+		}
+		// On TLS knock ports a real service accepts the connection and the
+		// ClientHello it receives is the knock
+		_, tls := s.sni[int(p.DstPort)]
+		if tls && (p.TCPFlags&tcpFlagSYN != 0 || len(p.Payload) == 0 || p.Payload[0] != tlsRecordHandshake) {
+			continue
+		}
+		if !tls && p.TCPFlags&(tcpFlagSYN|tcpFlagACK) != tcpFlagSYN {
+			continue
+		}
+		if bind.IsValid() && p.Dst.Unmap() != bind.Unmap() {
+			continue
+		}
+		if !s.familyAllows(p.Src) {
+			continue
+		}
+
+		now := time.Now()
+		key := synKey{src: p.Src, srcPort: p.SrcPort, dstPort: p.DstPort, seq: p.Seq}
+		if at, ok := seen[key]; ok && now.Sub(at) < synRetransmitWindow {
+			continue
+		}
+		seen[key] = now
+
+		if now.Sub(lastPrune) > synRetransmitWindow {
+			for k, at := range seen {
+				if now.Sub(at) >= synRetransmitWindow {
+					delete(seen, k)
+				}
+			}
+			lastPrune = now
+		}
+
+		var hello []byte
+		if tls {
+			hello = p.Payload
+		}
+		s.processKnock(p.Src.Unmap().WithZone("").String(), s.knockInterface(p.Dst, p.Ifindex), int(p.DstPort), int(p.SrcPort), hello)
+	}
+}
+
+func (s *Server) familyAllows(addr netip.Addr) bool {
+	switch s.cfg.Family {
+	case FamilyIPv4:
+		return addr.Unmap().Is4()
+	case FamilyIPv6:
+		return addr.Is6() && !addr.Is4In6()
+	default:
+		return true
+	}
+}
+
+// openKnockSource opens the packet source for the capture, nflog or syn mode.
+func (s *Server) openKnockSource() (knockSource, error) {
+	switch s.cfg.Mode {
+	case ModeNFLog:
+		src, err := openNFLog(s.cfg.NFLogGroup)
+		if err != nil {
+			return nil, fmt.Errorf("nflog mode: %w", err)
+		}
+		return src, nil
+	case ModeSYN:
+		src, err := s.openSYNSource()
+		if err != nil {
+			return nil, fmt.Errorf("syn mode: %w", err)
+		}
+		return src, nil
+	}
+
+	src, err := openPacketSource(s.cfg.Interface)
+	if err != nil {
+		return nil, fmt.Errorf("capture mode: %w", err)
+	}
+	return src, nil
+}
+
+// synSource is the capture source of syn mode. Its DROP rules keep the
+// kernel from answering knock SYNs, with a SYN-ACK or a reset, so knock
+// ports look filtered; the packet socket sees the SYNs before they are
+// dropped. Closing it removes the rules.
+type synSource struct {
+	*packetSource
+	rules  []synDrop
+	remove sync.Once
+}
+
+// synDrop is one DROP rule, as the binary managing it and its arguments.
+type synDrop struct {
+	bin  string
+	spec []string
+}
+
+func (s *Server) openSYNSource() (*synSource, error) {
+	src, err := openPacketSource(s.cfg.Interface)
+	if err != nil {
+		return nil, err
+	}
+	syn := &synSource{packetSource: src}
+
+	ctx := context.Background()
+	tag := "knock-syn:" + s.Name()
+	for _, bin := range synDropBinaries(s.cfg) {
+		for _, port := range listenPorts(s.cfg) {
+			spec := []string{"-p", "tcp", "--dport", strconv.Itoa(port), "--syn"}
+			if s.cfg.Bind != "" {
+				spec = append(spec, "-d", s.cfg.Bind)
+			}
+			if s.cfg.Interface != "" {
+				spec = append(spec, "-i", s.cfg.Interface)
+			}
+			spec = append(spec, "-m", "comment", "--comment", tag, "-j", "DROP")
+
+			// A rule left behind by an unclean exit is replaced, not doubled
+			for range maxStaleSYNDrops {
+				if _, err := runCommand(ctx, bin, append([]string{"-D", "INPUT"}, spec...)...); err != nil {
+					break
+				}
+			}
+			if _, err := runCommand(ctx, bin, append([]string{"-I", "INPUT"}, spec...)...); err != nil {
+				_ = syn.Close()
+				return nil, err
+			}
+			syn.rules = append(syn.rules, synDrop{bin: bin, spec: spec})
+		}
+	}
+	return syn, nil
+}
+
+func (s *synSource) Close() error {
+	return errors.Join(s.removeRules(), s.packetSource.Close())
+}
+
+// removeRules deletes the DROP rules once, whether the instance stopping or
+// the source closing gets there first.
+func (s *synSource) removeRules() error {
+	var errs []error
+	s.remove.Do(func() {
+		for _, r := range s.rules {
+			if _, err := runCommand(context.Background(), r.bin, append([]string{"-D", "INPUT"}, r.spec...)...); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// synDropBinaries returns the tools dropping knock SYNs of each family the
+// instance accepts.
+func synDropBinaries(cfg InstanceConfig) []string {
+	if cfg.Bind != "" {
+		if addr, err := netip.ParseAddr(cfg.Bind); err == nil {
+			if addr.Unmap().Is4() {
+				return []string{"iptables"}
+			}
+			return []string{"ip6tables"}
+		}
+	}
+	switch cfg.Family {
+	case FamilyIPv4:
+		return []string{"iptables"}
+	case FamilyIPv6:
+		return []string{"ip6tables"}
+	}
+	return []string{"iptables", "ip6tables"}
+}
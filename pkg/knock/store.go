@@ -0,0 +1,69 @@
+package knock
+
+import (
+	"log"
+	"time"
+)
+
+// StateStore shares knock progress between nodes running the same instances,
+// so a client can finish on one gateway a sequence started on another, as
+// happens behind anycast. Without a store each node only knows its own knocks.
+type StateStore interface {
+	// Progress returns the saved progress of ip on instance, nil when none.
+	Progress(instance, ip string) (*ClientProgress, error)
+	// SaveProgress stores progress for at most ttl.
+	SaveProgress(progress ClientProgress, ttl time.Duration) error
+	DeleteProgress(instance, ip string) error
+}
+
+// clientState returns the progress of ip, taken from the shared store when
+// there is one, since another node may have moved it since. Callers hold the
+// server mutex.
+func (s *Server) clientState(ip string, now time.Time) (*ClientState, bool) {
+	if s.store == nil {
+		return s.clients.get(ip)
+	}
+
+	cp, err := s.store.Progress(s.Name(), ip)
+	if err != nil {
+		log.Printf("[%s] Reading shared progress of %s: %v", s.Name(), ip, err)
+		return s.clients.get(ip)
+	}
+	if cp == nil {
+		s.clients.remove(ip)
+		return nil, false
+	}
+
+	state := s.resumeState(*cp, now)
+	if state == nil {
+		return nil, false
+	}
+	s.clients.put(ip, state, now)
+	return state, true
+}
+
+// share publishes the progress of ip after a knock. Callers hold the server
+// mutex.
+func (s *Server) share(ip string, state *ClientState, now time.Time) {
+	if s.store == nil {
+		return
+	}
+
+	cp := ClientProgress{Instance: s.Name(), IP: ip, Tracks: state.progress(now)}
+	if err := s.store.SaveProgress(cp, state.lifetime()); err != nil {
+		log.Printf("[%s] Sharing progress of %s: %v", s.Name(), ip, err)
+	}
+}
+
+// forget drops the progress of ip, on every node when shared. Callers hold
+// the server mutex.
+func (s *Server) forget(ip string) {
+	s.clients.remove(ip)
+	if s.store == nil {
+		return
+	}
+
+	if err := s.store.DeleteProgress(s.Name(), ip); err != nil {
+		log.Printf("[%s] Dropping shared progress of %s: %v", s.Name(), ip, err)
+	}
+}
@@ -0,0 +1,309 @@
+package knock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+var ErrUnknownInstance = errors.New("unknown instance")
+
+// InstanceStatus is the externally visible state of a supervised instance.
+type InstanceStatus struct {
+	Name      string      `json:"name"`
+	Running   bool        `json:"running"`
+	Bind      string      `json:"bind"`
+	Sequence  []KnockStep `json:"sequence"`
+	Profiles  []string    `json:"profiles,omitempty"`
+	LastError string      `json:"last_error,omitempty"`
+}
+
+type instance struct {
+	server  *Server
+	lastErr error
+}
+
+// Supervisor owns every knock server instance in the process.
+type Supervisor struct {
+	sessions      *SessionManager
+	bans          *BanList
+	secondFactors map[string]*SecondFactor
+	stateFile     string // Saved to periodically and on shutdown when set
+	order         []string
+	instances     map[string]*instance
+	mutex         sync.Mutex
+}
+
+func NewSupervisor(cfgs []InstanceConfig, reg *Registry) (*Supervisor, error) {
+	sup := &Supervisor{
+		sessions:      reg.sessions,
+		bans:          reg.bans,
+		secondFactors: reg.secondFactors,
+		instances:     make(map[string]*instance, len(cfgs)),
+	}
+
+	for _, cfg := range cfgs {
+		srv, err := NewServer(cfg, reg)
+		if err != nil {
+			return nil, fmt.Errorf("instance %s: %w", cfg.Name, err)
+		}
+
+		sup.order = append(sup.order, cfg.Name)
+		sup.instances[cfg.Name] = &instance{server: srv}
+	}
+	return sup, nil
+}
+
+// Run starts every enabled instance and stops them all when ctx is cancelled.
+// It fails only if no instance could be started.
+func (sup *Supervisor) Run(ctx context.Context) error {
+	var errs []error
+	started := 0
+
+	for _, name := range sup.order {
+		if sup.instances[name].server.cfg.Disabled {
+			log.Printf("[%s] Instance disabled, not starting", name)
+			continue
+		}
+
+		if err := sup.Start(name); err != nil {
+			log.Printf("[%s] Failed to start: %v", name, err)
+			errs = append(errs, fmt.Errorf("instance %s: %w", name, err))
+			continue
+		}
+		started++
+	}
+
+	if started == 0 && len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	if sup.stateFile != "" {
+		stop := make(chan struct{})
+		defer close(stop)
+		go sup.persist(stop)
+	}
+
+	sdNotify("READY=1")
+	if interval := watchdogInterval(); interval > 0 {
+		stop := make(chan struct{})
+		defer close(stop)
+		go sup.watchdog(interval, stop)
+	}
+
+	<-ctx.Done()
+	sdNotify("STOPPING=1")
+
+	// Save before stopping, which forgets the sequences in progress
+	if sup.stateFile != "" {
+		if err := sup.saveState(); err != nil {
+			log.Printf("Saving state: %v", err)
+		}
+	}
+	for _, name := range sup.order {
+		_ = sup.Stop(name)
+	}
+	return nil
+}
+
+// watchdog pings the systemd watchdog every interval while the supervisor,
+// its instances and the sessions can still be locked, so a deadlock stops
+// the pings and systemd restarts the service.
+func (sup *Supervisor) watchdog(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		_ = sup.Status()
+		_ = sup.sessions.List()
+		sdNotify("WATCHDOG=1")
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (sup *Supervisor) Start(name string) error {
+	sup.mutex.Lock()
+	defer sup.mutex.Unlock()
+
+	inst, ok := sup.instances[name]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownInstance, name)
+	}
+
+	inst.lastErr = inst.server.Start()
+	return inst.lastErr
+}
+
+func (sup *Supervisor) Stop(name string) error {
+	sup.mutex.Lock()
+	defer sup.mutex.Unlock()
+
+	inst, ok := sup.instances[name]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownInstance, name)
+	}
+
+	inst.server.Stop()
+	return nil
+}
+
+func (sup *Supervisor) Status() []InstanceStatus {
+	sup.mutex.Lock()
+	defer sup.mutex.Unlock()
+
+	statuses := make([]InstanceStatus, 0, len(sup.order))
+	for _, name := range sup.order {
+		inst := sup.instances[name]
+
+		status := InstanceStatus{
+			Name:     name,
+			Running:  inst.server.Running(),
+			Bind:     inst.server.cfg.Bind,
+			Sequence: inst.server.cfg.Sequence,
+			Profiles: slices.Sorted(maps.Keys(inst.server.cfg.Profiles)),
+		}
+		if inst.lastErr != nil {
+			status.LastError = inst.lastErr.Error()
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+func (sup *Supervisor) ExportState() *StateSnapshot {
+	now := sup.sessions.clock.Now()
+	snap := &StateSnapshot{
+		Sessions: sup.sessions.List(),
+		Progress: sup.Progress(),
+	}
+	snap.Bans, snap.Offenses = sup.bans.Snapshot()
+	for _, name := range slices.Sorted(maps.Keys(sup.secondFactors)) {
+		snap.TOTPCounters = append(snap.TOTPCounters, sup.secondFactors[name].totpCounters()...)
+	}
+	for _, name := range sup.order {
+		snap.Replays = append(snap.Replays, sup.instances[name].server.replayEntries(now)...)
+	}
+	return snap
+}
+
+// Progress returns the sequences in progress on every instance.
+func (sup *Supervisor) Progress() []ClientProgress {
+	now := sup.sessions.clock.Now()
+	progress := []ClientProgress{}
+	for _, name := range sup.order {
+		progress = append(progress, sup.instances[name].server.progress(now)...)
+	}
+	return progress
+}
+
+// ImportState restores sessions that have not expired yet and re-runs the
+// owning instance's actions so the access exists on this host too. Sequences
+// in progress resume where the client left them, and bans, used second
+// factor codes and replay caches merge with the server's own. Importing a
+// snapshot again skips the sessions already restored.
+func (sup *Supervisor) ImportState(ctx context.Context, snap *StateSnapshot) (int, error) {
+	sup.mutex.Lock()
+	defer sup.mutex.Unlock()
+
+	now := sup.sessions.clock.Now()
+	restored := 0
+	var errs []error
+
+	for _, s := range snap.Sessions {
+		if s.expired(now) {
+			continue
+		}
+
+		inst, ok := sup.instances[s.Instance]
+		if !ok {
+			errs = append(errs, fmt.Errorf("session %s: %w: %s", s.ID, ErrUnknownInstance, s.Instance))
+			continue
+		}
+		p := inst.server.profile(s.Profile)
+		if p.name != s.Profile {
+			errs = append(errs, fmt.Errorf("session %s: %w: %s", s.ID, ErrUnknownProfile, s.Profile))
+			continue
+		}
+
+		s.actions = p.actions
+		if !sup.sessions.Restore(s) {
+			continue
+		}
+		restored++
+
+		access := s.access()
+		for _, a := range s.actions {
+			if err := a.OnGranted(ctx, access); err != nil {
+				errs = append(errs, fmt.Errorf("session %s: action %s: %w", s.ID, a.Name(), err))
+			}
+		}
+	}
+
+	for _, cp := range snap.Progress {
+		if inst, ok := sup.instances[cp.Instance]; ok {
+			inst.server.restoreProgress(cp, now)
+		}
+	}
+	for _, e := range snap.Replays {
+		if inst, ok := sup.instances[e.Instance]; ok {
+			inst.server.restoreReplay(e, now)
+		}
+	}
+	for _, c := range snap.TOTPCounters {
+		if f, ok := sup.secondFactors[c.SecondFactor]; ok {
+			f.restoreTOTPCounter(c)
+		}
+	}
+	if err := sup.bans.Restore(snap.Bans, snap.Offenses); err != nil {
+		errs = append(errs, fmt.Errorf("saving bans: %w", err))
+	}
+
+	return restored, errors.Join(errs...)
+}
+
+// RestoreStateFile resumes the sessions and sequences saved by a previous run.
+func (sup *Supervisor) RestoreStateFile(ctx context.Context) error {
+	snap, err := loadStateFile(sup.stateFile)
+	if err != nil || snap == nil {
+		return err
+	}
+
+	restored, err := sup.ImportState(ctx, snap)
+	log.Printf("Restored %d session(s) and the knock progress of %d client(s) from %s", restored, len(snap.Progress), sup.stateFile)
+	if err != nil {
+		log.Printf("State restore finished with errors: %v", err)
+	}
+	return nil
+}
+
+func (sup *Supervisor) saveState() error {
+	return saveStateFile(sup.stateFile, sup.ExportState())
+}
+
+// persist saves the state every stateSaveInterval until stop is closed, so a
+// crash loses little.
+func (sup *Supervisor) persist(stop <-chan struct{}) {
+	ticker := time.NewTicker(stateSaveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := sup.saveState(); err != nil {
+				log.Printf("Saving state: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package knock
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSyslogTag   = "port-knocking"
+	syslogWriteTimeout = 2 * time.Second
+	// Private enterprise number used by the structured data ID, as RFC 5424
+	// examples do
+	syslogSDID = "knock@32473"
+)
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "daemon": 3, "auth": 4, "syslog": 5, "authpriv": 10,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// Severity of each event, between notice for grants and error for bans
+var syslogSeverities = map[string]int{
+	EventGrant:  5,
+	EventExpire: 6,
+	EventDeny:   4,
+	EventFail:   4,
+	EventBan:    3,
+}
+
+// SyslogConfig is a named action writing knock events as RFC 5424 messages,
+// to the local syslog daemon or to a remote collector.
+type SyslogConfig struct {
+	Network  string   `json:"network"`  // "udp" or "tcp" for a remote collector, empty for the local /dev/log
+	Addr     string   `json:"addr"`     // Collector host:port
+	Facility string   `json:"facility"` // "auth" when empty
+	Tag      string   `json:"tag"`      // APP-NAME, "port-knocking" when empty
+	Events   []string `json:"events"`   // As for webhooks, grant, deny and ban when empty
+}
+
+// SyslogAction formats events with their fields as structured data, so a SIEM
+// can index them without parsing the message text.
+type SyslogAction struct {
+	name     string
+	cfg      SyslogConfig
+	events   []string
+	facility int
+	hostname string
+	conn     net.Conn
+	mutex    sync.Mutex
+	privacy  PrivacyConfig // Masks the addresses sent
+}
+
+func NewSyslogAction(name string, cfg SyslogConfig) (*SyslogAction, error) {
+	switch cfg.Network {
+	case "":
+	case "udp", "tcp":
+		if cfg.Addr == "" {
+			return nil, fmt.Errorf("syslog %s: %s needs addr", name, cfg.Network)
+		}
+	default:
+		return nil, fmt.Errorf("syslog %s: unknown network %q", name, cfg.Network)
+	}
+
+	if cfg.Facility == "" {
+		cfg.Facility = "auth"
+	}
+	facility, ok := syslogFacilities[cfg.Facility]
+	if !ok {
+		return nil, fmt.Errorf("syslog %s: unknown facility %q", name, cfg.Facility)
+	}
+	if cfg.Tag == "" {
+		cfg.Tag = defaultSyslogTag
+	}
+
+	events := cfg.Events
+	if len(events) == 0 {
+		events = defaultEvents
+	}
+	for _, e := range events {
+		if !slices.Contains(allEvents, e) {
+			return nil, fmt.Errorf("syslog %s: unknown event %q", name, e)
+		}
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "-"
+	}
+	return &SyslogAction{name: name, cfg: cfg, events: events, facility: facility, hostname: hostname}, nil
+}
+
+func (s *SyslogAction) Name() string {
+	return s.name
+}
+
+func (s *SyslogAction) OnGranted(ctx context.Context, access Access) error {
+	return s.write(WebhookEvent{Event: EventGrant, Access: access})
+}
+
+func (s *SyslogAction) OnDenied(ctx context.Context, access Access, reason string) error {
+	return s.write(WebhookEvent{Event: EventDeny, Access: access, Reason: reason})
+}
+
+func (s *SyslogAction) OnFailed(ctx context.Context, access Access, reason string) error {
+	return s.write(WebhookEvent{Event: EventFail, Access: access, Reason: reason})
+}
+
+func (s *SyslogAction) OnBanned(ctx context.Context, access Access, until time.Time) error {
+	return s.write(WebhookEvent{Event: EventBan, Access: access, Until: until})
+}
+
+func (s *SyslogAction) OnExpired(ctx context.Context, access Access) error {
+	return s.write(WebhookEvent{Event: EventExpire, Access: access})
+}
+
+func (s *SyslogAction) write(event WebhookEvent) error {
+	if !slices.Contains(s.events, event.Event) {
+		return nil
+	}
+	event.Access = s.privacy.maskAccess(event.Access)
+	msg := s.format(event, time.Now())
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Retry once on a fresh connection, the collector may have restarted
+	var err error
+	for range 2 {
+		if s.conn == nil {
+			if s.conn, err = s.dial(); err != nil {
+				return fmt.Errorf("syslog %s: %w", s.name, err)
+			}
+		}
+
+		_ = s.conn.SetWriteDeadline(time.Now().Add(syslogWriteTimeout))
+		if _, err = s.conn.Write(msg); err == nil {
+			return nil
+		}
+		_ = s.conn.Close()
+		s.conn = nil
+	}
+	return fmt.Errorf("syslog %s: %w", s.name, err)
+}
+
+func (s *SyslogAction) dial() (net.Conn, error) {
+	if s.cfg.Network != "" {
+		return net.DialTimeout(s.cfg.Network, s.cfg.Addr, syslogWriteTimeout)
+	}
+	for _, path := range []string{"/dev/log", "/var/run/syslog", "/var/run/log"} {
+		if conn, err := net.Dial("unixgram", path); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, fmt.Errorf("no local syslog socket found")
+}
+
+// format builds the RFC 5424 message, framed by octet counting over TCP.
+func (s *SyslogAction) format(event WebhookEvent, now time.Time) []byte {
+	a := event.Access
+	pri := s.facility*8 + syslogSeverities[event.Event]
+
+	var sd strings.Builder
+	sd.WriteString("[" + syslogSDID)
+	param := func(name, value string) {
+		if value != "" {
+			sd.WriteString(" " + name + `="` + syslogEscape(value) + `"`)
+		}
+	}
+	param("instance", a.Instance)
+	param("ip", a.IP)
+	param("user", a.User)
+	param("profile", a.Profile)
+	param("session", a.Session)
+	if !a.Expires.IsZero() {
+		param("expires", a.Expires.UTC().Format(time.RFC3339))
+	}
+	if !event.Until.IsZero() {
+		param("until", event.Until.UTC().Format(time.RFC3339))
+	}
+	param("reason", event.Reason)
+	sd.WriteString("]")
+
+	msg := fmt.Sprintf("<%d>1 %s %s %s %d %s %s %s",
+		pri,
+		now.UTC().Format(time.RFC3339Nano),
+		s.hostname,
+		s.cfg.Tag,
+		os.Getpid(),
+		event.Event,
+		sd.String(),
+		alertText(event))
+
+	if s.cfg.Network == "tcp" {
+		msg = strconv.Itoa(len(msg)) + " " + msg
+	}
+	return []byte(msg)
+}
+
+// syslogEscape escapes a structured data parameter value.
+func syslogEscape(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(v)
+}
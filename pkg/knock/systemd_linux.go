@@ -0,0 +1,136 @@
+//go:build linux
+
+package knock
+
+import (
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// First file descriptor passed by socket activation, see sd_listen_fds(3)
+const listenFDsStart = 3
+
+var activation struct {
+	once  sync.Once
+	files []*os.File
+}
+
+// activatedFiles returns the sockets systemd passed to this process, read
+// once. The environment is cleared so child processes do not claim them.
+func activatedFiles() []*os.File {
+	activation.once.Do(func() {
+		pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+		if err != nil || pid != os.Getpid() {
+			return
+		}
+		n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if err != nil || n <= 0 {
+			return
+		}
+		for _, name := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+			_ = os.Unsetenv(name)
+		}
+
+		for fd := listenFDsStart; fd < listenFDsStart+n; fd++ {
+			syscall.CloseOnExec(fd)
+			activation.files = append(activation.files, os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd)))
+		}
+		log.Printf("Received %d socket(s) from systemd socket activation", n)
+	})
+	return activation.files
+}
+
+// activatedListener returns a listener on an inherited stream socket bound
+// to addr. Every call dups the socket, so an instance can be restarted.
+func activatedListener(addr string) (net.Listener, bool) {
+	for _, f := range activatedFiles() {
+		ln, err := net.FileListener(f)
+		if err != nil {
+			continue // Not a stream socket
+		}
+		if matchesAddr(ln.Addr(), addr) {
+			return ln, true
+		}
+		_ = ln.Close()
+	}
+	return nil, false
+}
+
+// activatedPacketConn is activatedListener for datagram sockets.
+func activatedPacketConn(addr string) (net.PacketConn, bool) {
+	for _, f := range activatedFiles() {
+		conn, err := net.FilePacketConn(f)
+		if err != nil {
+			continue
+		}
+		if matchesAddr(conn.LocalAddr(), addr) {
+			return conn, true
+		}
+		_ = conn.Close()
+	}
+	return nil, false
+}
+
+// matchesAddr reports whether a socket bound to local serves addr: the
+// ports agree and either side is a wildcard or the addresses are equal.
+func matchesAddr(local net.Addr, addr string) bool {
+	want, err := netip.ParseAddrPort(normalizeListenAddr(addr))
+	if err != nil {
+		return false
+	}
+	have, err := netip.ParseAddrPort(local.String())
+	if err != nil {
+		return false
+	}
+	if have.Port() != want.Port() {
+		return false
+	}
+	return have.Addr().IsUnspecified() || want.Addr().IsUnspecified() || have.Addr().Unmap() == want.Addr().Unmap()
+}
+
+// normalizeListenAddr turns ":7001" into "0.0.0.0:7001" for parsing.
+func normalizeListenAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host != "" {
+		return addr
+	}
+	return net.JoinHostPort("0.0.0.0", port)
+}
+
+// watchdogInterval returns how often to ping the systemd watchdog, half its
+// timeout as sd_watchdog_enabled(3) advises, or 0 when it is off.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// sdNotify sends a state such as "READY=1" to the service manager, doing
+// nothing when not run by systemd with Type=notify.
+func sdNotify(state string) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return
+	}
+	if path[0] == '@' {
+		path = "\x00" + path[1:] // Abstract namespace
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	_, _ = conn.Write([]byte(state))
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+
+package knock
+
+import (
+	"net"
+	"time"
+)
+
+func activatedListener(addr string) (net.Listener, bool) {
+	return nil, false
+}
+
+func activatedPacketConn(addr string) (net.PacketConn, bool) {
+	return nil, false
+}
+
+func sdNotify(state string) {}
+
+func watchdogInterval() time.Duration {
+	return 0
+}
@@ -0,0 +1,474 @@
+package knock
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TokenHS256 = "HS256" // HMAC-SHA256 with a shared secret
+	TokenES256 = "ES256" // ECDSA P-256, public key published as a JWKS
+
+	tokenPath = "/token"
+	jwksPath  = "/.well-known/jwks.json"
+)
+
+var errInvalidToken = errors.New("invalid token")
+
+// TokenConfig is a named action minting a short-lived JWT for each granted
+// session. The client collects it from the token endpoint, from the address
+// that knocked and naming the nonce of its sealed or signed request, and
+// presents it as a bearer token to the upstream service the endpoint fronts,
+// or to any service verifying it with the key. Tokens of plain knocks, which
+// carry no nonce, go to any request from the knocking address.
+type TokenConfig struct {
+	Listen    string   `json:"listen"`    // Token endpoint address, e.g. ":8443"
+	Issuer    string   `json:"issuer"`    // iss claim, the action name when empty
+	Audience  string   `json:"audience"`  // aud claim, checked by the upstream proxy
+	Algorithm string   `json:"algorithm"` // "HS256" (default) or "ES256"
+	Key       string   `json:"key"`       // HMAC secret file, or PEM EC P-256 private key for ES256
+	TTL       Duration `json:"ttl"`       // Token lifetime within the session, the whole session when zero
+	Upstream  string   `json:"upstream"`  // HTTP service proxied for requests bearing a valid token
+	TLSCert   string   `json:"tls_cert"`  // Serve the endpoint over HTTPS with this certificate
+	TLSKey    string   `json:"tls_key"`
+}
+
+// TokenClaims are the claims of the tokens minted on grant.
+type TokenClaims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"` // User, or the IP for anonymous sources
+	Audience  string `json:"aud,omitempty"`
+	IssuedAt  int64  `json:"iat"`
+	NotBefore int64  `json:"nbf"`
+	Expires   int64  `json:"exp"`
+	ID        string `json:"jti"` // The session
+	IP        string `json:"ip"`  // Source the token is bound to
+	Instance  string `json:"instance"`
+	Profile   string `json:"profile,omitempty"`
+}
+
+type issuedToken struct {
+	ip      string
+	nonce   string // Of the request the session was granted for, empty for plain knocks
+	token   string
+	expires time.Time
+}
+
+// TokenAction mints a JWT bound to the knocking IP when a session opens and
+// forgets it when the session ends, which also revokes it at the upstream
+// proxy. Services verifying tokens on their own rely on exp.
+type TokenAction struct {
+	name     string
+	cfg      TokenConfig
+	secret   []byte            // HS256
+	key      *ecdsa.PrivateKey // ES256
+	upstream *httputil.ReverseProxy
+
+	tokens map[string]issuedToken // By session
+	mutex  sync.Mutex
+	clock  Clock
+
+	ln  net.Listener
+	srv *http.Server
+}
+
+func NewTokenAction(name string, cfg TokenConfig) (*TokenAction, error) {
+	if cfg.Listen == "" {
+		return nil, fmt.Errorf("token %s: listen is required", name)
+	}
+	if cfg.Issuer == "" {
+		cfg.Issuer = name
+	}
+	if cfg.Algorithm == "" {
+		cfg.Algorithm = TokenHS256
+	}
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		return nil, fmt.Errorf("token %s: tls_cert and tls_key go together", name)
+	}
+	if cfg.Key == "" {
+		return nil, fmt.Errorf("token %s: key is required", name)
+	}
+
+	t := &TokenAction{name: name, cfg: cfg, tokens: make(map[string]issuedToken), clock: systemClock{}}
+
+	data, err := os.ReadFile(cfg.Key)
+	if err != nil {
+		return nil, fmt.Errorf("token %s: %w", name, err)
+	}
+	switch cfg.Algorithm {
+	case TokenHS256:
+		if t.secret = []byte(strings.TrimSpace(string(data))); len(t.secret) < 32 {
+			return nil, fmt.Errorf("token %s: the HS256 secret needs at least 32 bytes", name)
+		}
+	case TokenES256:
+		if t.key, err = parseECKey(data); err != nil {
+			return nil, fmt.Errorf("token %s: %s: %w", name, cfg.Key, err)
+		}
+	default:
+		return nil, fmt.Errorf("token %s: invalid algorithm %q", name, cfg.Algorithm)
+	}
+
+	if cfg.Upstream != "" {
+		u, err := url.Parse(cfg.Upstream)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("token %s: invalid upstream %q", name, cfg.Upstream)
+		}
+		t.upstream = httputil.NewSingleHostReverseProxy(u)
+	}
+	return t, nil
+}
+
+// parseECKey reads a P-256 private key in SEC 1 or PKCS #8 form.
+func parseECKey(data []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM private key")
+	}
+
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		if key, ok = parsed.(*ecdsa.PrivateKey); !ok {
+			return nil, errors.New("private key is not ECDSA")
+		}
+	}
+	if key.Curve != elliptic.P256() {
+		return nil, errors.New("ES256 needs a P-256 key")
+	}
+	return key, nil
+}
+
+func (t *TokenAction) Name() string {
+	return t.name
+}
+
+// Listen binds the token endpoint so failures surface before the server starts.
+func (t *TokenAction) Listen() error {
+	ln, err := listen("tcp", t.cfg.Listen)
+	if err != nil {
+		return fmt.Errorf("token %s: %w", t.name, err)
+	}
+	t.ln = ln
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(tokenPath, t.serveToken)
+	if t.key != nil {
+		mux.HandleFunc("GET "+jwksPath, t.serveJWKS)
+	}
+	if t.upstream != nil {
+		mux.HandleFunc("/", t.serveUpstream)
+	}
+	t.srv = &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	return nil
+}
+
+// Serve answers token requests until ctx is cancelled.
+func (t *TokenAction) Serve(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = t.srv.Shutdown(shutdownCtx)
+	}()
+
+	log.Printf("Token endpoint %s listening on %s", t.name, t.ln.Addr())
+	var err error
+	if t.cfg.TLSCert != "" {
+		err = t.srv.ServeTLS(t.ln, t.cfg.TLSCert, t.cfg.TLSKey)
+	} else {
+		err = t.srv.Serve(t.ln)
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("Token endpoint %s stopped: %v", t.name, err)
+	}
+}
+
+func (t *TokenAction) OnGranted(ctx context.Context, access Access) error {
+	return t.issue(access, access.nonce)
+}
+
+// OnExtended mints a token covering the new expiry, found with the nonce of
+// the request the session was granted for.
+func (t *TokenAction) OnExtended(ctx context.Context, access Access) error {
+	t.mutex.Lock()
+	nonce := t.tokens[access.Session].nonce
+	t.mutex.Unlock()
+	return t.issue(access, nonce)
+}
+
+// issue mints the token of access's session, handed out to requests naming
+// nonce.
+func (t *TokenAction) issue(access Access, nonce string) error {
+	token, expires, err := t.mint(access, t.clock.Now())
+	if err != nil {
+		return fmt.Errorf("token %s: %w", t.name, err)
+	}
+
+	t.mutex.Lock()
+	t.tokens[access.Session] = issuedToken{ip: access.IP, nonce: nonce, token: token, expires: expires}
+	t.mutex.Unlock()
+
+	log.Printf("[%s] Token %s: issued a token for IP %s until %s",
+		access.Instance, t.name, access.IP, expires.Format(time.RFC3339))
+	return nil
+}
+
+func (t *TokenAction) OnExpired(ctx context.Context, access Access) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	delete(t.tokens, access.Session)
+	return nil
+}
+
+// mint signs the claims for access, expiring with the session or the TTL.
+func (t *TokenAction) mint(access Access, now time.Time) (string, time.Time, error) {
+	expires := access.Expires
+	if ttl := t.cfg.TTL.Duration; ttl > 0 && now.Add(ttl).Before(expires) {
+		expires = now.Add(ttl)
+	}
+
+	subject := access.User
+	if subject == "" {
+		subject = access.IP
+	}
+	claims := TokenClaims{
+		Issuer:    t.cfg.Issuer,
+		Subject:   subject,
+		Audience:  t.cfg.Audience,
+		IssuedAt:  now.Unix(),
+		NotBefore: now.Unix(),
+		Expires:   expires.Unix(),
+		ID:        access.Session,
+		IP:        access.IP,
+		Instance:  access.Instance,
+		Profile:   access.Profile,
+	}
+
+	header := map[string]string{"alg": t.cfg.Algorithm, "typ": "JWT"}
+	if t.key != nil {
+		header["kid"] = t.keyID()
+	}
+	h, err := json.Marshal(header)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	enc := base64.RawURLEncoding
+	signed := enc.EncodeToString(h) + "." + enc.EncodeToString(c)
+	sig, err := t.sign([]byte(signed))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return signed + "." + enc.EncodeToString(sig), expires, nil
+}
+
+func (t *TokenAction) sign(data []byte) ([]byte, error) {
+	if t.key == nil {
+		mac := hmac.New(sha256.New, t.secret)
+		mac.Write(data)
+		return mac.Sum(nil), nil
+	}
+
+	sum := sha256.Sum256(data)
+	r, s, err := ecdsa.Sign(rand.Reader, t.key, sum[:])
+	if err != nil {
+		return nil, err
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return sig, nil
+}
+
+// verify checks the signature and lifetime of token and that it was minted
+// for ip and a session that is still open.
+func (t *TokenAction) verify(token, ip string, now time.Time) (*TokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidToken
+	}
+	enc := base64.RawURLEncoding
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	h, err := enc.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(h, &header) != nil || header.Alg != t.cfg.Algorithm {
+		return nil, errInvalidToken
+	}
+	sig, err := enc.DecodeString(parts[2])
+	if err != nil || !t.validSignature([]byte(parts[0]+"."+parts[1]), sig) {
+		return nil, errInvalidToken
+	}
+
+	var claims TokenClaims
+	c, err := enc.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(c, &claims) != nil {
+		return nil, errInvalidToken
+	}
+	switch {
+	case now.Unix() >= claims.Expires || now.Unix() < claims.NotBefore:
+		return nil, fmt.Errorf("%w: expired", errInvalidToken)
+	case claims.Issuer != t.cfg.Issuer || claims.Audience != t.cfg.Audience:
+		return nil, fmt.Errorf("%w: wrong issuer or audience", errInvalidToken)
+	case claims.IP != ip:
+		return nil, fmt.Errorf("%w: issued to another address", errInvalidToken)
+	}
+
+	t.mutex.Lock()
+	_, open := t.tokens[claims.ID]
+	t.mutex.Unlock()
+	if !open {
+		return nil, fmt.Errorf("%w: session ended", errInvalidToken)
+	}
+	return &claims, nil
+}
+
+func (t *TokenAction) validSignature(data, sig []byte) bool {
+	if t.key == nil {
+		mac := hmac.New(sha256.New, t.secret)
+		mac.Write(data)
+		return hmac.Equal(sig, mac.Sum(nil))
+	}
+
+	if len(sig) != 64 {
+		return false
+	}
+	sum := sha256.Sum256(data)
+	r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+	return ecdsa.Verify(&t.key.PublicKey, sum[:], r, s)
+}
+
+// keyID is the RFC 7638 thumbprint of the public key.
+func (t *TokenAction) keyID() string {
+	jwk := t.jwk()
+	thumb := fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":"%s","y":"%s"}`, jwk["x"], jwk["y"])
+	sum := sha256.Sum256([]byte(thumb))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func (t *TokenAction) jwk() map[string]string {
+	x, y := make([]byte, 32), make([]byte, 32)
+	t.key.X.FillBytes(x)
+	t.key.Y.FillBytes(y)
+	enc := base64.RawURLEncoding
+	return map[string]string{
+		"kty": "EC",
+		"crv": "P-256",
+		"x":   enc.EncodeToString(x),
+		"y":   enc.EncodeToString(y),
+		"use": "sig",
+		"alg": TokenES256,
+	}
+}
+
+// serveToken hands the token of the requesting address's latest session
+// out as an OAuth2 access token response. A session granted for a sealed or
+// signed request is only found with the nonce of that request, so clients
+// sharing a NAT cannot collect each other's tokens.
+func (t *TokenAction) serveToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ip, nonce := requestIP(r), r.FormValue("nonce")
+	now := t.clock.Now()
+
+	var latest issuedToken
+	t.mutex.Lock()
+	for _, it := range t.tokens {
+		if it.ip == ip && it.nonce == nonce && it.expires.After(now) && it.expires.After(latest.expires) {
+			latest = it
+		}
+	}
+	t.mutex.Unlock()
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	if latest.token == "" {
+		w.WriteHeader(http.StatusForbidden)
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"error":             "access_denied",
+			"error_description": "no active session for " + ip,
+		})
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"access_token": latest.token,
+		"token_type":   "Bearer",
+		"expires_in":   int(math.Ceil(latest.expires.Sub(now).Seconds())),
+	})
+}
+
+func (t *TokenAction) serveJWKS(w http.ResponseWriter, r *http.Request) {
+	jwk := t.jwk()
+	jwk["kid"] = t.keyID()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{jwk}})
+}
+
+// serveUpstream proxies requests bearing a valid token, telling the
+// upstream who they come from.
+func (t *TokenAction) serveUpstream(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="`+t.cfg.Issuer+`"`)
+		http.Error(w, "bearer token required", http.StatusUnauthorized)
+		return
+	}
+
+	claims, err := t.verify(strings.TrimSpace(token), requestIP(r), t.clock.Now())
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="`+t.cfg.Issuer+`", error="invalid_token"`)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	r.Header.Del("Authorization")
+	r.Header.Set("X-Knock-Subject", claims.Subject)
+	r.Header.Set("X-Knock-Session", claims.ID)
+	t.upstream.ServeHTTP(w, r)
+}
+
+// requestIP is the address a request came from, as sessions record it.
+func requestIP(r *http.Request) string {
+	ap, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ap.Addr().Unmap().WithZone("").String()
+}
@@ -0,0 +1,181 @@
+package knock
+
+import (
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	defaultTOTPPeriod    = 30 * time.Second
+	defaultTOTPSteps     = 4
+	defaultTOTPPortCount = 100
+	defaultTOTPSkew      = 1
+	defaultTOTPGrace     = 5 * time.Minute
+
+	TOTPModeWindow = "window" // HMAC of the secret and the current period
+	TOTPModeDaily  = "daily"  // HKDF of the secret, the UTC date and the profile
+
+	day = 24 * time.Hour
+)
+
+// TOTPConfig derives the knock sequence from a shared secret and the current
+// time window, so the ports rotate every period. Ports are picked from
+// [PortBase, PortBase+PortCount).
+//
+// Daily mode rotates at UTC midnight instead, keying each day's sequence
+// with HKDF(secret, date, profile) so the profiles sharing a secret knock
+// different ports. The previous or next day's sequence is accepted within
+// Grace of midnight, for clients whose clock is off or who knock across it.
+type TOTPConfig struct {
+	Secret    string   `json:"secret"` // Empty disables rotation
+	Period    Duration `json:"period"`
+	Steps     int      `json:"steps"`
+	PortBase  int      `json:"port_base"`
+	PortCount int      `json:"port_count"`
+	Skew      int      `json:"skew"` // Windows accepted on either side of the current one, negative for none
+
+	Mode    string   `json:"mode,omitempty"`    // "window" (default) or "daily"
+	Grace   Duration `json:"grace,omitzero"`    // Daily mode slack around midnight, 5m when zero
+	Profile string   `json:"profile,omitempty"` // Daily mode client side: the server profile knocked, the default one when empty
+}
+
+func (c TOTPConfig) Enabled() bool {
+	return c.Secret != ""
+}
+
+// Ports lists every port a sequence can use.
+func (c TOTPConfig) Ports() []int {
+	ports := make([]int, c.PortCount)
+	for i := range ports {
+		ports[i] = c.PortBase + i
+	}
+	return ports
+}
+
+func (c TOTPConfig) daily() bool {
+	return c.Mode == TOTPModeDaily
+}
+
+// Window is the index of the TOTP period t falls in, the day since the
+// Unix epoch in daily mode.
+func (c TOTPConfig) Window(t time.Time) int64 {
+	if c.daily() {
+		return t.Unix() / int64(day/time.Second)
+	}
+	return t.UnixNano() / int64(c.Period.Duration)
+}
+
+// Windows returns the windows whose sequences are accepted at t, current
+// first, each with its offset from the current one.
+func (c TOTPConfig) Windows(t time.Time) (windows []int64, offsets []int) {
+	current := c.Window(t)
+	windows, offsets = []int64{current}, []int{0}
+
+	if c.daily() {
+		midnight := time.Unix(current*int64(day/time.Second), 0)
+		switch {
+		case t.Sub(midnight) < c.Grace.Duration:
+			windows, offsets = append(windows, current-1), append(offsets, -1)
+		case midnight.Add(day).Sub(t) <= c.Grace.Duration:
+			windows, offsets = append(windows, current+1), append(offsets, 1)
+		}
+		return windows, offsets
+	}
+
+	for off := 1; off <= c.Skew; off++ {
+		windows = append(windows, current-int64(off), current+int64(off))
+		offsets = append(offsets, -off, off)
+	}
+	return windows, offsets
+}
+
+// dailyKey is HKDF-SHA256 of the secret, salted with the UTC date of window
+// and bound to the profile name.
+func dailyKey(c TOTPConfig, window int64) []byte {
+	date := time.Unix(window*int64(day/time.Second), 0).UTC().Format(time.DateOnly)
+	key, err := hkdf.Key(sha256.New, []byte(c.Secret), []byte(date), profileName(c.Profile), sha256.Size)
+	if err != nil {
+		panic(err) // Only for lengths beyond 255 hashes
+	}
+	return key
+}
+
+// TOTPSequence derives the distinct ports knocked once each during window.
+func TOTPSequence(c TOTPConfig, window int64) []KnockStep {
+	used := make(map[int]bool, c.Steps)
+	sequence := make([]KnockStep, 0, c.Steps)
+
+	key := []byte(c.Secret)
+	if c.daily() {
+		key = dailyKey(c, window)
+	}
+
+	var msg [12]byte
+	binary.BigEndian.PutUint64(msg[:8], uint64(window))
+
+	for block := uint32(0); len(sequence) < c.Steps; block++ {
+		binary.BigEndian.PutUint32(msg[8:], block)
+		mac := hmac.New(sha256.New, key)
+		mac.Write(msg[:])
+		sum := mac.Sum(nil)
+
+		for i := 0; i+2 <= len(sum) && len(sequence) < c.Steps; i += 2 {
+			port := c.PortBase + int(binary.BigEndian.Uint16(sum[i:]))%c.PortCount
+			if used[port] {
+				continue
+			}
+			used[port] = true
+			sequence = append(sequence, KnockStep{Port: port, Count: 1})
+		}
+	}
+	return sequence
+}
+
+// knockSequence is one sequence a client may be following. Skew is the
+// offset in windows from the server clock, always 0 for static sequences.
+type knockSequence struct {
+	steps   []KnockStep
+	skew    int
+	profile *profile
+}
+
+// NormalizeTOTP applies defaults and checks the port range fits the sequence.
+func NormalizeTOTP(c *TOTPConfig) error {
+	if c.Period.Duration == 0 {
+		c.Period = Duration{defaultTOTPPeriod}
+	}
+	if c.Steps == 0 {
+		c.Steps = defaultTOTPSteps
+	}
+	if c.PortCount == 0 {
+		c.PortCount = defaultTOTPPortCount
+	}
+	if c.Skew == 0 {
+		c.Skew = defaultTOTPSkew
+	}
+	if c.Mode == "" {
+		c.Mode = TOTPModeWindow
+	}
+	if c.daily() && c.Grace.Duration == 0 {
+		c.Grace = Duration{defaultTOTPGrace}
+	}
+
+	switch {
+	case c.Mode != TOTPModeWindow && c.Mode != TOTPModeDaily:
+		return fmt.Errorf("invalid totp mode %q", c.Mode)
+	case c.Grace.Duration < 0 || c.Grace.Duration >= day/2:
+		return fmt.Errorf("totp grace %s must be under 12h", c.Grace.Duration)
+	case c.Period.Duration < time.Second:
+		return errors.New("totp period must be at least 1s")
+	case c.PortBase < 1 || c.PortBase+c.PortCount-1 > 65535:
+		return fmt.Errorf("totp port range %d+%d is outside 1-65535", c.PortBase, c.PortCount)
+	case c.Steps < 2 || c.Steps > c.PortCount:
+		return fmt.Errorf("totp needs between 2 and port_count steps, got %d", c.Steps)
+	}
+	return nil
+}
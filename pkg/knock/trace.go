@@ -0,0 +1,306 @@
+package knock
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTraceService  = "port-knocking"
+	traceExportInterval  = 5 * time.Second
+	traceExportTimeout   = 10 * time.Second
+	maxPendingSpans      = 4096 // Spans held between exports, newer ones are dropped past it
+	traceScope           = "port-knocking/pkg/knock"
+	otlpSpanKindInternal = 1
+	otlpSpanKindServer   = 2
+	otlpStatusError      = 2
+)
+
+// TracingConfig exports spans of the knock pipeline, from the packet seen to
+// the state transition and the actions run, to an OpenTelemetry collector
+// over OTLP/HTTP, so slow firewall actions or lock contention show in
+// traces. Client addresses are masked as the privacy settings ask.
+type TracingConfig struct {
+	Endpoint    string            `json:"endpoint"`     // Collector base URL, like http://localhost:4318; disabled when empty
+	Headers     map[string]string `json:"headers"`      // Sent with every export, for collector authentication
+	ServiceName string            `json:"service_name"` // service.name of the spans, "port-knocking" by default
+	SampleRatio float64           `json:"sample_ratio"` // Share of knocks traced, from 0 to 1; all when zero
+}
+
+func (c TracingConfig) Enabled() bool {
+	return c.Endpoint != ""
+}
+
+// Tracer batches ended spans and exports them every few seconds. A nil
+// Tracer, like the spans it hands out when a knock is not sampled, records
+// nothing.
+type Tracer struct {
+	cfg     TracingConfig
+	url     string
+	client  *http.Client
+	privacy PrivacyConfig
+	pending []*span
+	dropped int
+	mutex   sync.Mutex
+}
+
+func NewTracer(cfg TracingConfig) (*Tracer, error) {
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("tracing: invalid endpoint %q, use an http or https URL", cfg.Endpoint)
+	}
+	if cfg.SampleRatio < 0 || cfg.SampleRatio > 1 {
+		return nil, fmt.Errorf("tracing: invalid sample_ratio %v, use 0 to 1", cfg.SampleRatio)
+	}
+	if cfg.ServiceName == "" {
+		cfg.ServiceName = defaultTraceService
+	}
+	u.Path = u.JoinPath("v1", "traces").Path
+
+	return &Tracer{cfg: cfg, url: u.String(), client: &http.Client{Timeout: traceExportTimeout}}, nil
+}
+
+// span is one timed step of a trace. Its methods do nothing on a nil span.
+type span struct {
+	tracer  *Tracer
+	traceID [16]byte
+	id      [8]byte
+	parent  [8]byte // Zero for a root span
+	name    string
+	kind    int
+	start   time.Time
+	end     time.Time
+	attrs   []otlpAttribute
+	err     string // Status message, set when the step failed
+}
+
+// start begins a span under parent, or a new trace subject to sampling
+// when parent is nil.
+func (t *Tracer) start(name string, parent *span) *span {
+	if t == nil {
+		return nil
+	}
+
+	sp := &span{tracer: t, name: name, kind: otlpSpanKindInternal, start: time.Now()}
+	if parent != nil {
+		sp.traceID, sp.parent = parent.traceID, parent.id
+	} else {
+		_, _ = rand.Read(sp.traceID[:])
+		// Sampled on the trace ID, as OpenTelemetry's ratio sampler does
+		if r := t.cfg.SampleRatio; r > 0 && binary.BigEndian.Uint64(sp.traceID[8:])>>1 >= uint64(r*(1<<63)) {
+			return nil
+		}
+		sp.kind = otlpSpanKindServer
+	}
+	_, _ = rand.Read(sp.id[:])
+	return sp
+}
+
+func (sp *span) set(key string, value any) {
+	if sp == nil {
+		return
+	}
+	attr := otlpAttribute{Key: key}
+	switch v := value.(type) {
+	case string:
+		attr.Value.String = &v
+	case int:
+		s := strconv.Itoa(v)
+		attr.Value.Int = &s
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		attr.Value.Int = &s
+	case bool:
+		attr.Value.Bool = &v
+	default:
+		s := fmt.Sprint(v)
+		attr.Value.String = &s
+	}
+
+	for i := range sp.attrs {
+		if sp.attrs[i].Key == key {
+			sp.attrs[i] = attr
+			return
+		}
+	}
+	sp.attrs = append(sp.attrs, attr)
+}
+
+// setClient records the client address, masked as the privacy settings ask.
+func (sp *span) setClient(ip string) {
+	if sp == nil {
+		return
+	}
+	sp.set("client.address", sp.tracer.privacy.MaskIP(ip))
+}
+
+// fail marks the span as failed with err, unless err is nil.
+func (sp *span) fail(err error) {
+	if sp == nil || err == nil {
+		return
+	}
+	sp.err = err.Error()
+}
+
+// finish ends the span and queues it for export.
+func (sp *span) finish() {
+	if sp == nil {
+		return
+	}
+	sp.end = time.Now()
+
+	t := sp.tracer
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if len(t.pending) >= maxPendingSpans {
+		t.dropped++
+		return
+	}
+	t.pending = append(t.pending, sp)
+}
+
+// Run exports the ended spans every few seconds until stop is closed, then
+// exports the last ones.
+func (t *Tracer) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(traceExportInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			if err := t.Flush(); err != nil {
+				log.Printf("Failed to export traces: %v", err)
+			}
+			return
+		}
+		if err := t.Flush(); err != nil {
+			log.Printf("Failed to export traces: %v", err)
+		}
+	}
+}
+
+// Flush exports the spans ended since the last export. They are dropped
+// when the collector cannot be reached.
+func (t *Tracer) Flush() error {
+	t.mutex.Lock()
+	spans, dropped := t.pending, t.dropped
+	t.pending, t.dropped = nil, 0
+	t.mutex.Unlock()
+
+	if dropped > 0 {
+		log.Printf("Dropped %d span(s) past the export buffer", dropped)
+	}
+	if len(spans) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(t.request(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, t.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+// The OTLP/HTTP JSON encoding of an export request, reduced to what the
+// spans use. IDs are hex and 64 bit integers strings, as the encoding asks.
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID      string          `json:"traceId"`
+		SpanID       string          `json:"spanId"`
+		ParentSpanID string          `json:"parentSpanId,omitempty"`
+		Name         string          `json:"name"`
+		Kind         int             `json:"kind"`
+		Start        string          `json:"startTimeUnixNano"`
+		End          string          `json:"endTimeUnixNano"`
+		Attributes   []otlpAttribute `json:"attributes,omitempty"`
+		Status       *otlpStatus     `json:"status,omitempty"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+	otlpAttribute struct {
+		Key   string `json:"key"`
+		Value struct {
+			String *string `json:"stringValue,omitempty"`
+			Int    *string `json:"intValue,omitempty"`
+			Bool   *bool   `json:"boolValue,omitempty"`
+		} `json:"value"`
+	}
+)
+
+func (t *Tracer) request(spans []*span) otlpRequest {
+	service := otlpAttribute{Key: "service.name"}
+	service.Value.String = &t.cfg.ServiceName
+
+	out := make([]otlpSpan, len(spans))
+	for i, sp := range spans {
+		out[i] = otlpSpan{
+			TraceID:    hex.EncodeToString(sp.traceID[:]),
+			SpanID:     hex.EncodeToString(sp.id[:]),
+			Name:       sp.name,
+			Kind:       sp.kind,
+			Start:      strconv.FormatInt(sp.start.UnixNano(), 10),
+			End:        strconv.FormatInt(sp.end.UnixNano(), 10),
+			Attributes: sp.attrs,
+		}
+		if sp.parent != [8]byte{} {
+			out[i].ParentSpanID = hex.EncodeToString(sp.parent[:])
+		}
+		if sp.err != "" {
+			out[i].Status = &otlpStatus{Code: otlpStatusError, Message: sp.err}
+		}
+	}
+
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: []otlpAttribute{service}},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: traceScope}, Spans: out}},
+	}}}
+}
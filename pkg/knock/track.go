@@ -0,0 +1,274 @@
+package knock
+
+import (
+	"slices"
+	"strings"
+	"time"
+)
+
+// ClientState is the progress of one source through every sequence it may
+// knock; each sequence advances independently.
+type ClientState struct {
+	LastKnock time.Time
+	Tracks    []*KnockTrack
+}
+
+// stale reports whether no track can still be completed, so the client
+// starts over with fresh candidate sequences.
+func (c *ClientState) stale(now time.Time) bool {
+	for _, t := range c.Tracks {
+		if len(t.pending) > 0 || ((t.StepIndex > 0 || t.HitCount > 0) && !t.stale(now)) {
+			return false
+		}
+	}
+	return true
+}
+
+// KnockTrack is the progress through one candidate sequence.
+type KnockTrack struct {
+	StepIndex int
+	HitCount  int
+	Started   time.Time // First knock of the sequence
+	LastHit   time.Time
+
+	sequence knockSequence
+	extra    int           // Knocks the previous step absorbed past its count
+	timeout  time.Duration // Longest gap between knocks, unless the step sets its own
+	deadline time.Duration // Longest time to knock the whole sequence, zero for none
+	// Knocks that arrived before their step, waiting for the ones due first
+	pending []earlyKnock
+}
+
+type earlyKnock struct {
+	port int
+	sni  string
+	at   time.Time
+}
+
+// knockHit is one knock counted by a track.
+type knockHit struct {
+	step  KnockStep
+	index int
+	hit   int
+}
+
+// advance counts a knock on port, carrying the TLS server name sni, at now,
+// returning the hits it counted, or
+// false if the knock is not on the track. A knock off the track, outside the
+// step's delay bounds or past the deadline restarts it, counting the knock if
+// it begins the sequence.
+//
+// With a reorder window, a knock belonging to a later step is held instead
+// and counted once the steps before it are done, as long as that happens
+// within the window. Held knocks skip the delay bounds.
+func (t *KnockTrack) advance(port int, sni string, now time.Time, reorder time.Duration) ([]knockHit, bool) {
+	if t.stale(now) || slices.ContainsFunc(t.pending, func(k earlyKnock) bool { return now.Sub(k.at) > reorder }) {
+		t.reset()
+	}
+
+	if t.absorbs(port, sni) {
+		t.extra++
+		prev := t.sequence.steps[t.StepIndex-1]
+		return []knockHit{{step: prev, index: t.StepIndex - 1, hit: prev.Count + t.extra}}, true
+	}
+
+	if !t.sequence.steps[t.StepIndex].matches(port, sni) || !t.onTime(now) {
+		if reorder > 0 && t.upcoming(port, sni) && len(t.pending) < len(t.sequence.steps) {
+			t.pending = append(t.pending, earlyKnock{port: port, sni: sni, at: now})
+			return nil, true
+		}
+
+		t.reset()
+		if !t.sequence.steps[0].matches(port, sni) {
+			return nil, false
+		}
+	}
+
+	hits := []knockHit{t.count(now)}
+	for !t.complete() {
+		i := slices.IndexFunc(t.pending, func(k earlyKnock) bool { return t.sequence.steps[t.StepIndex].matches(k.port, k.sni) })
+		if i < 0 {
+			break
+		}
+		t.pending = slices.Delete(t.pending, i, i+1)
+		hits = append(hits, t.count(now))
+	}
+	return hits, true
+}
+
+// count records a knock on the current step.
+func (t *KnockTrack) count(now time.Time) knockHit {
+	h := knockHit{step: t.sequence.steps[t.StepIndex], index: t.StepIndex}
+	if t.StepIndex == 0 && t.HitCount == 0 {
+		t.Started = now
+	}
+	t.HitCount++
+	t.LastHit = now
+	h.hit = t.HitCount
+
+	if t.HitCount == h.step.Count {
+		t.StepIndex++
+		t.HitCount = 0
+		t.extra = 0
+	}
+	return h
+}
+
+// absorbs reports whether a knock on port carrying sni is a surplus knock of
+// the step just completed, which its tolerance lets through while the next
+// step has not started. Knocks past the last step arrive once the sequence
+// is done and are not absorbed.
+func (t *KnockTrack) absorbs(port int, sni string) bool {
+	if t.StepIndex == 0 || t.HitCount > 0 || len(t.pending) > 0 || t.sequence.steps[t.StepIndex].matches(port, sni) {
+		return false
+	}
+	prev := t.sequence.steps[t.StepIndex-1]
+	return prev.matches(port, sni) && prev.accepts(prev.Count+t.extra+1)
+}
+
+// upcoming reports whether port and sni are knocked in a step after the
+// current one.
+func (t *KnockTrack) upcoming(port int, sni string) bool {
+	return slices.ContainsFunc(t.sequence.steps[t.StepIndex+1:], func(s KnockStep) bool { return s.matches(port, sni) })
+}
+
+// matches reports whether a knock on port carrying sni is one of the step's.
+func (s KnockStep) matches(port int, sni string) bool {
+	return s.Port == port && strings.EqualFold(s.SNI, sni)
+}
+
+func (t *KnockTrack) reset() {
+	t.StepIndex, t.HitCount = 0, 0
+	t.extra = 0
+	t.Started = time.Time{}
+	t.pending = nil
+}
+
+// stale reports whether the track waited too long for its next knock, or
+// for the whole sequence, to still be completed.
+func (t *KnockTrack) stale(now time.Time) bool {
+	if t.StepIndex == 0 && t.HitCount == 0 {
+		return false
+	}
+	if t.deadline > 0 && now.Sub(t.Started) > t.deadline {
+		return true
+	}
+
+	limit := t.timeout
+	if step := t.sequence.steps[t.StepIndex]; t.HitCount == 0 && step.MaxDelay.Duration > 0 {
+		limit = step.MaxDelay.Duration
+	}
+	return now.Sub(t.LastHit) > limit
+}
+
+// onTime reports whether a knock at now respects the minimum delay of the
+// step it would begin. Repeated knocks within a step are not bounded.
+func (t *KnockTrack) onTime(now time.Time) bool {
+	if t.StepIndex == 0 || t.HitCount > 0 {
+		return true
+	}
+
+	step := t.sequence.steps[t.StepIndex]
+	return step.MinDelay.Duration == 0 || now.Sub(t.LastHit) >= step.MinDelay.Duration
+}
+
+func (t *KnockTrack) complete() bool {
+	return t.StepIndex == len(t.sequence.steps)
+}
+
+// newClientState starts tracking every sequence ip may knock at now.
+func (s *Server) newClientState(ip string, now time.Time) *ClientState {
+	state := &ClientState{}
+	for _, seq := range s.candidateSequences(ip, now) {
+		state.Tracks = append(state.Tracks, &KnockTrack{
+			sequence: seq,
+			timeout:  s.cfg.Timeout.Duration,
+			deadline: s.cfg.SequenceTimeout.Duration,
+		})
+	}
+	return state
+}
+
+// progress returns the position on every track that can still be completed.
+func (c *ClientState) progress(now time.Time) []TrackProgress {
+	var tracks []TrackProgress
+	for _, t := range c.Tracks {
+		if (t.StepIndex > 0 || t.HitCount > 0) && !t.stale(now) {
+			tracks = append(tracks, TrackProgress{
+				Sequence:  sequenceKey(t.sequence),
+				Profile:   t.sequence.profile.name,
+				Steps:     len(t.sequence.steps),
+				StepIndex: t.StepIndex,
+				HitCount:  t.HitCount,
+				Started:   t.Started,
+				LastHit:   t.LastHit,
+			})
+		}
+	}
+	return tracks
+}
+
+// lifetime is the longest the state may wait for its next knock.
+func (c *ClientState) lifetime() time.Duration {
+	var d time.Duration
+	for _, t := range c.Tracks {
+		d = max(d, t.timeout, t.deadline)
+		for _, step := range t.sequence.steps {
+			d = max(d, step.MaxDelay.Duration)
+		}
+	}
+	return d
+}
+
+// progress returns the sequences in progress that can still be completed.
+func (s *Server) progress(now time.Time) []ClientProgress {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var progress []ClientProgress
+	for e := s.clients.order.Back(); e != nil; e = e.Prev() {
+		entry := e.Value.(*clientEntry)
+		if !entry.state.stale(now) {
+			progress = append(progress, ClientProgress{Instance: s.Name(), IP: entry.ip, Tracks: entry.state.progress(now)})
+		}
+	}
+	return progress
+}
+
+// resumeState rebuilds the state of a client from saved progress, keeping
+// the sequences it may still knock. Progress on a sequence that rotated away
+// since is dropped, and nil is returned when nothing can be completed.
+func (s *Server) resumeState(cp ClientProgress, now time.Time) *ClientState {
+	state := s.newClientState(cp.IP, now)
+	for _, t := range state.Tracks {
+		key := sequenceKey(t.sequence)
+		for _, tp := range cp.Tracks {
+			if tp.Sequence != key || tp.StepIndex >= len(t.sequence.steps) || tp.HitCount > t.sequence.steps[tp.StepIndex].Count {
+				continue
+			}
+			t.StepIndex, t.HitCount = tp.StepIndex, tp.HitCount
+			t.Started, t.LastHit = tp.Started, tp.LastHit
+			if tp.LastHit.After(state.LastKnock) {
+				state.LastKnock = tp.LastHit
+			}
+		}
+	}
+
+	if state.stale(now) {
+		return nil
+	}
+	return state
+}
+
+// restoreProgress resumes saved progress, reporting whether any was kept.
+func (s *Server) restoreProgress(cp ClientProgress, now time.Time) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	state := s.resumeState(cp, now)
+	if state == nil {
+		return false
+	}
+	s.clients.put(cp.IP, state, now)
+	return true
+}
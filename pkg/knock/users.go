@@ -0,0 +1,383 @@
+package knock
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+)
+
+var (
+	ErrUnknownUser   = errors.New("unknown user")
+	ErrInvalidUser   = errors.New("invalid user")
+	ErrUsersDisabled = errors.New("user management is not configured (users_file is empty)")
+)
+
+// User is a person or system allowed to knock. Grants from a source matching
+// one of the user's networks on an allowed instance are attributed to them,
+// as are request payloads and SPA packets sealed with one of their keys,
+// from any source when they list none.
+type User struct {
+	Name        string   `json:"name"`
+	Keys        []string `json:"keys,omitempty"`      // Payload and SPA keys of the user, each held by no other
+	HMACKey     string   `json:"hmac_key,omitempty"`  // HMAC key of their SPA packets, the instance one when empty
+	SSHKeys     []string `json:"ssh_keys,omitempty"`  // Public keys for ephemeral SSH access
+	Sources     []string `json:"sources"`             // CIDRs or IPs the user knocks from
+	Instances   []string `json:"instances,omitempty"` // Allowed sequences, empty for all
+	Profiles    []string `json:"profiles,omitempty"`  // Allowed profiles, "default" for the default one, empty for all
+	MaxSessions int      `json:"max_sessions,omitempty"`
+	NotifyAddr  string   `json:"notify_addr,omitempty"` // host:port receiving expiry notices
+	Disabled    bool     `json:"disabled,omitempty"`
+
+	// Second factor material, see SecondFactorConfig
+	Email      string `json:"email,omitempty"`       // Receives emailed confirmation codes
+	TOTPSecret string `json:"totp_secret,omitempty"` // Base32 authenticator app secret
+}
+
+func (u *User) validate() error {
+	if u.Name == "" {
+		return fmt.Errorf("%w: missing name", ErrInvalidUser)
+	}
+	for _, src := range u.Sources {
+		if _, err := parsePrefix(src); err != nil {
+			return fmt.Errorf("%w: source %q: %v", ErrInvalidUser, src, err)
+		}
+	}
+	if slices.Contains(u.Keys, "") {
+		return fmt.Errorf("%w: empty key", ErrInvalidUser)
+	}
+	for _, key := range u.SSHKeys {
+		if err := checkSSHKey(key); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidUser, err)
+		}
+	}
+	if u.TOTPSecret != "" {
+		if _, err := decodeTOTPSecret(u.TOTPSecret); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidUser, err)
+		}
+	}
+	return nil
+}
+
+func (u *User) matches(instance string, ip netip.Addr) bool {
+	if len(u.Instances) > 0 && !slices.Contains(u.Instances, instance) {
+		return false
+	}
+	return u.knocksFrom(ip)
+}
+
+func (u *User) knocksFrom(ip netip.Addr) bool {
+	for _, src := range u.Sources {
+		if p, err := parsePrefix(src); err == nil && p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsProfile reports whether the user may use the named profile,
+// "default" naming the default one.
+func (u *User) AllowsProfile(name string) bool {
+	return len(u.Profiles) == 0 || slices.Contains(u.Profiles, profileName(name))
+}
+
+// UserStore keeps users in memory and persists every change to a JSON file.
+type UserStore struct {
+	path  string
+	users map[string]*User
+	mutex sync.RWMutex
+}
+
+// LoadUsers reads the users file, starting empty when it does not exist yet.
+func LoadUsers(path string) (*UserStore, error) {
+	s := &UserStore{path: path, users: make(map[string]*User)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading users: %w", err)
+	}
+
+	var users []*User
+	if err := json.Unmarshal(data, &users); err != nil {
+		return nil, fmt.Errorf("parsing users %s: %w", path, err)
+	}
+	for _, u := range users {
+		if err := u.validate(); err != nil {
+			return nil, err
+		}
+		if err := s.checkKeysLocked(*u); err != nil {
+			return nil, err
+		}
+		s.users[u.Name] = u
+	}
+	return s, nil
+}
+
+func (s *UserStore) List() []User {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	list := make([]User, 0, len(s.users))
+	for _, u := range s.users {
+		list = append(list, *u)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func (s *UserStore) Get(name string) (User, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	u, ok := s.users[name]
+	if !ok {
+		return User{}, fmt.Errorf("%w: %s", ErrUnknownUser, name)
+	}
+	return *u, nil
+}
+
+// Put creates or replaces a user.
+func (s *UserStore) Put(u User) error {
+	if err := u.validate(); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.putLocked(u)
+}
+
+// Enroll creates the user, or gives an existing one, access to instance from
+// sources. Users allowed every instance are left so.
+func (s *UserStore) Enroll(name, instance string, sources []string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	u := User{Name: name, Instances: []string{instance}}
+	if prev, ok := s.users[name]; ok {
+		u = *prev
+		if len(u.Instances) > 0 && !slices.Contains(u.Instances, instance) {
+			u.Instances = append(slices.Clip(u.Instances), instance)
+		}
+	}
+	for _, src := range sources {
+		if !slices.Contains(u.Sources, src) {
+			u.Sources = append(slices.Clip(u.Sources), src)
+		}
+	}
+
+	if err := u.validate(); err != nil {
+		return err
+	}
+	return s.putLocked(u)
+}
+
+// EnsureKey returns the first key of the user, giving them a new one when
+// they hold none.
+func (s *UserStore) EnsureKey(name string) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	prev, ok := s.users[name]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnknownUser, name)
+	}
+	if len(prev.Keys) > 0 {
+		return prev.Keys[0], nil
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	u := *prev
+	u.Keys = []string{hex.EncodeToString(b)}
+	if err := s.putLocked(u); err != nil {
+		return "", err
+	}
+	return u.Keys[0], nil
+}
+
+// checkKeysLocked fails when another user holds one of the keys of u, which
+// would leave packets sealed with it attributed to either.
+func (s *UserStore) checkKeysLocked(u User) error {
+	for _, other := range s.users {
+		if other.Name == u.Name {
+			continue
+		}
+		for _, key := range u.Keys {
+			if slices.Contains(other.Keys, key) {
+				return fmt.Errorf("%w: user %s holds the same key", ErrInvalidUser, other.Name)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *UserStore) putLocked(u User) error {
+	if err := s.checkKeysLocked(u); err != nil {
+		return err
+	}
+	prev, existed := s.users[u.Name]
+	s.users[u.Name] = &u
+	if err := s.saveLocked(); err != nil {
+		if existed {
+			s.users[u.Name] = prev
+		} else {
+			delete(s.users, u.Name)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *UserStore) Delete(name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	prev, ok := s.users[name]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownUser, name)
+	}
+
+	delete(s.users, name)
+	if err := s.saveLocked(); err != nil {
+		s.users[name] = prev
+		return err
+	}
+	return nil
+}
+
+// Identify returns the first enabled user allowed to knock on instance from ip.
+func (s *UserStore) Identify(instance, ip string) (*User, bool) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil, false
+	}
+	addr = addr.Unmap()
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	names := make([]string, 0, len(s.users))
+	for name := range s.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		u := s.users[name]
+		if !u.Disabled && u.matches(instance, addr) {
+			c := *u
+			return &c, true
+		}
+	}
+	return nil, false
+}
+
+// Keyed returns, by name, the enabled users holding keys who may knock on
+// instance from ip, which a packet sealed with one of their keys identifies.
+func (s *UserStore) Keyed(instance, ip string) []User {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil
+	}
+	addr = addr.Unmap()
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var users []User
+	for _, u := range s.users {
+		if u.Disabled || len(u.Keys) == 0 {
+			continue
+		}
+		if len(u.Instances) > 0 && !slices.Contains(u.Instances, instance) {
+			continue
+		}
+		if len(u.Sources) > 0 && !u.knocksFrom(addr) {
+			continue
+		}
+		users = append(users, *u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	return users
+}
+
+func (s *UserStore) saveLocked() error {
+	users := make([]*User, 0, len(s.users))
+	for _, u := range s.users {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+
+	data, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write then rename so a crash never leaves a truncated file
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// parsePrefix accepts both "10.0.0.0/8" and a bare address.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if p, err := netip.ParsePrefix(s); err == nil {
+		return p.Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// accessUser returns the user a grant is attributed to: the one whose key
+// sealed the request, or else the first whose sources match. It is nil when
+// none does.
+func (s *Server) accessUser(access Access) (*User, error) {
+	if access.User == "" {
+		u, _ := s.users.Identify(s.Name(), access.IP)
+		return u, nil
+	}
+	u, err := s.users.Get(access.User)
+	if err != nil {
+		return nil, err
+	}
+	if u.Disabled {
+		return nil, fmt.Errorf("user %s is disabled", u.Name)
+	}
+	return &u, nil
+}
+
+// keyedUser returns the first user Keyed names for ip with a key open
+// succeeds with, or nil when none has one.
+func (s *Server) keyedUser(ip string, open func(u *User, key string) error) *User {
+	if s.users == nil {
+		return nil
+	}
+	users := s.users.Keyed(s.Name(), ip)
+	for i := range users {
+		for _, key := range users[i].Keys {
+			if open(&users[i], key) == nil {
+				return &users[i]
+			}
+		}
+	}
+	return nil
+}
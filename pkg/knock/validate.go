@@ -0,0 +1,140 @@
+package knock
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ErrConfigValidationFailed is returned by LoadConfig, with the details, when
+// a knock sequence is ambiguous, too easy to guess or cannot be completed in
+// time.
+var ErrConfigValidationFailed = errors.New("config validation failed")
+
+// minSequencePorts is how many distinct ports a sequence needs, about 32 bits
+// a scanner must guess, unless a payload, challenge or server name adds a
+// secret of its own.
+const minSequencePorts = 2
+
+// wellKnownPorts are unprivileged ports scanners probe for common services.
+var wellKnownPorts = map[int]string{
+	1433:  "SQL Server",
+	1521:  "Oracle",
+	2049:  "NFS",
+	3306:  "MySQL",
+	3389:  "RDP",
+	5432:  "PostgreSQL",
+	5900:  "VNC",
+	6379:  "Redis",
+	8080:  "HTTP",
+	8443:  "HTTPS",
+	9200:  "Elasticsearch",
+	27017: "MongoDB",
+}
+
+// validateSequences checks the sequences of every instance, reporting all
+// problems at once.
+func validateSequences(cfg *Config) error {
+	var details []string
+	for _, inst := range cfg.Instances {
+		details = append(details, instanceSequenceProblems(inst)...)
+	}
+	return validationError(details)
+}
+
+func instanceSequenceProblems(inst InstanceConfig) []string {
+	var details []string
+	eachSequence(inst, func(where string, steps []KnockStep) {
+		for _, problem := range sequenceProblems(inst, steps) {
+			details = append(details, where+": "+problem)
+		}
+	})
+	return details
+}
+
+func validationError(details []string) error {
+	if len(details) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w:\n  - %s", ErrConfigValidationFailed, strings.Join(details, "\n  - "))
+}
+
+// SequenceWarnings lists what weakens the sequences of inst without making
+// them unusable, such as knocks on ports scanners probe first.
+func SequenceWarnings(inst InstanceConfig) []string {
+	// Source ports are picked by the client, not probed by scanners
+	if inst.Encoding == EncodingSource {
+		return nil
+	}
+
+	var warnings []string
+	eachSequence(inst, func(where string, steps []KnockStep) {
+		for i, step := range steps {
+			switch service, known := wellKnownPorts[step.Port]; {
+			case step.Port > 0 && step.Port < 1024:
+				warnings = append(warnings, fmt.Sprintf("%s: step %d knocks privileged port %d, which scanners probe first", where, i+1, step.Port))
+			case known:
+				warnings = append(warnings, fmt.Sprintf("%s: step %d knocks port %d, commonly used by %s", where, i+1, step.Port, service))
+			}
+		}
+	})
+	return warnings
+}
+
+// WellKnownPort reports whether port is one of the unprivileged ports
+// scanners probe for common services.
+func WellKnownPort(port int) bool {
+	_, ok := wellKnownPorts[port]
+	return ok
+}
+
+// eachSequence calls f with every fixed sequence of inst, the default one
+// first. TOTP sequences are generated valid and skipped.
+func eachSequence(inst InstanceConfig, f func(where string, steps []KnockStep)) {
+	where := "instance " + inst.Name
+	if !inst.TOTP.Enabled() && len(inst.Sequence) > 0 {
+		f(where, inst.Sequence)
+	}
+	for _, name := range slices.Sorted(maps.Keys(inst.Profiles)) {
+		p := inst.Profiles[name]
+		if !p.TOTP.Enabled() && len(p.Sequence) > 0 {
+			f(where+" profile "+name, p.Sequence)
+		}
+	}
+}
+
+func sequenceProblems(inst InstanceConfig, steps []KnockStep) []string {
+	var problems []string
+
+	// The knocks of two such steps run together, so where one ends is a guess
+	for i := 1; i < len(steps); i++ {
+		prev, step := steps[i-1], steps[i]
+		if step.Port == prev.Port && step.SNI == prev.SNI && step.MinDelay.Duration == 0 {
+			problems = append(problems, fmt.Sprintf(
+				"steps %d and %d both knock port %d: merge them into one step with a count of %d, or set a min_delay on step %d",
+				i, i+1, step.Port, prev.Count+step.Count, i+1))
+		}
+	}
+
+	secret := inst.Payload.Enabled() || inst.Challenge.Enabled() || slices.ContainsFunc(steps, func(step KnockStep) bool {
+		return step.SNI != ""
+	})
+	if ports := len(knockPorts(steps)); !secret && ports < minSequencePorts {
+		problems = append(problems, fmt.Sprintf(
+			"only %d distinct port(s), easily found by a port scan: knock at least %d different ports, or add a payload or challenge",
+			ports, minSequencePorts))
+	}
+
+	var least time.Duration
+	for _, step := range steps {
+		least += step.MinDelay.Duration
+	}
+	if deadline := inst.SequenceTimeout.Duration; deadline > 0 && least > deadline {
+		problems = append(problems, fmt.Sprintf(
+			"the min_delays add up to %s, so the sequence never completes within the %s sequence_timeout", least, deadline))
+	}
+	return problems
+}
@@ -0,0 +1,209 @@
+package knock
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultWebhookTimeout = 5 * time.Second
+	defaultWebhookRetries = 3
+	webhookRetryDelay     = time.Second // Doubled after every failed attempt
+)
+
+const (
+	EventGrant  = "grant"
+	EventDeny   = "deny"
+	EventFail   = "fail"
+	EventBan    = "ban"
+	EventExpire = "expire"
+)
+
+var (
+	allEvents     = []string{EventGrant, EventDeny, EventFail, EventBan, EventExpire}
+	defaultEvents = []string{EventGrant, EventDeny, EventBan}
+)
+
+// WebhookConfig is a named action POSTing knock events as JSON, wrapped in
+// the same Response envelope as the admin API.
+type WebhookConfig struct {
+	URL     string            `json:"url"`
+	Secret  string            `json:"secret"`  // Signs every body, unsigned when empty
+	Events  []string          `json:"events"`  // "grant", "deny", "fail", "ban", "expire"; grant, deny and ban when empty
+	Retries int               `json:"retries"` // Attempts after the first failed one, 3 when zero
+	Timeout Duration          `json:"timeout"` // Per attempt, 5s when zero
+	Headers map[string]string `json:"headers"` // Extra request headers, e.g. Authorization
+}
+
+// WebhookEvent is the Data of a delivered envelope.
+type WebhookEvent struct {
+	Event  string    `json:"event"`
+	Access Access    `json:"access"`
+	Reason string    `json:"reason,omitempty"` // Why access was denied or the attempt failed
+	Until  time.Time `json:"until,omitzero"`   // End of a ban
+}
+
+// WebhookAction delivers events in the background so a slow receiver never
+// holds up the other actions. A delivery is retried on network errors and
+// 5xx or 429 responses with growing delays.
+type WebhookAction struct {
+	name    string
+	cfg     WebhookConfig
+	events  []string
+	timeout time.Duration
+	retries int
+	client  *http.Client
+	privacy PrivacyConfig // Masks the addresses delivered
+	// Builds the body for an event, the Response envelope for plain webhooks
+	encode func(WebhookEvent) ([]byte, error)
+}
+
+func NewWebhookAction(name string, cfg WebhookConfig) (*WebhookAction, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("webhook %s: invalid url %q", name, cfg.URL)
+	}
+
+	events := cfg.Events
+	if len(events) == 0 {
+		events = defaultEvents
+	}
+	for _, e := range events {
+		if !slices.Contains(allEvents, e) {
+			return nil, fmt.Errorf("webhook %s: unknown event %q", name, e)
+		}
+	}
+
+	w := &WebhookAction{name: name, cfg: cfg, events: events, timeout: cfg.Timeout.Duration, retries: cfg.Retries}
+	if w.timeout == 0 {
+		w.timeout = defaultWebhookTimeout
+	}
+	if w.retries == 0 {
+		w.retries = defaultWebhookRetries
+	}
+	w.client = &http.Client{Timeout: w.timeout}
+	w.encode = func(event WebhookEvent) ([]byte, error) {
+		return json.Marshal(Response{Success: true, Data: event})
+	}
+	return w, nil
+}
+
+func (w *WebhookAction) Name() string {
+	return w.name
+}
+
+func (w *WebhookAction) OnGranted(ctx context.Context, access Access) error {
+	return w.notify(WebhookEvent{Event: EventGrant, Access: access})
+}
+
+func (w *WebhookAction) OnDenied(ctx context.Context, access Access, reason string) error {
+	return w.notify(WebhookEvent{Event: EventDeny, Access: access, Reason: reason})
+}
+
+func (w *WebhookAction) OnFailed(ctx context.Context, access Access, reason string) error {
+	return w.notify(WebhookEvent{Event: EventFail, Access: access, Reason: reason})
+}
+
+func (w *WebhookAction) OnBanned(ctx context.Context, access Access, until time.Time) error {
+	return w.notify(WebhookEvent{Event: EventBan, Access: access, Until: until})
+}
+
+func (w *WebhookAction) OnExpired(ctx context.Context, access Access) error {
+	return w.notify(WebhookEvent{Event: EventExpire, Access: access})
+}
+
+// notify queues event for delivery when the webhook subscribes to it.
+func (w *WebhookAction) notify(event WebhookEvent) error {
+	if !slices.Contains(w.events, event.Event) {
+		return nil
+	}
+	event.Access = w.privacy.maskAccess(event.Access)
+
+	body, err := w.encode(event)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		if err := w.deliver(body); err != nil {
+			log.Printf("[%s] Webhook %s: %s event for IP %s not delivered: %v",
+				event.Access.Instance, w.name, event.Event, event.Access.IP, err)
+		}
+	}()
+	return nil
+}
+
+func (w *WebhookAction) deliver(body []byte) error {
+	delay := webhookRetryDelay
+
+	var err error
+	for attempt := 0; attempt <= w.retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+
+		var retry bool
+		if retry, err = w.post(body); err == nil || !retry {
+			return err
+		}
+	}
+	return fmt.Errorf("giving up after %d attempts: %w", w.retries+1, err)
+}
+
+// post sends body once, reporting whether a failure is worth retrying.
+func (w *WebhookAction) post(body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, w.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	if w.cfg.Secret != "" {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Knock-Timestamp", ts)
+		req.Header.Set("X-Knock-Signature", "sha256="+webhookSignature(w.cfg.Secret, ts, body))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		// Drop the URL from the error, it may hold a token
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return true, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("receiver answered %s", resp.Status)
+}
+
+// webhookSignature is the hex HMAC-SHA256 of "timestamp.body", so a
+// receiver can also reject old deliveries replayed to it.
+func webhookSignature(secret, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,109 @@
+package knockclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"port-knocking/pkg/knock"
+)
+
+const (
+	defaultConfirmTimeout = 5 * time.Second
+	maxConfirmation       = 1024
+)
+
+// ErrNotConfirmed is returned by Knock when the server did not confirm the
+// grant in time, so the sequence was likely refused.
+var ErrNotConfirmed = errors.New("knockclient: access was not confirmed in time")
+
+// confirmListener waits on the client port for the server to confirm a grant.
+type confirmListener struct {
+	ln net.Listener   // TCP confirmations
+	pc net.PacketConn // UDP confirmations
+}
+
+func listenConfirm(network string, port int) (*confirmListener, error) {
+	addr := ":" + strconv.Itoa(port)
+	switch network {
+	case "", knock.ConfirmUDP:
+		pc, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("knockclient: listening for the confirmation: %w", err)
+		}
+		return &confirmListener{pc: pc}, nil
+	case knock.ConfirmTCP:
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("knockclient: listening for the confirmation: %w", err)
+		}
+		return &confirmListener{ln: ln}, nil
+	}
+	return nil, fmt.Errorf("knockclient: invalid confirmation protocol %q", network)
+}
+
+// wait returns the first confirmation answering the request sealed with
+// nonce, skipping anything else arriving on the port.
+func (l *confirmListener) wait(ctx context.Context, key string, nonce []byte, timeout time.Duration) (knock.GrantConfirmation, error) {
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	stop := context.AfterFunc(ctx, func() { l.Close() })
+	defer stop()
+
+	for {
+		data, err := l.receive(deadline)
+		if err != nil {
+			if ctx.Err() != nil {
+				return knock.GrantConfirmation{}, ctx.Err()
+			}
+			if errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF) || isTimeout(err) {
+				return knock.GrantConfirmation{}, ErrNotConfirmed
+			}
+			return knock.GrantConfirmation{}, err
+		}
+		if c, err := knock.OpenConfirmation(key, data, nonce); err == nil {
+			return c, nil
+		}
+	}
+}
+
+func (l *confirmListener) receive(deadline time.Time) ([]byte, error) {
+	buf := make([]byte, maxConfirmation)
+	if l.pc != nil {
+		_ = l.pc.SetReadDeadline(deadline)
+		n, _, err := l.pc.ReadFrom(buf)
+		return buf[:n], err
+	}
+
+	_ = l.ln.(*net.TCPListener).SetDeadline(deadline)
+	conn, err := l.ln.Accept()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	_ = conn.SetReadDeadline(deadline)
+	data, err := io.ReadAll(io.LimitReader(conn, maxConfirmation))
+	if err != nil && !isTimeout(err) {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (l *confirmListener) Close() error {
+	if l.pc != nil {
+		return l.pc.Close()
+	}
+	return l.ln.Close()
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
@@ -0,0 +1,51 @@
+package knockclient
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"port-knocking/pkg/knock"
+)
+
+// DNSKnocker sends the equivalent of a sequence as one signed DNS query
+// under a server's knock zone, for networks where only DNS gets out.
+type DNSKnocker struct {
+	Zone    string
+	Key     string     // The instance's dns key
+	Allow   netip.Addr // Address to open, the query source when invalid
+	Profile string     // Server profile to complete, the default one when empty
+	Server  string     // host:port queried directly, the system resolver when empty
+
+	// Signature label of the query, set by Knock, which names the knock
+	// to a token endpoint
+	Nonce string
+}
+
+// Knock queries the signed name. The server answers every knock name the
+// same way, so an empty answer is success.
+func (k *DNSKnocker) Knock(ctx context.Context) error {
+	name := knock.DNSKnockName(k.Key, k.Zone, k.Allow, k.Profile, time.Now())
+	k.Nonce, _, _ = strings.Cut(name, ".")
+
+	r := net.DefaultResolver
+	if k.Server != "" {
+		r = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, k.Server)
+			},
+		}
+	}
+
+	_, err := r.LookupTXT(ctx, name+".")
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,68 @@
+package knockclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"port-knocking/pkg/knock"
+)
+
+// HTTPSKnocker sends the equivalent of a sequence as one signed request to
+// a server's HTTPS knock endpoint, for networks where only 443 gets out.
+type HTTPSKnocker struct {
+	URL     string // Knock endpoint, e.g. https://203.0.113.7/knock
+	Key     string // The instance's https key
+	Request knock.HTTPSKnockRequest
+	Client  *http.Client // http.DefaultClient when nil
+
+	// Nonce of the request sent, set by Knock, which names the knock to a
+	// token endpoint
+	Nonce string
+}
+
+// Knock signs and posts the request, stamping it with the current time and
+// a fresh nonce.
+func (k *HTTPSKnocker) Knock(ctx context.Context) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	req := k.Request
+	req.Time = time.Now().Unix()
+	req.Nonce = hex.EncodeToString(nonce)
+	k.Nonce = req.Nonce
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, k.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set(knock.HTTPSKnockSignatureHeader, knock.SignHTTPSKnock(k.Key, body))
+
+	client := k.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("https knock: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,283 @@
+// Package knockclient sends knock sequences, so applications can knock
+// before dialing a protected service:
+//
+//	k := &knockclient.Knocker{
+//		Host:  "203.0.113.7",
+//		Steps: knockclient.Ports(7001, 7001, 8002),
+//		Delay: 200 * time.Millisecond,
+//	}
+//	if err := k.Knock(ctx); err != nil {
+//		return err
+//	}
+//	conn, err := net.Dial("tcp", "203.0.113.7:22")
+package knockclient
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"port-knocking/pkg/knock"
+)
+
+// Step is one port of a sequence, with optional overrides of the Knocker
+// defaults.
+type Step struct {
+	Port  int
+	Count int           // Times the port is knocked, once when zero
+	Delay time.Duration // Pause after each knock, the Knocker's Delay when zero
+	SNI   string        // Send a TLS ClientHello for this server name instead of a bare connect
+}
+
+// Ports returns one single knock step per port, in order.
+func Ports(ports ...int) []Step {
+	steps := make([]Step, len(ports))
+	for i, port := range ports {
+		steps[i] = Step{Port: port}
+	}
+	return steps
+}
+
+// FromSequence converts server side knock steps, such as those of a
+// generated or TOTP sequence.
+func FromSequence(sequence []knock.KnockStep) []Step {
+	steps := make([]Step, len(sequence))
+	for i, s := range sequence {
+		steps[i] = Step{Port: s.Port, Count: s.Count, SNI: s.SNI}
+	}
+	return steps
+}
+
+// TOTP returns the steps of a rotating sequence for the window at t. The
+// config must have been through knock.NormalizeTOTP.
+func TOTP(cfg knock.TOTPConfig, t time.Time) []Step {
+	return FromSequence(knock.TOTPSequence(cfg, cfg.Window(t)))
+}
+
+// TOTPWindows returns the steps of every window within cfg.Skew of the one
+// at t, current first, then nearest first and earlier before later, with
+// their offsets from it. The rest after the first are Knocker.Fallbacks for
+// a clock that may be off.
+func TOTPWindows(cfg knock.TOTPConfig, t time.Time) (steps [][]Step, offsets []int) {
+	windows, offsets := cfg.Windows(t)
+	for _, w := range windows {
+		steps = append(steps, FromSequence(knock.TOTPSequence(cfg, w)))
+	}
+	return steps, offsets
+}
+
+// Knocker sends Steps to Host. The zero Transport knocks with TCP connects.
+type Knocker struct {
+	Host      string
+	Steps     []Step
+	Delay     time.Duration // Pause between knocks
+	Transport Transport
+
+	// With a PayloadKey, Request is sealed and sent with the last knock,
+	// asking the server for specific ports or an access length.
+	PayloadKey string
+	Request    knock.KnockRequest
+
+	// With an SPAPort, the sealed Request is sent alone, as one UDP packet
+	// to that port, instead of knocking the Steps. It names the address it
+	// is sent from: SPASource, the local one when empty, which a client
+	// behind a NAT sets to its public address.
+	SPAPort   int
+	SPASource string
+
+	// With a ConfirmPort, the request also asks the server to confirm the
+	// grant to that local port, and Knock fails unless it does in time.
+	ConfirmPort    int
+	ConfirmProto   string        // "udp" (default) or "tcp"
+	ConfirmTimeout time.Duration // 5s when zero
+
+	// The grant confirmed by the server, set by Knock with a ConfirmPort
+	Confirmation knock.GrantConfirmation
+
+	// With a ChallengeKey, the last knock waits for the server's challenge
+	// and Knock then hits the port it names. The Transport must be a
+	// ReplyTransport.
+	ChallengeKey string
+
+	// Sequences knocked in turn after Steps while the server does not
+	// confirm the grant, such as the adjacent windows of a TOTP sequence.
+	// Without a ConfirmPort every one is knocked, and those the server
+	// does not expect count as failed sequences towards a ban. They are
+	// not used with an SPAPort.
+	Fallbacks [][]Step
+
+	// Which sequence the server confirmed, set by Knock with a ConfirmPort:
+	// 0 for Steps, i+1 for Fallbacks[i]
+	Attempt int
+
+	// Hex nonce of the last request sealed, set by Knock with a PayloadKey,
+	// which names the knock to a token endpoint
+	Nonce string
+}
+
+// Knock sends the whole sequence, then the fallback ones while the server
+// does not confirm the grant, or all of them without a ConfirmPort,
+// stopping early when ctx is done.
+func (k *Knocker) Knock(ctx context.Context) error {
+	k.Attempt = 0
+	err := k.knock(ctx, k.Steps)
+	if k.SPAPort != 0 {
+		return err
+	}
+	for i, steps := range k.Fallbacks {
+		switch {
+		case k.ConfirmPort == 0 && err == nil:
+			// Nothing tells which sequence the server took
+			err = k.knock(ctx, steps)
+		case errors.Is(err, ErrNotConfirmed):
+			k.Attempt = i + 1
+			err = k.knock(ctx, steps)
+		default:
+			return err
+		}
+	}
+	return err
+}
+
+// knock sends steps, or the request alone with an SPAPort.
+func (k *Knocker) knock(ctx context.Context, steps []Step) error {
+	switch {
+	case k.SPAPort != 0 && k.PayloadKey == "":
+		return errors.New("knockclient: SPA needs a PayloadKey")
+	case k.SPAPort == 0 && len(steps) == 0:
+		return errors.New("knockclient: no steps to knock")
+	}
+	transport := k.Transport
+	if transport == nil {
+		transport = TCP{}
+	}
+
+	var confirm *confirmListener
+	if k.ConfirmPort != 0 {
+		if k.PayloadKey == "" {
+			return errors.New("knockclient: confirmations need a PayloadKey")
+		}
+		var err error
+		if confirm, err = listenConfirm(k.ConfirmProto, k.ConfirmPort); err != nil {
+			return err
+		}
+		defer confirm.Close()
+	}
+	var sealed []byte
+
+	if k.SPAPort != 0 {
+		var err error
+		sealed, err = sendSPA(ctx, k.Host, k.SPAPort, k.SPASource, func(source string) ([]byte, error) {
+			return k.sealRequest(source, confirm != nil)
+		})
+		if err != nil {
+			return err
+		}
+		steps = nil
+	}
+
+	for i, step := range steps {
+		count := max(step.Count, 1)
+		delay := k.Delay
+		if step.Delay > 0 {
+			delay = step.Delay
+		}
+
+		for n := range count {
+			var payload []byte
+			if step.SNI != "" {
+				var err error
+				if payload, err = ClientHello(step.SNI); err != nil {
+					return err
+				}
+			}
+			if k.PayloadKey != "" && i == len(steps)-1 && n == count-1 {
+				var err error
+				if payload, err = k.sealRequest("", confirm != nil); err != nil {
+					return err
+				}
+				sealed = payload
+			}
+
+			if k.ChallengeKey != "" && i == len(steps)-1 && n == count-1 {
+				if err := k.answerChallenge(ctx, transport, step.Port, payload); err != nil {
+					return err
+				}
+			} else if err := transport.Knock(ctx, k.Host, step.Port, payload); err != nil {
+				return err
+			}
+			if err := sleep(ctx, delay); err != nil {
+				return err
+			}
+		}
+	}
+
+	if sealed != nil {
+		k.Nonce = hex.EncodeToString(knock.RequestNonce(sealed))
+	}
+	if confirm != nil {
+		timeout := k.ConfirmTimeout
+		if timeout == 0 {
+			timeout = defaultConfirmTimeout
+		}
+		c, err := confirm.wait(ctx, k.PayloadKey, knock.RequestNonce(sealed), timeout)
+		if err != nil {
+			return err
+		}
+		k.Confirmation = c
+	}
+	return nil
+}
+
+// sealRequest seals Request as of now, sent from source when set, asking for
+// a confirmation when confirm is set.
+func (k *Knocker) sealRequest(source string, confirm bool) ([]byte, error) {
+	req := k.Request
+	req.Time = time.Now().Unix()
+	if source != "" {
+		req.Source = source
+	}
+	if confirm {
+		req.ConfirmPort, req.ConfirmProto = k.ConfirmPort, k.ConfirmProto
+	}
+	return knock.SealRequest(k.PayloadKey, req)
+}
+
+// answerChallenge sends the last knock, reads the challenge the server
+// replies with and knocks on the port it names.
+func (k *Knocker) answerChallenge(ctx context.Context, transport Transport, port int, payload []byte) error {
+	rt, ok := transport.(ReplyTransport)
+	if !ok {
+		return errors.New("knockclient: challenges need a transport reading replies")
+	}
+	reply, err := rt.KnockReply(ctx, k.Host, port, payload)
+	if err != nil {
+		return fmt.Errorf("knockclient: waiting for the challenge: %w", err)
+	}
+	if len(reply) == 0 {
+		return errors.New("knockclient: the server sent no challenge")
+	}
+	c, err := knock.OpenChallenge(k.ChallengeKey, reply)
+	if err != nil {
+		return fmt.Errorf("knockclient: reading the challenge: %w", err)
+	}
+	return transport.Knock(ctx, k.Host, c.Port, nil)
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
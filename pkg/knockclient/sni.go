@@ -0,0 +1,39 @@
+package knockclient
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// ClientHello returns the first TLS record a client sends to serverName,
+// which knocks on server name steps carry. It is produced by crypto/tls, so
+// it looks like any Go client's.
+func ClientHello(serverName string) ([]byte, error) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		c := tls.Client(client, &tls.Config{ServerName: serverName})
+		_ = c.Handshake()
+		_ = c.Close()
+	}()
+
+	_ = server.SetReadDeadline(time.Now().Add(time.Second))
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(server, header); err != nil {
+		return nil, err
+	}
+	if header[0] != 22 {
+		return nil, errors.New("knockclient: unexpected TLS record")
+	}
+	record := make([]byte, 5+int(binary.BigEndian.Uint16(header[3:5])))
+	copy(record, header)
+	if _, err := io.ReadFull(server, record[5:]); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
@@ -0,0 +1,33 @@
+package knockclient
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// sendSPA sends a request as a single UDP packet to port, sealed by seal
+// with the address it is sent from: source, or else the local address of
+// the route to host. Nothing answers it but a confirmation, when one was
+// asked for.
+func sendSPA(ctx context.Context, host string, port int, source string, seal func(source string) ([]byte, error)) ([]byte, error) {
+	d := net.Dialer{Timeout: defaultKnockTimeout}
+	conn, err := d.DialContext(ctx, "udp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if source == "" {
+		source = conn.LocalAddr().(*net.UDPAddr).AddrPort().Addr().Unmap().String()
+	}
+	sealed, err := seal(source)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(sealed); err != nil {
+		return nil, fmt.Errorf("knockclient: sending SPA request: %w", err)
+	}
+	return sealed, nil
+}
@@ -0,0 +1,131 @@
+package knockclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultKnockTimeout = 500 * time.Millisecond
+	replyTimeout        = 2 * time.Second
+	maxReply            = 1024
+)
+
+// Transport sends a single knock on port, carrying payload when it is not
+// empty.
+type Transport interface {
+	Knock(ctx context.Context, host string, port int, payload []byte) error
+}
+
+// ReplyTransport is a Transport that can also read what the server sends
+// back on a knock, as challenge-response sequences need on the last one.
+type ReplyTransport interface {
+	Transport
+	KnockReply(ctx context.Context, host string, port int, payload []byte) ([]byte, error)
+}
+
+// TransportFunc adapts a function to Transport.
+type TransportFunc func(ctx context.Context, host string, port int, payload []byte) error
+
+func (f TransportFunc) Knock(ctx context.Context, host string, port int, payload []byte) error {
+	return f(ctx, host, port, payload)
+}
+
+// TCP knocks by connecting to the port, which is what servers in listen,
+// capture and nflog modes all see.
+type TCP struct {
+	Timeout time.Duration // Per knock, 500ms when zero
+	Source  net.IP        // Local address knocks come from, the system's choice when nil
+}
+
+func (t TCP) Knock(ctx context.Context, host string, port int, payload []byte) error {
+	return knockWith(ctx, t.dialer(), host, port, payload, false)
+}
+
+func (t TCP) dialer() net.Dialer {
+	d := net.Dialer{Timeout: timeoutOr(t.Timeout)}
+	if t.Source != nil {
+		d.LocalAddr = &net.TCPAddr{IP: t.Source}
+	}
+	return d
+}
+
+// KnockReply connects to the port, sends payload and returns what the server
+// sends back before closing the connection.
+func (t TCP) KnockReply(ctx context.Context, host string, port int, payload []byte) ([]byte, error) {
+	d := t.dialer()
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(replyTimeout))
+	if len(payload) > 0 {
+		if _, err := conn.Write(payload); err != nil {
+			return nil, err
+		}
+	}
+	// The server reads a payload up to our end of the stream
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		_ = tcp.CloseWrite()
+	}
+	return io.ReadAll(io.LimitReader(conn, maxReply))
+}
+
+// SourcePort knocks every step on the one Port, from the step's port as the
+// local source port, for servers decoding the sequence from source ports.
+type SourcePort struct {
+	Port    int
+	Timeout time.Duration // Per knock, 500ms when zero
+}
+
+func (s SourcePort) Knock(ctx context.Context, host string, port int, payload []byte) error {
+	d := net.Dialer{
+		Timeout:   timeoutOr(s.Timeout),
+		LocalAddr: &net.TCPAddr{Port: port},
+	}
+	if err := knockWith(ctx, d, host, s.Port, payload, true); err != nil {
+		return fmt.Errorf("knocking from source port %d: %w", port, err)
+	}
+	return nil
+}
+
+// knockWith connects with d and sends payload. With reset the connection is
+// reset rather than closed, so its source port can be reused right away
+// instead of waiting out TIME_WAIT.
+func knockWith(ctx context.Context, d net.Dialer, host string, port int, payload []byte, reset bool) error {
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var ne net.Error
+		if errors.Is(err, syscall.ECONNREFUSED) || (errors.As(err, &ne) && ne.Timeout()) {
+			return nil // Closed or filtered knock port, the SYN still went out
+		}
+		return err
+	}
+
+	if len(payload) > 0 {
+		_ = conn.SetWriteDeadline(time.Now().Add(time.Second))
+		_, _ = conn.Write(payload)
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok && reset {
+		_ = tcp.SetLinger(0)
+	}
+	return conn.Close()
+}
+
+func timeoutOr(d time.Duration) time.Duration {
+	if d > 0 {
+		return d
+	}
+	return defaultKnockTimeout
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"port-knocking/pkg/knock"
+	"port-knocking/pkg/qrcode"
+)
+
+// Client profiles are provisioned as an otpauth-style URI,
+//
+//	portknock://profile/office?host=203.0.113.7&sequence=7001,7001,8002&delay=500ms
+//
+// whose query holds the profile's non-zero settings under their JSON names,
+// nested ones such as totp.secret dotted and lists comma separated, so a
+// client scanning its QR code needs no JSON at all.
+const (
+	profileScheme = "portknock"
+	profileKind   = "profile"
+)
+
+// ProfileURI encodes p as a provisioning URI labelled with label, usually the
+// server's name.
+func ProfileURI(label string, p *ClientProfile) (string, error) {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return "", err
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return "", err
+	}
+
+	query := url.Values{}
+	flattenQuery(query, "", pruneZero(fields))
+	// Commas may stand unescaped in a query and keep lists readable
+	raw := strings.ReplaceAll(query.Encode(), "%2C", ",")
+	u := url.URL{Scheme: profileScheme, Host: profileKind, Path: "/" + label, RawQuery: raw}
+	return u.String(), nil
+}
+
+// flattenQuery adds the decoded JSON object fields to query, keyed under prefix.
+func flattenQuery(query url.Values, prefix string, fields map[string]any) {
+	for name, v := range fields {
+		switch v := v.(type) {
+		case map[string]any:
+			flattenQuery(query, prefix+name+".", v)
+		case []any:
+			if len(v) == 0 {
+				continue
+			}
+			parts := make([]string, len(v))
+			for i, item := range v {
+				parts[i] = queryValue(item)
+			}
+			query.Set(prefix+name, strings.Join(parts, ","))
+		default:
+			query.Set(prefix+name, queryValue(v))
+		}
+	}
+}
+
+// queryValue writes a decoded JSON value, keeping large numbers out of
+// exponent notation.
+func queryValue(v any) string {
+	if n, ok := v.(float64); ok {
+		return strconv.FormatFloat(n, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+// isProfileURI reports whether s is a provisioning URI rather than a path.
+func isProfileURI(s string) bool {
+	return strings.HasPrefix(s, profileScheme+"://")
+}
+
+// ParseProfileURI decodes a provisioning URI over the default profile,
+// returning its label along with it.
+func ParseProfileURI(s string) (string, *ClientProfile, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", nil, fmt.Errorf("profile uri: %w", err)
+	}
+	if u.Scheme != profileScheme || u.Host != profileKind {
+		return "", nil, fmt.Errorf("profile uri: want %s://%s/<label>?...", profileScheme, profileKind)
+	}
+
+	fields := make(map[string]any)
+	for key, values := range u.Query() {
+		if err := setQueryField(fields, reflect.TypeFor[ClientProfile](), strings.Split(key, "."), values[len(values)-1]); err != nil {
+			return "", nil, fmt.Errorf("profile uri: %s: %w", key, err)
+		}
+	}
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return "", nil, err
+	}
+
+	p := defaultProfile()
+	if err := json.Unmarshal(data, p); err != nil {
+		return "", nil, fmt.Errorf("profile uri: %w", err)
+	}
+	return strings.TrimPrefix(u.Path, "/"), p, nil
+}
+
+// setQueryField stores raw under path in fields as the JSON value the field
+// of t it names expects.
+func setQueryField(fields map[string]any, t reflect.Type, path []string, raw string) error {
+	field, ok := jsonField(t, path[0])
+	if !ok {
+		return errors.New("unknown setting")
+	}
+	if len(path) == 1 {
+		v, err := jsonValue(field.Type, raw)
+		if err != nil {
+			return err
+		}
+		fields[path[0]] = v
+		return nil
+	}
+
+	if field.Type.Kind() != reflect.Struct || field.Type == reflect.TypeFor[knock.Duration]() {
+		return errors.New("unknown setting")
+	}
+	nested, ok := fields[path[0]].(map[string]any)
+	if !ok {
+		nested = make(map[string]any)
+		fields[path[0]] = nested
+	}
+	return setQueryField(nested, field.Type, path[1:], raw)
+}
+
+// jsonField finds the field of t encoded as name.
+func jsonField(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := range t.NumField() {
+		field := t.Field(i)
+		tag, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if tag == name {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// jsonValue reads raw as the JSON value of a field of type t.
+func jsonValue(t reflect.Type, raw string) (any, error) {
+	if t == reflect.TypeFor[knock.Duration]() {
+		return raw, nil
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return raw, nil
+	case reflect.Bool:
+		return strconv.ParseBool(raw)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.ParseInt(raw, 10, 64)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.ParseUint(raw, 10, 64)
+	case reflect.Float32, reflect.Float64:
+		return strconv.ParseFloat(raw, 64)
+	case reflect.Slice:
+		parts := strings.Split(raw, ",")
+		items := make([]any, len(parts))
+		for i, part := range parts {
+			item, err := jsonValue(t.Elem(), part)
+			if err != nil {
+				return nil, err
+			}
+			items[i] = item
+		}
+		return items, nil
+	}
+	return nil, errors.New("cannot be set from a uri")
+}
+
+// printProvisioning prints the provisioning URI of p and its QR code on
+// stderr, next to the JSON profile written to stdout or a file.
+func printProvisioning(label string, p *ClientProfile) error {
+	uri, err := ProfileURI(label, p)
+	if err != nil {
+		return err
+	}
+	code, err := qrcode.Encode([]byte(uri), qrcode.Medium)
+	if err != nil {
+		return fmt.Errorf("client profile QR code: %w", err)
+	}
+	fmt.Fprint(os.Stderr, code.Terminal())
+	fmt.Fprintln(os.Stderr, uri)
+	return nil
+}
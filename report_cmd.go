@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"port-knocking/pkg/knock"
+)
+
+// reportCommand prints a summary of the historical statistics of the running
+// server, or with -export their daily counters for other tools, e.g.
+//
+//	report -export csv -by port -from 2026-10-01 -to 2026-10-31 > october.csv
+func reportCommand(args []string) error {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to the JSON config file")
+	rangeFlag := fs.String("range", "7d", "period to report on, e.g. 7d, 30d, 48h")
+	export := fs.String("export", "", "print the daily counters as csv or json instead of a summary")
+	by := fs.String("by", knock.StatsByIP, "export counters by ip or port")
+	from := fs.String("from", "", "export from this day, date or duration ago, e.g. 2026-10-01 or 720h")
+	to := fs.String("to", "", "export up to this day, date or duration ago")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := knock.LoadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	client, err := knock.NewAdminClient(cfg.Admin)
+	if err != nil {
+		return err
+	}
+
+	if *export != "" {
+		return exportStats(client, *export, *by, *from, *to)
+	}
+
+	report := &knock.StatsReport{}
+	if err := client.Do(http.MethodGet, "/stats?range="+url.QueryEscape(*rangeFlag), nil, report); err != nil {
+		return err
+	}
+
+	fmt.Printf("Knock activity from %s to %s\n\n", report.From, report.To)
+	fmt.Printf("Attempts: %d  Completions: %d  Grants: %d  Denials: %d  Failures: %d  Bans: %d\n\n",
+		report.Total.Attempts,
+		report.Total.Completions,
+		report.Total.Grants,
+		report.Total.Denials,
+		report.Total.Failures,
+		report.Total.Bans)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	printCounters(tw, "DAY", report.ByDay)
+	fmt.Fprintln(tw)
+	printCounters(tw, "INSTANCE", report.ByInstance)
+	fmt.Fprintln(tw)
+	printCounters(tw, "PORT", report.ByPort)
+	fmt.Fprintln(tw)
+
+	fmt.Fprintln(tw, "TOP IP\tATTEMPTS\tCOMPLETIONS\tGRANTS\tDENIALS\tFAILURES\tBANS")
+	for _, c := range report.TopIPs {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\t%d\n", c.IP, c.Attempts, c.Completions, c.Grants, c.Denials, c.Failures, c.Bans)
+	}
+	return tw.Flush()
+}
+
+// exportStats prints the daily counters by ip or port between from and to.
+func exportStats(client *knock.AdminClient, format, by, from, to string) error {
+	if format != "csv" && format != "json" {
+		return fmt.Errorf("invalid export format %q, use csv or json", format)
+	}
+
+	v := url.Values{"by": {by}}
+	if from != "" {
+		v.Set("from", from)
+	}
+	if to != "" {
+		v.Set("to", to)
+	}
+
+	var rows []knock.StatsRow
+	if err := client.Do(http.MethodGet, "/stats/export?"+v.Encode(), nil, &rows); err != nil {
+		return err
+	}
+
+	if format == "csv" {
+		return knock.WriteStatsCSV(os.Stdout, by, rows)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(rows)
+}
+
+func printCounters(tw *tabwriter.Writer, title string, rows map[string]knock.Counters) {
+	keys := make([]string, 0, len(rows))
+	for k := range rows {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintf(tw, "%s\tATTEMPTS\tCOMPLETIONS\tGRANTS\tDENIALS\tFAILURES\tBANS\n", title)
+	for _, k := range keys {
+		c := rows[k]
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\t%d\n", k, c.Attempts, c.Completions, c.Grants, c.Denials, c.Failures, c.Bans)
+	}
+}
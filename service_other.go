@@ -0,0 +1,17 @@
+//go:build !windows
+
+package main
+
+import "errors"
+
+func isWindowsService() bool {
+	return false
+}
+
+func runService() error {
+	return errors.New("windows services are only supported on Windows")
+}
+
+func serviceCommand(args []string) error {
+	return errors.New("windows services are only supported on Windows")
+}
@@ -0,0 +1,292 @@
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+
+	"port-knocking/pkg/knock"
+)
+
+const (
+	serviceName        = "knock"
+	serviceDisplayName = "Port Knocking Server"
+	serviceDescription = "Listens for port knock sequences and grants access to protected services."
+)
+
+type knockService struct {
+	cfg  *knock.Config
+	elog *eventlog.Log
+}
+
+// eventLogWriter sends the server log to the Windows event log, which has
+// no console to go to under the SCM. Each write is one log line.
+type eventLogWriter struct {
+	elog *eventlog.Log
+}
+
+func (w eventLogWriter) Write(p []byte) (int, error) {
+	if err := w.elog.Info(1, strings.TrimSuffix(string(p), "\n")); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func isWindowsService() bool {
+	ok, err := svc.IsWindowsService()
+	return err == nil && ok
+}
+
+func runService() error {
+	elog, err := eventlog.Open(serviceName)
+	if err != nil {
+		return fmt.Errorf("opening event log: %w", err)
+	}
+	defer elog.Close()
+
+	// The SCM starts the binary with the arguments recorded at install time
+	var args []string
+	if len(os.Args) > 2 && os.Args[1] == "serve" {
+		args = os.Args[2:]
+	}
+
+	cfg, err := loadConfigFlags("serve", args)
+	if err != nil {
+		_ = elog.Error(1, fmt.Sprintf("%s service failed to load config: %v", serviceName, err))
+		return err
+	}
+
+	if err := svc.Run(serviceName, &knockService{cfg: cfg, elog: elog}); err != nil {
+		_ = elog.Error(1, fmt.Sprintf("%s service failed: %v", serviceName, err))
+		return err
+	}
+	return nil
+}
+
+func (s *knockService) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	const accepted = svc.AcceptStop | svc.AcceptShutdown
+
+	changes <- svc.Status{State: svc.StartPending}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Event log entries carry their own time
+	log.SetFlags(0)
+	log.SetOutput(eventLogWriter{elog: s.elog})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- knock.Run(ctx, s.cfg)
+	}()
+
+	changes <- svc.Status{State: svc.Running, Accepts: accepted}
+	_ = s.elog.Info(1, fmt.Sprintf("%s service started", serviceName))
+
+	for {
+		select {
+		case err := <-done:
+			// Server exited on its own: report the failure so the SCM recovery actions kick in
+			if err != nil {
+				_ = s.elog.Error(1, fmt.Sprintf("%s server failed: %v", serviceName, err))
+				return false, 1
+			}
+			return false, 0
+		case c := <-r:
+			switch c.Cmd {
+			case svc.Interrogate:
+				changes <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				changes <- svc.Status{State: svc.StopPending}
+				cancel()
+				if err := <-done; err != nil {
+					_ = s.elog.Error(1, fmt.Sprintf("%s server failed: %v", serviceName, err))
+				}
+				_ = s.elog.Info(1, fmt.Sprintf("%s service stopped", serviceName))
+				return false, 0
+			default:
+				_ = s.elog.Warning(1, fmt.Sprintf("unexpected control request #%d", c.Cmd))
+			}
+		}
+	}
+}
+
+func serviceCommand(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("usage: service install [-config file]|uninstall|start|stop")
+	}
+
+	switch args[0] {
+	case "install":
+		fs := flag.NewFlagSet("service install", flag.ExitOnError)
+		configPath := fs.String("config", "", "path to the JSON config file")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		return installService(*configPath)
+	case "uninstall":
+		return uninstallService()
+	case "start":
+		return startService()
+	case "stop":
+		return controlService(svc.Stop, svc.Stopped)
+	default:
+		return fmt.Errorf("unknown service command %q", args[0])
+	}
+}
+
+func installService(configPath string) error {
+	serviceArgs := []string{"serve"}
+	if configPath != "" {
+		abs, err := filepath.Abs(configPath)
+		if err != nil {
+			return err
+		}
+		serviceArgs = append(serviceArgs, "-config", abs)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	exe, err = filepath.Abs(exe)
+	if err != nil {
+		return err
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists", serviceName)
+	}
+
+	s, err = m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: serviceDisplayName,
+		Description: serviceDescription,
+		StartType:   mgr.StartAutomatic,
+	}, serviceArgs...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	// Restart the service when it exits with a failure
+	err = s.SetRecoveryActions([]mgr.RecoveryAction{
+		{Type: mgr.ServiceRestart, Delay: 5 * time.Second},
+		{Type: mgr.ServiceRestart, Delay: 30 * time.Second},
+	}, 24*60*60)
+	if err != nil {
+		return err
+	}
+
+	err = eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info)
+	if err != nil {
+		_ = s.Delete()
+		return fmt.Errorf("installing event log source: %w", err)
+	}
+
+	return nil
+}
+
+// uninstallService stops the service if it runs, then removes it and its
+// event log source.
+func uninstallService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", serviceName)
+	}
+	defer s.Close()
+
+	status, err := s.Query()
+	if err != nil {
+		return fmt.Errorf("could not retrieve service status: %w", err)
+	}
+	if status.State != svc.Stopped {
+		if err := controlService(svc.Stop, svc.Stopped); err != nil {
+			return err
+		}
+	}
+
+	if err := s.Delete(); err != nil {
+		return fmt.Errorf("could not delete service: %w", err)
+	}
+	if err := eventlog.Remove(serviceName); err != nil {
+		return fmt.Errorf("service deleted, but not its event log source: %w", err)
+	}
+	return nil
+}
+
+func startService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("could not access service: %w", err)
+	}
+	defer s.Close()
+
+	if err := s.Start(); err != nil {
+		return fmt.Errorf("could not start service: %w", err)
+	}
+	return nil
+}
+
+func controlService(c svc.Cmd, to svc.State) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("could not access service: %w", err)
+	}
+	defer s.Close()
+
+	status, err := s.Control(c)
+	if err != nil {
+		return fmt.Errorf("could not send control=%d: %w", c, err)
+	}
+
+	timeout := time.Now().Add(10 * time.Second)
+	for status.State != to {
+		if time.Now().After(timeout) {
+			return fmt.Errorf("timeout waiting for service to go to state=%d", to)
+		}
+		time.Sleep(300 * time.Millisecond)
+
+		status, err = s.Query()
+		if err != nil {
+			return fmt.Errorf("could not retrieve service status: %w", err)
+		}
+	}
+	return nil
+}
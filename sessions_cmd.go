@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"port-knocking/pkg/knock"
+)
+
+const sessionsUsage = "usage: sessions list | sessions extend <id> -by 30m | sessions revoke <id> | sessions revoke -all"
+
+// sessionsCommand lists, extends and revokes sessions on the running server.
+func sessionsCommand(args []string) error {
+	if len(args) < 1 {
+		return errors.New(sessionsUsage)
+	}
+
+	fs := flag.NewFlagSet("sessions "+args[0], flag.ExitOnError)
+	configPath := fs.String("config", "", "path to the JSON config file")
+	by := fs.Duration("by", 0, "how much longer the session lasts")
+	all := fs.Bool("all", false, "revoke every active session")
+
+	// Allow the session id before the flags: `sessions extend abc -by 1h`
+	rest := args[1:]
+	id := ""
+	if len(rest) > 0 && !strings.HasPrefix(rest[0], "-") {
+		id, rest = rest[0], rest[1:]
+	}
+	if err := fs.Parse(rest); err != nil {
+		return err
+	}
+	if id == "" && fs.NArg() > 0 {
+		id = fs.Arg(0)
+	}
+
+	cfg, err := knock.LoadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	client, err := knock.NewAdminClient(cfg.Admin)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "list":
+		var sessions []knock.SessionView
+		if err := client.Do(http.MethodGet, "/sessions", nil, &sessions); err != nil {
+			return err
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tINSTANCE\tIP\tUSER\tGRANTED\tEXPIRES\tREMAINING")
+		for _, s := range sessions {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				s.ID,
+				s.Instance,
+				s.IP,
+				s.User,
+				s.GrantedAt.Local().Format(time.DateTime),
+				s.ExpiresAt.Local().Format(time.DateTime),
+				s.Remaining)
+		}
+		return tw.Flush()
+
+	case "extend":
+		if id == "" || *by <= 0 {
+			return errors.New(sessionsUsage)
+		}
+
+		s := &knock.Session{}
+		if err := client.Do(http.MethodPost, "/sessions/"+url.PathEscape(id)+"/extend", knock.ExtendRequest{By: knock.Duration{Duration: *by}}, s); err != nil {
+			return err
+		}
+		fmt.Printf("Session %s now expires at %s\n", s.ID, s.ExpiresAt.Local().Format(time.DateTime))
+		return nil
+
+	case "revoke":
+		if *all {
+			var result map[string]int
+			if err := client.Do(http.MethodDelete, "/sessions", nil, &result); err != nil {
+				return err
+			}
+			fmt.Printf("Revoked %d session(s)\n", result["sessions"])
+			return nil
+		}
+		if id == "" {
+			return errors.New(sessionsUsage)
+		}
+
+		if err := client.Do(http.MethodDelete, "/sessions/"+url.PathEscape(id), nil, nil); err != nil {
+			return err
+		}
+		fmt.Printf("Revoked session %s\n", id)
+		return nil
+
+	default:
+		return fmt.Errorf("unknown sessions command %q", args[0])
+	}
+}
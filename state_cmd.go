@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+
+	"port-knocking/pkg/knock"
+)
+
+// stateCommand implements `state export|import` against the running server.
+func stateCommand(args []string) error {
+	if len(args) < 1 {
+		return errors.New("usage: state export [-config file] [-o file] | state import [-config file] file")
+	}
+
+	fs := flag.NewFlagSet("state "+args[0], flag.ExitOnError)
+	configPath := fs.String("config", "", "path to the JSON config file")
+	output := fs.String("o", "", "write the export to this file instead of stdout")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	cfg, err := knock.LoadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	client, err := knock.NewAdminClient(cfg.Admin)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "export":
+		signed := &knock.SignedState{}
+		if err := client.Do(http.MethodGet, "/state", nil, signed); err != nil {
+			return err
+		}
+
+		data, err := json.MarshalIndent(signed, "", "  ")
+		if err != nil {
+			return err
+		}
+		if *output == "" {
+			_, err = os.Stdout.Write(append(data, '\n'))
+			return err
+		}
+		return os.WriteFile(*output, data, 0o600)
+
+	case "import":
+		if fs.NArg() != 1 {
+			return errors.New("usage: state import [-config file] file")
+		}
+
+		data, err := os.ReadFile(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		signed := &knock.SignedState{}
+		if err := json.Unmarshal(data, signed); err != nil {
+			return fmt.Errorf("parsing %s: %w", fs.Arg(0), err)
+		}
+
+		var result map[string]int
+		if err := client.Do(http.MethodPost, "/state", signed, &result); err != nil {
+			return err
+		}
+		fmt.Printf("Restored %d session(s)\n", result["sessions"])
+		return nil
+
+	default:
+		return fmt.Errorf("unknown state command %q", args[0])
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"port-knocking/pkg/knock"
+)
+
+const statusEvents = 15
+
+// statusCommand prints the instances, knocks in progress, sessions and
+// latest events of the running server, redrawing them with -watch.
+func statusCommand(args []string) error {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to the JSON config file")
+	watch := fs.Bool("watch", false, "keep refreshing until interrupted")
+	interval := fs.Duration("interval", 2*time.Second, "refresh interval with -watch")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := knock.LoadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	client, err := knock.NewAdminClient(cfg.Admin)
+	if err != nil {
+		return err
+	}
+
+	if !*watch {
+		out, err := renderStatus(client, time.Now())
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(out)
+		return err
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	ticker := time.NewTicker(max(*interval, 100*time.Millisecond))
+	defer ticker.Stop()
+
+	for {
+		now := time.Now()
+		out, err := renderStatus(client, now)
+		if err != nil {
+			// Keep watching through server restarts
+			out = fmt.Appendf(nil, "%v\n", err)
+		}
+
+		// Home the cursor and clear the screen, then draw the whole frame at once
+		frame := fmt.Appendf(nil, "\x1b[H\x1b[2J%s  (every %s, Ctrl-C to quit)\n\n", now.Format(time.DateTime), *interval)
+		_, _ = os.Stdout.Write(append(frame, out...))
+
+		select {
+		case <-interrupt:
+			fmt.Println()
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func renderStatus(client *knock.AdminClient, now time.Time) ([]byte, error) {
+	var (
+		instances []knock.InstanceStatus
+		progress  []knock.ClientProgress
+		sessions  []knock.SessionView
+		events    []knock.RecentEvent
+	)
+	if err := client.Do(http.MethodGet, "/instances", nil, &instances); err != nil {
+		return nil, err
+	}
+	if err := client.Do(http.MethodGet, "/clients", nil, &progress); err != nil {
+		return nil, err
+	}
+	if err := client.Do(http.MethodGet, "/sessions", nil, &sessions); err != nil {
+		return nil, err
+	}
+	if err := client.Do(http.MethodGet, fmt.Sprintf("/events?limit=%d", statusEvents), nil, &events); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	tw := tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "INSTANCE\tSTATE\tBIND\tERROR")
+	for _, inst := range instances {
+		state := "stopped"
+		if inst.Running {
+			state = "running"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", inst.Name, state, inst.Bind, inst.LastError)
+	}
+
+	fmt.Fprintf(tw, "\nKNOCKING (%d)\n", len(progress))
+	if len(progress) > 0 {
+		fmt.Fprintln(tw, "INSTANCE\tIP\tSEQUENCE\tSTEP\tLAST KNOCK")
+	}
+	for _, cp := range progress {
+		for _, t := range cp.Tracks {
+			name := t.Profile
+			if name == "" {
+				name = "default"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d/%d\t%s ago\n",
+				cp.Instance, cp.IP, name, t.StepIndex, t.Steps, now.Sub(t.LastHit).Round(time.Second))
+		}
+	}
+
+	fmt.Fprintf(tw, "\nSESSIONS (%d)\n", len(sessions))
+	if len(sessions) > 0 {
+		fmt.Fprintln(tw, "ID\tINSTANCE\tIP\tUSER\tREMAINING")
+	}
+	for _, s := range sessions {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", s.ID, s.Instance, s.IP, s.User, s.Remaining)
+	}
+
+	fmt.Fprintln(tw, "\nRECENT EVENTS")
+	if len(events) > 0 {
+		fmt.Fprintln(tw, "TIME\tEVENT\tINSTANCE\tIP\tDETAIL")
+	}
+	for _, e := range events {
+		detail := e.Reason
+		if len(e.Access.Ports) > 0 {
+			detail = strings.TrimSpace("ports " + joinPorts(e.Access.Ports) + " " + detail)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n",
+			e.Time.Local().Format(time.TimeOnly), e.Event, e.Access.Instance, e.Access.IP, detail)
+	}
+
+	if err := tw.Flush(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
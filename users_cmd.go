@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"port-knocking/pkg/knock"
+)
+
+const usersUsage = "usage: users list | users add <name> -source cidr[,cidr] [-instances a,b] [-profiles a,b] [-max-sessions n] [-key k] [-hmac-key k] [-ssh-key file] [-email addr] [-totp] | users provision <name> -instance i [-profile p] [-host addr] [-source cidr] [-client file] [-qr] | users remove|enable|disable|revoke <name>"
+
+// usersCommand manages users on the running server through the admin API.
+func usersCommand(args []string) error {
+	if len(args) < 1 {
+		return errors.New(usersUsage)
+	}
+
+	fs := flag.NewFlagSet("users "+args[0], flag.ExitOnError)
+	configPath := fs.String("config", "", "path to the JSON config file")
+	sources := fs.String("source", "", "comma separated CIDRs the user knocks from")
+	instances := fs.String("instances", "", "comma separated instances the user may use")
+	profiles := fs.String("profiles", "", "comma separated profiles the user may use, \"default\" for the default one")
+	maxSessions := fs.Int("max-sessions", 0, "maximum simultaneous sessions, 0 for unlimited")
+	key := fs.String("key", "", "payload and SPA key identifying the user")
+	hmacKey := fs.String("hmac-key", "", "HMAC key of the user's SPA packets")
+	sshKey := fs.String("ssh-key", "", "public key file for ephemeral SSH access")
+	email := fs.String("email", "", "address receiving emailed second factor codes")
+	totp := fs.Bool("totp", false, "generate an authenticator secret for the TOTP second factor")
+	instance := fs.String("instance", "", "instance to provision a client profile of")
+	profile := fs.String("profile", "", "named profile to provision, the default one when empty")
+	host := fs.String("host", "", "address the client knocks on, the server's admin.public_host when empty")
+	clientPath := fs.String("client", "", "file to write the provisioned client profile to instead of stdout")
+	qr := fs.Bool("qr", false, "also print the provisioned profile as a URI and QR code on stderr")
+	force := fs.Bool("force", false, "overwrite an existing client profile file")
+
+	// Allow the user name before the flags: `users add alice -source ...`
+	rest := args[1:]
+	name := ""
+	if len(rest) > 0 && !strings.HasPrefix(rest[0], "-") {
+		name, rest = rest[0], rest[1:]
+	}
+	if err := fs.Parse(rest); err != nil {
+		return err
+	}
+	if name == "" && fs.NArg() > 0 {
+		name = fs.Arg(0)
+	}
+
+	cfg, err := knock.LoadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	client, err := knock.NewAdminClient(cfg.Admin)
+	if err != nil {
+		return err
+	}
+
+	if args[0] == "list" {
+		var users []knock.User
+		if err := client.Do(http.MethodGet, "/users", nil, &users); err != nil {
+			return err
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tSTATUS\tSOURCES\tINSTANCES\tPROFILES\tMAX SESSIONS")
+		for _, u := range users {
+			status := "enabled"
+			if u.Disabled {
+				status = "disabled"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\n",
+				u.Name,
+				status,
+				strings.Join(u.Sources, ","),
+				strings.Join(u.Instances, ","),
+				strings.Join(u.Profiles, ","),
+				u.MaxSessions)
+		}
+		return tw.Flush()
+	}
+
+	if name == "" {
+		return errors.New(usersUsage)
+	}
+	path := "/users/" + url.PathEscape(name)
+
+	switch args[0] {
+	case "add":
+		u := knock.User{
+			Name:        name,
+			Sources:     splitList(*sources),
+			Instances:   splitList(*instances),
+			Profiles:    splitList(*profiles),
+			MaxSessions: *maxSessions,
+			HMACKey:     *hmacKey,
+			Email:       *email,
+		}
+		if *key != "" {
+			u.Keys = []string{*key}
+		}
+		if *sshKey != "" {
+			data, err := os.ReadFile(*sshKey)
+			if err != nil {
+				return err
+			}
+			for line := range strings.Lines(string(data)) {
+				if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+					u.SSHKeys = append(u.SSHKeys, line)
+				}
+			}
+		}
+		if *totp {
+			if u.TOTPSecret, err = knock.NewTOTPSecret(); err != nil {
+				return err
+			}
+		}
+		if err := client.Do(http.MethodPut, path, u, nil); err != nil {
+			return err
+		}
+		if u.TOTPSecret != "" {
+			fmt.Printf("TOTP secret: %s\n", u.TOTPSecret)
+			fmt.Printf("Authenticator URI: %s\n", knock.TOTPURI("port-knocking", name, u.TOTPSecret))
+		}
+		return nil
+
+	case "provision":
+		if *instance == "" {
+			return errors.New("provisioning needs the instance (-instance)")
+		}
+		req := knock.ProvisionRequest{User: name, Sources: splitList(*sources), Profile: *profile, Host: *host}
+		var bundle knock.ClientBundle
+		if err := client.Do(http.MethodPost, "/instances/"+url.PathEscape(*instance)+"/provision", req, &bundle); err != nil {
+			return err
+		}
+
+		if *clientPath != "" {
+			if err := writeJSONFile(*clientPath, bundle, *force); err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "Wrote the client profile to %s\n", *clientPath)
+		} else if err := printJSON(bundle); err != nil {
+			return err
+		}
+		if !*qr {
+			return nil
+		}
+
+		data, err := json.Marshal(bundle)
+		if err != nil {
+			return err
+		}
+		p := &ClientProfile{}
+		if err := json.Unmarshal(data, p); err != nil {
+			return err
+		}
+		return printProvisioning(name, p)
+
+	case "remove":
+		return client.Do(http.MethodDelete, path, nil, nil)
+
+	case "enable", "disable":
+		var u knock.User
+		if err := client.Do(http.MethodGet, path, nil, &u); err != nil {
+			return err
+		}
+		u.Disabled = args[0] == "disable"
+		return client.Do(http.MethodPut, path, u, nil)
+
+	case "revoke":
+		var result map[string]int
+		if err := client.Do(http.MethodDelete, path+"/sessions", nil, &result); err != nil {
+			return err
+		}
+		fmt.Printf("Revoked %d session(s) of user %s\n", result["sessions"], name)
+		return nil
+
+	default:
+		return fmt.Errorf("unknown users command %q", args[0])
+	}
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}